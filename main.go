@@ -1,9 +1,62 @@
 package main
 
-import "github.com/Opafanls/hylan/server"
+import (
+	"flag"
+	"fmt"
+	"github.com/Opafanls/hylan/server"
+	"github.com/Opafanls/hylan/server/config"
+	"os"
+)
 
 func main() {
-	sv := server.NewHylanServer()
+	path := flag.String("c", "", "config file, the built-in defaults when empty")
+	check := flag.Bool("t", false, "validate the config and exit")
+	logLevel := flag.String("log-level", "", "override log.level")
+	logOutput := flag.String("log-output", "", "override log.output")
+	apiAddr := flag.String("api-addr", "", "override api.addr")
+	apiPort := flag.Int("api-port", 0, "override api.port")
+	apiToken := flag.String("api-token", "", "override api.token")
+	flag.Parse()
+
+	conf := config.Default()
+	if *path != "" {
+		var err error
+		if conf, err = config.Load(*path); err != nil {
+			fmt.Fprintf(os.Stderr, "load %s: %v\n", *path, err)
+			os.Exit(1)
+		}
+	}
+	//the flags win over the file, on every reload too
+	override := func(conf *config.Config) {
+		if *logLevel != "" {
+			conf.Log.Level = *logLevel
+		}
+		if *logOutput != "" {
+			conf.Log.Output = *logOutput
+		}
+		if *apiAddr != "" {
+			conf.API.Addr = *apiAddr
+		}
+		if *apiPort != 0 {
+			conf.API.Port = *apiPort
+		}
+		if *apiToken != "" {
+			conf.API.Token = *apiToken
+		}
+	}
+	override(conf)
+	if err := conf.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *check {
+		fmt.Println("config ok")
+		return
+	}
+
+	center := config.NewCenter(*path, conf)
+	center.SetOverride(override)
+	sv := server.NewHylanServer(center)
 
 	sv.Start()
 }
@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"sort"
+)
+
+// maxStreamSeries bounds the per-stream series, the streams past it only show up in hylan_streams
+const maxStreamSeries = 1000
+
+func init() {
+	metrics.DefaultRegistry.Register(metrics.CollectorFunc(collectStreams))
+	metrics.DefaultRegistry.Register(metrics.CollectorFunc(collectTasks))
+}
+
+// collectTasks reads the counters of the task pools
+func collectTasks() []*metrics.Family {
+	running := &metrics.Family{Name: "hylan_task_running", Help: "Tasks running on the pool.",
+		Type: metrics.TypeGauge, LabelNames: []string{"pool"}}
+	queued := &metrics.Family{Name: "hylan_task_queued", Help: "Tasks waiting for a worker of the pool.",
+		Type: metrics.TypeGauge, LabelNames: []string{"pool"}}
+	completed := &metrics.Family{Name: "hylan_task_completed_total", Help: "Tasks the pool ran to the end.",
+		Type: metrics.TypeCounter, LabelNames: []string{"pool"}}
+	rejected := &metrics.Family{Name: "hylan_task_rejected_total", Help: "Tasks refused because the pool was full.",
+		Type: metrics.TypeCounter, LabelNames: []string{"pool"}}
+	panics := &metrics.Family{Name: "hylan_task_panics_total", Help: "Tasks of the pool that panicked.",
+		Type: metrics.TypeCounter, LabelNames: []string{"pool"}}
+	for _, s := range task.Stats() {
+		running.Add(float64(s.Running), s.Name)
+		queued.Add(float64(s.Queued), s.Name)
+		completed.Add(float64(s.Completed), s.Name)
+		rejected.Add(float64(s.Rejected), s.Name)
+		panics.Add(float64(s.Panics), s.Name)
+	}
+	scheduled := &metrics.Family{Name: "hylan_task_scheduled", Help: "Delayed and periodic tasks waiting for their time.", Type: metrics.TypeGauge}
+	scheduled.Add(float64(task.Scheduled()))
+	return []*metrics.Family{running, queued, completed, rejected, panics, scheduled}
+}
+
+// collectStreams reads the stream counters at scrape time, the stream id is the only unbounded label
+func collectStreams() []*metrics.Family {
+	streamsFamily := &metrics.Family{Name: "hylan_streams", Help: "Streams being published.", Type: metrics.TypeGauge}
+	tasks := &metrics.Family{Name: "hylan_task_goroutines", Help: "Goroutines started by the task system and still running.", Type: metrics.TypeGauge}
+	tasks.Add(float64(task.GoroutineNum()))
+	if stream.DefaultHyStreamManager == nil {
+		streamsFamily.Add(0)
+		return []*metrics.Family{streamsFamily, tasks}
+	}
+	publishers := &metrics.Family{Name: "hylan_stream_publishers", Help: "Publishers of the stream.",
+		Type: metrics.TypeGauge, LabelNames: []string{"stream", "protocol"}}
+	players := &metrics.Family{Name: "hylan_stream_players", Help: "Players of the stream by protocol.",
+		Type: metrics.TypeGauge, LabelNames: []string{"stream", "protocol"}}
+	bytesIn := &metrics.Family{Name: "hylan_stream_bytes_in_total", Help: "Media payload bytes received for the stream.",
+		Type: metrics.TypeCounter, LabelNames: []string{"stream"}}
+	bytesOut := &metrics.Family{Name: "hylan_stream_bytes_out_total", Help: "Media payload bytes sent to the players of the stream.",
+		Type: metrics.TypeCounter, LabelNames: []string{"stream"}}
+	dropped := &metrics.Family{Name: "hylan_stream_dropped_packets_total", Help: "Packets the players of the stream were too slow to read.",
+		Type: metrics.TypeCounter, LabelNames: []string{"stream"}}
+	gopCache := &metrics.Family{Name: "hylan_stream_gop_cache_packets", Help: "Packets in the gop cache of the stream.",
+		Type: metrics.TypeGauge, LabelNames: []string{"stream"}}
+
+	streams := stream.DefaultHyStreamManager.Streams()
+	streamsFamily.Add(float64(len(streams)))
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Base().ID() < streams[j].Base().ID()
+	})
+	if len(streams) > maxStreamSeries {
+		streams = streams[:maxStreamSeries]
+	}
+	for _, hyStream := range streams {
+		id := hyStream.Base().ID()
+		source := hyStream.Source()
+		protocol := "unknown"
+		if peer := source.Peer(); peer != nil {
+			protocol = peer.Protocol
+		}
+		publishers.Add(1, id, protocol)
+		byProtocol := make(map[string]int)
+		for _, sink := range source.Sinks() {
+			byProtocol[sink.SinkType().String()]++
+		}
+		names := make([]string, 0, len(byProtocol))
+		for name := range byProtocol {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			players.Add(float64(byProtocol[name]), id, name)
+		}
+		stats := source.Stats()
+		bytesIn.Add(float64(stats.Video.Bytes+stats.Audio.Bytes), id)
+		bytesOut.Add(float64(stats.BytesOut), id)
+		dropped.Add(float64(stats.Dropped), id)
+		gopCache.Add(float64(stats.GopCache), id)
+	}
+	return []*metrics.Family{streamsFamily, tasks, publishers, players, bytesIn, bytesOut, dropped, gopCache}
+}
@@ -0,0 +1,340 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	streamsPath     = "/api/v1/streams"
+	connectionsPath = "/api/v1/connections"
+	reloadPath      = "/api/v1/reload"
+	drainPath       = "/api/v1/drain"
+	metricsPath     = "/metrics"
+)
+
+type ListenConfig struct {
+	Addr string
+	Port int
+	//Token is the bearer token every request has to carry, the api is open when empty
+	Token string
+	//serves https when set
+	TLS *tls.Config
+	//Reload backs POST /api/v1/reload, it returns the changed config sections
+	Reload func() ([]string, error)
+}
+
+// Server is the json api listing the streams and connections, both of them can be kicked with DELETE.
+// It also serves the prometheus metrics, scrapers send the same bearer token
+type Server struct {
+	ctx      context.Context
+	config   *ListenConfig
+	running  bool
+	listener net.Listener
+	server   *http.Server
+	//token can change on reload while requests are served
+	token atomic.Value
+}
+
+// StreamView is a published stream with its publisher and players
+type StreamView struct {
+	ID        string              `json:"id"`
+	URL       string              `json:"url"`
+	Vhost     string              `json:"vhost"`
+	Params    map[string]string   `json:"params"`
+	Video     *codec.VideoInfo    `json:"video,omitempty"`
+	Audio     *codec.AudioInfo    `json:"audio,omitempty"`
+	Stats     session.SourceStats `json:"stats"`
+	Publisher ConnectionView      `json:"publisher"`
+	Sinks     []ConnectionView    `json:"sinks"`
+}
+
+// ConnectionView is a publisher or a player, Duration is in milliseconds
+type ConnectionView struct {
+	ID         string    `json:"id"`
+	Stream     string    `json:"stream"`
+	Role       string    `json:"role"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	StartTime  time.Time `json:"start_time"`
+	Duration   int64     `json:"duration"`
+}
+
+func NewServer(config *ListenConfig) *Server {
+	s := &Server{}
+	s.config = config
+	s.token.Store(config.Token)
+	return s
+}
+
+// SetToken replaces the bearer token, the requests from then on have to carry the new one
+func (s *Server) SetToken(token string) {
+	s.token.Store(token)
+}
+
+func (s *Server) Init() error {
+	s.ctx = log.GetCtxWithLogID(context.Background(), "ADMIN_SERVER")
+	s.server = &http.Server{Handler: s.Handler()}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.Addr, s.config.Port))
+	if err != nil {
+		return err
+	}
+	if s.config.TLS != nil {
+		listener = tls.NewListener(listener, s.config.TLS)
+	}
+	s.listener = listener
+	s.running = true
+	return nil
+}
+
+func (s *Server) Start() error {
+	if s.token.Load().(string) == "" {
+		log.Warnf(s.ctx, "admin api has no token, anyone reaching %s:%d can kick streams", s.config.Addr, s.config.Port)
+	}
+	log.Infof(s.ctx, "listen admin server@%s:%d", s.config.Addr, s.config.Port)
+	task.SubmitTask0(s.ctx, func() {
+		err := s.server.Serve(s.listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			log.Errorf(s.ctx, "admin server stopped: %+v", err)
+		}
+	})
+	return nil
+}
+
+// StopAccept closes the listener, the requests being served go on
+func (s *Server) StopAccept() {
+	_ = s.listener.Close()
+}
+
+// Shutdown stops accepting and waits for the requests being served until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.running = false
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) Close() {
+	s.running = false
+	_ = s.server.Close()
+}
+
+// Handler serves the api behind the token check
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(streamsPath, s.serveStreams)
+	mux.HandleFunc(connectionsPath, s.serveConnections)
+	mux.HandleFunc(reloadPath, s.serveReload)
+	mux.HandleFunc(drainPath, s.serveDrain)
+	mux.Handle(metricsPath, metrics.DefaultRegistry.Handler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hylan"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token := s.token.Load().(string)
+	if token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+// serveDrain refuses new publishers on POST for a rolling deploy, DELETE admits them again
+func (s *Server) serveDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		log.Infof(s.ctx, "drain, new publishers are refused")
+		vhost.SetDraining(true)
+	case http.MethodDelete:
+		log.Infof(s.ctx, "drain ended, new publishers are admitted")
+		vhost.SetDraining(false)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"draining": vhost.Draining(),
+		"streams":  len(stream.DefaultHyStreamManager.Streams()),
+	})
+}
+
+// serveReload applies the config file again, the running config stays when the file is invalid
+func (s *Server) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.config.Reload == nil {
+		writeError(w, http.StatusNotImplemented, "reload is not supported")
+		return
+	}
+	changed, err := s.config.Reload()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	log.Infof(s.ctx, "reloaded config, changed %v", changed)
+	writeJSON(w, http.StatusOK, map[string][]string{"changed": changed})
+}
+
+// serveStreams lists the streams, or one of them with ?id=, DELETE kicks its publisher
+func (s *Server) serveStreams(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	switch r.Method {
+	case http.MethodGet:
+		if id == "" {
+			streams := stream.DefaultHyStreamManager.Streams()
+			views := make([]*StreamView, 0, len(streams))
+			for _, hyStream := range streams {
+				views = append(views, streamView(hyStream))
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"streams": views})
+			return
+		}
+		hyStream, exist := stream.DefaultHyStreamManager.GetStream(id)
+		if !exist {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("stream %s not found", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, streamView(hyStream))
+	case http.MethodDelete:
+		hyStream, exist := stream.DefaultHyStreamManager.GetStream(id)
+		if !exist {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("stream %s not found", id))
+			return
+		}
+		log.Infof(s.ctx, "kick publisher of %s", id)
+		hyStream.Source().Kick()
+		writeJSON(w, http.StatusOK, map[string]string{"kicked": hyStream.Source().ID()})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// serveConnections lists publishers and players, DELETE with ?id= kicks one of them
+func (s *Server) serveConnections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		views := make([]ConnectionView, 0)
+		for _, hyStream := range stream.DefaultHyStreamManager.Streams() {
+			view := streamView(hyStream)
+			views = append(views, view.Publisher)
+			views = append(views, view.Sinks...)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"connections": views})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		sess := findSession(id)
+		if sess == nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("connection %s not found", id))
+			return
+		}
+		log.Infof(s.ctx, "kick connection %s", id)
+		sess.Kick()
+		writeJSON(w, http.StatusOK, map[string]string{"kicked": id})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func findSession(id string) session.HySessionI {
+	if id == "" {
+		return nil
+	}
+	for _, hyStream := range stream.DefaultHyStreamManager.Streams() {
+		source := hyStream.Source()
+		if source.ID() == id {
+			return source
+		}
+		for _, sink := range source.Sinks() {
+			if sink.ID() == id {
+				return sink
+			}
+		}
+	}
+	return nil
+}
+
+func streamView(hyStream *stream.HyStream) *StreamView {
+	source := hyStream.Source()
+	id := hyStream.Base().ID()
+	stats := source.Stats()
+	view := &StreamView{
+		ID:     id,
+		URL:    hyStream.Base().URL().String(),
+		Vhost:  vhost.Match(hyStream.Base().URL()).Name,
+		Params: hyStream.Base().Params(),
+		Video:  source.VideoInfo(),
+		Audio:  source.AudioInfo(),
+		Stats:  stats,
+	}
+	view.Publisher = connectionView(source, id, "publisher")
+	view.Publisher.BytesIn = stats.Video.Bytes + stats.Audio.Bytes
+	sinks := source.Sinks()
+	view.Sinks = make([]ConnectionView, 0, len(sinks))
+	for _, sink := range sinks {
+		sinkView := connectionView(sink, id, "player")
+		sinkView.BytesOut = sink.BytesOut()
+		if sinkView.Protocol == "" {
+			sinkView.Protocol = sink.SinkType().String()
+		}
+		view.Sinks = append(view.Sinks, sinkView)
+	}
+	return view
+}
+
+func connectionView(sess session.HySessionI, streamID, role string) ConnectionView {
+	view := ConnectionView{
+		ID:        sess.ID(),
+		Stream:    streamID,
+		Role:      role,
+		StartTime: sess.StartTime(),
+		Duration:  time.Since(sess.StartTime()).Milliseconds(),
+	}
+	if peer := sess.Peer(); peer != nil {
+		view.Protocol = peer.Protocol
+		view.RemoteAddr = peer.RemoteAddr
+	}
+	return view
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
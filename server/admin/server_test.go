@@ -0,0 +1,236 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testBase = "http://127.0.0.1:18091"
+
+func request(t *testing.T, method, path, token string, v interface{}) int {
+	req, err := http.NewRequest(method, testBase+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func scrape(t *testing.T, token string) string {
+	req, err := http.NewRequest(http.MethodGet, testBase+metricsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected metrics status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestAdminAPI(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewServer(&ListenConfig{Addr: "127.0.0.1", Port: 18091, Token: "secret"})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if status := request(t, http.MethodGet, streamsPath, "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expect 401 without token, got %d", status)
+	}
+	if status := request(t, http.MethodGet, streamsPath, "wrong", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expect 401 with a wrong token, got %d", status)
+	}
+
+	ctx := context.Background()
+	source := session.NewSourceSession(ctx, nil)
+	kicked := make(chan struct{}, 1)
+	source.SetPeer(&proto.Peer{Protocol: "rtmp", RemoteAddr: "10.0.0.1:5000", Kick: func() {
+		kicked <- struct{}{}
+	}})
+	hyStream := stream.NewHyStream0(&url.URL{Host: "127.0.0.1", Path: "/live/admin", RawQuery: "k=v"}, source)
+	if err := stream.DefaultHyStreamManager.AddStream(hyStream); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.DefaultHyStreamManager.RemoveStreamIfMatch(hyStream)
+	source.Push(ctx, &proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, KeyFrame: true, Payload: make([]byte, 100)})
+	sink := source.AddSink(&proto.SinkArg{Ctx: ctx, Protocol: constdef.SinkTypeHttpTs, Peer: &proto.Peer{Protocol: "http-ts", RemoteAddr: "10.0.0.2:6000"}})
+	if _, ok := sink.Pull(ctx); !ok {
+		t.Fatal("expect the gop cache")
+	}
+
+	var list struct {
+		Streams []StreamView `json:"streams"`
+	}
+	if status := request(t, http.MethodGet, streamsPath, "secret", &list); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if len(list.Streams) != 1 {
+		t.Fatalf("expect one stream, got %+v", list.Streams)
+	}
+	view := list.Streams[0]
+	if view.ID != "127.0.0.1:/live/admin" || view.Params["k"] != "v" || view.Stats.Video.Frames != 1 {
+		t.Fatalf("unexpected stream %+v", view)
+	}
+	if view.Publisher.RemoteAddr != "10.0.0.1:5000" || view.Publisher.BytesIn != 100 || view.Publisher.Role != "publisher" {
+		t.Fatalf("unexpected publisher %+v", view.Publisher)
+	}
+	if len(view.Sinks) != 1 || view.Sinks[0].Protocol != "http-ts" || view.Sinks[0].BytesOut != 100 {
+		t.Fatalf("unexpected sinks %+v", view.Sinks)
+	}
+
+	var one StreamView
+	if status := request(t, http.MethodGet, streamsPath+"?id="+url.QueryEscape(view.ID), "secret", &one); status != http.StatusOK || one.ID != view.ID {
+		t.Fatalf("unexpected stream %d %+v", status, one)
+	}
+	if status := request(t, http.MethodGet, streamsPath+"?id=nope", "secret", nil); status != http.StatusNotFound {
+		t.Fatalf("expect 404, got %d", status)
+	}
+
+	var conns struct {
+		Connections []ConnectionView `json:"connections"`
+	}
+	if status := request(t, http.MethodGet, connectionsPath, "secret", &conns); status != http.StatusOK || len(conns.Connections) != 2 {
+		t.Fatalf("unexpected connections %d %+v", status, conns)
+	}
+
+	text := scrape(t, "secret")
+	for _, line := range []string{
+		`hylan_streams 1`,
+		`hylan_stream_publishers{stream="127.0.0.1:/live/admin",protocol="rtmp"} 1`,
+		`hylan_stream_players{stream="127.0.0.1:/live/admin",protocol="http-ts"} 1`,
+		`hylan_stream_bytes_in_total{stream="127.0.0.1:/live/admin"} 100`,
+		`hylan_stream_bytes_out_total{stream="127.0.0.1:/live/admin"} 100`,
+		`hylan_bytes_in_total{protocol="rtmp"}`,
+		`# TYPE hylan_task_goroutines gauge`,
+		`hylan_task_running{pool="default"}`,
+	} {
+		if !strings.Contains(text, line) {
+			t.Fatalf("expect %q in metrics\n%s", line, text)
+		}
+	}
+
+	//kicking the player ends its Pull and detaches it
+	if status := request(t, http.MethodDelete, fmt.Sprintf("%s?id=%s", connectionsPath, sink.ID()), "secret", nil); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if _, ok := sink.Pull(ctx); ok {
+		t.Fatal("expect the kicked sink to end")
+	}
+	if len(source.Sinks()) != 0 {
+		t.Fatal("expect the kicked sink to be detached")
+	}
+
+	if status := request(t, http.MethodDelete, streamsPath+"?id="+url.QueryEscape(view.ID), "secret", nil); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	select {
+	case <-kicked:
+	default:
+		t.Fatal("expect the publisher to be kicked")
+	}
+}
+
+func TestReload(t *testing.T) {
+	reloads := 0
+	server := NewServer(&ListenConfig{Token: "old", Reload: func() ([]string, error) {
+		reloads++
+		if reloads > 1 {
+			return nil, fmt.Errorf("bad config")
+		}
+		return []string{"api"}, nil
+	}})
+	server.ctx = context.Background()
+	handler := server.Handler()
+	serve := func(method string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, reloadPath, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve(http.MethodGet, "old"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expect 405, got %d", w.Code)
+	}
+	w := serve(http.MethodPost, "old")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"changed":["api"]`) {
+		t.Fatalf("unexpected reload %d %s", w.Code, w.Body.String())
+	}
+	if w = serve(http.MethodPost, "old"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expect the invalid config to be reported, got %d", w.Code)
+	}
+
+	server.SetToken("new")
+	if w = serve(http.MethodPost, "old"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expect the old token to be refused, got %d", w.Code)
+	}
+	server.config.Reload = nil
+	if w = serve(http.MethodPost, "new"); w.Code != http.StatusNotImplemented {
+		t.Fatalf("expect 501 without reload, got %d", w.Code)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	stream.InitHyStreamManager()
+	server := NewServer(&ListenConfig{})
+	server.ctx = context.Background()
+	handler := server.Handler()
+	defer vhost.SetDraining(false)
+	for _, step := range []struct {
+		method string
+		expect bool
+	}{{http.MethodPost, true}, {http.MethodGet, true}, {http.MethodDelete, false}} {
+		method, expect := step.method, step.expect
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, drainPath, nil))
+		var body struct {
+			Draining bool `json:"draining"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected response %d %s", method, w.Code, w.Body.String())
+		}
+		if body.Draining != expect || vhost.Draining() != expect {
+			t.Fatalf("%s: expect draining %v", method, expect)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Action is what a token allows, a play token can't publish
+type Action string
+
+const (
+	ActionPublish Action = "publish"
+	ActionPlay    Action = "play"
+)
+
+// query params of a signed url
+const (
+	ParamExpire = "expire"
+	ParamSign   = "sign"
+)
+
+// AnyApp is the app name whose config covers the apps without one of their own
+const AnyApp = "*"
+
+var (
+	ErrMissing = errors.New("token required")
+	ErrInvalid = errors.New("invalid token signature")
+	ErrExpired = errors.New("token expired")
+)
+
+// App is the token policy of the streams under one app
+type App struct {
+	Name   string
+	Secret string
+	//tokens are only required for the actions set here
+	Publish bool
+	Play    bool
+	//the client ip is part of the signature, the token only works from the address it was made for
+	BindIP bool
+}
+
+// Verifier checks the signed tokens of stream urls, the urls carry
+// expire=<unix seconds>&sign=<hex hmac-sha256> made by Sign
+type Verifier struct {
+	apps map[string]*App
+	now  func() time.Time
+}
+
+var verifier atomic.Value
+
+func NewVerifier(apps ...*App) *Verifier {
+	v := &Verifier{}
+	v.apps = make(map[string]*App, len(apps))
+	for _, app := range apps {
+		v.apps[app.Name] = app
+	}
+	v.now = time.Now
+	return v
+}
+
+// SetVerifier applies v to the publishers and players from now on, nil lets everyone in
+func SetVerifier(v *Verifier) {
+	verifier.Store(v)
+}
+
+// Verify checks u against the current verifier
+func Verify(action Action, u *url.URL, clientAddr string) error {
+	v, _ := verifier.Load().(*Verifier)
+	if v == nil {
+		return nil
+	}
+	return v.Verify(action, u, clientAddr)
+}
+
+// Verify lets u in when its app asks no token for action, otherwise the token has to be signed
+// with the app secret for this action, stream path, expiry and, when bound, the client ip
+func (v *Verifier) Verify(action Action, u *url.URL, clientAddr string) error {
+	app, resource := splitApp(u.Path)
+	conf := v.app(app)
+	if conf == nil || !conf.requires(action) {
+		return nil
+	}
+	query := u.Query()
+	expireParam, sign := query.Get(ParamExpire), query.Get(ParamSign)
+	if expireParam == "" || sign == "" {
+		return fmt.Errorf("%w to %s %s", ErrMissing, action, resource)
+	}
+	expire, err := strconv.ParseInt(expireParam, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: expire %q", ErrInvalid, expireParam)
+	}
+	if v.now().Unix() > expire {
+		return fmt.Errorf("%w at %s", ErrExpired, time.Unix(expire, 0).UTC().Format(time.RFC3339))
+	}
+	ip := ""
+	if conf.BindIP {
+		ip = ClientIP(clientAddr)
+	}
+	expected := Sign(conf.Secret, action, resource, expire, ip)
+	if !hmac.Equal([]byte(strings.ToLower(sign)), []byte(expected)) {
+		return fmt.Errorf("%w to %s %s", ErrInvalid, action, resource)
+	}
+	return nil
+}
+
+// Expired tells whether u carries an expire param already in the past, it is checked before the
+// stream is known, on rtmp connect
+func (v *Verifier) Expired(u *url.URL) bool {
+	expire, err := strconv.ParseInt(u.Query().Get(ParamExpire), 10, 64)
+	return err == nil && v.now().Unix() > expire
+}
+
+// Expired checks u against the current verifier
+func Expired(u *url.URL) bool {
+	v, _ := verifier.Load().(*Verifier)
+	if v == nil {
+		return false
+	}
+	return v.Expired(u)
+}
+
+func (v *Verifier) app(name string) *App {
+	if app, ok := v.apps[name]; ok {
+		return app
+	}
+	return v.apps[AnyApp]
+}
+
+func (a *App) requires(action Action) bool {
+	if action == ActionPublish {
+		return a.Publish
+	}
+	return a.Play
+}
+
+// Sign is the hex hmac-sha256 of "action\nresource\nexpire\nip" with secret, resource is "app/stream"
+// and ip is empty unless the token is bound to the client
+func Sign(secret string, action Action, resource string, expire int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%s\n%s\n%d\n%s", action, strings.Trim(resource, "/"), expire, ip)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL adds the token params to u for action on its stream until expire
+func SignURL(u *url.URL, secret string, action Action, expire time.Time, ip string) {
+	_, resource := splitApp(u.Path)
+	query := u.Query()
+	query.Set(ParamExpire, strconv.FormatInt(expire.Unix(), 10))
+	query.Set(ParamSign, Sign(secret, action, resource, expire.Unix(), ip))
+	u.RawQuery = query.Encode()
+}
+
+// splitApp takes the first path element as the app, resource is the whole path without slashes around
+func splitApp(path string) (string, string) {
+	resource := strings.Trim(path, "/")
+	if idx := strings.Index(resource, "/"); idx >= 0 {
+		return resource[:idx], resource
+	}
+	return resource, resource
+}
+
+// ClientIP is the host of a host:port client address, addr as it is without a port
+func ClientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
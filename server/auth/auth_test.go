@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func signed(t *testing.T, raw, secret string, action Action, expire time.Time, ip string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		SignURL(u, secret, action, expire, ip)
+	}
+	return u
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := NewVerifier(
+		&App{Name: "live", Secret: "live-secret", Publish: true},
+		&App{Name: "vip", Secret: "vip-secret", Publish: true, Play: true, BindIP: true},
+		&App{Name: AnyApp, Secret: "any-secret", Play: true},
+	)
+	v.now = func() time.Time { return now }
+	later, earlier := now.Add(time.Minute), now.Add(-time.Second)
+
+	for _, c := range []struct {
+		name   string
+		action Action
+		u      *url.URL
+		addr   string
+		err    error
+	}{
+		{"signed publish", ActionPublish, signed(t, "rtmp://h/live/a", "live-secret", ActionPublish, later, ""), "", nil},
+		{"play asks no token", ActionPlay, signed(t, "rtmp://h/live/a", "", ActionPlay, later, ""), "", nil},
+		{"no token", ActionPublish, signed(t, "rtmp://h/live/a", "", ActionPublish, later, ""), "", ErrMissing},
+		{"wrong secret", ActionPublish, signed(t, "rtmp://h/live/a", "other", ActionPublish, later, ""), "", ErrInvalid},
+		{"expired", ActionPublish, signed(t, "rtmp://h/live/a", "live-secret", ActionPublish, earlier, ""), "", ErrExpired},
+		{"bound ip", ActionPlay, signed(t, "rtmp://h/vip/a", "vip-secret", ActionPlay, later, "10.0.0.1"), "10.0.0.1:5000", nil},
+		{"other ip", ActionPlay, signed(t, "rtmp://h/vip/a", "vip-secret", ActionPlay, later, "10.0.0.1"), "10.0.0.2:5000", ErrInvalid},
+		{"publish token played", ActionPlay, signed(t, "rtmp://h/vip/a", "vip-secret", ActionPublish, later, "10.0.0.1"), "10.0.0.1:5000", ErrInvalid},
+		{"any app", ActionPlay, signed(t, "http://h/tv/a.ts", "any-secret", ActionPlay, later, ""), "", nil},
+		{"any app publish", ActionPublish, signed(t, "rtmp://h/tv/a", "", ActionPublish, later, ""), "", nil},
+	} {
+		if err := v.Verify(c.action, c.u, c.addr); !errors.Is(err, c.err) {
+			t.Errorf("%s: expect %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	//a token for one stream doesn't open another
+	u := signed(t, "rtmp://h/live/a", "live-secret", ActionPublish, later, "")
+	u.Path = "/live/b"
+	if err := v.Verify(ActionPublish, u, ""); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expect the stream to be bound, got %v", err)
+	}
+	if !v.Expired(signed(t, "rtmp://h/live", "live-secret", ActionPublish, earlier, "")) || v.Expired(&url.URL{Path: "/live"}) {
+		t.Fatal("expect only a past expire to be expired")
+	}
+}
+
+func TestDefaultVerifier(t *testing.T) {
+	u := &url.URL{Path: "/live/a"}
+	if err := Verify(ActionPublish, u, ""); err != nil {
+		t.Fatalf("expect everyone in without a verifier, got %v", err)
+	}
+	SetVerifier(NewVerifier(&App{Name: "live", Secret: "s", Publish: true}))
+	defer SetVerifier(nil)
+	if err := Verify(ActionPublish, u, ""); !errors.Is(err, ErrMissing) {
+		t.Fatalf("expect a token to be required, got %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for addr, expect := range map[string]string{
+		"10.0.0.1:1935": "10.0.0.1",
+		"[::1]:8080":    "::1",
+		"10.0.0.1":      "10.0.0.1",
+		"":              "",
+	} {
+		if ip := ClientIP(addr); ip != expect {
+			t.Fatalf("%q: expect %q, got %q", addr, expect, ip)
+		}
+	}
+}
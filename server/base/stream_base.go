@@ -5,14 +5,25 @@ import (
 	"github.com/Opafanls/hylan/server/constdef"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// vhostResolver holds a func(*url.URL) string naming the vhost of a stream url
+var vhostResolver atomic.Value
+
+// SetVhostResolver makes fn name the vhost part of every stream id from now on, the host of the url
+// names it again when fn is nil
+func SetVhostResolver(fn func(u *url.URL) string) {
+	vhostResolver.Store(fn)
+}
+
 type StreamBaseI interface {
 	ID() string
 	URL() *url.URL
 	GetParam(key string) string
 	SetParam(key, value string)
+	Params() map[string]string
 }
 
 type StreamBase struct {
@@ -35,6 +46,11 @@ func NewBase0(values *url.URL) *StreamBase {
 	streamBase := &StreamBase{}
 	streamBase.id = id(values)
 	streamBase.paramMap = make(map[string]string)
+	for key, vals := range values.Query() {
+		if len(vals) > 0 {
+			streamBase.paramMap[key] = vals[0]
+		}
+	}
 	streamBase.onTimestamp = time.Now().UnixNano()
 	streamBase.rw = &sync.RWMutex{}
 	streamBase.url = values
@@ -62,16 +78,30 @@ func (streamBase *StreamBase) SetParam(key, val string) {
 	streamBase.rw.Unlock()
 }
 
+// Params returns a copy of the stream parameters
+func (streamBase *StreamBase) Params() map[string]string {
+	streamBase.rw.RLock()
+	defer streamBase.rw.RUnlock()
+	params := make(map[string]string, len(streamBase.paramMap))
+	for key, val := range streamBase.paramMap {
+		params[key] = val
+	}
+	return params
+}
+
 func id(val *url.URL) string {
-	vhost := getPad(val.Host)
 	query := val.Query()
-	if tmp := query.Get("vhost"); tmp != "" {
-		vhost = tmp
-	}
 	path := getPad(val.Path)
 	if tmp := query.Get("path"); tmp != "" {
 		path = tmp
 	}
+	if resolve, _ := vhostResolver.Load().(func(u *url.URL) string); resolve != nil {
+		return fmt.Sprintf("%s:%s", getPad(resolve(val)), path)
+	}
+	vhost := getPad(val.Host)
+	if tmp := query.Get("vhost"); tmp != "" {
+		vhost = tmp
+	}
 	return fmt.Sprintf("%s:%s", vhost, path)
 }
 
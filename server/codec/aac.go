@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"fmt"
+)
+
+const (
+	AACObjectTypeMain = 1
+	AACObjectTypeLC   = 2
+	AACObjectTypeSBR  = 5
+	AACObjectTypePS   = 29
+
+	ADTSHeaderSize = 7
+	//samples of one aac frame
+	AACFrameSamples = 1024
+)
+
+// AACSampleRates is indexed by samplingFrequencyIndex
+var AACSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AudioSpecificConfig is the aac sequence header, ISO/IEC 14496-3 1.6.2.1
+type AudioSpecificConfig struct {
+	//core object type, 2 for LC even when sbr or ps is signalled explicitly
+	ObjectType int
+	SampleRate int
+	//channelConfiguration, 0 means a program config element defines them
+	Channels int
+	//5 (sbr) or 29 (ps) when signalled explicitly, the output rate is ExtensionSampleRate then
+	ExtensionObjectType int
+	ExtensionSampleRate int
+}
+
+func aacSampleRateIndex(rate int) int {
+	for i, r := range AACSampleRates {
+		if r == rate {
+			return i
+		}
+	}
+	return -1
+}
+
+func readAACObjectType(r *bitReader) int {
+	objectType := int(r.readBits(5))
+	if objectType == 31 {
+		objectType = 32 + int(r.readBits(6))
+	}
+	return objectType
+}
+
+func readAACSampleRate(r *bitReader) int {
+	index := int(r.readBits(4))
+	if index == 0x0f {
+		return int(r.readBits(24))
+	}
+	if index >= len(AACSampleRates) {
+		r.err = fmt.Errorf("invalid aac sample rate index %d", index)
+		return 0
+	}
+	return AACSampleRates[index]
+}
+
+// ParseAudioSpecificConfig reads the fields up to the channel configuration, the GASpecificConfig after them is not needed
+func ParseAudioSpecificConfig(data []byte) (*AudioSpecificConfig, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("short audio specific config")
+	}
+	r := newBitReader(data)
+	c := &AudioSpecificConfig{}
+	c.ObjectType = readAACObjectType(r)
+	c.SampleRate = readAACSampleRate(r)
+	c.Channels = int(r.readBits(4))
+	if c.ObjectType == AACObjectTypeSBR || c.ObjectType == AACObjectTypePS {
+		c.ExtensionObjectType = c.ObjectType
+		c.ExtensionSampleRate = readAACSampleRate(r)
+		c.ObjectType = readAACObjectType(r)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid audio specific config: %w", r.err)
+	}
+	if c.ObjectType == 0 || c.SampleRate == 0 {
+		return nil, fmt.Errorf("invalid audio specific config % x", data)
+	}
+	return c, nil
+}
+
+// OutputSampleRate is the rate the decoder produces, doubled by an explicit sbr
+func (c *AudioSpecificConfig) OutputSampleRate() int {
+	if c.ExtensionSampleRate > 0 {
+		return c.ExtensionSampleRate
+	}
+	return c.SampleRate
+}
+
+// Marshal writes the config the way encoders do, without GASpecificConfig flags set
+func (c *AudioSpecificConfig) Marshal() ([]byte, error) {
+	if c.ObjectType <= 0 || c.ObjectType >= 95 || c.Channels < 0 || c.Channels > 15 || c.SampleRate <= 0 {
+		return nil, fmt.Errorf("invalid audio specific config %+v", *c)
+	}
+	w := &bitWriter{}
+	objectType := c.ObjectType
+	if c.ExtensionObjectType != 0 {
+		objectType = c.ExtensionObjectType
+	}
+	writeAACObjectType(w, objectType)
+	writeAACSampleRate(w, c.SampleRate)
+	w.writeBits(uint32(c.Channels), 4)
+	if c.ExtensionObjectType != 0 {
+		writeAACSampleRate(w, c.ExtensionSampleRate)
+		writeAACObjectType(w, c.ObjectType)
+	}
+	//frameLengthFlag, dependsOnCoreCoder, extensionFlag
+	w.writeBits(0, 3)
+	return w.bytes(), nil
+}
+
+func writeAACObjectType(w *bitWriter, objectType int) {
+	if objectType >= 31 {
+		w.writeBits(31, 5)
+		w.writeBits(uint32(objectType-32), 6)
+		return
+	}
+	w.writeBits(uint32(objectType), 5)
+}
+
+func writeAACSampleRate(w *bitWriter, rate int) {
+	if index := aacSampleRateIndex(rate); index >= 0 {
+		w.writeBits(uint32(index), 4)
+		return
+	}
+	w.writeBits(0x0f, 4)
+	w.writeBits(uint32(rate), 24)
+}
+
+// ADTSHeader is the header in front of every aac frame of an elementary stream, ts and hls carry aac this way
+type ADTSHeader struct {
+	ObjectType      int
+	SampleRateIndex int
+	Channels        int
+	//FrameLength includes the header
+	FrameLength int
+	HeaderSize  int
+}
+
+// ParseADTSHeader reads the header at the start of data
+func ParseADTSHeader(data []byte) (*ADTSHeader, error) {
+	if len(data) < ADTSHeaderSize || data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+		return nil, fmt.Errorf("invalid adts sync word")
+	}
+	h := &ADTSHeader{
+		ObjectType:      int(data[2]>>6) + 1,
+		SampleRateIndex: int(data[2]>>2) & 0x0f,
+		Channels:        int(data[2]&0x01)<<2 | int(data[3]>>6),
+		FrameLength:     int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5),
+		HeaderSize:      ADTSHeaderSize,
+	}
+	if data[1]&0x01 == 0 {
+		//crc follows the header
+		h.HeaderSize += 2
+	}
+	if h.SampleRateIndex >= len(AACSampleRates) || h.FrameLength < h.HeaderSize {
+		return nil, fmt.Errorf("invalid adts header")
+	}
+	return h, nil
+}
+
+// NewADTSHeader returns the header repeating config, only the first 4 object types fit into adts
+func NewADTSHeader(config *AudioSpecificConfig) (*ADTSHeader, error) {
+	index := aacSampleRateIndex(config.SampleRate)
+	if config.ObjectType < AACObjectTypeMain || config.ObjectType > 4 || index < 0 {
+		return nil, fmt.Errorf("audio specific config not representable in adts")
+	}
+	return &ADTSHeader{
+		ObjectType:      config.ObjectType,
+		SampleRateIndex: index,
+		Channels:        config.Channels,
+		HeaderSize:      ADTSHeaderSize,
+	}, nil
+}
+
+func (h *ADTSHeader) SampleRate() int {
+	return AACSampleRates[h.SampleRateIndex]
+}
+
+// Config returns the 2 byte AudioSpecificConfig of the frame
+func (h *ADTSHeader) Config() []byte {
+	return []byte{
+		byte(h.ObjectType<<3 | h.SampleRateIndex>>1),
+		byte(h.SampleRateIndex<<7 | h.Channels<<3),
+	}
+}
+
+// Append writes the header of a frame without crc followed by the raw frame
+func (h *ADTSHeader) Append(buf []byte, frame []byte) []byte {
+	length := ADTSHeaderSize + len(frame)
+	buf = append(buf,
+		0xff,
+		0xf1,
+		byte((h.ObjectType-1)<<6|h.SampleRateIndex<<2|h.Channels>>2),
+		byte(h.Channels<<6|length>>11),
+		byte(length>>3),
+		byte(length<<5|0x1f),
+		0xfc,
+	)
+	return append(buf, frame...)
+}
+
+// SplitADTS calls fn with the header and raw payload of every complete frame, it returns the bytes it consumed
+func SplitADTS(data []byte, fn func(h *ADTSHeader, frame []byte)) int {
+	consumed := 0
+	for len(data) > 0 {
+		h, err := ParseADTSHeader(data)
+		if err != nil || h.FrameLength > len(data) {
+			break
+		}
+		fn(h, data[h.HeaderSize:h.FrameLength])
+		data = data[h.FrameLength:]
+		consumed += h.FrameLength
+	}
+	return consumed
+}
@@ -0,0 +1,43 @@
+package codec
+
+// SplitAnnexB splits a start code delimited byte stream into nal units
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			end := i
+			//a 4 byte start code leaves a zero behind
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, data[start:end])
+			}
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// EncodeAnnexB prefixes every nal unit with a 4 byte start code
+func EncodeAnnexB(nalus [][]byte) []byte {
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nalu...)
+	}
+	return data
+}
@@ -0,0 +1,169 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+)
+
+// opus always decodes at 48kHz whatever the input rate was
+const OpusSampleRate = 48000
+
+// AudioInfo is what the sequence header, or the frame header of mp3, tells about an audio stream
+type AudioInfo struct {
+	Codec      constdef.CodecID `json:"codec"`
+	SampleRate int              `json:"sample_rate"`
+	Channels   int              `json:"channels"`
+	//aac audio object type, 2 is LC
+	ObjectType int `json:"object_type"`
+}
+
+// ParseAudioInfo reads the parameters of a sequence header or of an mp3 frame, other packets return nil without error
+func ParseAudioInfo(pkt *proto.BasePacket) (*AudioInfo, error) {
+	switch {
+	case pkt.Codec == constdef.CodecAAC && pkt.SeqHeader:
+		config, err := ParseAudioSpecificConfig(pkt.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &AudioInfo{
+			Codec:      constdef.CodecAAC,
+			SampleRate: config.OutputSampleRate(),
+			Channels:   config.Channels,
+			ObjectType: config.ObjectType,
+		}, nil
+	case pkt.Codec == constdef.CodecOpus && pkt.SeqHeader:
+		head, err := ParseOpusHead(pkt.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &AudioInfo{Codec: constdef.CodecOpus, SampleRate: OpusSampleRate, Channels: head.Channels}, nil
+	case pkt.Codec == constdef.CodecMP3 && !pkt.SeqHeader:
+		h, err := ParseMP3FrameHeader(pkt.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &AudioInfo{Codec: constdef.CodecMP3, SampleRate: h.SampleRate, Channels: h.Channels}, nil
+	}
+	return nil, nil
+}
+
+// OpusHead is the identification header of RFC 7845, it tells the sinks the channel count
+func OpusHead(channels int) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint32(head[12:16], OpusSampleRate)
+	return head
+}
+
+// OpusHeader is the parsed identification header, RFC 7845 5.1
+type OpusHeader struct {
+	Version  int
+	Channels int
+	PreSkip  int
+	//rate of the encoder input, informational only
+	InputSampleRate int
+	//Q7.8 dB
+	OutputGain    int
+	MappingFamily int
+}
+
+func ParseOpusHead(data []byte) (*OpusHeader, error) {
+	if len(data) < 19 || string(data[:8]) != "OpusHead" {
+		return nil, fmt.Errorf("invalid opus id header")
+	}
+	h := &OpusHeader{
+		Version:         int(data[8]),
+		Channels:        int(data[9]),
+		PreSkip:         int(binary.LittleEndian.Uint16(data[10:12])),
+		InputSampleRate: int(binary.LittleEndian.Uint32(data[12:16])),
+		OutputGain:      int(int16(binary.LittleEndian.Uint16(data[16:18]))),
+		MappingFamily:   int(data[18]),
+	}
+	//the major version is the upper nibble, only 0 is defined
+	if h.Version>>4 != 0 || h.Channels == 0 {
+		return nil, fmt.Errorf("unsupported opus id header version %d channels %d", h.Version, h.Channels)
+	}
+	return h, nil
+}
+
+// MP3FrameHeader is the 4 byte header of an mpeg audio frame
+type MP3FrameHeader struct {
+	//1, 2 or 25 for mpeg 2.5
+	Version int
+	Layer   int
+	//bits per second, 0 for free format
+	Bitrate    int
+	SampleRate int
+	Channels   int
+	//FrameSize includes the header, 0 for free format
+	FrameSize int
+	Samples   int
+}
+
+var (
+	mp3Bitrates = [2][3][15]int{
+		{
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	mp3SampleRates = [3]int{44100, 48000, 32000}
+)
+
+func ParseMP3FrameHeader(data []byte) (*MP3FrameHeader, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1]&0xe0 != 0xe0 {
+		return nil, fmt.Errorf("invalid mp3 sync word")
+	}
+	versionBits := (data[1] >> 3) & 0x03
+	layerBits := (data[1] >> 1) & 0x03
+	bitrateIndex := int(data[2] >> 4)
+	rateIndex := int(data[2]>>2) & 0x03
+	padding := int(data[2]>>1) & 0x01
+	if versionBits == 1 || layerBits == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return nil, fmt.Errorf("invalid mp3 frame header % x", data[:4])
+	}
+	h := &MP3FrameHeader{Layer: int(4 - layerBits), Channels: 2}
+	table := 1
+	switch versionBits {
+	case 3:
+		h.Version = 1
+		table = 0
+		h.SampleRate = mp3SampleRates[rateIndex]
+	case 2:
+		h.Version = 2
+		h.SampleRate = mp3SampleRates[rateIndex] / 2
+	default:
+		h.Version = 25
+		h.SampleRate = mp3SampleRates[rateIndex] / 4
+	}
+	if data[3]>>6 == 3 {
+		h.Channels = 1
+	}
+	h.Bitrate = mp3Bitrates[table][h.Layer-1][bitrateIndex] * 1000
+	switch {
+	case h.Layer == 1:
+		h.Samples = 384
+	case h.Layer == 3 && h.Version != 1:
+		h.Samples = 576
+	default:
+		h.Samples = 1152
+	}
+	if h.Bitrate > 0 {
+		if h.Layer == 1 {
+			h.FrameSize = (12*h.Bitrate/h.SampleRate + padding) * 4
+		} else {
+			h.FrameSize = h.Samples/8*h.Bitrate/h.SampleRate + padding
+		}
+	}
+	return h, nil
+}
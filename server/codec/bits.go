@@ -0,0 +1,120 @@
+package codec
+
+import (
+	"fmt"
+)
+
+var errBitsExhausted = fmt.Errorf("bitstream exhausted")
+
+// bitReader reads the msb first fields of a rbsp, errors stick so a parser checks once at the end
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) readBit() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data)*8 {
+		r.err = errBitsExhausted
+		return 0
+	}
+	bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint32(bit)
+}
+
+func (r *bitReader) readBits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.readBit()
+	}
+	return v
+}
+
+func (r *bitReader) readFlag() bool {
+	return r.readBit() == 1
+}
+
+func (r *bitReader) skipBits(n int) {
+	if r.err != nil {
+		return
+	}
+	if r.pos+n > len(r.data)*8 {
+		r.err = errBitsExhausted
+		return
+	}
+	r.pos += n
+}
+
+// readUE reads an unsigned exp-golomb code
+func (r *bitReader) readUE() uint32 {
+	zeros := 0
+	for r.readBit() == 0 {
+		if r.err != nil {
+			return 0
+		}
+		zeros++
+		if zeros > 31 {
+			r.err = fmt.Errorf("invalid exp-golomb code")
+			return 0
+		}
+	}
+	return (1<<uint(zeros) - 1) + r.readBits(zeros)
+}
+
+// readSE reads a signed exp-golomb code
+func (r *bitReader) readSE() int32 {
+	v := r.readUE()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+// RemoveEmulationPrevention turns the payload of a nal unit into its rbsp by dropping the 0x03 of every 00 00 03
+func RemoveEmulationPrevention(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// bitWriter appends msb first fields, the last byte is zero padded
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) writeBits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.data[len(w.data)-1] |= 1 << (7 - uint(w.pos%8))
+		}
+		w.pos++
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.data
+}
@@ -0,0 +1,146 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ParseAVCDecoderConfig returns the sps and pps of an AVCDecoderConfigurationRecord
+func ParseAVCDecoderConfig(data []byte) (sps []byte, pps []byte, err error) {
+	if len(data) < 6 {
+		return nil, nil, fmt.Errorf("short avc decoder config")
+	}
+	pos := 5
+	spsCount := int(data[pos] & 0x1f)
+	pos++
+	for i := 0; i < spsCount; i++ {
+		if pos+2 > len(data) {
+			return nil, nil, fmt.Errorf("invalid avc decoder config")
+		}
+		size := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+size > len(data) {
+			return nil, nil, fmt.Errorf("invalid avc decoder config")
+		}
+		if sps == nil {
+			sps = data[pos : pos+size]
+		}
+		pos += size
+	}
+	if pos >= len(data) {
+		return nil, nil, fmt.Errorf("invalid avc decoder config")
+	}
+	ppsCount := int(data[pos])
+	pos++
+	for i := 0; i < ppsCount; i++ {
+		if pos+2 > len(data) {
+			return nil, nil, fmt.Errorf("invalid avc decoder config")
+		}
+		size := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+size > len(data) {
+			return nil, nil, fmt.Errorf("invalid avc decoder config")
+		}
+		if pps == nil {
+			pps = data[pos : pos+size]
+		}
+		pos += size
+	}
+	if sps == nil || pps == nil {
+		return nil, nil, fmt.Errorf("avc decoder config without sps/pps")
+	}
+	return sps, pps, nil
+}
+
+// BuildAVCDecoderConfig builds an AVCDecoderConfigurationRecord with one sps and pps
+func BuildAVCDecoderConfig(sps []byte, pps []byte) []byte {
+	if len(sps) < 4 {
+		return nil
+	}
+	data := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+	data = append(data, byte(len(sps)>>8), byte(len(sps)))
+	data = append(data, sps...)
+	data = append(data, 1, byte(len(pps)>>8), byte(len(pps)))
+	return append(data, pps...)
+}
+
+// ParseHEVCDecoderConfig returns the vps, sps and pps of a HEVCDecoderConfigurationRecord
+func ParseHEVCDecoderConfig(data []byte) (vps []byte, sps []byte, pps []byte, err error) {
+	if len(data) < 23 {
+		return nil, nil, nil, fmt.Errorf("short hevc decoder config")
+	}
+	pos := 22
+	numArrays := int(data[pos])
+	pos++
+	for i := 0; i < numArrays; i++ {
+		if pos+3 > len(data) {
+			return nil, nil, nil, fmt.Errorf("invalid hevc decoder config")
+		}
+		naluType := data[pos] & 0x3f
+		numNalus := int(binary.BigEndian.Uint16(data[pos+1:]))
+		pos += 3
+		for j := 0; j < numNalus; j++ {
+			if pos+2 > len(data) {
+				return nil, nil, nil, fmt.Errorf("invalid hevc decoder config")
+			}
+			size := int(binary.BigEndian.Uint16(data[pos:]))
+			pos += 2
+			if pos+size > len(data) {
+				return nil, nil, nil, fmt.Errorf("invalid hevc decoder config")
+			}
+			nalu := data[pos : pos+size]
+			switch naluType {
+			case H265NaluVPS:
+				vps = nalu
+			case H265NaluSPS:
+				sps = nalu
+			case H265NaluPPS:
+				pps = nalu
+			}
+			pos += size
+		}
+	}
+	if vps == nil || sps == nil || pps == nil {
+		return nil, nil, nil, fmt.Errorf("hevc decoder config without vps/sps/pps")
+	}
+	return vps, sps, pps, nil
+}
+
+// BuildHEVCDecoderConfig copies profile_tier_level out of the sps, the remaining fields use safe defaults
+func BuildHEVCDecoderConfig(vps []byte, sps []byte, pps []byte) []byte {
+	rbsp := RemoveEmulationPrevention(sps)
+	if len(rbsp) < 15 {
+		return nil
+	}
+	data := make([]byte, 23)
+	data[0] = 1
+	//general_profile_space, tier, profile_idc, compatibility flags, constraint flags, level_idc
+	copy(data[1:13], rbsp[3:15])
+	data[13] = 0xf0 //min_spatial_segmentation_idc
+	data[15] = 0xfc //parallelismType
+	data[16] = 0xfd //chroma_format_idc 4:2:0
+	data[17] = 0xf8 //bit_depth_luma_minus8
+	data[18] = 0xf8 //bit_depth_chroma_minus8
+	//avgFrameRate 0, constantFrameRate 0, numTemporalLayers 1, temporalIdNested 1, lengthSizeMinusOne 3
+	data[21] = 0x0f
+	data[22] = 3
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		data = append(data, 0x80|(nalu[0]>>1)&0x3f, 0, 1, byte(len(nalu)>>8), byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+	return data
+}
+
+// EncodeAVCC prefixes every nal unit with its 4 byte length
+func EncodeAVCC(nalus [][]byte) []byte {
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+	return data
+}
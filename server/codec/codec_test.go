@@ -0,0 +1,205 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"testing"
+)
+
+var (
+	//720p baseline without vui timing
+	sps720p = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	//1080p30 high with frame cropping and emulation prevention bytes
+	sps1080p = []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58}
+	//1080p30 hevc main
+	hevcSPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0xa0, 0x03, 0xc0, 0x80, 0x10, 0xe5, 0x96, 0x66, 0x69, 0x24, 0xca, 0xe0, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x01, 0xe0, 0x80}
+	hevcVPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff}
+	hevcPPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+	pps     = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func checkInfo(t *testing.T, info *VideoInfo, err error, expect VideoInfo, profile string, level string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *info != expect {
+		t.Fatalf("expect %+v, got %+v", expect, *info)
+	}
+	if info.ProfileName() != profile || info.LevelName() != level {
+		t.Fatalf("expect %s@%s, got %s@%s", profile, level, info.ProfileName(), info.LevelName())
+	}
+}
+
+func TestParseSPS(t *testing.T) {
+	info, err := ParseH264SPS(sps720p)
+	checkInfo(t, info, err, VideoInfo{Codec: constdef.CodecH264, Profile: 66, Level: 31, Width: 1280, Height: 720}, "Baseline", "3.1")
+
+	info, err = ParseH264SPS(sps1080p)
+	checkInfo(t, info, err, VideoInfo{Codec: constdef.CodecH264, Profile: 100, Level: 40, Width: 1920, Height: 1080, FrameRate: 30}, "High", "4")
+
+	info, err = ParseH265SPS(hevcSPS)
+	checkInfo(t, info, err, VideoInfo{Codec: constdef.CodecH265, Profile: 1, Level: 120, Width: 1920, Height: 1080, FrameRate: 30}, "Main", "4")
+
+	info, err = ParseVideoConfig(constdef.CodecH265, BuildHEVCDecoderConfig(hevcVPS, hevcSPS, hevcPPS))
+	checkInfo(t, info, err, VideoInfo{Codec: constdef.CodecH265, Profile: 1, Level: 120, Width: 1920, Height: 1080, FrameRate: 30}, "Main", "4")
+
+	for _, broken := range [][]byte{sps720p[:6], pps, {0x67}} {
+		if _, err = ParseH264SPS(broken); err == nil {
+			t.Fatalf("expect error for % x", broken)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	idr := []byte{0x65, 0x88, 0x84, 0x00}
+	avcc := EncodeAVCC([][]byte{sps720p, pps, idr})
+	annexB, err := AVCCToAnnexB(avcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(AnnexBToAVCC(annexB), avcc) {
+		t.Fatalf("annex-b round trip changed the access unit")
+	}
+	if _, err = AVCCToAnnexB([]byte{0, 0, 0, 9, 1}); err == nil {
+		t.Fatalf("expect error for truncated avcc")
+	}
+
+	var types []byte
+	if err = ForEachNALU(avcc, func(nalu []byte) bool {
+		types = append(types, H264NaluType(nalu))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(types, []byte{H264NaluSPS, H264NaluPPS, H264NaluIDR}) {
+		t.Fatalf("unexpected nal units %v", types)
+	}
+	if !IsKeyFrame(constdef.CodecH264, avcc) || IsKeyFrame(constdef.CodecH264, EncodeAVCC([][]byte{{0x41, 0x9a}})) {
+		t.Fatalf("h264 key frame detection failed")
+	}
+	//CRA is an irap picture, TRAIL_R is not
+	if !IsKeyFrame(constdef.CodecH265, EncodeAVCC([][]byte{{21 << 1, 1}})) || IsKeyFrame(constdef.CodecH265, EncodeAVCC([][]byte{{1 << 1, 1}})) {
+		t.Fatalf("h265 key frame detection failed")
+	}
+
+	config, err := ConfigToAnnexB(constdef.CodecH264, BuildAVCDecoderConfig(sps720p, pps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(config, EncodeAnnexB([][]byte{sps720p, pps})) {
+		t.Fatalf("unexpected parameter sets % x", config)
+	}
+}
+
+func TestRemoveEmulationPrevention(t *testing.T) {
+	rbsp := RemoveEmulationPrevention([]byte{1, 0, 0, 3, 0, 0, 0, 3, 3, 0, 0, 3})
+	if !bytes.Equal(rbsp, []byte{1, 0, 0, 0, 0, 0, 3, 0, 0}) {
+		t.Fatalf("unexpected rbsp % x", rbsp)
+	}
+}
+
+func TestAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		config AudioSpecificConfig
+	}{
+		//aac lc 44.1kHz stereo
+		{[]byte{0x12, 0x10}, AudioSpecificConfig{ObjectType: 2, SampleRate: 44100, Channels: 2}},
+		//he-aac v1 signalled explicitly, 24kHz core
+		{[]byte{0x2b, 0x11, 0x88, 0x00}, AudioSpecificConfig{ObjectType: 2, SampleRate: 24000, Channels: 2, ExtensionObjectType: 5, ExtensionSampleRate: 48000}},
+		//explicit 37800Hz mono
+		{[]byte{0x17, 0x80, 0x49, 0xd4, 0x08}, AudioSpecificConfig{ObjectType: 2, SampleRate: 37800, Channels: 1}},
+	}
+	for _, test := range tests {
+		config, err := ParseAudioSpecificConfig(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *config != test.config {
+			t.Fatalf("expect %+v, got %+v", test.config, *config)
+		}
+		data, err := config.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, test.data) {
+			t.Fatalf("expect % x, got % x", test.data, data)
+		}
+	}
+	if _, err := ParseAudioSpecificConfig([]byte{0x17}); err == nil {
+		t.Fatalf("expect error for short config")
+	}
+}
+
+func TestADTS(t *testing.T) {
+	config, _ := ParseAudioSpecificConfig([]byte{0x11, 0x90})
+	h, err := NewADTSHeader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream []byte
+	stream = h.Append(stream, []byte{1, 2, 3})
+	stream = h.Append(stream, []byte{4, 5})
+	var frames [][]byte
+	consumed := SplitADTS(append(stream, 0xff, 0xf1), func(h *ADTSHeader, frame []byte) {
+		if h.SampleRate() != 48000 || h.Channels != 2 || !bytes.Equal(h.Config(), []byte{0x11, 0x90}) {
+			t.Fatalf("unexpected adts header %+v", h)
+		}
+		frames = append(frames, frame)
+	})
+	if consumed != len(stream) || len(frames) != 2 || !bytes.Equal(frames[1], []byte{4, 5}) {
+		t.Fatalf("unexpected adts split %d %v", consumed, frames)
+	}
+	if _, err = NewADTSHeader(&AudioSpecificConfig{ObjectType: 42, SampleRate: 48000, Channels: 2}); err == nil {
+		t.Fatalf("expect error for usac in adts")
+	}
+}
+
+func TestAudioInfo(t *testing.T) {
+	head, err := ParseOpusHead(OpusHead(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Channels != 2 || head.InputSampleRate != OpusSampleRate {
+		t.Fatalf("unexpected opus head %+v", head)
+	}
+
+	//mpeg1 layer3 128kbps 44.1kHz joint stereo with padding
+	mp3, err := ParseMP3FrameHeader([]byte{0xff, 0xfb, 0x92, 0x44})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := MP3FrameHeader{Version: 1, Layer: 3, Bitrate: 128000, SampleRate: 44100, Channels: 2, FrameSize: 418, Samples: 1152}
+	if *mp3 != expect {
+		t.Fatalf("expect %+v, got %+v", expect, *mp3)
+	}
+	//mpeg2 layer3 64kbps 22.05kHz mono
+	mp3, err = ParseMP3FrameHeader([]byte{0xff, 0xf3, 0x80, 0xc4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp3.SampleRate != 22050 || mp3.Channels != 1 || mp3.Samples != 576 || mp3.FrameSize != 208 {
+		t.Fatalf("unexpected mp3 header %+v", *mp3)
+	}
+
+	tests := []struct {
+		pkt  *proto.BasePacket
+		info *AudioInfo
+	}{
+		{&proto.BasePacket{Codec: constdef.CodecAAC, SeqHeader: true, Payload: []byte{0x12, 0x10}}, &AudioInfo{Codec: constdef.CodecAAC, SampleRate: 44100, Channels: 2, ObjectType: 2}},
+		{&proto.BasePacket{Codec: constdef.CodecOpus, SeqHeader: true, Payload: OpusHead(1)}, &AudioInfo{Codec: constdef.CodecOpus, SampleRate: 48000, Channels: 1}},
+		{&proto.BasePacket{Codec: constdef.CodecMP3, Payload: []byte{0xff, 0xfb, 0x92, 0x44}}, &AudioInfo{Codec: constdef.CodecMP3, SampleRate: 44100, Channels: 2}},
+		{&proto.BasePacket{Codec: constdef.CodecAAC, Payload: []byte{0x21}}, nil},
+	}
+	for _, test := range tests {
+		info, err := ParseAudioInfo(test.pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (info == nil) != (test.info == nil) || info != nil && *info != *test.info {
+			t.Fatalf("expect %+v, got %+v", test.info, info)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+)
+
+// VideoFramer turns the nal units of access units into media packets,
+// a sequence header goes out first and again whenever the parameter sets change
+type VideoFramer struct {
+	codec      constdef.CodecID
+	paramSets  [3][]byte
+	headerSent bool
+}
+
+// NewVideoFramer starts with the parameter sets known out of band, they may be nil
+func NewVideoFramer(codecID constdef.CodecID, vps []byte, sps []byte, pps []byte) *VideoFramer {
+	f := &VideoFramer{}
+	f.codec = codecID
+	f.paramSets = [3][]byte{vps, sps, pps}
+	return f
+}
+
+// paramSetIndex returns the slot of a vps/sps/pps, -1 for other units
+func (f *VideoFramer) paramSetIndex(nalu []byte) int {
+	if f.codec == constdef.CodecH264 {
+		switch nalu[0] & 0x1f {
+		case H264NaluSPS:
+			return 1
+		case H264NaluPPS:
+			return 2
+		}
+		return -1
+	}
+	switch H265NaluType(nalu) {
+	case H265NaluVPS:
+		return 0
+	case H265NaluSPS:
+		return 1
+	case H265NaluPPS:
+		return 2
+	}
+	return -1
+}
+
+func (f *VideoFramer) isAUD(nalu []byte) bool {
+	if f.codec == constdef.CodecH264 {
+		return nalu[0]&0x1f == H264NaluAUD
+	}
+	return H265NaluType(nalu) == H265NaluAUD
+}
+
+func (f *VideoFramer) config() []byte {
+	if f.codec == constdef.CodecH264 {
+		if f.paramSets[1] == nil || f.paramSets[2] == nil {
+			return nil
+		}
+		return BuildAVCDecoderConfig(f.paramSets[1], f.paramSets[2])
+	}
+	if f.paramSets[0] == nil || f.paramSets[1] == nil || f.paramSets[2] == nil {
+		return nil
+	}
+	return BuildHEVCDecoderConfig(f.paramSets[0], f.paramSets[1], f.paramSets[2])
+}
+
+// Frame appends the packets of one access unit to pkts, frames before the first sequence header are dropped
+func (f *VideoFramer) Frame(pkts []*proto.BasePacket, nalus [][]byte, dts int64, pts int64) []*proto.BasePacket {
+	var frame [][]byte
+	keyFrame := false
+	changed := false
+	for _, nalu := range nalus {
+		if len(nalu) < 2 || f.isAUD(nalu) {
+			continue
+		}
+		if idx := f.paramSetIndex(nalu); idx >= 0 {
+			if !bytes.Equal(nalu, f.paramSets[idx]) {
+				f.paramSets[idx] = nalu
+				changed = true
+			}
+		} else if IsKeyNalu(f.codec, nalu) {
+			keyFrame = true
+		}
+		frame = append(frame, nalu)
+	}
+	if changed || !f.headerSent {
+		if config := f.config(); config != nil {
+			f.headerSent = true
+			pkts = append(pkts, &proto.BasePacket{
+				MediaType: protocol.MediaDataTypeVideo,
+				Codec:     f.codec,
+				DTS:       dts,
+				PTS:       dts,
+				SeqHeader: true,
+				Payload:   config,
+			})
+		}
+	}
+	if !f.headerSent || len(frame) == 0 {
+		return pkts
+	}
+	return append(pkts, &proto.BasePacket{
+		MediaType: protocol.MediaDataTypeVideo,
+		Codec:     f.codec,
+		DTS:       dts,
+		PTS:       pts,
+		KeyFrame:  keyFrame,
+		Payload:   EncodeAVCC(frame),
+	})
+}
@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Opafanls/hylan/server/constdef"
+)
+
+const (
+	H264NaluSPS = 7
+	H264NaluPPS = 8
+	H264NaluAUD = 9
+	H264NaluIDR = 5
+
+	H265NaluVPS = 32
+	H265NaluSPS = 33
+	H265NaluPPS = 34
+	H265NaluAUD = 35
+)
+
+// H264NaluType reads the type out of the 1 byte nal unit header
+func H264NaluType(nalu []byte) byte {
+	return nalu[0] & 0x1f
+}
+
+// H264IsIDR reports instantaneous decoding refresh slices
+func H264IsIDR(naluType byte) bool {
+	return naluType == H264NaluIDR
+}
+
+// H265NaluType reads the type out of the 2 byte nal unit header
+func H265NaluType(nalu []byte) byte {
+	return (nalu[0] >> 1) & 0x3f
+}
+
+// H265IsIRAP reports BLA/IDR/CRA pictures
+func H265IsIRAP(naluType byte) bool {
+	return naluType >= 16 && naluType <= 23
+}
+
+// IsKeyNalu reports a nal unit a decoder can start from, IDR for h264 and IRAP for hevc
+func IsKeyNalu(codecID constdef.CodecID, nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+	if codecID == constdef.CodecH264 {
+		return H264IsIDR(H264NaluType(nalu))
+	}
+	return len(nalu) >= 2 && H265IsIRAP(H265NaluType(nalu))
+}
+
+// ForEachNALU walks the 4 byte length prefixed nal units of an avcc/hvcc payload without copying, fn returns false to stop
+func ForEachNALU(data []byte, fn func(nalu []byte) bool) error {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return fmt.Errorf("short avcc nal unit length")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size > len(data) {
+			return fmt.Errorf("avcc nal unit exceeds payload")
+		}
+		if size > 0 && !fn(data[:size]) {
+			return nil
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// DecodeAVCC splits 4 byte length prefixed nal units
+func DecodeAVCC(data []byte) ([][]byte, error) {
+	var nalus [][]byte
+	err := ForEachNALU(data, func(nalu []byte) bool {
+		nalus = append(nalus, nalu)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nalus, nil
+}
+
+// IsKeyFrame reports whether an avcc/hvcc access unit carries a key picture
+func IsKeyFrame(codecID constdef.CodecID, data []byte) bool {
+	key := false
+	_ = ForEachNALU(data, func(nalu []byte) bool {
+		key = IsKeyNalu(codecID, nalu)
+		return !key
+	})
+	return key
+}
+
+// AVCCToAnnexB replaces the length prefixes of an avcc/hvcc payload with start codes
+func AVCCToAnnexB(data []byte) ([]byte, error) {
+	nalus, err := DecodeAVCC(data)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeAnnexB(nalus), nil
+}
+
+// AnnexBToAVCC replaces the start codes of a byte stream with 4 byte length prefixes
+func AnnexBToAVCC(data []byte) []byte {
+	return EncodeAVCC(SplitAnnexB(data))
+}
+
+// ConfigToAnnexB returns the parameter sets of an avcC/hvcC record as a byte stream, the way ts and rtp carry them in band
+func ConfigToAnnexB(codecID constdef.CodecID, config []byte) ([]byte, error) {
+	switch codecID {
+	case constdef.CodecH264:
+		sps, pps, err := ParseAVCDecoderConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeAnnexB([][]byte{sps, pps}), nil
+	case constdef.CodecH265:
+		vps, sps, pps, err := ParseHEVCDecoderConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeAnnexB([][]byte{vps, sps, pps}), nil
+	}
+	return nil, fmt.Errorf("unsupported video codec %v", codecID)
+}
@@ -0,0 +1,443 @@
+package codec
+
+import (
+	"fmt"
+	"github.com/Opafanls/hylan/server/constdef"
+)
+
+// VideoInfo is what the sps tells about a video stream
+type VideoInfo struct {
+	Codec constdef.CodecID `json:"codec"`
+	//profile_idc, general_profile_idc for hevc
+	Profile int `json:"profile"`
+	//level_idc, general_level_idc for hevc
+	Level  int `json:"level"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	//0 when the vui carries no timing info
+	FrameRate float64 `json:"frame_rate"`
+}
+
+var h264Profiles = map[int]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4",
+}
+
+var h265Profiles = map[int]string{
+	1: "Main",
+	2: "Main 10",
+	3: "Main Still Picture",
+	4: "Range Extensions",
+}
+
+// ProfileName returns the readable profile, the number when it is not a common one
+func (v *VideoInfo) ProfileName() string {
+	names := h264Profiles
+	if v.Codec == constdef.CodecH265 {
+		names = h265Profiles
+	}
+	if name, ok := names[v.Profile]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", v.Profile)
+}
+
+// LevelName returns the level the way encoders write it, like 3.1
+func (v *VideoInfo) LevelName() string {
+	level := v.Level
+	if v.Codec == constdef.CodecH265 {
+		//general_level_idc is 30 times the level
+		level = v.Level / 3
+	}
+	if level%10 == 0 {
+		return fmt.Sprintf("%d", level/10)
+	}
+	return fmt.Sprintf("%d.%d", level/10, level%10)
+}
+
+// ParseVideoConfig parses the sps inside the avcC/hvcC record of a video sequence header
+func ParseVideoConfig(codecID constdef.CodecID, config []byte) (*VideoInfo, error) {
+	switch codecID {
+	case constdef.CodecH264:
+		sps, _, err := ParseAVCDecoderConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return ParseH264SPS(sps)
+	case constdef.CodecH265:
+		_, sps, _, err := ParseHEVCDecoderConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return ParseH265SPS(sps)
+	}
+	return nil, fmt.Errorf("unsupported video codec %v", codecID)
+}
+
+// ParseH264SPS parses a sps nal unit including its header, ITU-T H.264 7.3.2.1.1
+func ParseH264SPS(sps []byte) (*VideoInfo, error) {
+	if len(sps) < 4 || H264NaluType(sps) != H264NaluSPS {
+		return nil, fmt.Errorf("invalid h264 sps")
+	}
+	r := newBitReader(RemoveEmulationPrevention(sps[1:]))
+	info := &VideoInfo{Codec: constdef.CodecH264}
+	info.Profile = int(r.readBits(8))
+	//constraint_set flags
+	r.skipBits(8)
+	info.Level = int(r.readBits(8))
+	//seq_parameter_set_id
+	r.readUE()
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	switch info.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.readUE()
+		if chromaFormat == 3 {
+			separateColourPlane = r.readFlag()
+		}
+		//bit_depth_luma_minus8, bit_depth_chroma_minus8
+		r.readUE()
+		r.readUE()
+		//qpprime_y_zero_transform_bypass_flag
+		r.skipBits(1)
+		if r.readFlag() {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.readFlag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				skipH264ScalingList(r, size)
+			}
+		}
+	}
+	//log2_max_frame_num_minus4
+	r.readUE()
+	switch r.readUE() {
+	case 0:
+		//log2_max_pic_order_cnt_lsb_minus4
+		r.readUE()
+	case 1:
+		//delta_pic_order_always_zero_flag, offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		r.skipBits(1)
+		r.readSE()
+		r.readSE()
+		cycle := r.readUE()
+		if cycle > 255 {
+			return nil, fmt.Errorf("invalid h264 sps poc cycle %d", cycle)
+		}
+		for i := uint32(0); i < cycle; i++ {
+			r.readSE()
+		}
+	}
+	//max_num_ref_frames, gaps_in_frame_num_value_allowed_flag
+	r.readUE()
+	r.skipBits(1)
+	widthInMbs := int(r.readUE()) + 1
+	heightInMapUnits := int(r.readUE()) + 1
+	frameMbsOnly := r.readFlag()
+	if !frameMbsOnly {
+		//mb_adaptive_frame_field_flag
+		r.skipBits(1)
+	}
+	//direct_8x8_inference_flag
+	r.skipBits(1)
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+	info.Width = widthInMbs * 16
+	info.Height = fieldFactor * heightInMapUnits * 16
+	if r.readFlag() {
+		left, right, top, bottom := int(r.readUE()), int(r.readUE()), int(r.readUE()), int(r.readUE())
+		cropX, cropY := 1, fieldFactor
+		if chromaFormat != 0 && !separateColourPlane {
+			subWidth, subHeight := 2, 2
+			if chromaFormat == 2 {
+				subHeight = 1
+			} else if chromaFormat == 3 {
+				subWidth, subHeight = 1, 1
+			}
+			cropX, cropY = subWidth, subHeight*fieldFactor
+		}
+		info.Width -= cropX * (left + right)
+		info.Height -= cropY * (top + bottom)
+	}
+	if r.readFlag() {
+		info.FrameRate = parseH264VUITiming(r)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid h264 sps: %w", r.err)
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, fmt.Errorf("invalid h264 sps size %dx%d", info.Width, info.Height)
+	}
+	return info, nil
+}
+
+func skipH264ScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			next = (last + r.readSE() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseH264VUITiming reads the vui up to the timing info, a frame is two fields
+func parseH264VUITiming(r *bitReader) float64 {
+	skipVUIHead(r)
+	if !r.readFlag() {
+		return 0
+	}
+	unitsInTick := r.readBits(32)
+	timeScale := r.readBits(32)
+	if unitsInTick == 0 || r.err != nil {
+		return 0
+	}
+	return float64(timeScale) / float64(2*unitsInTick)
+}
+
+// skipVUIHead skips the vui fields in front of the ones that differ between h264 and hevc
+func skipVUIHead(r *bitReader) {
+	if r.readFlag() {
+		//aspect_ratio_idc, 255 is Extended_SAR
+		if r.readBits(8) == 255 {
+			r.skipBits(32)
+		}
+	}
+	if r.readFlag() {
+		//overscan_appropriate_flag
+		r.skipBits(1)
+	}
+	if r.readFlag() {
+		//video_format, video_full_range_flag
+		r.skipBits(4)
+		if r.readFlag() {
+			//colour_primaries, transfer_characteristics, matrix_coefficients
+			r.skipBits(24)
+		}
+	}
+	if r.readFlag() {
+		//chroma_sample_loc_type_top_field, bottom_field
+		r.readUE()
+		r.readUE()
+	}
+}
+
+// ParseH265SPS parses a sps nal unit including its header, ITU-T H.265 7.3.2.2
+func ParseH265SPS(sps []byte) (*VideoInfo, error) {
+	if len(sps) < 4 || H265NaluType(sps) != H265NaluSPS {
+		return nil, fmt.Errorf("invalid h265 sps")
+	}
+	r := newBitReader(RemoveEmulationPrevention(sps[2:]))
+	info := &VideoInfo{Codec: constdef.CodecH265}
+	//sps_video_parameter_set_id
+	r.skipBits(4)
+	maxSubLayers := int(r.readBits(3))
+	//sps_temporal_id_nesting_flag
+	r.skipBits(1)
+	//general_profile_space, general_tier_flag
+	r.skipBits(3)
+	info.Profile = int(r.readBits(5))
+	//compatibility flags, progressive/interlaced/non packed/frame only flags and the reserved bits
+	r.skipBits(32 + 48)
+	info.Level = int(r.readBits(8))
+	profilePresent := make([]bool, maxSubLayers)
+	levelPresent := make([]bool, maxSubLayers)
+	for i := 0; i < maxSubLayers; i++ {
+		profilePresent[i] = r.readFlag()
+		levelPresent[i] = r.readFlag()
+	}
+	if maxSubLayers > 0 {
+		r.skipBits(2 * (8 - maxSubLayers))
+	}
+	for i := 0; i < maxSubLayers; i++ {
+		if profilePresent[i] {
+			r.skipBits(88)
+		}
+		if levelPresent[i] {
+			r.skipBits(8)
+		}
+	}
+	//sps_seq_parameter_set_id
+	r.readUE()
+	chromaFormat := r.readUE()
+	separateColourPlane := false
+	if chromaFormat == 3 {
+		separateColourPlane = r.readFlag()
+	}
+	info.Width = int(r.readUE())
+	info.Height = int(r.readUE())
+	if r.readFlag() {
+		left, right, top, bottom := int(r.readUE()), int(r.readUE()), int(r.readUE()), int(r.readUE())
+		subWidth, subHeight := 1, 1
+		if !separateColourPlane {
+			switch chromaFormat {
+			case 1:
+				subWidth, subHeight = 2, 2
+			case 2:
+				subWidth = 2
+			}
+		}
+		info.Width -= subWidth * (left + right)
+		info.Height -= subHeight * (top + bottom)
+	}
+	//bit_depth_luma_minus8, bit_depth_chroma_minus8
+	r.readUE()
+	r.readUE()
+	log2MaxPocLsb := int(r.readUE()) + 4
+	start := maxSubLayers
+	if r.readFlag() {
+		start = 0
+	}
+	for i := start; i <= maxSubLayers; i++ {
+		//max_dec_pic_buffering_minus1, max_num_reorder_pics, max_latency_increase_plus1
+		r.readUE()
+		r.readUE()
+		r.readUE()
+	}
+	//coding and transform block sizes, transform hierarchy depths
+	for i := 0; i < 6; i++ {
+		r.readUE()
+	}
+	if r.readFlag() && r.readFlag() {
+		skipH265ScalingListData(r)
+	}
+	//amp_enabled_flag, sample_adaptive_offset_enabled_flag
+	r.skipBits(2)
+	if r.readFlag() {
+		//pcm bit depths
+		r.skipBits(8)
+		r.readUE()
+		r.readUE()
+		//pcm_loop_filter_disabled_flag
+		r.skipBits(1)
+	}
+	if err := skipH265ShortTermRefPicSets(r); err != nil {
+		return nil, err
+	}
+	if r.readFlag() {
+		count := r.readUE()
+		if count > 32 {
+			return nil, fmt.Errorf("invalid h265 sps long term ref pics %d", count)
+		}
+		for i := uint32(0); i < count; i++ {
+			//lt_ref_pic_poc_lsb_sps, used_by_curr_pic_lt_sps_flag
+			r.skipBits(log2MaxPocLsb + 1)
+		}
+	}
+	//sps_temporal_mvp_enabled_flag, strong_intra_smoothing_enabled_flag
+	r.skipBits(2)
+	if r.readFlag() {
+		info.FrameRate = parseH265VUITiming(r)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid h265 sps: %w", r.err)
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, fmt.Errorf("invalid h265 sps size %dx%d", info.Width, info.Height)
+	}
+	return info, nil
+}
+
+func skipH265ScalingListData(r *bitReader) {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if !r.readFlag() {
+				//scaling_list_pred_matrix_id_delta
+				r.readUE()
+				continue
+			}
+			coefs := 1 << uint(4+sizeID<<1)
+			if coefs > 64 {
+				coefs = 64
+			}
+			if sizeID > 1 {
+				//scaling_list_dc_coef_minus8
+				r.readSE()
+			}
+			for i := 0; i < coefs; i++ {
+				r.readSE()
+			}
+		}
+	}
+}
+
+// skipH265ShortTermRefPicSets walks st_ref_pic_set(), a predicted set needs the size of the one before it
+func skipH265ShortTermRefPicSets(r *bitReader) error {
+	count := int(r.readUE())
+	if count > 64 {
+		return fmt.Errorf("invalid h265 sps short term ref pic sets %d", count)
+	}
+	deltaPocs := make([]int, count)
+	for i := 0; i < count; i++ {
+		if i > 0 && r.readFlag() {
+			//delta_rps_sign, abs_delta_rps_minus1
+			r.skipBits(1)
+			r.readUE()
+			for j := 0; j <= deltaPocs[i-1]; j++ {
+				used := r.readFlag()
+				useDelta := true
+				if !used {
+					useDelta = r.readFlag()
+				}
+				if used || useDelta {
+					deltaPocs[i]++
+				}
+			}
+			continue
+		}
+		negative := r.readUE()
+		positive := r.readUE()
+		if negative > 16 || positive > 16 {
+			return fmt.Errorf("invalid h265 sps short term ref pic set")
+		}
+		for j := uint32(0); j < negative+positive; j++ {
+			//delta_poc_minus1, used_by_curr_pic_flag
+			r.readUE()
+			r.skipBits(1)
+		}
+		deltaPocs[i] = int(negative + positive)
+	}
+	return r.err
+}
+
+func parseH265VUITiming(r *bitReader) float64 {
+	skipVUIHead(r)
+	//neutral_chroma_indication_flag, field_seq_flag, frame_field_info_present_flag
+	r.skipBits(3)
+	if r.readFlag() {
+		//default display window offsets
+		for i := 0; i < 4; i++ {
+			r.readUE()
+		}
+	}
+	if !r.readFlag() {
+		return 0
+	}
+	unitsInTick := r.readBits(32)
+	timeScale := r.readBits(32)
+	if unitsInTick == 0 || r.err != nil {
+		return 0
+	}
+	return float64(timeScale) / float64(unitsInTick)
+}
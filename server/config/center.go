@@ -0,0 +1,389 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// sections of the config, Reload reports the changed ones by these names
+const (
+	SectionLog         = "log"
+	SectionCache       = "cache"
+	SectionTimeouts    = "timeouts"
+	SectionConnections = "connections"
+	SectionShutdown    = "shutdown"
+	SectionTaskPools   = "task_pools"
+	SectionRecord      = "record"
+	SectionAPI         = "api"
+	SectionAuth        = "auth"
+	SectionHooks       = "hooks"
+	SectionListeners   = "listeners"
+	SectionRtspPulls   = "rtsp_pulls"
+	SectionSrtCalls    = "srt_calls"
+	SectionVhosts      = "vhosts"
+)
+
+// Center owns the running config, a reload validates the file, diffs it against the running one and
+// calls the subscribers of the changed sections. A config that doesn't validate is never applied.
+type Center struct {
+	path string
+	//override runs on every config read from the file, before it is validated
+	override func(conf *Config)
+
+	//reloads run one at a time
+	reloadMu sync.Mutex
+	mu       sync.RWMutex
+	current  *Config
+	modTime  time.Time
+	size     int64
+
+	subs subscribers
+}
+
+type subscribers struct {
+	onLog         []func(old, new LogConfig)
+	onCache       []func(old, new CacheConfig)
+	onTimeouts    []func(old, new TimeoutConfig)
+	onConnections []func(old, new ConnectionsConfig)
+	onRecord      []func(old, new RecordConfig)
+	onAPI         []func(old, new APIConfig)
+	onAuth        []func(old, new AuthConfig)
+	onHooks       []func(old, new HooksConfig)
+	onListeners   []func(added, removed []ListenerConfig)
+	onRtspPulls   []func(added, removed []RtspPullConfig)
+	onSrtCalls    []func(added, removed []SrtCallConfig)
+	onVhosts      []func(old, new []VhostConfig)
+}
+
+// NewCenter starts from the config loaded out of path, an empty path can only be changed with Apply
+func NewCenter(path string, current *Config) *Center {
+	c := &Center{}
+	c.path = path
+	c.current = current
+	if info, err := os.Stat(path); path != "" && err == nil {
+		c.modTime = info.ModTime()
+		c.size = info.Size()
+	}
+	return c
+}
+
+// SetOverride keeps settings that don't come from the file, the command line flags, over every reload
+func (c *Center) SetOverride(fn func(conf *Config)) {
+	c.override = fn
+}
+
+func (c *Center) Current() *Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current
+}
+
+func (c *Center) OnLog(fn func(old, new LogConfig)) {
+	c.mu.Lock()
+	c.subs.onLog = append(c.subs.onLog, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnCache(fn func(old, new CacheConfig)) {
+	c.mu.Lock()
+	c.subs.onCache = append(c.subs.onCache, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnTimeouts(fn func(old, new TimeoutConfig)) {
+	c.mu.Lock()
+	c.subs.onTimeouts = append(c.subs.onTimeouts, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnConnections(fn func(old, new ConnectionsConfig)) {
+	c.mu.Lock()
+	c.subs.onConnections = append(c.subs.onConnections, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnRecord(fn func(old, new RecordConfig)) {
+	c.mu.Lock()
+	c.subs.onRecord = append(c.subs.onRecord, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnAPI(fn func(old, new APIConfig)) {
+	c.mu.Lock()
+	c.subs.onAPI = append(c.subs.onAPI, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnAuth(fn func(old, new AuthConfig)) {
+	c.mu.Lock()
+	c.subs.onAuth = append(c.subs.onAuth, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnHooks(fn func(old, new HooksConfig)) {
+	c.mu.Lock()
+	c.subs.onHooks = append(c.subs.onHooks, fn)
+	c.mu.Unlock()
+}
+
+// OnListeners gets the listeners to start and to stop, a changed listener is in both
+func (c *Center) OnListeners(fn func(added, removed []ListenerConfig)) {
+	c.mu.Lock()
+	c.subs.onListeners = append(c.subs.onListeners, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnRtspPulls(fn func(added, removed []RtspPullConfig)) {
+	c.mu.Lock()
+	c.subs.onRtspPulls = append(c.subs.onRtspPulls, fn)
+	c.mu.Unlock()
+}
+
+func (c *Center) OnSrtCalls(fn func(added, removed []SrtCallConfig)) {
+	c.mu.Lock()
+	c.subs.onSrtCalls = append(c.subs.onSrtCalls, fn)
+	c.mu.Unlock()
+}
+
+// OnVhosts gets the whole vhost list, the vhosts are matched as one table
+func (c *Center) OnVhosts(fn func(old, new []VhostConfig)) {
+	c.mu.Lock()
+	c.subs.onVhosts = append(c.subs.onVhosts, fn)
+	c.mu.Unlock()
+}
+
+// Reload reads the file again and applies it, see Apply
+func (c *Center) Reload() ([]string, error) {
+	if c.path == "" {
+		return nil, fmt.Errorf("no config file to reload")
+	}
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return nil, err
+	}
+	next, err := Load(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if c.override != nil {
+		c.override(next)
+	}
+	changed, err := c.Apply(next)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+	c.mu.Unlock()
+	return changed, nil
+}
+
+// Apply validates next, makes it the running config and returns the changed sections
+func (c *Center) Apply(next *Config) ([]string, error) {
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.mu.Lock()
+	old := c.current
+	c.current = next
+	//subscribers are called without the lock, they may read Current
+	subs := c.subs
+	c.mu.Unlock()
+
+	var changed []string
+	if !reflect.DeepEqual(old.Log, next.Log) {
+		changed = append(changed, SectionLog)
+		for _, fn := range subs.onLog {
+			fn(old.Log, next.Log)
+		}
+	}
+	if !reflect.DeepEqual(old.Cache, next.Cache) {
+		changed = append(changed, SectionCache)
+		for _, fn := range subs.onCache {
+			fn(old.Cache, next.Cache)
+		}
+	}
+	if !reflect.DeepEqual(old.Timeouts, next.Timeouts) {
+		changed = append(changed, SectionTimeouts)
+		for _, fn := range subs.onTimeouts {
+			fn(old.Timeouts, next.Timeouts)
+		}
+	}
+	if !reflect.DeepEqual(old.Connections, next.Connections) {
+		changed = append(changed, SectionConnections)
+		for _, fn := range subs.onConnections {
+			fn(old.Connections, next.Connections)
+		}
+	}
+	//shutdown has no subscribers, it is read when the server stops
+	if !reflect.DeepEqual(old.Shutdown, next.Shutdown) {
+		changed = append(changed, SectionShutdown)
+	}
+	//the pools are sized at start, the change is only reported
+	if !reflect.DeepEqual(old.TaskPools, next.TaskPools) {
+		changed = append(changed, SectionTaskPools)
+	}
+	if !reflect.DeepEqual(old.Record, next.Record) {
+		changed = append(changed, SectionRecord)
+		for _, fn := range subs.onRecord {
+			fn(old.Record, next.Record)
+		}
+	}
+	if !reflect.DeepEqual(old.API, next.API) {
+		changed = append(changed, SectionAPI)
+		for _, fn := range subs.onAPI {
+			fn(old.API, next.API)
+		}
+	}
+	if !reflect.DeepEqual(old.Auth, next.Auth) {
+		changed = append(changed, SectionAuth)
+		for _, fn := range subs.onAuth {
+			fn(old.Auth, next.Auth)
+		}
+	}
+	if !reflect.DeepEqual(old.Hooks, next.Hooks) {
+		changed = append(changed, SectionHooks)
+		for _, fn := range subs.onHooks {
+			fn(old.Hooks, next.Hooks)
+		}
+	}
+	if added, removed := diffListeners(old.Listeners, next.Listeners); len(added)+len(removed) > 0 {
+		changed = append(changed, SectionListeners)
+		for _, fn := range subs.onListeners {
+			fn(added, removed)
+		}
+	}
+	if added, removed := diffRtspPulls(old.RtspPulls, next.RtspPulls); len(added)+len(removed) > 0 {
+		changed = append(changed, SectionRtspPulls)
+		for _, fn := range subs.onRtspPulls {
+			fn(added, removed)
+		}
+	}
+	if added, removed := diffSrtCalls(old.SrtCalls, next.SrtCalls); len(added)+len(removed) > 0 {
+		changed = append(changed, SectionSrtCalls)
+		for _, fn := range subs.onSrtCalls {
+			fn(added, removed)
+		}
+	}
+	if !reflect.DeepEqual(old.Vhosts, next.Vhosts) {
+		changed = append(changed, SectionVhosts)
+		for _, fn := range subs.onVhosts {
+			fn(old.Vhosts, next.Vhosts)
+		}
+	}
+	return changed, nil
+}
+
+// Watch reloads the file whenever its modification time or size changes, until ctx is done
+func (c *Center) Watch(ctx context.Context, interval time.Duration) {
+	if c.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(c.path)
+		if err != nil {
+			continue
+		}
+		c.mu.RLock()
+		same := info.ModTime().Equal(c.modTime) && info.Size() == c.size
+		c.mu.RUnlock()
+		if same {
+			continue
+		}
+		changed, err := c.Reload()
+		if err != nil {
+			log.Errorf(ctx, "reload %s, keep the running config: %v", c.path, err)
+			//don't retry the same broken file every tick
+			c.mu.Lock()
+			c.modTime = info.ModTime()
+			c.size = info.Size()
+			c.mu.Unlock()
+			continue
+		}
+		log.Infof(ctx, "reloaded %s, changed %v", c.path, changed)
+	}
+}
+
+func diffListeners(old, next []ListenerConfig) (added, removed []ListenerConfig) {
+	for _, l := range next {
+		if !containsListener(old, l) {
+			added = append(added, l)
+		}
+	}
+	for _, l := range old {
+		if !containsListener(next, l) {
+			removed = append(removed, l)
+		}
+	}
+	return added, removed
+}
+
+func containsListener(list []ListenerConfig, l ListenerConfig) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func diffRtspPulls(old, next []RtspPullConfig) (added, removed []RtspPullConfig) {
+	for _, p := range next {
+		if !containsRtspPull(old, p) {
+			added = append(added, p)
+		}
+	}
+	for _, p := range old {
+		if !containsRtspPull(next, p) {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+func containsRtspPull(list []RtspPullConfig, p RtspPullConfig) bool {
+	for _, item := range list {
+		if item == p {
+			return true
+		}
+	}
+	return false
+}
+
+func diffSrtCalls(old, next []SrtCallConfig) (added, removed []SrtCallConfig) {
+	for _, s := range next {
+		if !containsSrtCall(old, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if !containsSrtCall(next, s) {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+func containsSrtCall(list []SrtCallConfig, s SrtCallConfig) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
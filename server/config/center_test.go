@@ -0,0 +1,121 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const centerBase = `
+log:
+  level: info
+listeners:
+  - protocol: rtmp
+    port: 1935
+  - protocol: http-ts
+    port: 8080
+`
+
+func writeFile(t *testing.T, path, data string) {
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCenterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hylan.yaml")
+	writeFile(t, path, centerBase)
+	conf, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override := func(conf *Config) {
+		conf.API.Token = "flag"
+	}
+	override(conf)
+	center := NewCenter(path, conf)
+	center.SetOverride(override)
+	var levels []string
+	center.OnLog(func(old, new LogConfig) {
+		levels = append(levels, old.Level, new.Level)
+	})
+	var added, removed []ListenerConfig
+	center.OnListeners(func(a, r []ListenerConfig) {
+		added, removed = a, r
+	})
+	cacheCalled := false
+	center.OnCache(func(old, new CacheConfig) {
+		cacheCalled = true
+	})
+
+	writeFile(t, path, `
+log:
+  level: debug
+listeners:
+  - protocol: rtmp
+    port: 1935
+  - protocol: http-ts
+    port: 8081
+`)
+	changed, err := center.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{SectionLog, SectionListeners}) {
+		t.Fatalf("unexpected changed sections %v", changed)
+	}
+	if !reflect.DeepEqual(levels, []string{"info", "debug"}) || cacheCalled {
+		t.Fatalf("unexpected callbacks %v %v", levels, cacheCalled)
+	}
+	if len(added) != 1 || added[0].Port != 8081 || len(removed) != 1 || removed[0].Port != 8080 {
+		t.Fatalf("unexpected listener diff +%+v -%+v", added, removed)
+	}
+	if center.Current().API.Token != "flag" {
+		t.Fatal("expect the override on the reloaded config")
+	}
+
+	//an invalid file leaves the running config alone
+	writeFile(t, path, "listeners:\n  - protocol: rtmp\n    port: 0\n")
+	if _, err = center.Reload(); err == nil {
+		t.Fatal("expect the invalid config to be refused")
+	}
+	if center.Current().Log.Level != "debug" || len(center.Current().Listeners) != 2 {
+		t.Fatalf("expect the running config to stay, got %+v", center.Current())
+	}
+
+	changed, err = center.Apply(center.Current())
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("expect nothing to change, got %v %v", changed, err)
+	}
+}
+
+func TestCenterWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hylan.yaml")
+	writeFile(t, path, centerBase)
+	conf, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := NewCenter(path, conf)
+	levels := make(chan string, 1)
+	center.OnLog(func(old, new LogConfig) {
+		levels <- new.Level
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go center.Watch(ctx, 10*time.Millisecond)
+
+	writeFile(t, path, strings.Replace(centerBase, "info", "warn", 1))
+	select {
+	case level := <-levels:
+		if level != "warn" {
+			t.Fatalf("unexpected level %s", level)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect the changed file to be reloaded")
+	}
+}
@@ -0,0 +1,739 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// listener protocols
+const (
+	ProtocolRtmp   = "rtmp"
+	ProtocolRtsp   = "rtsp"
+	ProtocolWebrtc = "webrtc"
+	ProtocolSrt    = "srt"
+	ProtocolHttpTs = "http-ts"
+	ProtocolTs     = "ts"
+)
+
+// Config is the whole server, see hylan.yaml for a commented example
+type Config struct {
+	Log         LogConfig         `yaml:"log"`
+	Cache       CacheConfig       `yaml:"cache"`
+	Timeouts    TimeoutConfig     `yaml:"timeouts"`
+	Connections ConnectionsConfig `yaml:"connections"`
+	Shutdown    ShutdownConfig    `yaml:"shutdown"`
+	TaskPools   []TaskPoolConfig  `yaml:"task_pools"`
+	Record      RecordConfig      `yaml:"record"`
+	API         APIConfig         `yaml:"api"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Hooks       HooksConfig       `yaml:"hooks"`
+	Listeners   []ListenerConfig  `yaml:"listeners"`
+	RtspPulls   []RtspPullConfig  `yaml:"rtsp_pulls"`
+	SrtCalls    []SrtCallConfig   `yaml:"srt_calls"`
+	Vhosts      []VhostConfig     `yaml:"vhosts"`
+}
+
+type LogConfig struct {
+	//trace, debug, info, warn or error
+	Level string `yaml:"level"`
+	//stdout, stderr or a file path
+	Output string `yaml:"output"`
+}
+
+type CacheConfig struct {
+	//packets queued per session before a slow reader loses the oldest
+	Packets int `yaml:"packets"`
+	//packets of the latest gop kept for joining players
+	GopPackets int `yaml:"gop_packets"`
+	//accepted tcp connections waiting for a handler
+	ConnQueue int `yaml:"conn_queue"`
+}
+
+type TimeoutConfig struct {
+	//rtsp requests and responses
+	Read  time.Duration `yaml:"read"`
+	Write time.Duration `yaml:"write"`
+	//udp ts ingest and srt peers end after this long without data
+	Idle time.Duration `yaml:"idle"`
+	//rtmp phases, not enforced when zero: the handshake, the wait from the handshake until
+	//publish or play, a publisher without media and a player that doesn't read
+	Handshake    time.Duration `yaml:"handshake"`
+	FirstCommand time.Duration `yaml:"first_command"`
+	PublishIdle  time.Duration `yaml:"publish_idle"`
+	PlayStall    time.Duration `yaml:"play_stall"`
+}
+
+// ConnectionsConfig limits the connections of every listener together, no limit when zero
+type ConnectionsConfig struct {
+	Max      int `yaml:"max"`
+	MaxPerIP int `yaml:"max_per_ip"`
+}
+
+// ShutdownConfig is read when SIGINT or SIGTERM arrives, a second signal skips the drain
+type ShutdownConfig struct {
+	//new publishers are refused and the running ones get this long to finish, no drain when zero
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	//recordings and connections get this long to end after the streams are unpublished
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// AuthConfig asks signed url tokens per app, see auth.Sign for how they are made
+type AuthConfig struct {
+	Apps []AuthAppConfig `yaml:"apps"`
+}
+
+type AuthAppConfig struct {
+	//app name, "*" for the apps without their own entry
+	App    string `yaml:"app"`
+	Secret string `yaml:"secret"`
+	//tokens are required for the actions set here
+	Publish bool `yaml:"publish"`
+	Play    bool `yaml:"play"`
+	//the token is signed for the client ip and doesn't work from another address
+	BindIP bool `yaml:"bind_ip"`
+}
+
+// HooksConfig posts the stream events to http callbacks, on_publish and on_play are refused
+// when a callback fails or answers {"deny": true}
+type HooksConfig struct {
+	HookURLs `yaml:",inline"`
+	//each request, 3s when zero
+	Timeout time.Duration `yaml:"timeout"`
+	//the events nobody waits for are sent again this many times after a failure
+	Retries       int           `yaml:"retries"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// HookURLs are the callbacks of each event
+type HookURLs struct {
+	OnConnect   []string `yaml:"on_connect"`
+	OnPublish   []string `yaml:"on_publish"`
+	OnUnpublish []string `yaml:"on_unpublish"`
+	OnPlay      []string `yaml:"on_play"`
+	OnStop      []string `yaml:"on_stop"`
+	//a recording file is complete
+	OnRecordDone []string `yaml:"on_record_done"`
+	//there is no hls output yet, nothing is sent
+	OnHlsSegment []string `yaml:"on_hls_segment"`
+}
+
+// Map has the events with callbacks set by their hook name
+func (h HookURLs) Map() map[string][]string {
+	urls := make(map[string][]string)
+	for name, list := range map[string][]string{
+		"on_connect":     h.OnConnect,
+		"on_publish":     h.OnPublish,
+		"on_unpublish":   h.OnUnpublish,
+		"on_play":        h.OnPlay,
+		"on_stop":        h.OnStop,
+		"on_record_done": h.OnRecordDone,
+		"on_hls_segment": h.OnHlsSegment,
+	} {
+		if list != nil {
+			urls[name] = list
+		}
+	}
+	return urls
+}
+
+func (h HookURLs) validate(where string, add func(format string, args ...interface{})) {
+	urls := h.Map()
+	for _, name := range []string{"on_connect", "on_publish", "on_unpublish", "on_play", "on_stop", "on_record_done", "on_hls_segment"} {
+		for _, raw := range urls[name] {
+			if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add("%s.%s: %q is not a http url", where, name, raw)
+			}
+		}
+	}
+}
+
+// TaskPoolConfig sizes a task pool, the pools are created at start and a change needs a restart
+type TaskPoolConfig struct {
+	//default, scheduled or a new pool
+	Name string `yaml:"name"`
+	//tasks running at once, unbounded when zero
+	Workers int `yaml:"workers"`
+	//tasks waiting for a worker before the pool refuses more
+	Queue int `yaml:"queue"`
+}
+
+type RecordConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	//only ts for now
+	Format string `yaml:"format"`
+	//apps to record, every app when empty
+	Apps []string `yaml:"apps"`
+}
+
+// APIConfig is the http endpoint of the admin api and the prometheus metrics
+type APIConfig struct {
+	Enabled bool       `yaml:"enabled"`
+	Addr    string     `yaml:"addr"`
+	Port    int        `yaml:"port"`
+	Token   string     `yaml:"token"`
+	TLS     *TLSConfig `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// ListenerConfig is one port of one protocol, the fields after TLS only apply to some protocols
+type ListenerConfig struct {
+	Protocol string     `yaml:"protocol"`
+	Addr     string     `yaml:"addr"`
+	Port     int        `yaml:"port"`
+	TLS      *TLSConfig `yaml:"tls"`
+	//rtsp udp transport
+	RtpPort  int `yaml:"rtp_port"`
+	RtcpPort int `yaml:"rtcp_port"`
+	//webrtc ice
+	ICEPortMin uint16   `yaml:"ice_port_min"`
+	ICEPortMax uint16   `yaml:"ice_port_max"`
+	PublicIPs  []string `yaml:"public_ips"`
+	//srt
+	Latency    time.Duration `yaml:"latency"`
+	Passphrase string        `yaml:"passphrase"`
+	PbKeyLen   int           `yaml:"pbkeylen"`
+	//ts ingest, udp or tcp
+	Network   string `yaml:"network"`
+	Interface string `yaml:"interface"`
+	StreamURL string `yaml:"stream_url"`
+	//every protocol but udp ts ingest
+	Access AccessConfig `yaml:"access"`
+	//every tcp listener, the client address is taken from the load balancers in front of it
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+	//rtmp
+	RtmpLimits RtmpLimitsConfig `yaml:"rtmp_limits"`
+	Write      WriteConfig      `yaml:"write"`
+}
+
+// flush policies of WriteConfig
+const (
+	FlushMessage  = "message"
+	FlushBytes    = "bytes"
+	FlushInterval = "interval"
+)
+
+// WriteConfig buffers the writes of a connection. The buffer goes out at the end of every message, at the end
+// of a message once flush_bytes are buffered or flush_interval after its first byte, commands always go out at once.
+type WriteConfig struct {
+	//bytes, 64KiB when zero, every message is written with one writev when negative
+	Buffer        int           `yaml:"buffer"`
+	Flush         string        `yaml:"flush"`
+	FlushBytes    int           `yaml:"flush_bytes"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+func (w *WriteConfig) validate(where string, add func(format string, args ...interface{})) {
+	switch w.Flush {
+	case "", FlushMessage:
+	case FlushBytes:
+		if w.FlushBytes <= 0 {
+			add("%s: write.flush_bytes: must be positive with the bytes flush", where)
+		}
+	case FlushInterval:
+		if w.FlushInterval <= 0 {
+			add("%s: write.flush_interval: must be positive with the interval flush", where)
+		}
+	default:
+		add("%s: write.flush: %q, expect one of message, bytes, interval", where, w.Flush)
+	}
+}
+
+// ProxyProtocolConfig lists the load balancers that send a PROXY protocol v1 or v2 header, cidrs or single
+// ips. They have to send one and no one else may, an empty list reads no header.
+type ProxyProtocolConfig struct {
+	Trusted []string `yaml:"trusted"`
+	//a trusted peer is closed without a complete header in this long, 5s when zero
+	HeaderTimeout time.Duration `yaml:"header_timeout"`
+}
+
+func (p *ProxyProtocolConfig) validate(where string, add func(format string, args ...interface{})) {
+	for _, s := range p.Trusted {
+		if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+			add("%s: proxy_protocol.trusted: %q is not a cidr or an ip", where, s)
+		}
+	}
+	if p.HeaderTimeout < 0 {
+		add("%s: proxy_protocol.header_timeout: must not be negative", where)
+	}
+}
+
+// RtmpLimitsConfig bounds what one rtmp peer can make the server hold, a zero field takes the default.
+// Sizes are bytes, aggregate messages count as video and every other type but audio and control as data.
+type RtmpLimitsConfig struct {
+	MaxVideoMessage int `yaml:"max_video_message"`
+	MaxAudioMessage int `yaml:"max_audio_message"`
+	MaxDataMessage  int `yaml:"max_data_message"`
+	MaxChunkStreams int `yaml:"max_chunk_streams"`
+	//partial messages of a connection over every chunk stream
+	MaxBuffered int `yaml:"max_buffered"`
+	//nesting of amf objects and arrays, and the longest string or the most members of one value
+	MaxAMFDepth  int `yaml:"max_amf_depth"`
+	MaxAMFLength int `yaml:"max_amf_length"`
+}
+
+func (r *RtmpLimitsConfig) validate(where string, add func(format string, args ...interface{})) {
+	if r.MaxVideoMessage < 0 || r.MaxAudioMessage < 0 || r.MaxDataMessage < 0 || r.MaxChunkStreams < 0 ||
+		r.MaxBuffered < 0 || r.MaxAMFDepth < 0 || r.MaxAMFLength < 0 {
+		add("%s: rtmp_limits must not be negative", where)
+	}
+}
+
+// AccessConfig admits the clients of a listener, the lists take cidrs or single ips. Deny wins over
+// allow and an empty allow list allows everyone, the publish and play lists apply on top of the others.
+type AccessConfig struct {
+	Allow        []string `yaml:"allow"`
+	Deny         []string `yaml:"deny"`
+	PublishAllow []string `yaml:"publish_allow"`
+	PublishDeny  []string `yaml:"publish_deny"`
+	PlayAllow    []string `yaml:"play_allow"`
+	PlayDeny     []string `yaml:"play_deny"`
+	//connections of one ip open at once on this listener, no limit when zero
+	MaxConnsPerIP int `yaml:"max_conns_per_ip"`
+	//new connections of one ip per second and how many more come in at once, no limit when zero
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (a *AccessConfig) validate(where string, add func(format string, args ...interface{})) {
+	for name, list := range map[string][]string{
+		"allow":         a.Allow,
+		"deny":          a.Deny,
+		"publish_allow": a.PublishAllow,
+		"publish_deny":  a.PublishDeny,
+		"play_allow":    a.PlayAllow,
+		"play_deny":     a.PlayDeny,
+	} {
+		for _, s := range list {
+			if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+				add("%s: access.%s: %q is not a cidr or an ip", where, name, s)
+			}
+		}
+	}
+	if a.MaxConnsPerIP < 0 || a.Rate < 0 || a.Burst < 0 {
+		add("%s: access: max_conns_per_ip, rate and burst must not be negative", where)
+	}
+	if a.Burst > 0 && a.Rate == 0 {
+		add("%s: access: burst needs a rate", where)
+	}
+}
+
+// IsZero is true when the listener lets everyone in
+func (a *AccessConfig) IsZero() bool {
+	return len(a.Allow)+len(a.Deny)+len(a.PublishAllow)+len(a.PublishDeny)+len(a.PlayAllow)+len(a.PlayDeny) == 0 &&
+		a.MaxConnsPerIP == 0 && a.Rate == 0
+}
+
+type RtspPullConfig struct {
+	URL        string        `yaml:"url"`
+	StreamURL  string        `yaml:"stream_url"`
+	Transport  string        `yaml:"transport"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+type SrtCallConfig struct {
+	Addr       string        `yaml:"addr"`
+	StreamID   string        `yaml:"stream_id"`
+	StreamURL  string        `yaml:"stream_url"`
+	Push       bool          `yaml:"push"`
+	Latency    time.Duration `yaml:"latency"`
+	Passphrase string        `yaml:"passphrase"`
+	PbKeyLen   int           `yaml:"pbkeylen"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// VhostConfig is the policy of the streams on some domains, the stream ids are named after the vhost
+// as soon as one is configured
+type VhostConfig struct {
+	Name string `yaml:"name"`
+	//exact domains or wildcards like *.example.com, the vhost query param names a vhost as well
+	Domains []string `yaml:"domains"`
+	//takes the domains no other vhost has, one vhost at most
+	Default bool `yaml:"default"`
+	//publishers and players of a disabled vhost are rejected, enabled when not set
+	Enabled *bool           `yaml:"enabled"`
+	Auth    VhostAuthConfig `yaml:"auth"`
+	//the record section applies when not set, the format is always the one of the record section
+	Record  *RecordConfig     `yaml:"record"`
+	Forward []ForwardConfig   `yaml:"forward"`
+	Limits  VhostLimitsConfig `yaml:"limits"`
+	//the callbacks set here take the place of the server ones for the streams of the vhost
+	Hooks HookURLs `yaml:"hooks"`
+}
+
+// VhostAuthConfig are tokens the clients carry in the token query param, not asked when empty
+type VhostAuthConfig struct {
+	PublishToken string `yaml:"publish_token"`
+	PlayToken    string `yaml:"play_token"`
+}
+
+// ForwardConfig pushes every stream of the vhost to a remote srt listener
+type ForwardConfig struct {
+	Addr       string        `yaml:"addr"`
+	Latency    time.Duration `yaml:"latency"`
+	Passphrase string        `yaml:"passphrase"`
+	PbKeyLen   int           `yaml:"pbkeylen"`
+}
+
+// VhostLimitsConfig are not enforced when zero
+type VhostLimitsConfig struct {
+	MaxStreams          int `yaml:"max_streams"`
+	MaxPlayers          int `yaml:"max_players"`
+	MaxPlayersPerStream int `yaml:"max_players_per_stream"`
+}
+
+func (v *VhostConfig) IsEnabled() bool {
+	return v.Enabled == nil || *v.Enabled
+}
+
+// Default is what the server runs with without a config file
+func Default() *Config {
+	return &Config{
+		Log: LogConfig{Level: "info", Output: "stderr"},
+		Cache: CacheConfig{
+			Packets:    1024,
+			GopPackets: 512,
+			ConnQueue:  1024,
+		},
+		Timeouts: TimeoutConfig{
+			Read:         10 * time.Second,
+			Write:        10 * time.Second,
+			Idle:         5 * time.Second,
+			Handshake:    10 * time.Second,
+			FirstCommand: 10 * time.Second,
+			PublishIdle:  30 * time.Second,
+			PlayStall:    30 * time.Second,
+		},
+		Shutdown: ShutdownConfig{Timeout: 10 * time.Second},
+		Record:   RecordConfig{Dir: "record", Format: "ts"},
+		API:      APIConfig{Enabled: true, Addr: "127.0.0.1", Port: 8081},
+		Listeners: []ListenerConfig{
+			{Protocol: ProtocolRtmp, Port: 1935},
+			{Protocol: ProtocolRtsp, Port: 8554, RtpPort: 8000, RtcpPort: 8001},
+			{Protocol: ProtocolWebrtc, Port: 8088},
+			{Protocol: ProtocolSrt, Port: 10080},
+			{Protocol: ProtocolHttpTs, Port: 8080},
+		},
+	}
+}
+
+// Load reads a yaml file over the defaults, unknown keys are errors so typos don't go unnoticed
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Config, error) {
+	c := Default()
+	//listeners in the file replace the default ones instead of being merged by index
+	c.Listeners = nil
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	return c, nil
+}
+
+// ValidationError lists every problem of a config at once
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+var logLevels = map[string]bool{"trace": true, "debug": true, "info": true, "warn": true, "warning": true, "error": true}
+
+// Validate checks the config before anything listens
+func (c *Config) Validate() error {
+	var errs ValidationError
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	if !logLevels[c.Log.Level] {
+		add("log.level: %q is not one of trace, debug, info, warn, error", c.Log.Level)
+	}
+	if c.Cache.Packets <= 0 {
+		add("cache.packets: must be positive, got %d", c.Cache.Packets)
+	}
+	if c.Cache.GopPackets <= 0 {
+		add("cache.gop_packets: must be positive, got %d", c.Cache.GopPackets)
+	}
+	if c.Cache.ConnQueue <= 0 {
+		add("cache.conn_queue: must be positive, got %d", c.Cache.ConnQueue)
+	}
+	for name, d := range map[string]time.Duration{
+		"read":          c.Timeouts.Read,
+		"write":         c.Timeouts.Write,
+		"idle":          c.Timeouts.Idle,
+		"handshake":     c.Timeouts.Handshake,
+		"first_command": c.Timeouts.FirstCommand,
+		"publish_idle":  c.Timeouts.PublishIdle,
+		"play_stall":    c.Timeouts.PlayStall,
+	} {
+		if d < 0 {
+			add("timeouts.%s: must not be negative, got %s", name, d)
+		}
+	}
+	if c.Connections.Max < 0 || c.Connections.MaxPerIP < 0 {
+		add("connections: max and max_per_ip must not be negative")
+	}
+	if c.Shutdown.DrainTimeout < 0 || c.Shutdown.Timeout < 0 {
+		add("shutdown: timeouts must not be negative")
+	}
+	apps := make(map[string]bool)
+	for i, a := range c.Auth.Apps {
+		where := fmt.Sprintf("auth.apps[%d] (%s)", i, a.App)
+		switch {
+		case a.App == "" || strings.Contains(a.App, "/"):
+			add("%s: app is required and has no slash", where)
+		case apps[a.App]:
+			add("%s: app is already used", where)
+		}
+		apps[a.App] = true
+		if a.Secret == "" && (a.Publish || a.Play) {
+			add("%s: secret is required", where)
+		}
+	}
+	c.Hooks.validate("hooks", add)
+	if c.Hooks.Timeout < 0 || c.Hooks.Retries < 0 || c.Hooks.RetryInterval < 0 {
+		add("hooks: timeout, retries and retry_interval must not be negative")
+	}
+	pools := make(map[string]bool)
+	for i, p := range c.TaskPools {
+		where := fmt.Sprintf("task_pools[%d] (%s)", i, p.Name)
+		switch {
+		case p.Name == "":
+			add("%s: name is required", where)
+		case pools[p.Name]:
+			add("%s: name is already used", where)
+		}
+		pools[p.Name] = true
+		if p.Workers < 0 || p.Queue < 0 {
+			add("%s: workers and queue must not be negative", where)
+		}
+		if p.Name == "default" && p.Workers > 0 {
+			add("%s: the default pool runs the connections and can not be bounded", where)
+		}
+		if p.Workers == 0 && p.Queue > 0 {
+			add("%s: queue needs workers", where)
+		}
+	}
+	if c.Record.Enabled {
+		if c.Record.Dir == "" {
+			add("record.dir: required when recording is enabled")
+		}
+		if c.Record.Format != "ts" {
+			add("record.format: %q is not supported, only ts is", c.Record.Format)
+		}
+	}
+	//tcp and udp ports are separate, each one can only be bound once
+	bound := make(map[string]string)
+	bind := func(where, network, addr string, port int) {
+		key := fmt.Sprintf("%s/%s:%d", network, addr, port)
+		if prev, ok := bound[key]; ok {
+			add("%s: %s port %d is already used by %s", where, network, port, prev)
+			return
+		}
+		bound[key] = where
+	}
+	if c.API.Enabled {
+		checkAddr(add, "api", c.API.Addr, c.API.Port)
+		checkTLS(add, "api", c.API.TLS)
+		bind("api", "tcp", c.API.Addr, c.API.Port)
+	}
+	if len(c.Listeners) == 0 {
+		add("listeners: at least one listener is required")
+	}
+	for i, l := range c.Listeners {
+		where := fmt.Sprintf("listeners[%d] (%s)", i, l.Protocol)
+		checkAddr(add, where, l.Addr, l.Port)
+		switch l.Protocol {
+		case ProtocolRtmp, ProtocolWebrtc, ProtocolHttpTs:
+			checkTLS(add, where, l.TLS)
+			bind(where, "tcp", l.Addr, l.Port)
+		case ProtocolRtsp:
+			checkTLS(add, where, l.TLS)
+			bind(where, "tcp", l.Addr, l.Port)
+			if (l.RtpPort == 0) != (l.RtcpPort == 0) {
+				add("%s: rtp_port and rtcp_port go together", where)
+			}
+			if l.RtpPort != 0 {
+				if l.TLS != nil {
+					add("%s: tls can't be combined with the udp transport, drop rtp_port and rtcp_port", where)
+				}
+				if l.RtpPort%2 != 0 || l.RtcpPort != l.RtpPort+1 {
+					add("%s: rtp_port has to be even and rtcp_port the next one, got %d and %d", where, l.RtpPort, l.RtcpPort)
+				}
+				bind(where, "udp", l.Addr, l.RtpPort)
+				bind(where, "udp", l.Addr, l.RtcpPort)
+			}
+		case ProtocolSrt:
+			if l.TLS != nil {
+				add("%s: tls is not supported, srt encrypts with passphrase", where)
+			}
+			checkKeyLen(add, where, l.PbKeyLen, l.Passphrase)
+			bind(where, "udp", l.Addr, l.Port)
+		case ProtocolTs:
+			if l.TLS != nil {
+				add("%s: tls is not supported", where)
+			}
+			if l.Network != "udp" && l.Network != "tcp" {
+				add("%s: network has to be udp or tcp, got %q", where, l.Network)
+			}
+			if l.StreamURL == "" {
+				add("%s: stream_url is required", where)
+			}
+			bind(where, l.Network, l.Addr, l.Port)
+		default:
+			add("%s: unknown protocol, expect one of rtmp, rtsp, webrtc, srt, http-ts, ts", where)
+		}
+		l.Access.validate(where, add)
+		if l.Protocol == ProtocolTs && l.Network == "udp" && !l.Access.IsZero() {
+			add("%s: access is not supported on udp", where)
+		}
+		l.ProxyProtocol.validate(where, add)
+		if len(l.ProxyProtocol.Trusted) > 0 && (l.Protocol == ProtocolSrt || l.Protocol == ProtocolTs && l.Network == "udp") {
+			add("%s: proxy_protocol is only for tcp", where)
+		}
+		l.RtmpLimits.validate(where, add)
+		if l.Protocol != ProtocolRtmp && l.RtmpLimits != (RtmpLimitsConfig{}) {
+			add("%s: rtmp_limits is only for rtmp", where)
+		}
+		l.Write.validate(where, add)
+		if l.Protocol != ProtocolRtmp && l.Write != (WriteConfig{}) {
+			add("%s: write is only for rtmp", where)
+		}
+		if l.Protocol == ProtocolWebrtc && l.ICEPortMin > l.ICEPortMax {
+			add("%s: ice_port_min %d is above ice_port_max %d", where, l.ICEPortMin, l.ICEPortMax)
+		}
+	}
+	for i, p := range c.RtspPulls {
+		where := fmt.Sprintf("rtsp_pulls[%d]", i)
+		if !strings.HasPrefix(p.URL, "rtsp://") && !strings.HasPrefix(p.URL, "rtsps://") {
+			add("%s: url has to be rtsp:// or rtsps://, got %q", where, p.URL)
+		}
+		if p.StreamURL == "" {
+			add("%s: stream_url is required", where)
+		}
+		if p.Transport != "" && p.Transport != "tcp" && p.Transport != "udp" {
+			add("%s: transport has to be tcp, udp or empty, got %q", where, p.Transport)
+		}
+	}
+	for i, s := range c.SrtCalls {
+		where := fmt.Sprintf("srt_calls[%d]", i)
+		if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+			add("%s: addr %q is not host:port", where, s.Addr)
+		}
+		if s.StreamURL == "" {
+			add("%s: stream_url is required", where)
+		}
+		checkKeyLen(add, where, s.PbKeyLen, s.Passphrase)
+	}
+	names := make(map[string]bool)
+	domains := make(map[string]string)
+	defaults := 0
+	for i, v := range c.Vhosts {
+		where := fmt.Sprintf("vhosts[%d] (%s)", i, v.Name)
+		if v.Name == "" || strings.ContainsAny(v.Name, ":/") {
+			add("%s: name is required and can't have ':' or '/'", where)
+		} else if names[v.Name] {
+			add("%s: name is already used", where)
+		}
+		names[v.Name] = true
+		if v.Default {
+			defaults++
+		}
+		for _, domain := range v.Domains {
+			domain = strings.ToLower(domain)
+			if prev, ok := domains[domain]; ok {
+				add("%s: domain %s is already on vhost %s", where, domain, prev)
+			}
+			domains[domain] = v.Name
+		}
+		if v.Record != nil && v.Record.Enabled && v.Record.Dir == "" {
+			add("%s: record.dir: required when recording is enabled", where)
+		}
+		if v.Record != nil && v.Record.Format != "" && v.Record.Format != "ts" {
+			add("%s: record.format: %q is not supported, only ts is", where, v.Record.Format)
+		}
+		for j, f := range v.Forward {
+			if _, _, err := net.SplitHostPort(f.Addr); err != nil {
+				add("%s: forward[%d]: addr %q is not host:port", where, j, f.Addr)
+			}
+			checkKeyLen(add, fmt.Sprintf("%s: forward[%d]", where, j), f.PbKeyLen, f.Passphrase)
+		}
+		if v.Limits.MaxStreams < 0 || v.Limits.MaxPlayers < 0 || v.Limits.MaxPlayersPerStream < 0 {
+			add("%s: limits must not be negative", where)
+		}
+		v.Hooks.validate(where+": hooks", add)
+	}
+	if defaults > 1 {
+		add("vhosts: only one vhost can be the default, got %d", defaults)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkAddr(add func(string, ...interface{}), where, addr string, port int) {
+	if port <= 0 || port > 65535 {
+		add("%s: port %d is out of range", where, port)
+	}
+	if addr != "" && net.ParseIP(addr) == nil {
+		add("%s: addr %q is not an ip", where, addr)
+	}
+}
+
+func checkTLS(add func(string, ...interface{}), where string, t *TLSConfig) {
+	if t == nil {
+		return
+	}
+	if t.Cert == "" || t.Key == "" {
+		add("%s: tls needs both cert and key", where)
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(t.Cert, t.Key); err != nil {
+		add("%s: tls: %v", where, err)
+	}
+}
+
+func checkKeyLen(add func(string, ...interface{}), where string, keyLen int, passphrase string) {
+	if keyLen != 0 && keyLen != 16 && keyLen != 24 && keyLen != 32 {
+		add("%s: pbkeylen has to be 16, 24 or 32, got %d", where, keyLen)
+	}
+	if passphrase != "" && (len(passphrase) < 10 || len(passphrase) > 79) {
+		add("%s: passphrase has to be 10 to 79 characters", where)
+	}
+}
+
+// Load builds the tls config of the certificate pair, nil when t is nil
+func (t *TLSConfig) Load() (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
@@ -0,0 +1,421 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExample(t *testing.T) {
+	c, err := Load("../../hylan.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listeners) != 5 || c.Listeners[3].Latency != 120*time.Millisecond || c.API.Port != 8081 {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	if err = Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`
+log:
+  level: debug
+listeners:
+  - protocol: rtmp
+    port: 1936
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Log.Level != "debug" || c.Log.Output != "stderr" || c.Cache.Packets != 1024 {
+		t.Fatalf("expect defaults under the file, got %+v", c)
+	}
+	if len(c.Listeners) != 1 || c.Listeners[0].Port != 1936 {
+		t.Fatalf("expect the listeners of the file only, got %+v", c.Listeners)
+	}
+	if _, err = Parse([]byte("listeners:\n  - protocol: rtmp\n    prot: 1935\n")); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Fatalf("expect the typo to be reported, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c, err := Parse([]byte(`
+log:
+  level: loud
+cache:
+  packets: 0
+timeouts:
+  play_stall: -1s
+record:
+  enabled: true
+  format: flv
+listeners:
+  - protocol: rtmp
+    port: 1935
+  - protocol: http-ts
+    port: 1935
+  - protocol: srt
+    port: 70000
+    tls:
+      cert: a.pem
+      key: a.key
+  - protocol: rtsp
+    port: 8554
+    rtp_port: 8001
+    rtcp_port: 8002
+  - protocol: hls
+    port: 80
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`log.level: "loud"`,
+		`cache.packets: must be positive`,
+		`timeouts.play_stall: must not be negative`,
+		`record.format: "flv"`,
+		`listeners[1] (http-ts): tcp port 1935 is already used by listeners[0] (rtmp)`,
+		`listeners[2] (srt): port 70000 is out of range`,
+		`listeners[2] (srt): tls is not supported`,
+		`listeners[3] (rtsp): rtp_port has to be even`,
+		`listeners[4] (hls): unknown protocol`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+}
+
+func TestVhosts(t *testing.T) {
+	c, err := Parse([]byte(`
+listeners:
+  - protocol: rtmp
+    port: 1935
+vhosts:
+  - name: a
+    domains: [a.example.com]
+    default: true
+    record:
+      enabled: true
+  - name: a
+    domains: [A.example.com, "*.b.example.com"]
+    default: true
+    enabled: false
+    forward:
+      - addr: nowhere
+    limits:
+      max_players: -1
+  - name: "b:c"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Vhosts[0].IsEnabled() || c.Vhosts[1].IsEnabled() {
+		t.Fatal("expect vhosts to be enabled unless disabled")
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`vhosts[0] (a): record.dir: required`,
+		`vhosts[1] (a): name is already used`,
+		`vhosts[1] (a): domain a.example.com is already on vhost a`,
+		`vhosts[1] (a): forward[0]: addr "nowhere" is not host:port`,
+		`vhosts[1] (a): limits must not be negative`,
+		`vhosts[2] (b:c): name is required`,
+		`vhosts: only one vhost can be the default`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+}
+
+func TestTaskPools(t *testing.T) {
+	c, err := Parse([]byte(`
+listeners:
+  - protocol: rtmp
+    port: 1935
+task_pools:
+  - name: scheduled
+    workers: 8
+    queue: 512
+  - name: default
+    workers: 4
+  - name: scheduled
+  - name: idle
+    queue: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`task_pools[1] (default): the default pool runs the connections and can not be bounded`,
+		`task_pools[2] (scheduled): name is already used`,
+		`task_pools[3] (idle): queue needs workers`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+	if strings.Contains(err.Error(), "task_pools[0]") {
+		t.Errorf("expect the first pool to be valid\n%v", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	c, err := Parse([]byte(`
+listeners:
+  - protocol: rtmp
+    port: 1935
+auth:
+  apps:
+    - app: live
+      secret: s
+      publish: true
+    - app: live
+      secret: s
+    - app: a/b
+    - app: tv
+      play: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`auth.apps[1] (live): app is already used`,
+		`auth.apps[2] (a/b): app is required and has no slash`,
+		`auth.apps[3] (tv): secret is required`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	c, err := Parse([]byte(`
+listeners:
+  - protocol: rtmp
+    port: 1935
+hooks:
+  retries: -1
+  on_publish: [http://127.0.0.1:9000/publish, "ftp://nowhere"]
+  on_stop: []
+vhosts:
+  - name: a
+    hooks:
+      on_play: [localhost]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := c.Hooks.Map(); len(urls) != 2 || len(urls["on_publish"]) != 2 || urls["on_stop"] == nil {
+		t.Fatalf("expect the set events only, got %v", urls)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`hooks.on_publish: "ftp://nowhere" is not a http url`,
+		`hooks: timeout, retries and retry_interval must not be negative`,
+		`vhosts[0] (a): hooks.on_play: "localhost" is not a http url`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+}
+
+func TestAccess(t *testing.T) {
+	c, err := Parse([]byte(`
+connections:
+  max: -1
+listeners:
+  - protocol: rtmp
+    port: 1935
+    access:
+      allow: [10.0.0.0/8, 192.168.1.7, "2001:db8::/32"]
+      publish_deny: [10.1.0.0/16]
+      max_conns_per_ip: 4
+      rate: 2
+      burst: 5
+  - protocol: http-ts
+    port: 8080
+    access:
+      deny: [10.0.0.0/33, nowhere]
+      burst: 3
+  - protocol: ts
+    network: udp
+    port: 1234
+    stream_url: udp://127.0.0.1/live/ts
+    access:
+      deny: [10.0.0.1]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := c.Listeners[0].Access; len(a.Allow) != 3 || a.MaxConnsPerIP != 4 || a.Rate != 2 || a.Burst != 5 {
+		t.Fatalf("unexpected access %+v", a)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`connections: max and max_per_ip must not be negative`,
+		`listeners[1] (http-ts): access.deny: "10.0.0.0/33" is not a cidr or an ip`,
+		`listeners[1] (http-ts): access.deny: "nowhere" is not a cidr or an ip`,
+		`listeners[1] (http-ts): access: burst needs a rate`,
+		`listeners[2] (ts): access is not supported on udp`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+	if strings.Contains(err.Error(), "listeners[0]") {
+		t.Errorf("expect the rtmp access to be valid:\n%v", err)
+	}
+}
+
+func TestRtmpLimits(t *testing.T) {
+	c, err := Parse([]byte(`
+listeners:
+  - protocol: rtmp
+    port: 1935
+    rtmp_limits:
+      max_video_message: 4194304
+      max_chunk_streams: 16
+      max_amf_depth: -1
+  - protocol: http-ts
+    port: 8080
+    rtmp_limits:
+      max_buffered: 1024
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.Listeners[0].RtmpLimits; r.MaxVideoMessage != 4194304 || r.MaxChunkStreams != 16 {
+		t.Fatalf("unexpected rtmp limits %+v", r)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`listeners[0] (rtmp): rtmp_limits must not be negative`,
+		`listeners[1] (http-ts): rtmp_limits is only for rtmp`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	c, err := Parse([]byte(`
+listeners:
+  - protocol: rtmp
+    port: 1935
+    proxy_protocol:
+      trusted: [10.0.0.0/8, 192.0.2.10]
+      header_timeout: 3s
+  - protocol: srt
+    port: 10080
+    proxy_protocol:
+      trusted: [10.0.0.0/8]
+  - protocol: http-ts
+    port: 8080
+    proxy_protocol:
+      trusted: [nowhere]
+      header_timeout: -1s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := c.Listeners[0].ProxyProtocol; len(p.Trusted) != 2 || p.HeaderTimeout != 3*time.Second {
+		t.Fatalf("unexpected proxy protocol %+v", p)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`listeners[1] (srt): proxy_protocol is only for tcp`,
+		`listeners[2] (http-ts): proxy_protocol.trusted: "nowhere" is not a cidr or an ip`,
+		`listeners[2] (http-ts): proxy_protocol.header_timeout: must not be negative`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+	if strings.Contains(err.Error(), "listeners[0]") {
+		t.Errorf("expect the rtmp proxy protocol to be valid:\n%v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	c, err := Parse([]byte(`
+listeners:
+  - protocol: rtmp
+    port: 1935
+    write:
+      buffer: 131072
+      flush: interval
+      flush_interval: 10ms
+  - protocol: rtmp
+    port: 1936
+    write:
+      flush: bytes
+  - protocol: rtmp
+    port: 1937
+    write:
+      flush: always
+  - protocol: http-ts
+    port: 8080
+    write:
+      buffer: 1024
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := c.Listeners[0].Write; w.Buffer != 131072 || w.Flush != FlushInterval || w.FlushInterval != 10*time.Millisecond {
+		t.Fatalf("unexpected write %+v", w)
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expect errors")
+	}
+	for _, msg := range []string{
+		`listeners[1] (rtmp): write.flush_bytes: must be positive with the bytes flush`,
+		`listeners[2] (rtmp): write.flush: "always", expect one of message, bytes, interval`,
+		`listeners[3] (http-ts): write is only for rtmp`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expect %q in\n%v", msg, err)
+		}
+	}
+	if strings.Contains(err.Error(), "listeners[0]") {
+		t.Errorf("expect the first write to be valid:\n%v", err)
+	}
+}
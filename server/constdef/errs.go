@@ -2,9 +2,16 @@ package constdef
 
 import (
 	"context"
+	"errors"
 	"fmt"
 )
 
+var (
+	ErrStreamExists   = errors.New("stream already exists")
+	ErrStreamNotFound = errors.New("stream not found")
+	ErrSessionClosed  = errors.New("session closed")
+)
+
 type HyError struct {
 	Err    error
 	CtxMsg string
@@ -30,3 +37,7 @@ func (h *HyError) Error() string {
 	}
 	return fmt.Sprintf("Err:%+v;Msg:%s", h.Err, h.CtxMsg)
 }
+
+func (h *HyError) Unwrap() error {
+	return h.Err
+}
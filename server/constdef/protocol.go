@@ -1 +1,48 @@
 package constdef
+
+type CodecID uint16
+
+const (
+	CodecUnknown CodecID = iota
+	CodecH264
+	CodecH265
+	CodecAAC
+	CodecOpus
+	CodecMP3
+	CodecPCMA
+	CodecPCMU
+)
+
+var codecNames = map[CodecID]string{
+	CodecUnknown: "unknown",
+	CodecH264:    "h264",
+	CodecH265:    "h265",
+	CodecAAC:     "aac",
+	CodecOpus:    "opus",
+	CodecMP3:     "mp3",
+	CodecPCMA:    "pcma",
+	CodecPCMU:    "pcmu",
+}
+
+func (c CodecID) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return codecNames[CodecUnknown]
+}
+
+// MarshalText writes the codec name into json
+func (c CodecID) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText reads a codec name, unknown names become CodecUnknown
+func (c *CodecID) UnmarshalText(text []byte) error {
+	*c = CodecUnknown
+	for id, name := range codecNames {
+		if name == string(text) {
+			*c = id
+		}
+	}
+	return nil
+}
@@ -7,8 +7,28 @@ type SessionType uint16
 const (
 	SinkTypeFile SinkType = iota
 	SinkTypeRtmp
+	SinkTypeRtsp
+	SinkTypeWebrtc
+	SinkTypeSrt
+	SinkTypeHttpTs
 )
 
+var sinkTypeNames = map[SinkType]string{
+	SinkTypeFile:   "file",
+	SinkTypeRtmp:   "rtmp",
+	SinkTypeRtsp:   "rtsp",
+	SinkTypeWebrtc: "webrtc",
+	SinkTypeSrt:    "srt",
+	SinkTypeHttpTs: "http-ts",
+}
+
+func (s SinkType) String() string {
+	if name, ok := sinkTypeNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 const (
 	SessionTypeInvalid = iota
 	SessionTypeSource
@@ -17,3 +37,6 @@ const (
 )
 
 const DefaultCacheSize = 1024
+
+// DefaultGopCacheSize bounds how many packets of the latest gop are kept for late joiners
+const DefaultGopCacheSize = 512
@@ -0,0 +1,361 @@
+package hynet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op is what an admitted client asks for
+type Op string
+
+const (
+	OpPublish Op = "publish"
+	OpPlay    Op = "play"
+)
+
+// rejection reasons, the reason label of the rejected counter
+const (
+	ReasonDenied   = "denied"
+	ReasonRate     = "rate"
+	ReasonPerIP    = "max_conns_per_ip"
+	ReasonMaxConns = "max_conns"
+	ReasonPublish  = "publish_denied"
+	ReasonPlay     = "play_denied"
+)
+
+const (
+	//a reason is logged once per period, a scraper would flood the log otherwise
+	rejectLogPeriod = time.Second
+	//idle buckets are dropped this often, a full bucket is no different from a missing one
+	sweepInterval = time.Minute
+)
+
+var ErrRejected = errors.New("rejected by access rules")
+
+// AccessConfig is who may use one listener, deny wins over allow and an empty allow list allows everyone
+type AccessConfig struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	//checked on publish and play, on top of Allow and Deny
+	PublishAllow []*net.IPNet
+	PublishDeny  []*net.IPNet
+	PlayAllow    []*net.IPNet
+	PlayDeny     []*net.IPNet
+	//connections of one ip open at once, no limit when zero
+	MaxConnsPerIP int
+	//new connections of one ip per second, Burst more are let in at once, no limit when zero
+	Rate  float64
+	Burst int
+}
+
+// Limits apply to the connections of every listener together, no limit when zero
+type Limits struct {
+	MaxConns      int
+	MaxConnsPerIP int
+}
+
+// Access admits the connections of one listener, a nil one admits everything
+type Access struct {
+	ctx      context.Context
+	protocol string
+	config   *AccessConfig
+	now      func() time.Time
+
+	mu      sync.Mutex
+	conns   map[string]int
+	buckets map[string]*bucket
+	swept   time.Time
+	//rejections are logged once per reason and period, the others are counted until the next line
+	logged     map[string]time.Time
+	suppressed map[string]int
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// counter is the connections of every listener
+type counter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+var (
+	limits atomic.Value
+	global = &counter{perIP: make(map[string]int)}
+)
+
+// SetLimits applies to the connections accepted from now on, the open ones are kept
+func SetLimits(l Limits) {
+	limits.Store(l)
+}
+
+func NewAccess(ctx context.Context, protocol string, config *AccessConfig) *Access {
+	a := &Access{}
+	a.ctx = ctx
+	a.protocol = protocol
+	a.config = config
+	a.now = time.Now
+	a.conns = make(map[string]int)
+	a.buckets = make(map[string]*bucket)
+	a.logged = make(map[string]time.Time)
+	a.suppressed = make(map[string]int)
+	return a
+}
+
+// ParseCIDRs reads cidrs, a single ip is a network of its own
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", s)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Admit checks a new connection from addr, release has to be called once it is closed
+func (a *Access) Admit(addr net.Addr) (release func(), err error) {
+	if a == nil {
+		return func() {}, nil
+	}
+	ip := addrIP(addr)
+	l, _ := limits.Load().(Limits)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !allowed(ip, a.config.Allow, a.config.Deny) {
+		return nil, a.reject(ReasonDenied, ip)
+	}
+	key := ip.String()
+	if a.config.Rate > 0 && !a.take(key) {
+		return nil, a.reject(ReasonRate, ip)
+	}
+	if a.config.MaxConnsPerIP > 0 && a.conns[key] >= a.config.MaxConnsPerIP {
+		return nil, a.reject(ReasonPerIP, ip)
+	}
+	if reason := global.add(key, l); reason != "" {
+		return nil, a.reject(reason, ip)
+	}
+	a.conns[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			global.remove(key)
+			a.mu.Lock()
+			if a.conns[key]--; a.conns[key] <= 0 {
+				delete(a.conns, key)
+			}
+			a.mu.Unlock()
+		})
+	}, nil
+}
+
+// Allow checks the publish or play lists for a client at addr, host:port or a bare ip
+func (a *Access) Allow(op Op, addr string) error {
+	if a == nil {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = net.ParseIP(host)
+	}
+	allow, deny, reason := a.config.PlayAllow, a.config.PlayDeny, ReasonPlay
+	if op == OpPublish {
+		allow, deny, reason = a.config.PublishAllow, a.config.PublishDeny, ReasonPublish
+	}
+	if allowed(ip, allow, deny) {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reject(reason, ip)
+}
+
+// Listener closes the connections the access rejects before anyone reads them
+func (a *Access) Listener(l net.Listener) net.Listener {
+	if a == nil {
+		return l
+	}
+	return &accessListener{Listener: l, access: a}
+}
+
+// Conns is the connections of ip open on this listener
+func (a *Access) Conns(ip string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conns[ip]
+}
+
+// take spends a token of the bucket of ip, the bucket refills at Rate up to Burst
+func (a *Access) take(ip string) bool {
+	now := a.now()
+	burst := float64(a.config.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(a.config.Rate))
+	}
+	if now.Sub(a.swept) > sweepInterval {
+		for key, b := range a.buckets {
+			if b.tokens+now.Sub(b.at).Seconds()*a.config.Rate >= burst {
+				delete(a.buckets, key)
+			}
+		}
+		a.swept = now
+	}
+	b, ok := a.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: burst, at: now}
+		a.buckets[ip] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.at).Seconds()*a.config.Rate)
+	b.at = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reject counts and logs a refused client, a.mu is held
+func (a *Access) reject(reason string, ip net.IP) error {
+	metrics.Rejected.With(a.protocol, reason).Inc()
+	now := a.now()
+	if now.Sub(a.logged[reason]) < rejectLogPeriod {
+		a.suppressed[reason]++
+	} else {
+		log.Warnf(a.ctx, "%s rejected %s: %s, %d more not logged", a.protocol, ip, reason, a.suppressed[reason])
+		a.logged[reason] = now
+		a.suppressed[reason] = 0
+	}
+	return fmt.Errorf("%w: %s %s", ErrRejected, ip, reason)
+}
+
+// add counts a connection of ip against the limits, the reason is empty when it fits
+func (c *counter) add(ip string, l Limits) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l.MaxConns > 0 && c.total >= l.MaxConns {
+		return ReasonMaxConns
+	}
+	if l.MaxConnsPerIP > 0 && c.perIP[ip] >= l.MaxConnsPerIP {
+		return ReasonPerIP
+	}
+	c.total++
+	c.perIP[ip]++
+	return ""
+}
+
+func (c *counter) remove(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total--
+	if c.perIP[ip]--; c.perIP[ip] <= 0 {
+		delete(c.perIP, ip)
+	}
+}
+
+// allowed is false for an ip in deny, or not in a non empty allow list
+func allowed(ip net.IP, allow, deny []*net.IPNet) bool {
+	if len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, n := range allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// accessListener hands out the admitted connections only, they release their slot on Close
+type accessListener struct {
+	net.Listener
+	access *Access
+}
+
+func (l *accessListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, err := l.access.Admit(conn.RemoteAddr())
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+		return &admittedConn{Conn: conn, release: release}, nil
+	}
+}
+
+type admittedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// ProxyHeader keeps the header of a proxied connection reachable under the wrapper
+func (c *admittedConn) ProxyHeader() *ProxyHeader {
+	return ProxyHeaderOf(c.Conn)
+}
+
+func (c *admittedConn) writeConn() net.Conn {
+	return c.Conn
+}
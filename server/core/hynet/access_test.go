@@ -0,0 +1,207 @@
+package hynet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestAccess starts without limits and without the connections of the previous tests
+func newTestAccess(t *testing.T, config *AccessConfig) *Access {
+	SetLimits(Limits{})
+	global.mu.Lock()
+	global.total = 0
+	global.perIP = make(map[string]int)
+	global.mu.Unlock()
+	t.Cleanup(func() {
+		SetLimits(Limits{})
+	})
+	return NewAccess(context.Background(), "test", config)
+}
+
+func cidrs(t *testing.T, list ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}
+}
+
+func TestAdmit(t *testing.T) {
+	a := newTestAccess(t, &AccessConfig{
+		Allow:         cidrs(t, "10.0.0.0/8", "192.168.1.7"),
+		Deny:          cidrs(t, "10.1.0.0/16"),
+		MaxConnsPerIP: 2,
+	})
+	for ip, ok := range map[string]bool{"10.0.0.1": true, "192.168.1.7": true, "10.1.2.3": false, "192.168.1.8": false, "::1": false} {
+		release, err := a.Admit(tcpAddr(ip))
+		if ok != (err == nil) {
+			t.Fatalf("%s: expect admitted %v, got %v", ip, ok, err)
+		}
+		if err == nil {
+			release()
+		} else if !errors.Is(err, ErrRejected) {
+			t.Fatalf("%s: expect ErrRejected, got %v", ip, err)
+		}
+	}
+
+	first, _ := a.Admit(tcpAddr("10.0.0.2"))
+	second, _ := a.Admit(tcpAddr("10.0.0.2"))
+	if _, err := a.Admit(tcpAddr("10.0.0.2")); err == nil {
+		t.Fatal("expect the third connection of the ip to be rejected")
+	}
+	if _, err := a.Admit(tcpAddr("10.0.0.3")); err != nil {
+		t.Fatalf("expect another ip to get in, got %v", err)
+	}
+	first()
+	first()
+	if n := a.Conns("10.0.0.2"); n != 1 {
+		t.Fatalf("expect a release to count once, got %d connections", n)
+	}
+	if _, err := a.Admit(tcpAddr("10.0.0.2")); err != nil {
+		t.Fatalf("expect a released slot to be reused, got %v", err)
+	}
+	second()
+}
+
+func TestLimits(t *testing.T) {
+	a := newTestAccess(t, &AccessConfig{})
+	b := NewAccess(context.Background(), "other", &AccessConfig{})
+	SetLimits(Limits{MaxConns: 3, MaxConnsPerIP: 2})
+	r1, _ := a.Admit(tcpAddr("10.0.0.1"))
+	if _, err := b.Admit(tcpAddr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Admit(tcpAddr("10.0.0.1")); err == nil {
+		t.Fatal("expect the per ip limit to count every listener")
+	}
+	if _, err := a.Admit(tcpAddr("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Admit(tcpAddr("10.0.0.3")); err == nil {
+		t.Fatal("expect the server wide limit")
+	}
+	r1()
+	if _, err := b.Admit(tcpAddr("10.0.0.3")); err != nil {
+		t.Fatalf("expect a closed connection to make room, got %v", err)
+	}
+}
+
+func TestRate(t *testing.T) {
+	a := newTestAccess(t, &AccessConfig{Rate: 2, Burst: 3})
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time {
+		return now
+	}
+	admit := func(ip string) bool {
+		release, err := a.Admit(tcpAddr(ip))
+		if err != nil {
+			return false
+		}
+		release()
+		return true
+	}
+	for i := 0; i < 3; i++ {
+		if !admit("10.0.0.1") {
+			t.Fatalf("expect the burst to get in, rejected at %d", i)
+		}
+	}
+	if admit("10.0.0.1") {
+		t.Fatal("expect the rate to reject past the burst")
+	}
+	if !admit("10.0.0.2") {
+		t.Fatal("expect every ip to have its own bucket")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !admit("10.0.0.1") || admit("10.0.0.1") {
+		t.Fatal("expect one token back after half a second")
+	}
+	now = now.Add(2 * sweepInterval)
+	admit("10.0.0.3")
+	if len(a.buckets) != 1 {
+		t.Fatalf("expect the idle buckets to be dropped, got %d", len(a.buckets))
+	}
+}
+
+func TestAllow(t *testing.T) {
+	a := newTestAccess(t, &AccessConfig{
+		PublishAllow: cidrs(t, "10.0.0.0/24"),
+		PlayDeny:     cidrs(t, "10.0.0.5", "2001:db8::/32"),
+	})
+	for _, c := range []struct {
+		op   Op
+		addr string
+		ok   bool
+	}{
+		{OpPublish, "10.0.0.9:1935", true},
+		{OpPublish, "10.0.1.9:1935", false},
+		{OpPlay, "10.0.1.9:80", true},
+		{OpPlay, "10.0.0.5:80", false},
+		{OpPlay, "[2001:db8::1]:80", false},
+		{OpPlay, "10.0.0.5", false},
+	} {
+		if err := a.Allow(c.op, c.addr); c.ok != (err == nil) {
+			t.Errorf("%s from %s: expect allowed %v, got %v", c.op, c.addr, c.ok, err)
+		}
+	}
+	var none *Access
+	if err := none.Allow(OpPublish, "10.0.1.9:1935"); err != nil {
+		t.Fatal("expect a nil access to allow everyone")
+	}
+}
+
+func TestListener(t *testing.T) {
+	a := newTestAccess(t, &AccessConfig{MaxConnsPerIP: 1})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = a.Listener(ln)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	conn := <-accepted
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var netErr net.Error
+	if _, err = second.Read(make([]byte, 1)); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("expect the second connection to be closed, got %v", err)
+	}
+
+	_ = conn.Close()
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	select {
+	case conn = <-accepted:
+		_ = conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("expect the closed connection to free the slot")
+	}
+}
@@ -2,6 +2,8 @@ package hynet
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Opafanls/hylan/server/constdef"
 	"io"
 	"net"
@@ -9,23 +11,55 @@ import (
 	"time"
 )
 
+// closeFlushTimeout bounds the flush of Close, the bytes a stalled peer does not take are dropped
+const closeFlushTimeout = 500 * time.Millisecond
+
 type IHyConn interface {
 	Init() error
 	SetConfig(netConfig NetConfig, config interface{}) error
 	GetConfig(netConfig NetConfig) (data interface{}, exist bool)
 	Ctx() context.Context
 	Conn() io.ReadWriter
+	//the client behind a trusted load balancer when the connection came with a PROXY header
+	RemoteAddr() net.Addr
+	//nil without a PROXY header
+	ProxyHeader() *ProxyHeader
+	//WriteBuffers writes header and payload pairs in one call, writev on a plain tcp conn
+	WriteBuffers(bufs net.Buffers) (int64, error)
 	Flushable
 	io.ReadWriteCloser
 }
 
 type Flushable interface {
+	//Flush sends the buffered writes
 	Flush() error
+	//EndMessage marks the end of a protocol message, the flush policy decides if the buffer goes out
+	EndMessage() error
+}
+
+// writeConn is a listener wrapper whose writes go to the conn it wraps unchanged
+type writeConn interface {
+	writeConn() net.Conn
 }
 
 func NewHyConn(conn net.Conn) IHyConn {
+	return newHyConn(conn, ProxyHeaderOf(conn))
+}
+
+// newHyConn takes the header apart, a tls connection hides the one it wraps
+func newHyConn(conn net.Conn, header *ProxyHeader) *DefaultConn {
 	hyConn := &DefaultConn{}
 	hyConn.conn = conn
+	hyConn.proxy = header
+	//net.Buffers only use writev on the socket itself
+	hyConn.vectored = conn
+	for {
+		w, ok := hyConn.vectored.(writeConn)
+		if !ok {
+			break
+		}
+		hyConn.vectored = w.writeConn()
+	}
 	return hyConn
 }
 
@@ -33,6 +67,16 @@ type DefaultConn struct {
 	conn   net.Conn
 	ctx    context.Context
 	config sync.Map
+	proxy  *ProxyHeader
+
+	//the writes, buf is nil when they are not buffered
+	wmu      sync.Mutex
+	buf      []byte
+	policy   FlushPolicy
+	timer    *time.Timer
+	vectored net.Conn
+	//the error of a flush of the timer, the next write returns it
+	werr error
 }
 
 func (hyConn *DefaultConn) Init() error {
@@ -43,8 +87,97 @@ func (hyConn *DefaultConn) Conn() io.ReadWriter {
 	return hyConn.conn
 }
 
+func (hyConn *DefaultConn) RemoteAddr() net.Addr {
+	return hyConn.conn.RemoteAddr()
+}
+
+func (hyConn *DefaultConn) ProxyHeader() *ProxyHeader {
+	return hyConn.proxy
+}
+
 func (hyConn *DefaultConn) Write(data []byte) (int, error) {
-	return hyConn.conn.Write(data)
+	hyConn.wmu.Lock()
+	defer hyConn.wmu.Unlock()
+	if hyConn.buf == nil {
+		return hyConn.conn.Write(data)
+	}
+	n, err := hyConn.writeBuffers(net.Buffers{data}, len(data))
+	return int(n), err
+}
+
+func (hyConn *DefaultConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	hyConn.wmu.Lock()
+	defer hyConn.wmu.Unlock()
+	if hyConn.buf == nil {
+		return bufs.WriteTo(hyConn.vectored)
+	}
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
+	return hyConn.writeBuffers(bufs, size)
+}
+
+// writeBuffers appends bufs to the buffer, what does not fit goes out with the buffer in one writev
+func (hyConn *DefaultConn) writeBuffers(bufs net.Buffers, size int) (int64, error) {
+	if hyConn.werr != nil {
+		return 0, hyConn.werr
+	}
+	if len(hyConn.buf)+size <= cap(hyConn.buf) {
+		if len(hyConn.buf) == 0 {
+			hyConn.armTimer()
+		}
+		for _, b := range bufs {
+			hyConn.buf = append(hyConn.buf, b...)
+		}
+		return int64(size), nil
+	}
+	pending := int64(len(hyConn.buf))
+	out := make(net.Buffers, 0, len(bufs)+1)
+	out = append(out, hyConn.buf)
+	out = append(out, bufs...)
+	n, err := out.WriteTo(hyConn.vectored)
+	hyConn.buf = hyConn.buf[:0]
+	hyConn.stopTimer()
+	if n -= pending; n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// flush writes the buffer out, wmu is held
+func (hyConn *DefaultConn) flush() error {
+	hyConn.stopTimer()
+	if hyConn.werr != nil {
+		return hyConn.werr
+	}
+	if len(hyConn.buf) == 0 {
+		return nil
+	}
+	_, err := hyConn.vectored.Write(hyConn.buf)
+	hyConn.buf = hyConn.buf[:0]
+	return err
+}
+
+// armTimer flushes the first bytes of an empty buffer after the interval of the policy
+func (hyConn *DefaultConn) armTimer() {
+	if hyConn.policy.Mode != FlushInterval || hyConn.policy.Interval <= 0 {
+		return
+	}
+	hyConn.timer = time.AfterFunc(hyConn.policy.Interval, func() {
+		hyConn.wmu.Lock()
+		defer hyConn.wmu.Unlock()
+		if err := hyConn.flush(); err != nil {
+			hyConn.werr = err
+		}
+	})
+}
+
+func (hyConn *DefaultConn) stopTimer() {
+	if hyConn.timer != nil {
+		hyConn.timer.Stop()
+		hyConn.timer = nil
+	}
 }
 
 func (hyConn *DefaultConn) Read(data []byte) (int, error) {
@@ -52,6 +185,7 @@ func (hyConn *DefaultConn) Read(data []byte) (int, error) {
 }
 
 func (hyConn *DefaultConn) SetConfig(netConfig NetConfig, config interface{}) error {
+	hyConn.config.Store(netConfig, config)
 	switch netConfig {
 	case WriteTimeout:
 		timeout := config.(time.Time)
@@ -59,6 +193,19 @@ func (hyConn *DefaultConn) SetConfig(netConfig NetConfig, config interface{}) er
 	case ReadTimeout:
 		timeout := config.(time.Time)
 		return hyConn.conn.SetReadDeadline(timeout)
+	case WriteBuffer:
+		hyConn.wmu.Lock()
+		defer hyConn.wmu.Unlock()
+		err := hyConn.flush()
+		hyConn.buf = nil
+		if size := config.(int); size > 0 {
+			hyConn.buf = make([]byte, 0, size)
+		}
+		return err
+	case Flush:
+		hyConn.wmu.Lock()
+		hyConn.policy = config.(FlushPolicy)
+		hyConn.wmu.Unlock()
 	default:
 
 	}
@@ -69,7 +216,13 @@ func (hyConn *DefaultConn) GetConfig(netConfig NetConfig) (interface{}, bool) {
 	return hyConn.config.Load(netConfig)
 }
 
+// Close writes the buffered bytes out first. The write deadline it sets before bounds the flush, and
+// a writer stuck on a stalled peer, to closeFlushTimeout.
 func (hyConn *DefaultConn) Close() error {
+	_ = hyConn.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+	hyConn.wmu.Lock()
+	_ = hyConn.flush()
+	hyConn.wmu.Unlock()
 	err := hyConn.conn.Close()
 	if err != nil {
 		return nil
@@ -77,10 +230,68 @@ func (hyConn *DefaultConn) Close() error {
 	return constdef.NewHyError("active close", err)
 }
 
+// Flush writes the buffered bytes out at once
 func (hyConn *DefaultConn) Flush() error {
+	hyConn.wmu.Lock()
+	defer hyConn.wmu.Unlock()
+	return hyConn.flush()
+}
+
+func (hyConn *DefaultConn) EndMessage() error {
+	hyConn.wmu.Lock()
+	defer hyConn.wmu.Unlock()
+	switch hyConn.policy.Mode {
+	case FlushMessage:
+		return hyConn.flush()
+	case FlushBytes:
+		if len(hyConn.buf) >= hyConn.policy.Bytes {
+			return hyConn.flush()
+		}
+	}
 	return nil
 }
 
 func (hyConn *DefaultConn) Ctx() context.Context {
 	return hyConn.ctx
 }
+
+// SetDeadline arms the ReadTimeout or WriteTimeout deadline of conn d from now, zero clears it
+func SetDeadline(conn IHyConn, netConfig NetConfig, d time.Duration) error {
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	return conn.SetConfig(netConfig, deadline)
+}
+
+// TimeoutError closes a connection that stayed in a phase for too long
+type TimeoutError struct {
+	Phase string
+	After time.Duration
+	Err   error
+}
+
+// NewTimeoutError wraps err when it is a deadline error, the other errors are returned as they are
+func NewTimeoutError(err error, phase string, timeout time.Duration) error {
+	var netErr net.Error
+	if err == nil || phase == "" || !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	return &TimeoutError{Phase: phase, After: timeout, Err: err}
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout after %s: %v", e.Phase, e.After, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Temporary() bool {
+	return false
+}
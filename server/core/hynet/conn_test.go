@@ -0,0 +1,262 @@
+package hynet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimeoutError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := NewHyConn(server)
+	if err := SetDeadline(conn, ReadTimeout, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	_, err := conn.Read(make([]byte, 1))
+	err = NewTimeoutError(err, PhaseHandshake, 20*time.Millisecond)
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || timeout.Phase != PhaseHandshake || !strings.HasPrefix(err.Error(), "handshake timeout after 20ms") {
+		t.Fatalf("expect a handshake timeout, got %v", err)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("expect the timeout to stay a net timeout")
+	}
+
+	if err = SetDeadline(conn, ReadTimeout, 0); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = client.Write([]byte{1})
+	}()
+	if _, err = conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("expect a cleared deadline to read, got %v", err)
+	}
+	if err = NewTimeoutError(io.EOF, PhaseHandshake, time.Second); err != io.EOF {
+		t.Fatalf("expect other errors as they are, got %v", err)
+	}
+}
+
+// recordConn keeps every write as one entry, net.Buffers write to it one buffer at a time
+type recordConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes []string
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, string(p))
+	return len(p), nil
+}
+
+func (c *recordConn) written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.writes...)
+}
+
+func TestWriteBuffer(t *testing.T) {
+	rc := &recordConn{}
+	conn := NewHyConn(rc)
+	if _, err := conn.WriteBuffers(net.Buffers{[]byte("h1"), []byte("p1")}); err != nil {
+		t.Fatal(err)
+	}
+	if w := rc.written(); len(w) != 2 {
+		t.Fatalf("expect the writes to go straight out without a buffer, got %q", w)
+	}
+
+	rc = &recordConn{}
+	conn = NewHyConn(rc)
+	_ = conn.SetConfig(Flush, FlushPolicy{Mode: FlushBytes, Bytes: 8})
+	_ = conn.SetConfig(WriteBuffer, 16)
+	_, _ = conn.WriteBuffers(net.Buffers{[]byte("h1"), []byte("p1")})
+	_ = conn.EndMessage()
+	if w := rc.written(); len(w) != 0 {
+		t.Fatalf("expect 4 bytes to stay under the threshold, got %q", w)
+	}
+	_, _ = conn.Write([]byte("h2p2"))
+	_ = conn.EndMessage()
+	if w := rc.written(); len(w) != 1 || w[0] != "h1p1h2p2" {
+		t.Fatalf("expect the threshold to flush once, got %q", w)
+	}
+	_, _ = conn.Write([]byte("0123456789"))
+	if n, err := conn.WriteBuffers(net.Buffers{[]byte("abcdef"), []byte("gh")}); n != 8 || err != nil {
+		t.Fatalf("expect the overflow to be written, got %d %v", n, err)
+	}
+	if w := rc.written(); strings.Join(w, "") != "h1p1h2p20123456789abcdefgh" || len(w) != 4 {
+		t.Fatalf("expect the buffer to go out with the overflow, got %q", w)
+	}
+
+	_ = conn.SetConfig(Flush, FlushPolicy{Mode: FlushMessage})
+	_, _ = conn.Write([]byte("m"))
+	_ = conn.EndMessage()
+	_ = conn.SetConfig(Flush, FlushPolicy{Mode: FlushInterval, Interval: 20 * time.Millisecond})
+	_, _ = conn.Write([]byte("i"))
+	_ = conn.EndMessage()
+	if w := rc.written(); w[len(w)-1] != "m" {
+		t.Fatalf("expect every message to go out, got %q", w)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if w := rc.written(); w[len(w)-1] != "i" {
+		t.Fatalf("expect the interval to flush, got %q", w)
+	}
+	_, _ = conn.Write([]byte("f"))
+	if err := conn.Flush(); err != nil || rc.written()[len(rc.written())-1] != "f" {
+		t.Fatalf("expect Flush to write at once, got %v", err)
+	}
+}
+
+func TestWritevConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	raw, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &ProxyHeader{Version: 1}
+	conn := newHyConn(&admittedConn{Conn: &proxyConn{Conn: raw, header: header}, release: func() {}}, header)
+	if conn.vectored != raw {
+		t.Fatalf("expect the writes to skip the wrappers, got %T", conn.vectored)
+	}
+	if _, err = conn.WriteBuffers(net.Buffers{[]byte("ab"), []byte("cd")}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(client, buf); err != nil || string(buf) != "abcd" {
+		t.Fatalf("expect the buffers in order, got %q %v", buf, err)
+	}
+	_ = conn.Close()
+}
+
+// benchConn is the accepted end of a loopback connection whose peer reads everything
+func benchConn(b *testing.B) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, client)
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = conn.Close()
+		_ = client.Close()
+	})
+	return conn
+}
+
+// BenchmarkWrite sends chunk header and payload pairs, direct is the path of the writes before the buffer
+func BenchmarkWrite(b *testing.B) {
+	header := make([]byte, 12)
+	for _, size := range []int{128, 4096} {
+		payload := make([]byte, size)
+		b.Run(fmt.Sprintf("direct/%d", size), func(b *testing.B) {
+			conn := benchConn(b)
+			b.SetBytes(int64(len(header) + size))
+			for i := 0; i < b.N; i++ {
+				_, _ = conn.Write(header)
+				_, _ = conn.Write(payload)
+			}
+		})
+		for _, c := range []struct {
+			name   string
+			buffer int
+			policy FlushPolicy
+		}{
+			{"writev", 0, FlushPolicy{}},
+			{"message", 64 * 1024, FlushPolicy{Mode: FlushMessage}},
+			{"bytes", 64 * 1024, FlushPolicy{Mode: FlushBytes, Bytes: 32 * 1024}},
+			{"interval", 64 * 1024, FlushPolicy{Mode: FlushInterval, Interval: 10 * time.Millisecond}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", c.name, size), func(b *testing.B) {
+				conn := NewHyConn(benchConn(b))
+				_ = conn.SetConfig(Flush, c.policy)
+				_ = conn.SetConfig(WriteBuffer, c.buffer)
+				b.SetBytes(int64(len(header) + size))
+				for i := 0; i < b.N; i++ {
+					_, _ = conn.WriteBuffers(net.Buffers{header, payload})
+					_ = conn.EndMessage()
+				}
+				_ = conn.Flush()
+			})
+		}
+	}
+}
+
+func TestCloseFlushes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewHyConn(server)
+	_ = conn.SetConfig(Flush, FlushPolicy{Mode: FlushBytes, Bytes: 4096})
+	_ = conn.SetConfig(WriteBuffer, 4096)
+	_, _ = conn.Write([]byte("last words"))
+	_ = conn.EndMessage()
+	_ = conn.Close()
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(client); err != nil || string(got) != "last words" {
+		t.Fatalf("expect the buffered bytes before the close, got %q %v", got, err)
+	}
+
+	//a peer that reads nothing holds the close up for the flush timeout at most
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	if server, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	conn = NewHyConn(server)
+	_ = conn.SetConfig(WriteBuffer, 4096)
+	go func() {
+		chunk := make([]byte, 1<<20)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	_ = conn.Close()
+	if elapsed := time.Since(start); elapsed > closeFlushTimeout+time.Second {
+		t.Fatalf("close took %s on a stalled peer", elapsed)
+	}
+}
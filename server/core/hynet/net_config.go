@@ -1,14 +1,72 @@
 package hynet
 
+import (
+	"crypto/tls"
+	"time"
+)
+
 type NetConfig uint16
 
 const (
 	_ = iota
 	ReadTimeout
 	WriteTimeout
+	//an int, the size of the write buffer, the writes go straight to the socket when zero
+	WriteBuffer
+	//a FlushPolicy, when the buffered writes go out
+	Flush
 )
 
+type FlushMode int
+
+const (
+	//the buffer goes out at the end of every message
+	FlushMessage FlushMode = iota
+	//the buffer goes out at the end of a message once FlushPolicy.Bytes are buffered
+	FlushBytes
+	//the buffer goes out FlushPolicy.Interval after its first byte
+	FlushInterval
+)
+
+// FlushPolicy says when a buffered conn writes, a full buffer always goes out and Flush sends it at once
+type FlushPolicy struct {
+	Mode     FlushMode
+	Bytes    int
+	Interval time.Duration
+}
+
 type TcpListenConfig struct {
 	Addr string
 	Port int
+	//accepted connections are wrapped in tls when set
+	TLS *tls.Config
+	//connections, publishes and plays are checked against it, nil lets everyone in
+	Access *Access
+	//reads the PROXY header of the trusted load balancers, nil reads none
+	Proxy    *Proxy
+	Timeouts Timeouts
+	//write buffer of the accepted connections, writes go straight to the socket when zero
+	WriteBuffer int
+	Flush       FlushPolicy
+}
+
+// phases of a connection, each one has its own timeout
+const (
+	PhaseHandshake    = "handshake"
+	PhaseFirstCommand = "first_command"
+	PhasePublishIdle  = "publish_idle"
+	PhasePlayStall    = "play_stall"
+)
+
+// Timeouts bound the phases of a connection, a zero one is not enforced
+type Timeouts struct {
+	//the protocol handshake, tls included
+	Handshake time.Duration
+	//from the end of the handshake, or of an unpublish, to publish or play; armed once, other commands
+	//don't extend it
+	FirstCommand time.Duration
+	//a publisher sending no media
+	PublishIdle time.Duration
+	//a player not reading what is written to it
+	PlayStall time.Duration
 }
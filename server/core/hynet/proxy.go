@@ -0,0 +1,393 @@
+package hynet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/task"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//a trusted peer that does not finish its header in time is closed
+	DefaultProxyHeaderTimeout = 5 * time.Second
+	//"PROXY TCP6 " with two full ipv6 addresses, two ports and the crlf
+	proxyV1MaxLen    = 107
+	proxyV2HeaderLen = 16
+)
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	castagnoli       = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// tlv types of the v2 header
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+	//aws network load balancers put the vpc endpoint id here
+	ProxyTLVAWS byte = 0xea
+)
+
+var ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+// ProxyConfig lists the load balancers of a listener, only they may send a PROXY header and
+// they have to send one. The other peers are taken as they are.
+type ProxyConfig struct {
+	Trusted []*net.IPNet
+	//DefaultProxyHeaderTimeout when zero
+	HeaderTimeout time.Duration
+}
+
+// ProxyHeader is what the load balancer said about a connection
+type ProxyHeader struct {
+	//1 for the text header, 2 for the binary one
+	Version int
+	//the client and the address it connected to, nil for a health check, a LOCAL command or
+	//an UNKNOWN or unix family: the connection keeps its socket addresses then
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyTLV
+}
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV is the value of the first tlv of type t
+func (h *ProxyHeader) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Proxy reads the PROXY headers of one listener, a nil one reads none
+type Proxy struct {
+	ctx      context.Context
+	protocol string
+	config   *ProxyConfig
+}
+
+func NewProxy(ctx context.Context, protocol string, config *ProxyConfig) *Proxy {
+	p := &Proxy{}
+	p.ctx = ctx
+	p.protocol = protocol
+	p.config = config
+	if p.config.HeaderTimeout <= 0 {
+		p.config.HeaderTimeout = DefaultProxyHeaderTimeout
+	}
+	return p
+}
+
+// Trusted is true when addr may send a PROXY header
+func (p *Proxy) Trusted(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if p == nil || ip == nil {
+		return false
+	}
+	for _, n := range p.config.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener reads the header of every trusted connection before Accept returns it, so whatever
+// wraps the listener sees the client address. Headers are read aside, a slow peer holds no one else.
+func (p *Proxy) Listener(l net.Listener) net.Listener {
+	if p == nil {
+		return l
+	}
+	pl := &proxyListener{Listener: l, proxy: p}
+	pl.accepted = make(chan acceptResult)
+	pl.done = make(chan struct{})
+	task.SubmitTask0(p.ctx, pl.accept)
+	return pl
+}
+
+// ProxyHeaderOf is the header conn came with, nil when it has none
+func ProxyHeaderOf(conn net.Conn) *ProxyHeader {
+	if c, ok := conn.(interface{ ProxyHeader() *ProxyHeader }); ok {
+		return c.ProxyHeader()
+	}
+	return nil
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+type proxyListener struct {
+	net.Listener
+	proxy    *Proxy
+	accepted chan acceptResult
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (l *proxyListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !l.deliver(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !l.proxy.Trusted(conn.RemoteAddr()) {
+			if !l.deliver(acceptResult{conn: conn}) {
+				_ = conn.Close()
+			}
+			continue
+		}
+		task.SubmitTask0(l.proxy.ctx, func() {
+			pc, err := l.proxy.readHeader(conn)
+			if err != nil {
+				metrics.HandshakeFailures.With(l.proxy.protocol, "proxy_header").Inc()
+				log.Warnf(l.proxy.ctx, "%s close %s: %+v", l.proxy.protocol, conn.RemoteAddr(), err)
+				_ = conn.Close()
+				return
+			}
+			if !l.deliver(acceptResult{conn: pc}) {
+				_ = pc.Close()
+			}
+		})
+	}
+}
+
+// deliver hands r to Accept, false once the listener is closed
+func (l *proxyListener) deliver(r acceptResult) bool {
+	select {
+	case l.accepted <- r:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// proxyConn reports the addresses of the header, the bytes read past it are kept in r
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *ProxyHeader
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		return c.Conn.Read(p)
+	}
+	n, err := c.r.Read(p)
+	if c.r.Buffered() == 0 {
+		c.r = nil
+	}
+	return n, err
+}
+
+func (c *proxyConn) writeConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyConn) ProxyHeader() *ProxyHeader {
+	return c.header
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readHeader reads the v1 or v2 header conn has to start with
+func (p *Proxy) readHeader(conn net.Conn) (*proxyConn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(p.config.HeaderTimeout))
+	r := bufio.NewReader(conn)
+	header, err := ReadProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	pc := &proxyConn{Conn: conn, r: r, header: header}
+	if r.Buffered() == 0 {
+		pc.r = nil
+	}
+	return pc, nil
+}
+
+// ReadProxyHeader reads a v1 or v2 header off r
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	//the shortest headers, "PROXY UNKNOWN\r\n" and a bare v2 one, are longer than the signature
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("%w: no header", ErrProxyHeader)
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLen {
+			return nil, fmt.Errorf("%w: v1 line over %d bytes", ErrProxyHeader, proxyV1MaxLen)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 line without crlf", ErrProxyHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("%w: v1 line %q", ErrProxyHeader, line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := parseProxyPort(fields[4])
+	dstPort, err2 := parseProxyPort(fields[5])
+	if src == nil || dst == nil || err1 != nil || err2 != nil || (src.To4() != nil) != (fields[1] == "TCP4") || (dst.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: v1 line %q", ErrProxyHeader, line)
+	}
+	header.Source = &net.TCPAddr{IP: src, Port: srcPort}
+	header.Destination = &net.TCPAddr{IP: dst, Port: dstPort}
+	return header, nil
+}
+
+func parseProxyPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 || s[0] == '+' || s[0] == '-' {
+		return 0, fmt.Errorf("port %q", s)
+	}
+	return port, nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	buf := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 version %d", ErrProxyHeader, buf[12]>>4)
+	}
+	command := buf[12] & 0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("%w: v2 command %d", ErrProxyHeader, command)
+	}
+	family := buf[13] >> 4
+	length := int(binary.BigEndian.Uint16(buf[14:16]))
+	buf = append(buf, make([]byte, length)...)
+	if _, err := io.ReadFull(r, buf[proxyV2HeaderLen:]); err != nil {
+		return nil, err
+	}
+	body := buf[proxyV2HeaderLen:]
+	header := &ProxyHeader{Version: 2}
+	var addrLen int
+	switch family {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	case 0x0:
+	default:
+		return nil, fmt.Errorf("%w: v2 family %d", ErrProxyHeader, family)
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("%w: v2 address block of %d bytes", ErrProxyHeader, len(body))
+	}
+	//a LOCAL command is the balancer itself, a health check most of the time
+	if command == 1 && (family == 0x1 || family == 0x2) {
+		ipLen := (addrLen - 4) / 2
+		ports := body[2*ipLen:]
+		header.Source = &net.TCPAddr{IP: net.IP(append([]byte(nil), body[:ipLen]...)), Port: int(binary.BigEndian.Uint16(ports))}
+		header.Destination = &net.TCPAddr{IP: net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	}
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 || len(tlvs) < 3+int(binary.BigEndian.Uint16(tlvs[1:3])) {
+			return nil, fmt.Errorf("%w: truncated v2 tlv", ErrProxyHeader)
+		}
+		n := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		header.TLVs = append(header.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3:n]})
+		if tlvs[0] == ProxyTLVCRC32C {
+			if err := checkProxyCRC(buf, len(buf)-len(tlvs)+3, tlvs[3:n]); err != nil {
+				return nil, err
+			}
+		}
+		tlvs = tlvs[n:]
+	}
+	return header, nil
+}
+
+// checkProxyCRC checks the crc32c of the whole header, computed with the checksum at off zeroed
+func checkProxyCRC(header []byte, off int, sum []byte) error {
+	if len(sum) != 4 {
+		return fmt.Errorf("%w: crc32c of %d bytes", ErrProxyHeader, len(sum))
+	}
+	want := binary.BigEndian.Uint32(sum)
+	zeroed := append([]byte(nil), header...)
+	copy(zeroed[off:off+4], make([]byte, 4))
+	if got := crc32.Checksum(zeroed, castagnoli); got != want {
+		return fmt.Errorf("%w: crc32c %08x, expect %08x", ErrProxyHeader, got, want)
+	}
+	return nil
+}
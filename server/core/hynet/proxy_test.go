@@ -0,0 +1,204 @@
+package hynet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/Opafanls/hylan/server/task"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header, a crc32c tlv is filled in when crc is set
+func proxyV2(command, family byte, addrs []byte, crc bool, tlvs ...ProxyTLV) []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, 0x20|command, family<<4|1, 0, 0)
+	b = append(b, addrs...)
+	for _, tlv := range tlvs {
+		b = append(b, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		b = append(b, tlv.Value...)
+	}
+	off := len(b) + 3
+	if crc {
+		b = append(b, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(b)-proxyV2HeaderLen))
+	if crc {
+		binary.BigEndian.PutUint32(b[off:], crc32.Checksum(b, castagnoli))
+	}
+	return b
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x13, 0x88, 0x07, 0x8f}
+	inet6 := make([]byte, 36)
+	copy(inet6, net.ParseIP("2001:db8::1"))
+	copy(inet6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(inet6[32:], 5000)
+	binary.BigEndian.PutUint16(inet6[34:], 1935)
+	badCRC := proxyV2(1, 1, inet, true)
+	badCRC[len(badCRC)-1]++
+	//one byte of a tlv inside the header length
+	badTLV := append(proxyV2(1, 1, inet, false), ProxyTLVNoop)
+	badTLV[15]++
+
+	for name, c := range map[string]struct {
+		header string
+		source string
+		err    bool
+	}{
+		"v1 tcp4":        {"PROXY TCP4 192.0.2.1 198.51.100.7 5000 1935\r\n", "192.0.2.1:5000", false},
+		"v1 tcp6":        {"PROXY TCP6 2001:db8::1 2001:db8::2 5000 1935\r\n", "[2001:db8::1]:5000", false},
+		"v1 unknown":     {"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		"v1 family":      {"PROXY TCP4 2001:db8::1 198.51.100.7 5000 1935\r\n", "", true},
+		"v1 port":        {"PROXY TCP4 192.0.2.1 198.51.100.7 -1 1935\r\n", "", true},
+		"v1 crlf":        {"PROXY TCP4 192.0.2.1 198.51.100.7 5000 1935\n", "", true},
+		"v1 long":        {"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+		"v2 inet":        {string(proxyV2(1, 1, inet, true, ProxyTLV{ProxyTLVAWS, []byte("vpce-1")})), "192.0.2.1:5000", false},
+		"v2 inet6":       {string(proxyV2(1, 2, inet6, false)), "[2001:db8::1]:5000", false},
+		"v2 local":       {string(proxyV2(0, 1, inet, false)), "", false},
+		"v2 crc":         {string(badCRC), "", true},
+		"v2 short":       {string(proxyV2(1, 1, inet[:8], false)), "", true},
+		"v2 command":     {string(proxyV2(2, 1, inet, false)), "", true},
+		"v2 tlv":         {string(badTLV), "", true},
+		"no header":      {"GET / HTTP/1.1\r\n\r\n", "", true},
+		"short v1 start": {"PROXY", "", true},
+	} {
+		r := bufio.NewReader(strings.NewReader(c.header + "rest"))
+		header, err := ReadProxyHeader(r)
+		if c.err != (err != nil) {
+			t.Errorf("%s: expect error %v, got %v", name, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if source := header.Source; c.source == "" && source != nil || c.source != "" && (source == nil || source.String() != c.source) {
+			t.Errorf("%s: expect source %q, got %v", name, c.source, source)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("%s: expect the bytes after the header, got %q", name, rest)
+		}
+	}
+	header, _ := ReadProxyHeader(bufio.NewReader(bytes.NewReader(proxyV2(1, 1, inet, true, ProxyTLV{ProxyTLVAWS, []byte("vpce-1")}))))
+	if v, ok := header.TLV(ProxyTLVAWS); !ok || string(v) != "vpce-1" || len(header.TLVs) != 2 {
+		t.Fatalf("expect the tlvs, got %+v", header.TLVs)
+	}
+}
+
+type connHandlerFunc func(conn IHyConn)
+
+func (f connHandlerFunc) HandleConn(conn IHyConn) {
+	f(conn)
+}
+
+func TestProxyServer(t *testing.T) {
+	task.InitTaskSystem()
+	ctx := context.Background()
+	server := NewTcpServer(ctx, "127.0.0.1", 19110)
+	server.Proxy = NewProxy(ctx, "test", &ProxyConfig{Trusted: cidrs(t, "127.0.0.1"), HeaderTimeout: 300 * time.Millisecond})
+	server.Access = newTestAccess(t, &AccessConfig{Deny: cidrs(t, "192.0.2.66")})
+	accepted := make(chan IHyConn, 4)
+	server.ConnHandler = connHandlerFunc(func(conn IHyConn) {
+		accepted <- conn
+	})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	dial := func(header string) net.Conn {
+		conn, err := net.Dial("tcp", "127.0.0.1:19110")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		if header != "" {
+			_, _ = conn.Write([]byte(header))
+		}
+		return conn
+	}
+	next := func() IHyConn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(2 * time.Second):
+			t.Fatal("expect a connection")
+		}
+		return nil
+	}
+
+	//a trusted peer stuck in its header holds no one else
+	slow := dial("PROXY TCP4 192.0.2")
+	dial("PROXY TCP4 192.0.2.1 198.51.100.7 5000 1935\r\nhello")
+	conn := next()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expect the data after the header, got %q %v", buf, err)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.1:5000" || conn.ProxyHeader() == nil || conn.ProxyHeader().Version != 1 {
+		t.Fatalf("expect the client address, got %v", conn.RemoteAddr())
+	}
+	_ = conn.Close()
+	_ = slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var netErr net.Error
+	if _, err := slow.Read(buf); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("expect the slow header to be closed, got %v", err)
+	}
+
+	//access sees the client behind the balancer
+	denied := dial("PROXY TCP4 192.0.2.66 198.51.100.7 5000 1935\r\n")
+	_ = denied.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := denied.Read(buf); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("expect the denied client to be closed, got %v", err)
+	}
+	select {
+	case conn = <-accepted:
+		t.Fatalf("expect nothing of the denied client, got %v", conn.RemoteAddr())
+	default:
+	}
+}
+
+func TestProxyUntrusted(t *testing.T) {
+	task.InitTaskSystem()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(context.Background(), "test", &ProxyConfig{Trusted: cidrs(t, "10.0.0.0/8")})
+	ln = proxy.Listener(ln)
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	header := "PROXY TCP4 192.0.2.1 198.51.100.7 5000 1935\r\n"
+	_, _ = client.Write([]byte(header))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ProxyHeaderOf(conn) != nil || conn.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("expect an untrusted peer to be taken as it is, got %v", conn.RemoteAddr())
+	}
+	buf := make([]byte, len(header))
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != header {
+		t.Fatalf("expect the header to be left to the protocol, got %q %v", buf, err)
+	}
+	_ = ln.Close()
+	if _, err = ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect a closed listener, got %v", err)
+	}
+}
@@ -2,9 +2,12 @@ package hynet
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/Opafanls/hylan/server/log"
 	"github.com/Opafanls/hylan/server/task"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type ListenServer interface {
@@ -13,6 +16,17 @@ type ListenServer interface {
 	Close()
 }
 
+// Acceptor stops taking connections while the accepted ones go on, a listener without it can only Close
+type Acceptor interface {
+	StopAccept()
+}
+
+// Drainer knows when the connections a stopped Acceptor let go on are gone, it can be closed then
+type Drainer interface {
+	Acceptor
+	Drained() bool
+}
+
 type TcpListenServer interface {
 	ListenServer
 	ConnHandler
@@ -31,6 +45,9 @@ type DataHandler interface {
 	HandleData(data []byte)
 }
 
+// DefaultConnChanSize is the accept queue of a TcpServer that does not set its own
+var DefaultConnChanSize = 1024
+
 type TcpServer struct {
 	ctx  context.Context
 	ip   string
@@ -43,8 +60,17 @@ type TcpServer struct {
 	connChanSize int
 
 	ConnHandler ConnHandler
+	//TLSConfig makes the listener a tls one
+	TLSConfig *tls.Config
+	//Access closes the rejected connections before the tls handshake, everyone is let in when nil
+	Access *Access
+	//Proxy reads the PROXY header of the trusted load balancers before Access sees the connection
+	Proxy *Proxy
 
 	stop chan struct{}
+	once sync.Once
+	//the accepted connections not closed yet
+	tracker Tracker
 }
 
 func NewTcpServer(ctx context.Context, ip string, port int) *TcpServer {
@@ -64,9 +90,12 @@ func (tcpServer *TcpServer) Start() error {
 	if err != nil {
 		return err
 	}
+	listener = tcpServer.Proxy.Listener(listener)
+	listener = tcpServer.Access.Listener(listener)
+	listener = tcpServer.tracker.Listener(listener)
 	tcpServer.listener = listener
 	task.SubmitTask0(tcpServer.ctx, func() {
-		log.Infof(context.Background(), "listen rtmp server@%s:%d", tcpServer.ip, tcpServer.port)
+		log.Infof(tcpServer.ctx, "listen tcp server@%s:%d", tcpServer.ip, tcpServer.port)
 		tcpServer.Accept()
 	})
 	return nil
@@ -75,19 +104,30 @@ func (tcpServer *TcpServer) Start() error {
 func (tcpServer *TcpServer) Init() error {
 	tcpServer.running = true
 	if tcpServer.connChanSize == 0 {
-		tcpServer.connChanSize = 1024
+		tcpServer.connChanSize = DefaultConnChanSize
 	}
 	tcpServer.conn = make(chan IHyConn, tcpServer.connChanSize)
+	tcpServer.stop = make(chan struct{})
 	return nil
 }
 
 func (tcpServer *TcpServer) Accept() {
-	for tcpServer.running {
+	for {
 		conn, err := tcpServer.listener.Accept()
 		if err != nil {
+			select {
+			case <-tcpServer.stop:
+				return
+			default:
+			}
 			continue
 		}
-		tcpServer.ConnHandler.HandleConn(NewHyConn(conn))
+		header := ProxyHeaderOf(conn)
+		if tcpServer.TLSConfig != nil {
+			//the tls handshake runs on the first read, in the handler
+			conn = tls.Server(conn, tcpServer.TLSConfig)
+		}
+		tcpServer.ConnHandler.HandleConn(newHyConn(conn, header))
 	}
 }
 
@@ -95,19 +135,52 @@ func (tcpServer *TcpServer) Listener() net.Listener {
 	return tcpServer.listener
 }
 
+// StopAccept closes the listener only, the handlers own the accepted connections
+func (tcpServer *TcpServer) StopAccept() {
+	tcpServer.Close()
+}
+
+// Drained is true once every accepted connection is closed
+func (tcpServer *TcpServer) Drained() bool {
+	return tcpServer.tracker.Active() == 0
+}
+
 func (tcpServer *TcpServer) Close() {
-	tcpServer.stop <- struct{}{}
+	tcpServer.once.Do(func() {
+		tcpServer.running = false
+		//nil when the server was never initialized
+		if tcpServer.stop != nil {
+			close(tcpServer.stop)
+		}
+		if tcpServer.listener != nil {
+			_ = tcpServer.listener.Close()
+		}
+	})
 }
 
+// UdpServer reads datagrams and hands them to the DataHandler, a multicast ip joins the group
 type UdpServer struct {
+	ctx  context.Context
 	ip   string
 	port int
+	//interface of the multicast group, the system default when empty
+	Interface string
+	//socket receive buffer, ts bitrates overflow the default one
+	ReadBufferSize int
 
 	udpConn *net.UDPConn
-	running bool
+	stop    chan struct{}
+	once    sync.Once
 
-	dataChan     chan []byte
-	dataChanSize int
+	DataHandler DataHandler
+}
+
+func NewUdpServer(ctx context.Context, ip string, port int) *UdpServer {
+	s := &UdpServer{}
+	s.ctx = ctx
+	s.ip = ip
+	s.port = port
+	return s
 }
 
 func (u *UdpServer) Start() error {
@@ -115,29 +188,115 @@ func (u *UdpServer) Start() error {
 		Port: u.port,
 		IP:   net.ParseIP(u.ip),
 	}
-	udpConn, err := net.ListenUDP("udp", &addr) // code does not block here
+	var udpConn *net.UDPConn
+	var err error
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if u.Interface != "" {
+			if ifi, err = net.InterfaceByName(u.Interface); err != nil {
+				return err
+			}
+		}
+		udpConn, err = net.ListenMulticastUDP("udp", ifi, &addr)
+	} else {
+		udpConn, err = net.ListenUDP("udp", &addr)
+	}
 	if err != nil {
 		return err
 	}
+	if u.ReadBufferSize > 0 {
+		_ = udpConn.SetReadBuffer(u.ReadBufferSize)
+	}
 	u.udpConn = udpConn
+	task.SubmitTask0(u.ctx, func() {
+		log.Infof(u.ctx, "listen udp server@%s:%d", u.ip, u.port)
+		u.read()
+	})
 	return nil
 }
 
 func (u *UdpServer) Init() error {
-	u.running = true
-	if u.dataChanSize == 0 {
-		u.dataChanSize = 1024
-	}
-	u.dataChan = make(chan []byte, u.dataChanSize)
+	u.stop = make(chan struct{})
 	return nil
 }
 
-func (u *UdpServer) HandleData(data []byte) {
-	for u.running {
-		select {
-		case u.dataChan <- data:
-		default:
+// read passes every datagram to the handler, the data is only valid during the call
+func (u *UdpServer) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := u.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-u.stop:
+			default:
+				log.Errorf(u.ctx, "udp server@%s:%d read failed: %+v", u.ip, u.port, err)
+			}
+			return
+		}
+		u.DataHandler.HandleData(buf[:n])
+	}
+}
+
+func (u *UdpServer) LocalAddr() net.Addr {
+	return u.udpConn.LocalAddr()
+}
 
+func (u *UdpServer) Close() {
+	u.once.Do(func() {
+		if u.stop != nil {
+			close(u.stop)
 		}
+		if u.udpConn != nil {
+			_ = u.udpConn.Close()
+		}
+	})
+}
+
+// Tracker counts the connections of its listeners that are not closed yet, the zero value is ready
+type Tracker struct {
+	active int64
+}
+
+func (t *Tracker) Listener(l net.Listener) net.Listener {
+	return &trackedListener{Listener: l, tracker: t}
+}
+
+func (t *Tracker) Active() int {
+	return int(atomic.LoadInt64(&t.active))
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker *Tracker
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
 	}
+	atomic.AddInt64(&l.tracker.active, 1)
+	return &trackedConn{Conn: conn, tracker: l.tracker}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *Tracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		atomic.AddInt64(&c.tracker.active, -1)
+	})
+	return err
+}
+
+func (c *trackedConn) ProxyHeader() *ProxyHeader {
+	return ProxyHeaderOf(c.Conn)
+}
+
+func (c *trackedConn) writeConn() net.Conn {
+	return c.Conn
 }
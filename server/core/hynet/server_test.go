@@ -0,0 +1,56 @@
+package hynet
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/task"
+	"net"
+	"testing"
+	"time"
+)
+
+type chanHandler chan IHyConn
+
+func (h chanHandler) HandleConn(conn IHyConn) {
+	h <- conn
+}
+
+func TestTcpServerDrained(t *testing.T) {
+	task.InitTaskSystem()
+	handler := make(chanHandler, 1)
+	server := NewTcpServer(context.Background(), "127.0.0.1", 18095)
+	server.ConnHandler = handler
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.Dial("tcp", "127.0.0.1:18095")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var conn IHyConn
+	select {
+	case conn = <-handler:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not handed out")
+	}
+
+	server.StopAccept()
+	if server.Drained() {
+		t.Fatal("drained with a connection open")
+	}
+	if _, err = conn.Write([]byte("still served")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+	if !server.Drained() {
+		t.Fatalf("not drained after the close, %d connections left", server.tracker.Active())
+	}
+	if _, err = net.DialTimeout("tcp", "127.0.0.1:18095", time.Second); err == nil {
+		t.Fatal("connected after the listener stopped accepting")
+	}
+}
@@ -1,21 +1,30 @@
 package pb
 
-import "github.com/aler9/gortsplib/pkg/ringbuffer"
+import (
+	"github.com/aler9/gortsplib/pkg/ringbuffer"
+	"sync/atomic"
+)
 
 type CacheRing interface {
 	Close()
 	Pull() (interface{}, bool)
-	Push(interface{})
+	//Push returns false when the ring was full and the oldest unread item got overwritten
+	Push(interface{}) bool
 	Reset()
 }
 
 type Ring0 struct {
 	ringBuffer *ringbuffer.RingBuffer
+	size       uint64
+	//pushed and consumed track the unread items, a dropped item counts as consumed
+	pushed   uint64
+	consumed uint64
 }
 
 func NewRing0(size uint64) *Ring0 {
 	ring := &Ring0{}
 	ring.ringBuffer = ringbuffer.New(size)
+	ring.size = size
 
 	return ring
 }
@@ -25,13 +34,27 @@ func (r *Ring0) Close() {
 }
 
 func (r *Ring0) Pull() (interface{}, bool) {
-	return r.ringBuffer.Pull()
+	data, ok := r.ringBuffer.Pull()
+	if ok {
+		atomic.AddUint64(&r.consumed, 1)
+	}
+	return data, ok
 }
 
-func (r *Ring0) Push(data interface{}) {
+func (r *Ring0) Push(data interface{}) bool {
+	kept := true
+	//signed, a racing Pull may briefly make consumed overtake pushed
+	if int64(atomic.LoadUint64(&r.pushed)-atomic.LoadUint64(&r.consumed)) >= int64(r.size) {
+		atomic.AddUint64(&r.consumed, 1)
+		kept = false
+	}
+	atomic.AddUint64(&r.pushed, 1)
 	r.ringBuffer.Push(data)
+	return kept
 }
 
 func (r *Ring0) Reset() {
 	r.ringBuffer.Reset()
+	atomic.StoreUint64(&r.pushed, 0)
+	atomic.StoreUint64(&r.consumed, 0)
 }
@@ -12,7 +12,8 @@ func TestRing0(t *testing.T) {
 		data, exist := ring.Pull()
 
 		if !exist {
-			t.Fatal("should exist")
+			t.Error("should exist")
+			return
 		}
 
 		t.Logf("%s", data)
@@ -20,7 +21,8 @@ func TestRing0(t *testing.T) {
 		data, exist = ring.Pull()
 
 		if exist {
-			t.Fatal("should not exist")
+			t.Error("should not exist")
+			return
 		}
 
 		t.Logf("%s", data)
@@ -29,3 +31,21 @@ func TestRing0(t *testing.T) {
 	ring.Push("2")
 	time.Sleep(time.Second)
 }
+
+func TestRing0Drop(t *testing.T) {
+	ring := NewRing0(4)
+	for i := 0; i < 4; i++ {
+		if !ring.Push(i) {
+			t.Fatalf("unexpected drop of %d", i)
+		}
+	}
+	if ring.Push(4) {
+		t.Fatal("expect the full ring to drop")
+	}
+	if _, ok := ring.Pull(); !ok {
+		t.Fatal("expect data")
+	}
+	if !ring.Push(5) {
+		t.Fatal("expect room after a pull")
+	}
+}
@@ -0,0 +1,114 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/protocol/srt"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/vhost"
+	"strings"
+	"sync"
+)
+
+// Forwarder pushes the streams published on a vhost with forward targets to the remote srt listeners,
+// a push retries until its stream ends
+type Forwarder struct {
+	ctx context.Context
+
+	mu      sync.Mutex
+	running bool
+	callers map[*stream.HyStream][]*srt.Caller
+	cancel  []func()
+}
+
+func NewForwarder() *Forwarder {
+	f := &Forwarder{}
+	return f
+}
+
+func (f *Forwarder) Init() error {
+	f.ctx = log.GetCtxWithLogID(context.Background(), "FORWARDER")
+	f.callers = make(map[*stream.HyStream][]*srt.Caller)
+	return nil
+}
+
+func (f *Forwarder) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running = true
+	f.cancel = []func(){
+		stream.DefaultHyStreamManager.OnAdd(f.onStream),
+		stream.DefaultHyStreamManager.OnRemove(f.onRemove),
+	}
+	return nil
+}
+
+// Close ends every push
+func (f *Forwarder) Close() {
+	f.mu.Lock()
+	f.running = false
+	for _, cancel := range f.cancel {
+		cancel()
+	}
+	f.cancel = nil
+	callers := f.callers
+	f.callers = make(map[*stream.HyStream][]*srt.Caller)
+	f.mu.Unlock()
+	for _, list := range callers {
+		for _, caller := range list {
+			caller.Close()
+		}
+	}
+}
+
+func (f *Forwarder) onStream(hyStream *stream.HyStream) {
+	u := hyStream.Base().URL()
+	targets := vhost.Match(u).Forward
+	if len(targets) == 0 {
+		return
+	}
+	sid := fmt.Sprintf("#!::r=%s,m=publish", strings.Trim(u.Path, "/"))
+	var callers []*srt.Caller
+	for _, target := range targets {
+		caller := srt.NewCaller(&srt.CallerConfig{
+			Addr:       target.Addr,
+			StreamID:   sid,
+			StreamURL:  u.String(),
+			Push:       true,
+			Latency:    target.Latency,
+			Passphrase: target.Passphrase,
+			PbKeyLen:   target.PbKeyLen,
+		})
+		if err := caller.Init(); err != nil {
+			log.Errorf(f.ctx, "forward %s to %s: %+v", hyStream.Base().ID(), target.Addr, err)
+			continue
+		}
+		log.Infof(f.ctx, "forward %s to %s", hyStream.Base().ID(), target.Addr)
+		callers = append(callers, caller)
+	}
+	f.mu.Lock()
+	if !f.running {
+		f.mu.Unlock()
+		return
+	}
+	f.callers[hyStream] = callers
+	f.mu.Unlock()
+	for _, caller := range callers {
+		_ = caller.Start()
+	}
+	//the stream may have ended before its pushes were registered
+	if current, exist := stream.DefaultHyStreamManager.GetStream(hyStream.Base().ID()); !exist || current != hyStream {
+		f.onRemove(hyStream)
+	}
+}
+
+func (f *Forwarder) onRemove(hyStream *stream.HyStream) {
+	f.mu.Lock()
+	callers := f.callers[hyStream]
+	delete(f.callers, hyStream)
+	f.mu.Unlock()
+	for _, caller := range callers {
+		caller.Close()
+	}
+}
@@ -0,0 +1,64 @@
+package forward
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/protocol/srt"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestForward(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	vhost.SetTable(vhost.NewTable(nil, &vhost.Vhost{Name: "a", Domains: []string{"a.example.com"}, Enabled: true,
+		Forward: []vhost.Forward{{Addr: "127.0.0.1:19081"}}}))
+	defer vhost.SetTable(nil)
+	//the remote listener is local, the pushed stream lands on the default vhost
+	server := srt.NewServer(&srt.ListenConfig{Addr: "127.0.0.1", Port: 19081})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	f := NewForwarder()
+	if err := f.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	source := session.NewSourceSession(context.Background(), nil)
+	hyStream := stream.NewHyStream0(&url.URL{Host: "a.example.com", Path: "/live/x"}, source)
+	if err := stream.DefaultHyStreamManager.AddStream(hyStream); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, exist := stream.DefaultHyStreamManager.GetStream("PAD:/live/x"); exist {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect the stream to be pushed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	//the push ends with the stream
+	stream.DefaultHyStreamManager.RemoveStreamIfMatch(hyStream)
+	source.Close()
+	f.mu.Lock()
+	pushes := len(f.callers)
+	f.mu.Unlock()
+	if pushes != 0 {
+		t.Fatalf("expect no push left, got %d", pushes)
+	}
+}
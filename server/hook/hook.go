@@ -0,0 +1,320 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/auth"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// events, on_publish and on_play wait for the answer and can deny, the others are sent in the background
+const (
+	OnConnect    = "on_connect"
+	OnPublish    = "on_publish"
+	OnUnpublish  = "on_unpublish"
+	OnPlay       = "on_play"
+	OnStop       = "on_stop"
+	OnRecordDone = "on_record_done"
+	OnHlsSegment = "on_hls_segment"
+)
+
+const (
+	DefaultTimeout       = 3 * time.Second
+	DefaultRetryInterval = time.Second
+	//answers past it are not read, a deny fits in much less
+	maxAnswerSize = 64 * 1024
+	//approved publishes whose stream never showed up are forgotten after it
+	publishedTTL = time.Minute
+)
+
+var ErrDenied = errors.New("denied by hook")
+
+type Config struct {
+	//callback urls by event name, every url gets the event
+	URLs map[string][]string
+	//each request, DefaultTimeout when zero
+	Timeout time.Duration
+	//background events are sent again this many times after a failure, RetryInterval times the attempt apart
+	Retries       int
+	RetryInterval time.Duration
+}
+
+// Event is the json body posted to the callbacks
+type Event struct {
+	Event     string            `json:"event"`
+	StreamID  string            `json:"stream_id,omitempty"`
+	SessionID string            `json:"session_id,omitempty"`
+	Protocol  string            `json:"protocol,omitempty"`
+	ClientIP  string            `json:"client_ip,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	//tcUrl of on_connect
+	URL string `json:"url,omitempty"`
+	//recording of on_record_done or segment of on_hls_segment
+	File string `json:"file,omitempty"`
+	//unix milliseconds of the event, a retry keeps it
+	Time int64 `json:"time"`
+
+	//picks the vhost callbacks
+	u *url.URL
+}
+
+// answer is what a callback may reply to on_publish and on_play, a 2xx without body admits
+type answer struct {
+	Deny   bool   `json:"deny"`
+	Reason string `json:"reason"`
+}
+
+// Hooks posts the events to the callbacks of the vhost of the stream, else to the server ones
+type Hooks struct {
+	ctx    context.Context
+	config atomic.Value
+	client *http.Client
+
+	mu      sync.Mutex
+	running bool
+	cancel  func()
+	stop    context.CancelFunc
+	//events of the approved publishes by source session id, their removal sends on_unpublish
+	published map[string]*published
+}
+
+type published struct {
+	event *Event
+	at    time.Time
+}
+
+var current atomic.Value
+
+func NewHooks(config *Config) *Hooks {
+	h := &Hooks{}
+	h.SetConfig(config)
+	return h
+}
+
+// SetConfig applies to the events from now on, the retries being waited for keep their config
+func (h *Hooks) SetConfig(config *Config) {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+	h.config.Store(config)
+}
+
+func (h *Hooks) Init() error {
+	h.ctx = log.GetCtxWithLogID(context.Background(), "HOOKS")
+	h.client = &http.Client{}
+	h.published = make(map[string]*published)
+	return nil
+}
+
+func (h *Hooks) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = true
+	h.cancel = stream.DefaultHyStreamManager.OnRemove(h.onRemove)
+	var ctx context.Context
+	ctx, h.stop = context.WithCancel(h.ctx)
+	task.Every(ctx, publishedTTL, h.forget)
+	current.Store(h)
+	return nil
+}
+
+// Close stops sending events, the background ones already submitted still go out
+func (h *Hooks) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.running {
+		return
+	}
+	h.running = false
+	h.cancel()
+	h.stop()
+	if cur, _ := current.Load().(*Hooks); cur == h {
+		current.Store((*Hooks)(nil))
+	}
+}
+
+// NewEvent is an event of the stream of u, clientAddr is host:port or empty for the server itself
+func NewEvent(name string, u *url.URL, sessionID, protocol, clientAddr string) *Event {
+	ev := &Event{Event: name, SessionID: sessionID, Protocol: protocol, ClientIP: auth.ClientIP(clientAddr), Time: time.Now().UnixMilli()}
+	ev.u = u
+	if u != nil {
+		b := base.NewBase0(u)
+		ev.StreamID = b.ID()
+		ev.Params = b.Params()
+	}
+	return ev
+}
+
+// Publish asks the callbacks to admit a publisher, the publish ends when it returns an error. An approved
+// publish gets on_unpublish once its stream is removed, ev.SessionID has to be the id of its source session.
+func Publish(ctx context.Context, ev *Event) error {
+	h, _ := current.Load().(*Hooks)
+	if h == nil {
+		return nil
+	}
+	ev.Event = OnPublish
+	if err := h.call(ctx, ev); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.published[ev.SessionID] = &published{event: ev, at: time.Now()}
+	h.mu.Unlock()
+	return nil
+}
+
+// Play asks the callbacks to admit a player, stop sends on_stop the first time it is called
+func Play(ctx context.Context, ev *Event) (stop func(), err error) {
+	h, _ := current.Load().(*Hooks)
+	if h == nil {
+		return func() {}, nil
+	}
+	ev.Event = OnPlay
+	if err = h.call(ctx, ev); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.notify(ev.with(OnStop))
+		})
+	}, nil
+}
+
+// Notify sends ev in the background, a failed request is retried
+func Notify(ev *Event) {
+	if h, _ := current.Load().(*Hooks); h != nil {
+		h.notify(ev)
+	}
+}
+
+func (h *Hooks) onRemove(hyStream *stream.HyStream) {
+	id := hyStream.Source().ID()
+	h.mu.Lock()
+	p, ok := h.published[id]
+	delete(h.published, id)
+	h.mu.Unlock()
+	if ok {
+		h.notify(p.event.with(OnUnpublish))
+	}
+}
+
+// forget drops the approvals whose publish failed after on_publish, there is no stream to remove for them
+func (h *Hooks) forget() {
+	live := make(map[string]bool)
+	for _, hyStream := range stream.DefaultHyStreamManager.Streams() {
+		live[hyStream.Source().ID()] = true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, p := range h.published {
+		if !live[id] && time.Since(p.at) > publishedTTL {
+			delete(h.published, id)
+		}
+	}
+}
+
+// call posts ev to every callback and waits, any of them failing or denying denies
+func (h *Hooks) call(ctx context.Context, ev *Event) error {
+	config := h.config.Load().(*Config)
+	for _, target := range h.urls(config, ev) {
+		a, err := h.post(ctx, config, target, ev)
+		if err != nil {
+			//nobody approved, the publish or play is refused
+			return fmt.Errorf("%w: %s %s: %v", ErrDenied, ev.Event, target, err)
+		}
+		if a.Deny {
+			return fmt.Errorf("%w: %s %s: %s", ErrDenied, ev.Event, target, a.Reason)
+		}
+	}
+	return nil
+}
+
+// notify posts ev to every callback in the background
+func (h *Hooks) notify(ev *Event) {
+	config := h.config.Load().(*Config)
+	for _, target := range h.urls(config, ev) {
+		h.send(config, target, ev, 0)
+	}
+}
+
+// send posts ev to target in the background, attempt counts the tries so far
+func (h *Hooks) send(config *Config, target string, ev *Event, attempt int) {
+	task.SubmitTask0(h.ctx, func() {
+		_, err := h.post(h.ctx, config, target, ev)
+		if err == nil {
+			return
+		}
+		if attempt >= config.Retries {
+			log.Warnf(h.ctx, "%s %s for %s failed after %d tries: %v", ev.Event, target, ev.StreamID, attempt+1, err)
+			return
+		}
+		task.After(h.ctx, config.RetryInterval*time.Duration(attempt+1), func() {
+			h.send(config, target, ev, attempt+1)
+		})
+	})
+}
+
+func (h *Hooks) urls(config *Config, ev *Event) []string {
+	if ev.u != nil {
+		if urls, ok := vhost.Match(ev.u).Hooks[ev.Event]; ok {
+			return urls
+		}
+	}
+	return config.URLs[ev.Event]
+}
+
+func (h *Hooks) post(ctx context.Context, config *Config, target string, ev *Event) (*answer, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAnswerSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	a := &answer{}
+	if len(bytes.TrimSpace(data)) > 0 && json.Unmarshal(data, a) != nil {
+		//a body that isn't json is no deny
+		a = &answer{}
+	}
+	return a, nil
+}
+
+// with is a copy of ev for another event of the same session
+func (ev *Event) with(name string) *Event {
+	next := *ev
+	next.Event = name
+	next.Time = time.Now().UnixMilli()
+	return &next
+}
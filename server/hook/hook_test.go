@@ -0,0 +1,198 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mock records the events it gets and answers with the reply of the event
+type mock struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []*Event
+	reply  map[string]func(w http.ResponseWriter)
+}
+
+func newMock(t *testing.T) *mock {
+	m := &mock{reply: make(map[string]func(w http.ResponseWriter))}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := &Event{}
+		if err := json.NewDecoder(r.Body).Decode(ev); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		m.mu.Lock()
+		m.events = append(m.events, ev)
+		reply := m.reply[ev.Event]
+		m.mu.Unlock()
+		if reply != nil {
+			reply(w)
+		}
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mock) setReply(event string, reply func(w http.ResponseWriter)) {
+	m.mu.Lock()
+	m.reply[event] = reply
+	m.mu.Unlock()
+}
+
+func (m *mock) got(name string) []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []*Event
+	for _, ev := range m.events {
+		if ev.Event == name {
+			list = append(list, ev)
+		}
+	}
+	return list
+}
+
+func (m *mock) waitFor(t *testing.T, name string, n int) []*Event {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(m.got(name)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d %s, got %d", n, name, len(m.got(name)))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return m.got(name)
+}
+
+func startHooks(t *testing.T, config *Config) *Hooks {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	h := NewHooks(config)
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+func allEvents(target string) map[string][]string {
+	urls := make(map[string][]string)
+	for _, name := range []string{OnConnect, OnPublish, OnUnpublish, OnPlay, OnStop, OnRecordDone} {
+		urls[name] = []string{target}
+	}
+	return urls
+}
+
+func TestPublish(t *testing.T) {
+	m := newMock(t)
+	startHooks(t, &Config{URLs: allEvents(m.URL)})
+	u, _ := url.Parse("rtmp://127.0.0.1/live/x?sign=abc")
+	source := session.NewSourceSession(context.Background(), nil)
+	hyStream := stream.NewHyStream0(u, source)
+
+	if err := Publish(context.Background(), NewEvent(OnPublish, u, source.ID(), "rtmp", "10.0.0.1:5000")); err != nil {
+		t.Fatal(err)
+	}
+	ev := m.got(OnPublish)[0]
+	if ev.StreamID != "127.0.0.1:/live/x" || ev.SessionID != source.ID() || ev.ClientIP != "10.0.0.1" || ev.Params["sign"] != "abc" || ev.Protocol != "rtmp" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if err := stream.DefaultHyStreamManager.AddStream(hyStream); err != nil {
+		t.Fatal(err)
+	}
+	stream.DefaultHyStreamManager.RemoveStreamIfMatch(hyStream)
+	if ev = m.waitFor(t, OnUnpublish, 1)[0]; ev.SessionID != source.ID() || ev.StreamID != "127.0.0.1:/live/x" {
+		t.Fatalf("unexpected unpublish %+v", ev)
+	}
+
+	m.setReply(OnPublish, func(w http.ResponseWriter) {
+		_, _ = w.Write([]byte(`{"deny": true, "reason": "not on the list"}`))
+	})
+	if err := Publish(context.Background(), NewEvent(OnPublish, u, "2", "rtmp", "")); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect the json deny to refuse, got %v", err)
+	}
+	m.setReply(OnPublish, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	if err := Publish(context.Background(), NewEvent(OnPublish, u, "3", "rtmp", "")); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect the status to refuse, got %v", err)
+	}
+}
+
+func TestPlay(t *testing.T) {
+	m := newMock(t)
+	startHooks(t, &Config{URLs: allEvents(m.URL), Timeout: 50 * time.Millisecond})
+	u, _ := url.Parse("http://127.0.0.1/live/x.ts")
+	stop, err := Play(context.Background(), NewEvent(OnPlay, u, "7", "http-ts", "10.0.0.2:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	stop()
+	if ev := m.waitFor(t, OnStop, 1)[0]; ev.SessionID != "7" || ev.ClientIP != "10.0.0.2" {
+		t.Fatalf("unexpected stop %+v", ev)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(m.got(OnStop)); n != 1 {
+		t.Fatalf("expect one on_stop, got %d", n)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	m.setReply(OnPlay, func(w http.ResponseWriter) {
+		<-release
+	})
+	if _, err = Play(context.Background(), NewEvent(OnPlay, u, "8", "http-ts", "")); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect a silent callback to refuse, got %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	m := newMock(t)
+	startHooks(t, &Config{URLs: allEvents(m.URL), Retries: 2, RetryInterval: 10 * time.Millisecond})
+	m.setReply(OnRecordDone, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	u, _ := url.Parse("rtmp://127.0.0.1/live/x")
+	ev := NewEvent(OnRecordDone, u, "9", "record", "")
+	ev.File = "record/live/x.ts"
+	Notify(ev)
+	got := m.waitFor(t, OnRecordDone, 3)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(m.got(OnRecordDone)); n != 3 || got[2].File != ev.File || got[2].Time != ev.Time {
+		t.Fatalf("expect the first try and 2 retries of the same event, got %d %+v", n, got[2])
+	}
+}
+
+func TestVhostHooks(t *testing.T) {
+	server, vip := newMock(t), newMock(t)
+	startHooks(t, &Config{URLs: allEvents(server.URL)})
+	vhost.SetTable(vhost.NewTable(nil, &vhost.Vhost{Name: "vip", Domains: []string{"vip.example.com"}, Enabled: true,
+		Hooks: map[string][]string{OnPublish: {vip.URL}, OnConnect: nil}}))
+	defer vhost.SetTable(nil)
+
+	u, _ := url.Parse("rtmp://vip.example.com/live/x")
+	if err := Publish(context.Background(), NewEvent(OnPublish, u, "1", "rtmp", "")); err != nil {
+		t.Fatal(err)
+	}
+	Notify(NewEvent(OnConnect, u, "1", "rtmp", ""))
+	Notify(NewEvent(OnRecordDone, u, "1", "record", ""))
+	server.waitFor(t, OnRecordDone, 1)
+	if len(vip.got(OnPublish)) != 1 || len(server.got(OnPublish)) != 0 {
+		t.Fatal("expect the vhost callback in place of the server one")
+	}
+	if len(server.got(OnConnect))+len(vip.got(OnConnect)) != 0 {
+		t.Fatal("expect an empty vhost list to silence the event")
+	}
+}
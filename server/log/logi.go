@@ -26,6 +26,14 @@ type ILog interface {
 	Errorf(ctx context.Context, format string, args ...interface{})
 }
 
+// Init applies config to the main log while it's in use, nothing changes when config is invalid
+func Init(config *Config) error {
+	if l, ok := MainLog.(*Logrus); ok {
+		return l.configure(config)
+	}
+	return MainLog.Init(config)
+}
+
 func Tracef(ctx context.Context, format string, args ...interface{}) {
 	MainLog.Tracef(ctx, format, args...)
 }
@@ -2,18 +2,73 @@ package log
 
 import (
 	"context"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
+	"os"
 )
 
+// Config picks the level and where the lines go
+type Config struct {
+	//trace, debug, info, warn or error, info when empty
+	Level string
+	//stdout, stderr or a file appended to, stderr when empty
+	Output string
+}
+
 type Logrus struct {
 	l *logrus.Logger
+	//file is the output opened by the last configure, closed once replaced
+	file *os.File
 }
 
+// Init takes a *Config, the logrus defaults are kept for nil
 func (l *Logrus) Init(param interface{}) error {
 	l.l = logrus.New()
+	config, ok := param.(*Config)
+	if !ok || config == nil {
+		return nil
+	}
+	return l.configure(config)
+}
+
+// configure changes the logger in place, logrus guards level and output itself
+func (l *Logrus) configure(config *Config) error {
+	level := logrus.InfoLevel
+	if config.Level != "" {
+		var err error
+		if level, err = logrus.ParseLevel(config.Level); err != nil {
+			return err
+		}
+	}
+	out, file, err := openOutput(config.Output)
+	if err != nil {
+		return err
+	}
+	l.l.SetLevel(level)
+	l.l.SetOutput(out)
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+	l.file = file
 	return nil
 }
 
+// openOutput returns the file it opened as well, nil for stdout and stderr
+func openOutput(output string) (io.Writer, *os.File, error) {
+	switch output {
+	case "", "stderr":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return os.Stdout, nil, nil
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open log output: %w", err)
+	}
+	return f, f, nil
+}
+
 func (l *Logrus) Tracef(ctx context.Context, format string, args ...interface{}) {
 	l.l.Tracef(getLogIDFormat(ctx, format), args...)
 }
@@ -0,0 +1,245 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+// ContentType is the prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Family is one metric name with all of its samples, the labels of every sample follow LabelNames
+type Family struct {
+	Name       string
+	Help       string
+	Type       string
+	LabelNames []string
+	Samples    []Sample
+}
+
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Add appends a sample, the label values are in the order of LabelNames
+func (f *Family) Add(value float64, labelValues ...string) {
+	f.Samples = append(f.Samples, Sample{LabelValues: labelValues, Value: value})
+}
+
+// Collector is asked for its families on every scrape
+type Collector interface {
+	Collect() []*Family
+}
+
+// CollectorFunc builds the families at scrape time, for values owned by someone else
+type CollectorFunc func() []*Family
+
+func (f CollectorFunc) Collect() []*Family {
+	return f()
+}
+
+type Registry struct {
+	mu         sync.RWMutex
+	collectors []Collector
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Gather collects every family sorted by name, families of the same name are merged
+func (r *Registry) Gather() []*Family {
+	r.mu.RLock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.RUnlock()
+	byName := make(map[string]*Family)
+	var families []*Family
+	for _, c := range collectors {
+		for _, f := range c.Collect() {
+			if prev, ok := byName[f.Name]; ok {
+				prev.Samples = append(prev.Samples, f.Samples...)
+				continue
+			}
+			byName[f.Name] = f
+			families = append(families, f)
+		}
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// WriteText writes the families in the text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	for _, f := range r.Gather() {
+		if f.Help != "" {
+			fmt.Fprintf(buf, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			buf.WriteString(f.Name)
+			if len(f.LabelNames) > 0 {
+				buf.WriteByte('{')
+				for i, name := range f.LabelNames {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					value := ""
+					if i < len(s.LabelValues) {
+						value = s.LabelValues[i]
+					}
+					fmt.Fprintf(buf, "%s=\"%s\"", name, escapeLabel(value))
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(formatValue(s.Value))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Flush()
+}
+
+// Handler serves the registry to a prometheus scraper
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.WriteText(w)
+	})
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// Value is a single series of a vector, keep it around to skip the label lookup on hot paths
+type Value struct {
+	labelValues []string
+	v           int64
+}
+
+func (v *Value) Add(delta int64) {
+	atomic.AddInt64(&v.v, delta)
+}
+
+func (v *Value) Inc() {
+	atomic.AddInt64(&v.v, 1)
+}
+
+func (v *Value) Dec() {
+	atomic.AddInt64(&v.v, -1)
+}
+
+func (v *Value) Set(value int64) {
+	atomic.StoreInt64(&v.v, value)
+}
+
+func (v *Value) Get() int64 {
+	return atomic.LoadInt64(&v.v)
+}
+
+// Vec is an integer counter or gauge with fixed label names,
+// callers only pass label values out of a bounded set, never addresses or ids
+type Vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	mu     sync.RWMutex
+	values map[string]*Value
+}
+
+// NewCounter registers a counter vector to the default registry
+func NewCounter(name, help string, labelNames ...string) *Vec {
+	return newVec(name, help, TypeCounter, labelNames)
+}
+
+// NewGauge registers a gauge vector to the default registry
+func NewGauge(name, help string, labelNames ...string) *Vec {
+	return newVec(name, help, TypeGauge, labelNames)
+}
+
+func newVec(name, help, typ string, labelNames []string) *Vec {
+	v := &Vec{name: name, help: help, typ: typ, labelNames: labelNames}
+	v.values = make(map[string]*Value)
+	DefaultRegistry.Register(v)
+	return v
+}
+
+// With returns the series of the label values, missing values are empty
+func (v *Vec) With(labelValues ...string) *Value {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.RLock()
+	value, ok := v.values[key]
+	v.mu.RUnlock()
+	if ok {
+		return value
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if value, ok = v.values[key]; ok {
+		return value
+	}
+	value = &Value{labelValues: append([]string(nil), labelValues...)}
+	v.values[key] = value
+	return value
+}
+
+func (v *Vec) Collect() []*Family {
+	f := &Family{Name: v.name, Help: v.help, Type: v.typ, LabelNames: v.labelNames}
+	v.mu.RLock()
+	for _, value := range v.values {
+		f.Add(float64(value.Get()), value.labelValues...)
+	}
+	v.mu.RUnlock()
+	sort.Slice(f.Samples, func(i, j int) bool {
+		return strings.Join(f.Samples[i].LabelValues, "\xff") < strings.Join(f.Samples[j].LabelValues, "\xff")
+	})
+	return []*Family{f}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	v := &Vec{name: "test_requests_total", help: "Requests\nserved.", typ: TypeCounter, labelNames: []string{"code"}, values: map[string]*Value{}}
+	r.Register(v)
+	v.With("200").Add(3)
+	v.With("500").Inc()
+	v.With("200").Inc()
+	r.Register(CollectorFunc(func() []*Family {
+		f := &Family{Name: "test_info", Type: TypeGauge, LabelNames: []string{"name"}}
+		f.Add(1.5, `a"b\c`)
+		return []*Family{f}
+	}))
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		`# TYPE test_info gauge`,
+		`test_info{name="a\"b\\c"} 1.5`,
+		`# HELP test_requests_total Requests\nserved.`,
+		`# TYPE test_requests_total counter`,
+		`test_requests_total{code="200"} 4`,
+		`test_requests_total{code="500"} 1`,
+		``,
+	}, "\n")
+	if buf.String() != expect {
+		t.Fatalf("unexpected exposition\n%s", buf.String())
+	}
+}
+
+func TestGatherMerges(t *testing.T) {
+	r := NewRegistry()
+	for _, name := range []string{"a", "b"} {
+		name := name
+		r.Register(CollectorFunc(func() []*Family {
+			f := &Family{Name: "test_merged", Type: TypeGauge, LabelNames: []string{"name"}}
+			f.Add(1, name)
+			return []*Family{f}
+		}))
+	}
+	families := r.Gather()
+	if len(families) != 1 || len(families[0].Samples) != 2 {
+		t.Fatalf("expect one family with two samples, got %+v", families)
+	}
+}
@@ -0,0 +1,23 @@
+package metrics
+
+// server wide series, label values come out of small fixed sets
+var (
+	Connections = NewGauge("hylan_connections",
+		"Connections open right now.", "protocol")
+	HandshakeFailures = NewCounter("hylan_handshake_failures_total",
+		"Connections dropped before a session started.", "protocol", "reason")
+	Rejected = NewCounter("hylan_rejected_total",
+		"Connections, publishes and plays refused by the listener access rules.", "protocol", "reason")
+	Timeouts = NewCounter("hylan_timeouts_total",
+		"Connections closed for staying too long in a phase.", "protocol", "phase")
+	ProtocolErrors = NewCounter("hylan_protocol_errors_total",
+		"Connections closed for going over the message, chunk stream or amf limits.", "protocol", "reason")
+	BytesIn = NewCounter("hylan_bytes_in_total",
+		"Media payload bytes received from publishers.", "protocol")
+	BytesOut = NewCounter("hylan_bytes_out_total",
+		"Media payload bytes sent to players.", "protocol")
+	SinkDropped = NewCounter("hylan_sink_dropped_packets_total",
+		"Packets overwritten before a slow player read them.", "protocol")
+	RtmpMessages = NewCounter("hylan_rtmp_messages_total",
+		"RTMP messages received by type.", "type")
+)
@@ -1,7 +1,35 @@
 package proto
 
+import (
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/protocol"
+)
+
 type PacketI interface {
+	Base() *BasePacket
 }
 
+// BasePacket is one access unit moving from a source session to its sinks.
+// DTS/PTS are in milliseconds. Video payloads are length prefixed (AVCC/HVCC) nal units,
+// sequence headers carry the decoder configuration record or the AudioSpecificConfig.
 type BasePacket struct {
+	MediaType protocol.MediaDataType
+	Codec     constdef.CodecID
+	DTS       int64
+	PTS       int64
+	KeyFrame  bool
+	SeqHeader bool
+	Payload   []byte
+}
+
+func (pkt *BasePacket) Base() *BasePacket {
+	return pkt
+}
+
+func (pkt *BasePacket) IsVideo() bool {
+	return pkt.MediaType == protocol.MediaDataTypeVideo
+}
+
+func (pkt *BasePacket) IsAudio() bool {
+	return pkt.MediaType == protocol.MediaDataTypeAudio
 }
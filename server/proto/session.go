@@ -6,10 +6,32 @@ import (
 )
 
 type SinkArg struct {
-	Ctx      context.Context
-	Protocol constdef.SinkType
-	SinkFile *SinkFile
-	SinkRtmp *SinkRtmp
+	Ctx        context.Context
+	Protocol   constdef.SinkType
+	Peer       *Peer
+	SinkFile   *SinkFile
+	SinkRtmp   *SinkRtmp
+	SinkRtsp   *SinkRtsp
+	SinkWebrtc *SinkWebrtc
+	SinkSrt    *SinkSrt
+	SinkHttpTs *SinkHttpTs
+
+	//ID of the sink, a new one when empty
+	ID string
+	//OnClose is called once when the sink is closed
+	OnClose func()
+}
+
+// Peer is the connection behind a session as the admin api shows it
+type Peer struct {
+	Protocol   string
+	RemoteAddr string
+	//Kick ends the connection, nil when ending the session is enough
+	Kick func()
+	//Internal sessions like recordings and configured pushes are no players of the stream
+	Internal bool
+	//Players counts the players fed by a shared sink, nil when the sink is one player or none
+	Players func() int
 }
 
 type SinkFile struct {
@@ -17,3 +39,15 @@ type SinkFile struct {
 
 type SinkRtmp struct {
 }
+
+type SinkRtsp struct {
+}
+
+type SinkWebrtc struct {
+}
+
+type SinkSrt struct {
+}
+
+type SinkHttpTs struct {
+}
@@ -0,0 +1,193 @@
+package httpts
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	tsSuffix        = ".ts"
+	writeBufferSize = 64 * 1024
+)
+
+type ListenConfig struct {
+	Addr string
+	Port int
+	//serves https when set
+	TLS *tls.Config
+	//connections, publishes and plays are checked against it, nil lets everyone in
+	Access *hynet.Access
+	//reads the PROXY header of the trusted load balancers, nil reads none
+	Proxy *hynet.Proxy
+}
+
+// Server streams live mpeg-ts over http on /{app}/{stream}.ts until the client goes away
+type Server struct {
+	ctx      context.Context
+	config   *ListenConfig
+	running  bool
+	listener net.Listener
+	server   *http.Server
+	//the connections not closed yet
+	tracker hynet.Tracker
+}
+
+func NewServer(config *ListenConfig) *Server {
+	s := &Server{}
+	s.config = config
+	return s
+}
+
+func (s *Server) Init() error {
+	s.ctx = log.GetCtxWithLogID(context.Background(), "HTTP_TS_SERVER")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveTS)
+	s.server = &http.Server{Handler: mux}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.Addr, s.config.Port))
+	if err != nil {
+		return err
+	}
+	listener = s.config.Proxy.Listener(listener)
+	listener = s.config.Access.Listener(listener)
+	listener = s.tracker.Listener(listener)
+	if s.config.TLS != nil {
+		listener = tls.NewListener(listener, s.config.TLS)
+	}
+	s.listener = listener
+	s.running = true
+	return nil
+}
+
+func (s *Server) Start() error {
+	log.Infof(s.ctx, "listen http-ts server@%s:%d", s.config.Addr, s.config.Port)
+	task.SubmitTask0(s.ctx, func() {
+		err := s.server.Serve(s.listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			log.Errorf(s.ctx, "http-ts server stopped: %+v", err)
+		}
+	})
+	return nil
+}
+
+// StopAccept closes the listener, the requests being served go on and the idle connections are closed
+func (s *Server) StopAccept() {
+	_ = s.listener.Close()
+	s.server.SetKeepAlivesEnabled(false)
+}
+
+// Drained is true once the requests being served when it stopped accepting are done
+func (s *Server) Drained() bool {
+	return s.tracker.Active() == 0
+}
+
+func (s *Server) Close() {
+	s.running = false
+	_ = s.server.Close()
+}
+
+func (s *Server) serveTS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, tsSuffix) {
+		http.NotFound(w, r)
+		return
+	}
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     strings.TrimSuffix(r.URL.Path, tsSuffix),
+		RawQuery: r.URL.RawQuery,
+	}
+	if err := s.config.Access.Allow(hynet.OpPlay, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := vhost.Play(u, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), vhost.HTTPStatus(err))
+		return
+	}
+	id := base.NewBase0(u).ID()
+	hyStream, exist := stream.DefaultHyStreamManager.GetStream(id)
+	if !exist {
+		http.Error(w, fmt.Sprintf("stream %s not found", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	ctx := log.GetCtxWithLogID(s.ctx, "HTTP_TS")
+	sinkID := session.NextID()
+	stop, err := hook.Play(ctx, hook.NewEvent(hook.OnPlay, u, sinkID, "http-ts", r.RemoteAddr))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	metrics.Connections.With("http-ts").Inc()
+	defer metrics.Connections.With("http-ts").Dec()
+	log.Infof(ctx, "http-ts play stream %s to %s", id, r.RemoteAddr)
+	play(ctx, r.Context(), hyStream, w, &proto.SinkArg{
+		Protocol: constdef.SinkTypeHttpTs,
+		Peer:     &proto.Peer{Protocol: "http-ts", RemoteAddr: r.RemoteAddr},
+		ID:       sinkID,
+		OnClose:  stop,
+	})
+}
+
+// play attaches a sink of arg so the client starts with the gop cache, the muxer puts the tables in front of it
+func play(ctx context.Context, reqCtx context.Context, hyStream *stream.HyStream, w http.ResponseWriter, arg *proto.SinkArg) {
+	arg.Ctx = ctx
+	arg.SinkHttpTs = &proto.SinkHttpTs{}
+	sink := hyStream.Source().AddSink(arg)
+	defer sink.Close()
+	task.SubmitTask0(ctx, func() {
+		//a silent stream would keep the sink blocked after the client left
+		<-reqCtx.Done()
+		sink.Close()
+	})
+	flusher, _ := w.(http.Flusher)
+	buf := bufio.NewWriterSize(w, writeBufferSize)
+	muxer := mpegts.NewMuxer(buf)
+	for {
+		data, ok := sink.Pull(ctx)
+		if !ok {
+			log.Infof(ctx, "http-ts player of %s done", hyStream.Base().ID())
+			return
+		}
+		err := muxer.WritePacket(data.Base())
+		if err == nil {
+			err = buf.Flush()
+		}
+		if err != nil {
+			log.Infof(ctx, "http-ts player of %s left: %+v", hyStream.Base().ID(), err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
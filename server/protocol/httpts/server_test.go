@@ -0,0 +1,125 @@
+package httpts
+
+import (
+	"bytes"
+	"context"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	testPPS = []byte{0x68, 0xce, 0x06, 0xe2}
+)
+
+func frame(i int) *proto.BasePacket {
+	nalu := make([]byte, 500)
+	nalu[0] = 0x41
+	if i%5 == 0 {
+		nalu[0] = 0x65
+	}
+	return &proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, DTS: int64(i * 40), PTS: int64(i * 40),
+		KeyFrame: i%5 == 0, Payload: codec.EncodeAVCC([][]byte{nalu})}
+}
+
+func TestHttpTs(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewServer(&ListenConfig{Addr: "127.0.0.1", Port: 18090})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	resp, err := http.Get("http://127.0.0.1:18090/live/ts.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %d for a missing stream", resp.StatusCode)
+	}
+
+	//publish through the ts demuxer, the source gets what a ts ingest would push,
+	//on the host and port the players ask for since the stream id names both
+	pub := mpegts.NewPublisher(context.Background(), &url.URL{Host: "127.0.0.1:18090", Path: "/live/ts"})
+	if err = stream.DefaultHyStreamManager.AddStream(pub.HyStream()); err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	muxer := mpegts.NewMuxer(pub)
+	write := func(pkt *proto.BasePacket) {
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, SeqHeader: true,
+		Payload: codec.BuildAVCDecoderConfig(testSPS, testPPS)})
+	for i := 0; i < 8; i++ {
+		write(frame(i))
+	}
+
+	resp, err = http.Get("http://127.0.0.1:18090/live/ts.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/mp2t" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	done := make(chan struct{})
+	defer func() {
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		for i := 8; i < 30; i++ {
+			write(frame(i))
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	data := make([]byte, 60*mpegts.PacketSize)
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		t.Fatal(err)
+	}
+	//pat first, then the pmt
+	if data[0] != 0x47 || data[1]&0x1f != 0 || data[2] != 0 || data[mpegts.PacketSize+1]&0x1f != 0x10 {
+		t.Fatalf("stream doesn't start with the tables: % x", data[:4])
+	}
+	cc := -1
+	for pos := 0; pos < len(data); pos += mpegts.PacketSize {
+		p := data[pos:]
+		if p[0] != 0x47 {
+			t.Fatalf("lost sync at %d", pos)
+		}
+		if pid := int(p[1]&0x1f)<<8 | int(p[2]); pid != 0x100 {
+			continue
+		}
+		if cc >= 0 && int(p[3]&0x0f) != (cc+1)&0x0f {
+			t.Fatalf("continuity counter jumped from %d to %d", cc, p[3]&0x0f)
+		}
+		cc = int(p[3] & 0x0f)
+	}
+	var got []*proto.BasePacket
+	demuxer := mpegts.NewDemuxer(func(pkt *proto.BasePacket) {
+		got = append(got, pkt)
+	})
+	_ = demuxer.Write(data)
+	if len(got) < 2 || !got[0].SeqHeader || !bytes.Equal(got[0].Payload, codec.BuildAVCDecoderConfig(testSPS, testPPS)) || !got[1].KeyFrame {
+		t.Fatalf("unexpected stream start %+v", got)
+	}
+}
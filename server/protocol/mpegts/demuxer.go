@@ -0,0 +1,258 @@
+package mpegts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+)
+
+type pesStream struct {
+	streamType byte
+	cc         int
+	buf        []byte
+	expected   int
+	framer     *codec.VideoFramer
+	aacConfig  []byte
+}
+
+// Demuxer turns a transport stream into media packets, the first program of the PAT is used
+type Demuxer struct {
+	onPacket func(pkt *proto.BasePacket)
+	pending  []byte
+	pmtPID   int
+	streams  map[uint16]*pesStream
+	unwrap   timestampUnwrapper
+	// Discontinuities counts the pes packets dropped because of continuity counter gaps
+	Discontinuities uint64
+}
+
+func NewDemuxer(onPacket func(pkt *proto.BasePacket)) *Demuxer {
+	d := &Demuxer{}
+	d.onPacket = onPacket
+	d.pmtPID = -1
+	d.streams = make(map[uint16]*pesStream)
+	return d
+}
+
+// Write accepts the stream in chunks of any size, it resynchronizes on the sync byte after garbage
+func (d *Demuxer) Write(data []byte) error {
+	d.pending = append(d.pending, data...)
+	var err error
+	for len(d.pending) >= PacketSize {
+		if d.pending[0] != syncByte {
+			idx := bytes.IndexByte(d.pending, syncByte)
+			if idx < 0 {
+				d.pending = d.pending[:0]
+				break
+			}
+			d.pending = d.pending[idx:]
+			continue
+		}
+		if e := d.parsePacket(d.pending[:PacketSize]); e != nil {
+			err = e
+		}
+		d.pending = d.pending[PacketSize:]
+	}
+	d.pending = append(d.pending[:0], d.pending...)
+	return err
+}
+
+// Flush emits the pes packets still waiting for their successor
+func (d *Demuxer) Flush() {
+	for _, s := range d.streams {
+		d.flushPES(s)
+	}
+}
+
+func (d *Demuxer) parsePacket(p []byte) error {
+	if p[1]&0x80 != 0 {
+		return fmt.Errorf("transport error indicator set")
+	}
+	pusi := p[1]&0x40 != 0
+	pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+	afc := (p[3] >> 4) & 0x03
+	cc := int(p[3] & 0x0f)
+	if afc&0x01 == 0 {
+		return nil
+	}
+	offset := 4
+	if afc&0x02 != 0 {
+		offset += 1 + int(p[4])
+		if offset >= PacketSize {
+			return fmt.Errorf("invalid adaptation field length")
+		}
+	}
+	payload := p[offset:]
+	switch {
+	case pid == pidPAT:
+		return d.parsePAT(payload, pusi)
+	case int(pid) == d.pmtPID:
+		return d.parsePMT(payload, pusi)
+	}
+	s, exist := d.streams[pid]
+	if !exist {
+		return nil
+	}
+	if s.cc >= 0 {
+		if cc == s.cc {
+			//duplicated packet
+			return nil
+		}
+		if cc != (s.cc+1)&0x0f {
+			d.Discontinuities++
+			s.buf = nil
+		}
+	}
+	s.cc = cc
+	if pusi {
+		d.flushPES(s)
+		s.buf = append(make([]byte, 0, 64*1024), payload...)
+		s.expected = 0
+		if len(payload) >= 6 {
+			if length := int(binary.BigEndian.Uint16(payload[4:6])); length > 0 {
+				s.expected = 6 + length
+			}
+		}
+	} else if s.buf != nil {
+		s.buf = append(s.buf, payload...)
+	}
+	if s.expected > 0 && len(s.buf) >= s.expected {
+		d.flushPES(s)
+	}
+	return nil
+}
+
+// psiSection returns the section starting in the payload, sections spanning packets are not supported
+func psiSection(payload []byte, pusi bool, tableID byte) ([]byte, error) {
+	if !pusi {
+		return nil, nil
+	}
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil, fmt.Errorf("invalid psi pointer field")
+	}
+	payload = payload[1+int(payload[0]):]
+	if len(payload) < 3 || payload[0] != tableID {
+		return nil, fmt.Errorf("unexpected table id")
+	}
+	length := int(binary.BigEndian.Uint16(payload[1:3]) & 0x0fff)
+	if length < 9 || 3+length > len(payload) {
+		return nil, fmt.Errorf("invalid section length %d", length)
+	}
+	section := payload[:3+length]
+	if crc32(section) != 0 {
+		return nil, fmt.Errorf("psi crc mismatch")
+	}
+	return section, nil
+}
+
+func (d *Demuxer) parsePAT(payload []byte, pusi bool) error {
+	section, err := psiSection(payload, pusi, tableIDPAT)
+	if err != nil || section == nil {
+		return err
+	}
+	for pos := 8; pos+4 <= len(section)-4; pos += 4 {
+		program := binary.BigEndian.Uint16(section[pos:])
+		if program == 0 {
+			//network pid
+			continue
+		}
+		d.pmtPID = int(binary.BigEndian.Uint16(section[pos+2:]) & 0x1fff)
+		return nil
+	}
+	return nil
+}
+
+func (d *Demuxer) parsePMT(payload []byte, pusi bool) error {
+	section, err := psiSection(payload, pusi, tableIDPMT)
+	if err != nil || section == nil {
+		return err
+	}
+	if len(section) < 16 {
+		return fmt.Errorf("short pmt")
+	}
+	pos := 12 + int(binary.BigEndian.Uint16(section[10:12])&0x0fff)
+	for pos+5 <= len(section)-4 {
+		streamType := section[pos]
+		pid := binary.BigEndian.Uint16(section[pos+1:]) & 0x1fff
+		pos += 5 + int(binary.BigEndian.Uint16(section[pos+3:])&0x0fff)
+		if s, exist := d.streams[pid]; exist && s.streamType == streamType {
+			continue
+		}
+		s := &pesStream{streamType: streamType, cc: -1}
+		switch streamType {
+		case streamTypeH264:
+			s.framer = codec.NewVideoFramer(constdef.CodecH264, nil, nil, nil)
+		case streamTypeH265:
+			s.framer = codec.NewVideoFramer(constdef.CodecH265, nil, nil, nil)
+		case streamTypeAAC:
+		default:
+			continue
+		}
+		d.streams[pid] = s
+	}
+	return nil
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func (d *Demuxer) flushPES(s *pesStream) {
+	buf := s.buf
+	s.buf = nil
+	if len(buf) < 9 || buf[0] != 0 || buf[1] != 0 || buf[2] != 1 {
+		return
+	}
+	flags := buf[7] >> 6
+	headerEnd := 9 + int(buf[8])
+	if headerEnd > len(buf) || flags&0x02 == 0 || 14 > len(buf) {
+		return
+	}
+	pts := d.unwrap.unwrap(readTimestamp(buf[9:14]))
+	dts := pts
+	if flags == 0x03 && len(buf) >= 19 {
+		dts = d.unwrap.unwrap(readTimestamp(buf[14:19]))
+	}
+	payload := buf[headerEnd:]
+	if s.expected > 0 && s.expected <= len(buf) {
+		payload = buf[headerEnd:s.expected]
+	}
+	if s.framer != nil {
+		for _, pkt := range s.framer.Frame(nil, codec.SplitAnnexB(payload), dts/clockRate, pts/clockRate) {
+			d.onPacket(pkt)
+		}
+		return
+	}
+	d.flushADTS(s, payload, pts)
+}
+
+// flushADTS emits every adts frame of the pes, a sequence header goes first whenever the config changes
+func (d *Demuxer) flushADTS(s *pesStream, payload []byte, pts int64) {
+	i := 0
+	codec.SplitADTS(payload, func(h *codec.ADTSHeader, frame []byte) {
+		framePts := (pts + int64(i*codec.AACFrameSamples*clockRate*1000/h.SampleRate())) / clockRate
+		i++
+		if config := h.Config(); !bytes.Equal(config, s.aacConfig) {
+			s.aacConfig = config
+			d.onPacket(&proto.BasePacket{
+				MediaType: protocol.MediaDataTypeAudio,
+				Codec:     constdef.CodecAAC,
+				DTS:       framePts,
+				PTS:       framePts,
+				SeqHeader: true,
+				Payload:   config,
+			})
+		}
+		d.onPacket(&proto.BasePacket{
+			MediaType: protocol.MediaDataTypeAudio,
+			Codec:     constdef.CodecAAC,
+			DTS:       framePts,
+			PTS:       framePts,
+			Payload:   frame,
+		})
+	})
+}
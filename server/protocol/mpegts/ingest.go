@@ -0,0 +1,238 @@
+package mpegts
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIdleTimeout = 5 * time.Second
+	udpReadBufferSize  = 4 * 1024 * 1024
+
+	rtpVersion         = 2
+	rtpPayloadTypeMP2T = 33
+)
+
+type IngestConfig struct {
+	//udp or tcp
+	Network string
+	//a multicast ip joins the group
+	Addr string
+	Port int
+	//interface of the multicast group, the system default when empty
+	Interface string
+	//url of the published stream, its host and path make the stream id
+	StreamURL string
+	//udp streams end after this long without data
+	IdleTimeout time.Duration
+	//tcp publishers are checked against it, nil lets everyone in
+	Access *hynet.Access
+	//reads the PROXY header of the trusted load balancers in front of tcp, nil reads none
+	Proxy *hynet.Proxy
+}
+
+// IngestServer publishes the raw ts received on one port as one stream,
+// every tcp connection is a publisher while udp publishes from the first datagram until it goes idle
+type IngestServer struct {
+	ctx       context.Context
+	config    *IngestConfig
+	streamURL *url.URL
+	running   bool
+	udp       *hynet.UdpServer
+	tcp       *hynet.TcpServer
+
+	mu        sync.Mutex
+	publisher *Publisher
+	lastData  time.Time
+	stopIdle  context.CancelFunc
+}
+
+func NewIngestServer(config *IngestConfig) *IngestServer {
+	s := &IngestServer{}
+	s.config = config
+	return s
+}
+
+func (s *IngestServer) Init() error {
+	streamURL, err := url.Parse(s.config.StreamURL)
+	if err != nil {
+		return err
+	}
+	s.streamURL = streamURL
+	if s.config.IdleTimeout <= 0 {
+		s.config.IdleTimeout = DefaultIdleTimeout
+	}
+	s.ctx = log.GetCtxWithLogID(context.Background(), "TS_INGEST")
+	switch strings.ToLower(s.config.Network) {
+	case "", "udp":
+		s.udp = hynet.NewUdpServer(s.ctx, s.config.Addr, s.config.Port)
+		s.udp.Interface = s.config.Interface
+		s.udp.ReadBufferSize = udpReadBufferSize
+		s.udp.DataHandler = s
+		err = s.udp.Init()
+	case "tcp":
+		s.tcp = hynet.NewTcpServer(s.ctx, s.config.Addr, s.config.Port)
+		s.tcp.ConnHandler = s
+		s.tcp.Access = s.config.Access
+		s.tcp.Proxy = s.config.Proxy
+		err = s.tcp.Init()
+	default:
+		return fmt.Errorf("invalid ts ingest network %s", s.config.Network)
+	}
+	if err != nil {
+		return err
+	}
+	s.running = true
+	return nil
+}
+
+func (s *IngestServer) Start() error {
+	log.Infof(s.ctx, "ingest %s ts@%s:%d as %s", s.network(), s.config.Addr, s.config.Port, s.config.StreamURL)
+	if s.tcp != nil {
+		return s.tcp.Start()
+	}
+	if err := s.udp.Start(); err != nil {
+		return err
+	}
+	var idleCtx context.Context
+	idleCtx, s.stopIdle = context.WithCancel(s.ctx)
+	task.Every(idleCtx, time.Second, s.checkIdle)
+	return nil
+}
+
+// StopAccept lets the tcp publisher go on, a udp ingest has no connection to keep and is closed
+func (s *IngestServer) StopAccept() {
+	if s.tcp != nil {
+		s.tcp.StopAccept()
+		return
+	}
+	s.Close()
+}
+
+// Drained is true once the tcp publisher is gone, a udp ingest is closed when it stops accepting
+func (s *IngestServer) Drained() bool {
+	if s.tcp != nil {
+		return s.tcp.Drained()
+	}
+	return true
+}
+
+func (s *IngestServer) Close() {
+	s.running = false
+	if s.tcp != nil {
+		s.tcp.Close()
+		return
+	}
+	if s.stopIdle != nil {
+		s.stopIdle()
+	}
+	s.udp.Close()
+	s.closePublisher()
+}
+
+func (s *IngestServer) network() string {
+	if s.tcp != nil {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// HandleData demuxes a datagram, the stream starts with the first one
+func (s *IngestServer) HandleData(data []byte) {
+	data = stripRTP(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastData = time.Now()
+	if s.publisher == nil {
+		p := NewPublisher(log.GetCtxWithLogID(s.ctx, "TS_UDP"), s.streamURL)
+		if err := stream.DefaultHyStreamManager.AddStream(p.HyStream()); err != nil {
+			//published by someone else, retried with the next datagram
+			return
+		}
+		p.SetPeer(&proto.Peer{Protocol: "udp-ts", Kick: s.closePublisher})
+		log.Infof(s.ctx, "udp ts publish stream %s", p.HyStream().Base().ID())
+		s.publisher = p
+	}
+	_, _ = s.publisher.Write(data)
+}
+
+// checkIdle ends the udp stream once the sender stops, it runs every second while the ingest is open
+func (s *IngestServer) checkIdle() {
+	s.mu.Lock()
+	idle := s.publisher != nil && time.Since(s.lastData) > s.config.IdleTimeout
+	s.mu.Unlock()
+	if idle {
+		log.Infof(s.ctx, "udp ts stream %s idle", s.config.StreamURL)
+		s.closePublisher()
+	}
+}
+
+func (s *IngestServer) closePublisher() {
+	s.mu.Lock()
+	p := s.publisher
+	s.publisher = nil
+	s.mu.Unlock()
+	if p != nil {
+		_ = p.Close()
+	}
+}
+
+// HandleConn publishes a tcp connection until it closes
+func (s *IngestServer) HandleConn(conn hynet.IHyConn) {
+	task.SubmitTask0(s.ctx, func() {
+		defer conn.Close()
+		metrics.Connections.With("ts").Inc()
+		defer metrics.Connections.With("ts").Dec()
+		if err := s.config.Access.Allow(hynet.OpPublish, conn.RemoteAddr().String()); err != nil {
+			return
+		}
+		p := NewPublisher(log.GetCtxWithLogID(s.ctx, "TS_TCP"), s.streamURL)
+		if err := stream.DefaultHyStreamManager.AddStream(p.HyStream()); err != nil {
+			log.Warnf(s.ctx, "tcp ts publish failed: %+v", err)
+			return
+		}
+		p.SetPeer(&proto.Peer{Protocol: "tcp-ts", RemoteAddr: conn.RemoteAddr().String(), Kick: func() { _ = conn.Close() }})
+		log.Infof(s.ctx, "tcp ts publish stream %s", p.HyStream().Base().ID())
+		defer p.Close()
+		buf := make([]byte, 64*PacketSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				_, _ = p.Write(buf[:n])
+			}
+			if err != nil {
+				log.Infof(s.ctx, "tcp ts stream %s ended: %+v", p.HyStream().Base().ID(), err)
+				return
+			}
+		}
+	})
+}
+
+// stripRTP removes the rtp header of ts carried in rtp, the way ffmpeg's rtp_mpegts sends it
+func stripRTP(data []byte) []byte {
+	if len(data) < 12 || data[0] == syncByte || data[0]>>6 != rtpVersion || data[1]&0x7f != rtpPayloadTypeMP2T {
+		return data
+	}
+	offset := 12 + 4*int(data[0]&0x0f)
+	if data[0]&0x10 != 0 {
+		//header extension
+		if len(data) < offset+4 {
+			return nil
+		}
+		offset += 4 + 4*(int(data[offset+2])<<8|int(data[offset+3]))
+	}
+	if offset > len(data) {
+		return nil
+	}
+	return data[offset:]
+}
@@ -0,0 +1,116 @@
+package mpegts
+
+import (
+	"bytes"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"net"
+	"testing"
+	"time"
+)
+
+func testTS(t *testing.T) []byte {
+	var ts bytes.Buffer
+	muxer := NewMuxer(&ts)
+	for _, pkt := range testPackets() {
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ts.Bytes()
+}
+
+func waitStream(t *testing.T, id string, exist bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, ok := stream.DefaultHyStreamManager.GetStream(id); ok == exist {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream %s exist %v timeout", id, exist)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUdpIngest(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewIngestServer(&IngestConfig{Addr: "127.0.0.1", Port: 19100, StreamURL: "udp://127.0.0.1/live/udp", IdleTimeout: 500 * time.Millisecond})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("udp", "127.0.0.1:19100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ts := testTS(t)
+	//rtp wrapped datagrams of 7 ts packets
+	for seq := 0; len(ts) > 0; seq++ {
+		n := 7 * PacketSize
+		if n > len(ts) {
+			n = len(ts)
+		}
+		datagram := append([]byte{0x80, rtpPayloadTypeMP2T, 0, byte(seq), 0, 0, 0, 0, 0, 0, 0, 1}, ts[:n]...)
+		if _, err = conn.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+		ts = ts[n:]
+	}
+	id := base.NewBase0(server.streamURL).ID()
+	waitStream(t, id, true)
+	hyStream, _ := stream.DefaultHyStreamManager.GetStream(id)
+	deadline := time.Now().Add(3 * time.Second)
+	for len(hyStream.Source().SeqHeaders()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected sequence headers %d", len(hyStream.Source().SeqHeaders()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//the sender stopped
+	waitStream(t, id, false)
+}
+
+func TestTcpIngest(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewIngestServer(&IngestConfig{Network: "tcp", Addr: "127.0.0.1", Port: 19101, StreamURL: "tcp://127.0.0.1/live/tcp"})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:19101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(testTS(t)); err != nil {
+		t.Fatal(err)
+	}
+	id := base.NewBase0(server.streamURL).ID()
+	waitStream(t, id, true)
+	_ = conn.Close()
+	waitStream(t, id, false)
+}
+
+func TestStripRTP(t *testing.T) {
+	ts := []byte{syncByte, 1, 2, 3}
+	if !bytes.Equal(stripRTP(ts), ts) {
+		t.Fatal("plain ts modified")
+	}
+	//one csrc and a one word extension
+	wrapped := append([]byte{0x91, rtpPayloadTypeMP2T, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0xbe, 0xde, 0, 1, 9, 9, 9, 9}, ts...)
+	if !bytes.Equal(stripRTP(wrapped), ts) {
+		t.Fatalf("unexpected stripped %x", stripRTP(wrapped))
+	}
+}
@@ -0,0 +1,118 @@
+package mpegts
+
+import (
+	"bytes"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"testing"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+	testASC = []byte{0x12, 0x10}
+)
+
+func testPackets() []*proto.BasePacket {
+	idr := make([]byte, 1000)
+	idr[0] = 0x65
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i) | 0x80
+	}
+	return []*proto.BasePacket{
+		{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, SeqHeader: true, Payload: codec.BuildAVCDecoderConfig(testSPS, testPPS)},
+		{MediaType: protocol.MediaDataTypeAudio, Codec: constdef.CodecAAC, SeqHeader: true, Payload: testASC},
+		{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, DTS: 1000, PTS: 1080, KeyFrame: true, Payload: codec.EncodeAVCC([][]byte{idr})},
+		{MediaType: protocol.MediaDataTypeAudio, Codec: constdef.CodecAAC, DTS: 1010, PTS: 1010, Payload: []byte{0x21, 0x10, 0x04}},
+		{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, DTS: 1040, PTS: 1040, Payload: codec.EncodeAVCC([][]byte{{0x41, 0x9a, 0x02}})},
+	}
+}
+
+func TestMuxDemux(t *testing.T) {
+	var ts bytes.Buffer
+	muxer := NewMuxer(&ts)
+	for _, pkt := range testPackets() {
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ts.Len()%PacketSize != 0 {
+		t.Fatalf("unaligned ts length %d", ts.Len())
+	}
+	var got []*proto.BasePacket
+	demuxer := NewDemuxer(func(pkt *proto.BasePacket) {
+		got = append(got, pkt)
+	})
+	//garbage in front and odd chunk sizes
+	data := append([]byte{1, 2, 3}, ts.Bytes()...)
+	for len(data) > 0 {
+		n := 100
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := demuxer.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	demuxer.Flush()
+
+	var video, audio []*proto.BasePacket
+	for _, pkt := range got {
+		if pkt.IsVideo() {
+			video = append(video, pkt)
+		} else {
+			audio = append(audio, pkt)
+		}
+	}
+	expected := testPackets()
+	if len(video) != 3 || !video[0].SeqHeader || !bytes.Equal(video[0].Payload, expected[0].Payload) {
+		t.Fatalf("unexpected video %+v", video)
+	}
+	for i, pkt := range video[1:] {
+		want := expected[2+2*i]
+		if pkt.DTS != want.DTS || pkt.PTS != want.PTS || pkt.KeyFrame != want.KeyFrame {
+			t.Fatalf("unexpected video timestamps %+v", pkt)
+		}
+	}
+	nalus, _ := codec.DecodeAVCC(video[1].Payload)
+	wantNalus, _ := codec.DecodeAVCC(expected[2].Payload)
+	if len(nalus) != 3 || !bytes.Equal(nalus[2], wantNalus[0]) {
+		t.Fatalf("keyframe must carry sps, pps and idr, got %d units", len(nalus))
+	}
+	if len(audio) != 2 || !bytes.Equal(audio[0].Payload, testASC) || !bytes.Equal(audio[1].Payload, expected[3].Payload) || audio[1].PTS != 1010 {
+		t.Fatalf("unexpected audio %+v", audio)
+	}
+}
+
+func TestDemuxContinuityGap(t *testing.T) {
+	var ts bytes.Buffer
+	muxer := NewMuxer(&ts)
+	for _, pkt := range testPackets()[:3] {
+		_ = muxer.WritePacket(pkt)
+	}
+	data := ts.Bytes()
+	//drop the second packet of the keyframe pes, after PAT, PMT and its first packet
+	data = append(data[:3*PacketSize:3*PacketSize], data[4*PacketSize:]...)
+	var frames int
+	demuxer := NewDemuxer(func(pkt *proto.BasePacket) {
+		if !pkt.SeqHeader {
+			frames++
+		}
+	})
+	_ = demuxer.Write(data)
+	demuxer.Flush()
+	if frames != 0 || demuxer.Discontinuities != 1 {
+		t.Fatalf("broken pes must be dropped, got %d frames %d discontinuities", frames, demuxer.Discontinuities)
+	}
+}
+
+func TestTimestampWraparound(t *testing.T) {
+	u := timestampUnwrapper{}
+	u.unwrap(timestampMask - 90)
+	if ts := u.unwrap(90); ts != timestampMask+91 {
+		t.Fatalf("unexpected unwrapped timestamp %d", ts)
+	}
+}
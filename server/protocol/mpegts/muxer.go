@@ -0,0 +1,267 @@
+package mpegts
+
+import (
+	"encoding/binary"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"io"
+)
+
+// tables are repeated at video keyframes, audio only streams repeat them every audioTableInterval packets
+const audioTableInterval = 50
+
+type muxStream struct {
+	pid        uint16
+	streamType byte
+	streamID   byte
+	cc         byte
+	codec      constdef.CodecID
+	paramSets  [][]byte
+	adts       *codec.ADTSHeader
+}
+
+// Muxer writes media packets as a transport stream with one program, sequence headers configure the streams
+type Muxer struct {
+	w             io.Writer
+	video         *muxStream
+	audio         *muxStream
+	patCC         byte
+	pmtCC         byte
+	pmtVersion    byte
+	tablesPending bool
+	audioPackets  int
+	pkt           [PacketSize]byte
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	m := &Muxer{}
+	m.w = w
+	return m
+}
+
+func (m *Muxer) WritePacket(pkt *proto.BasePacket) error {
+	if pkt.SeqHeader {
+		m.configure(pkt)
+		return nil
+	}
+	s := m.audio
+	if pkt.IsVideo() {
+		s = m.video
+	}
+	if s == nil || s.codec != pkt.Codec {
+		return nil
+	}
+	if m.video == nil && pkt.IsAudio() {
+		m.audioPackets++
+		if m.audioPackets%audioTableInterval == 1 {
+			m.tablesPending = true
+		}
+	}
+	if m.tablesPending || (pkt.IsVideo() && pkt.KeyFrame) {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+		m.tablesPending = false
+	}
+	var payload []byte
+	if pkt.IsVideo() {
+		nalus, err := codec.DecodeAVCC(pkt.Payload)
+		if err != nil {
+			return err
+		}
+		if s.codec == constdef.CodecH264 {
+			payload = append(payload, 0, 0, 0, 1, codec.H264NaluAUD, 0xf0)
+		} else {
+			payload = append(payload, 0, 0, 0, 1, codec.H265NaluAUD<<1, 1, 0x50)
+		}
+		if pkt.KeyFrame {
+			payload = append(payload, codec.EncodeAnnexB(s.paramSets)...)
+		}
+		payload = append(payload, codec.EncodeAnnexB(nalus)...)
+	} else {
+		payload = s.adts.Append(nil, pkt.Payload)
+	}
+	return m.writePES(s, pkt, payload)
+}
+
+// configure sets up a stream from its sequence header, a new stream bumps the pmt version
+func (m *Muxer) configure(pkt *proto.BasePacket) {
+	var s *muxStream
+	switch pkt.Codec {
+	case constdef.CodecH264:
+		sps, pps, err := codec.ParseAVCDecoderConfig(pkt.Payload)
+		if err != nil {
+			return
+		}
+		s = &muxStream{pid: pidVideo, streamType: streamTypeH264, streamID: streamIDVideo, paramSets: [][]byte{sps, pps}}
+	case constdef.CodecH265:
+		vps, sps, pps, err := codec.ParseHEVCDecoderConfig(pkt.Payload)
+		if err != nil {
+			return
+		}
+		s = &muxStream{pid: pidVideo, streamType: streamTypeH265, streamID: streamIDVideo, paramSets: [][]byte{vps, sps, pps}}
+	case constdef.CodecAAC:
+		config, err := codec.ParseAudioSpecificConfig(pkt.Payload)
+		if err != nil {
+			return
+		}
+		h, err := codec.NewADTSHeader(config)
+		if err != nil {
+			return
+		}
+		s = &muxStream{pid: pidAudio, streamType: streamTypeAAC, streamID: streamIDAudio, adts: h}
+	default:
+		return
+	}
+	s.codec = pkt.Codec
+	old := m.audio
+	if pkt.IsVideo() {
+		old = m.video
+	}
+	if old != nil {
+		s.cc = old.cc
+		if old.streamType == s.streamType {
+			//same stream with new parameters
+			*old = *s
+			return
+		}
+	}
+	if pkt.IsVideo() {
+		m.video = s
+	} else {
+		m.audio = s
+	}
+	m.pmtVersion = (m.pmtVersion + 1) & 0x1f
+	m.tablesPending = true
+}
+
+func (m *Muxer) pcrPID() uint16 {
+	if m.video != nil {
+		return m.video.pid
+	}
+	return pidAudio
+}
+
+func (m *Muxer) writeTables() error {
+	pat := []byte{tableIDPAT, 0, 0, 0, 1, 0xc1, 0, 0, 0, 1, 0xe0 | pidPMT>>8, pidPMT & 0xff}
+	if err := m.writeSection(pidPAT, &m.patCC, pat); err != nil {
+		return err
+	}
+	pcrPID := m.pcrPID()
+	pmt := []byte{tableIDPMT, 0, 0, 0, 1, 0xc1 | m.pmtVersion<<1, 0, 0, 0xe0 | byte(pcrPID>>8), byte(pcrPID), 0xf0, 0}
+	for _, s := range []*muxStream{m.video, m.audio} {
+		if s != nil {
+			pmt = append(pmt, s.streamType, 0xe0|byte(s.pid>>8), byte(s.pid), 0xf0, 0)
+		}
+	}
+	return m.writeSection(pidPMT, &m.pmtCC, pmt)
+}
+
+// writeSection fills in the section length and crc and writes it as one packet
+func (m *Muxer) writeSection(pid uint16, cc *byte, section []byte) error {
+	length := len(section) - 3 + 4
+	section[1] = 0xb0 | byte(length>>8)
+	section[2] = byte(length)
+	crc := crc32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	p := m.pkt[:]
+	p[0] = syncByte
+	p[1] = 0x40 | byte(pid>>8)
+	p[2] = byte(pid)
+	p[3] = 0x10 | *cc
+	*cc = (*cc + 1) & 0x0f
+	p[4] = 0
+	n := copy(p[5:], section)
+	for i := 5 + n; i < PacketSize; i++ {
+		p[i] = 0xff
+	}
+	_, err := m.w.Write(p)
+	return err
+}
+
+func appendTimestamp(buf []byte, prefix byte, ts int64) []byte {
+	ts &= timestampMask
+	return append(buf,
+		prefix<<4|byte(ts>>29)&0x0e|1,
+		byte(ts>>22),
+		byte(ts>>14)|1,
+		byte(ts>>7),
+		byte(ts<<1)|1,
+	)
+}
+
+func (m *Muxer) writePES(s *muxStream, pkt *proto.BasePacket, payload []byte) error {
+	pts := pkt.PTS * clockRate
+	dts := pkt.DTS * clockRate
+	header := []byte{0, 0, 1, s.streamID, 0, 0, 0x80, 0x80, 5}
+	if pts != dts {
+		header[7] = 0xc0
+		header[8] = 10
+		header = appendTimestamp(header, 0x03, pts)
+		header = appendTimestamp(header, 0x01, dts)
+	} else {
+		header = appendTimestamp(header, 0x02, pts)
+	}
+	if length := len(header) - 6 + len(payload); length <= 0xffff && s.streamID == streamIDAudio {
+		binary.BigEndian.PutUint16(header[4:6], uint16(length))
+	}
+	data := append(header, payload...)
+	first := true
+	for len(data) > 0 {
+		p := m.pkt[:]
+		p[0] = syncByte
+		p[1] = byte(s.pid >> 8)
+		if first {
+			p[1] |= 0x40
+		}
+		p[2] = byte(s.pid)
+		p[3] = s.cc
+		s.cc = (s.cc + 1) & 0x0f
+		pos := 4
+		var adaptation []byte
+		if first && s.pid == m.pcrPID() {
+			flags := byte(0x10)
+			if pkt.KeyFrame || s.streamID == streamIDAudio {
+				flags |= 0x40
+			}
+			pcr := dts & timestampMask
+			adaptation = []byte{flags, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7) | 0x7e, 0}
+		}
+		room := PacketSize - pos
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+		if len(data) < room {
+			//stuff the adaptation field so the payload ends the packet
+			if adaptation == nil {
+				adaptation = []byte{}
+				room--
+			}
+			stuffing := room - len(data)
+			if len(adaptation) == 0 && stuffing > 0 {
+				adaptation = append(adaptation, 0)
+				stuffing--
+			}
+			for i := 0; i < stuffing; i++ {
+				adaptation = append(adaptation, 0xff)
+			}
+			room = len(data)
+		}
+		if adaptation != nil {
+			p[3] |= 0x30
+			p[4] = byte(len(adaptation))
+			copy(p[5:], adaptation)
+			pos = 5 + len(adaptation)
+		} else {
+			p[3] |= 0x10
+		}
+		copy(p[pos:], data[:room])
+		data = data[room:]
+		first = false
+		if _, err := m.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package mpegts
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"net/url"
+	"sync"
+)
+
+// Publisher demuxes a transport stream written in chunks of any size into a source session
+type Publisher struct {
+	ctx      context.Context
+	hyStream *stream.HyStream
+	source   session.SourceSessionI
+	demuxer  *Demuxer
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewPublisher(ctx context.Context, u *url.URL) *Publisher {
+	p := &Publisher{}
+	p.ctx = ctx
+	p.source = session.NewSourceSession(ctx, p)
+	p.hyStream = stream.NewHyStream0(u, p.source)
+	p.demuxer = NewDemuxer(func(pkt *proto.BasePacket) {
+		_ = p.OnMedia(p.ctx, pkt.MediaType, pkt)
+	})
+	return p
+}
+
+func (p *Publisher) HyStream() *stream.HyStream {
+	return p.hyStream
+}
+
+// SetPeer tells the admin api where the stream comes from and how to end it
+func (p *Publisher) SetPeer(peer *proto.Peer) {
+	p.source.SetPeer(peer)
+}
+
+// Write never fails, broken packets are skipped so a noisy source keeps publishing
+func (p *Publisher) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return len(data), nil
+	}
+	if err := p.demuxer.Write(data); err != nil {
+		log.Debugf(p.ctx, "ts demux: %+v", err)
+	}
+	return len(data), nil
+}
+
+func (p *Publisher) OnInit(ctx context.Context) {
+}
+
+func (p *Publisher) OnMedia(ctx context.Context, mediaType protocol.MediaDataType, data interface{}) error {
+	pkt, ok := data.(*proto.BasePacket)
+	if !ok {
+		return fmt.Errorf("unexpected media %T for %d", data, mediaType)
+	}
+	p.source.Push(ctx, pkt)
+	return nil
+}
+
+func (p *Publisher) OnClose() error {
+	stream.DefaultHyStreamManager.RemoveStreamIfMatch(p.hyStream)
+	p.source.Close()
+	return nil
+}
+
+// Close emits the pending pes packets and ends the stream
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	p.demuxer.Flush()
+	return p.OnClose()
+}
@@ -0,0 +1,70 @@
+package mpegts
+
+const (
+	PacketSize = 188
+	syncByte   = 0x47
+
+	pidPAT   = 0x0000
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+	streamTypeH265 = 0x24
+
+	streamIDVideo = 0xe0
+	streamIDAudio = 0xc0
+
+	tableIDPAT = 0x00
+	tableIDPMT = 0x02
+
+	// timestamps are 33 bit in a 90kHz clock
+	clockRate     = 90
+	timestampMask = 1<<33 - 1
+)
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32 is the MPEG-2 checksum of the psi sections
+func crc32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// timestampUnwrapper extends 33 bit timestamps so they keep increasing across wraparound
+type timestampUnwrapper struct {
+	started bool
+	last    int64
+}
+
+func (u *timestampUnwrapper) unwrap(ts int64) int64 {
+	if !u.started {
+		u.started = true
+		u.last = ts
+		return ts
+	}
+	diff := (ts - u.last) & timestampMask
+	if diff > timestampMask/2 {
+		diff -= timestampMask + 1
+	}
+	u.last += diff
+	return u.last
+}
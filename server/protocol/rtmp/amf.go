@@ -0,0 +1,60 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/yutopp/go-amf0"
+	"io"
+)
+
+// decodeAMF0 decodes every value of a command or data message body
+func decodeAMF0(payload []byte) ([]interface{}, error) {
+	var values []interface{}
+	d := amf0.NewDecoder(bytes.NewReader(payload))
+	for {
+		var v interface{}
+		err := d.Decode(&v)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return values, nil
+			}
+			return values, err
+		}
+		values = append(values, v)
+	}
+}
+
+func encodeAMF0(values ...interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	e := amf0.NewEncoder(buf)
+	for _, v := range values {
+		if err := e.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func amfString(values []interface{}, idx int) string {
+	if idx >= len(values) {
+		return ""
+	}
+	s, _ := values[idx].(string)
+	return s
+}
+
+func amfNumber(values []interface{}, idx int) float64 {
+	if idx >= len(values) {
+		return 0
+	}
+	n, _ := values[idx].(float64)
+	return n
+}
+
+func amfObject(values []interface{}, idx int) map[string]interface{} {
+	if idx >= len(values) {
+		return nil
+	}
+	obj, _ := values[idx].(map[string]interface{})
+	return obj
+}
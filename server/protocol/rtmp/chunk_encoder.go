@@ -0,0 +1,135 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// the longest chunk header, a three byte basic header, a fmt 0 message header and an extended timestamp
+const maxChunkHeader = 18
+
+// buffersWriter takes the chunks of a message in one call, hynet.IHyConn does
+type buffersWriter interface {
+	WriteBuffers(bufs net.Buffers) (int64, error)
+}
+
+// messageWriter is told where messages end, it flushes by its policy
+type messageWriter interface {
+	EndMessage() error
+}
+
+// chunkEncoder splits messages into chunks, commands and media are written from different goroutines
+type chunkEncoder struct {
+	mu        sync.Mutex
+	w         io.Writer
+	chunkSize uint32
+	//chunk headers and the header and payload pairs of the message being written
+	headers []byte
+	bufs    net.Buffers
+}
+
+func newChunkEncoder(w io.Writer) *chunkEncoder {
+	return &chunkEncoder{
+		w:         w,
+		chunkSize: defaultChunkSize,
+	}
+}
+
+func (ce *chunkEncoder) setChunkSize(size uint32) {
+	ce.mu.Lock()
+	ce.chunkSize = size
+	ce.mu.Unlock()
+}
+
+// writeMessage writes every chunk of msg with one call to the writer
+func (ce *chunkEncoder) writeMessage(msg *rtmpMessage) error {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	payload := msg.payload
+	extended := msg.timestamp >= 0xffffff
+	chunks := (len(payload) + int(ce.chunkSize) - 1) / int(ce.chunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	//the headers are sliced out of one array, it must not grow under them
+	if cap(ce.headers) < chunks*maxChunkHeader {
+		ce.headers = make([]byte, 0, chunks*maxChunkHeader)
+	}
+	headers := ce.headers[:0]
+	bufs := ce.bufs[:0]
+	first := true
+	for first || len(payload) > 0 {
+		start := len(headers)
+		if first {
+			headers = appendFmt0(headers, msg, extended)
+			first = false
+		} else {
+			headers = appendBasicHeader(headers, 3, msg.csID)
+			if extended {
+				headers = append(headers, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(headers[len(headers)-4:], msg.timestamp)
+			}
+		}
+		bufs = append(bufs, headers[start:])
+		size := uint32(len(payload))
+		if size > ce.chunkSize {
+			size = ce.chunkSize
+		}
+		if size > 0 {
+			bufs = append(bufs, payload[:size])
+		}
+		payload = payload[size:]
+	}
+	ce.bufs = bufs
+	var err error
+	if w, ok := ce.w.(buffersWriter); ok {
+		_, err = w.WriteBuffers(bufs)
+	} else {
+		_, err = bufs.WriteTo(ce.w)
+	}
+	//the payload is not kept until the next message
+	for i := range ce.bufs {
+		ce.bufs[i] = nil
+	}
+	if err != nil {
+		return err
+	}
+	if w, ok := ce.w.(messageWriter); ok {
+		return w.EndMessage()
+	}
+	return nil
+}
+
+func appendBasicHeader(h []byte, fmt0 byte, csID int) []byte {
+	switch {
+	case csID < 64:
+		h = append(h, fmt0<<6|byte(csID))
+	case csID < 320:
+		h = append(h, fmt0<<6, byte(csID-64))
+	default:
+		id := csID - 64
+		h = append(h, fmt0<<6|1, byte(id), byte(id>>8))
+	}
+	return h
+}
+
+func appendFmt0(h []byte, msg *rtmpMessage, extended bool) []byte {
+	h = appendBasicHeader(h, 0, msg.csID)
+	var mh [11]byte
+	if extended {
+		putUint24(mh[0:3], 0xffffff)
+	} else {
+		putUint24(mh[0:3], msg.timestamp)
+	}
+	putUint24(mh[3:6], uint32(len(msg.payload)))
+	mh[6] = byte(msg.typeID)
+	binary.LittleEndian.PutUint32(mh[7:11], msg.streamID)
+	h = append(h, mh[:]...)
+	if extended {
+		h = append(h, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(h[len(h)-4:], msg.timestamp)
+	}
+	return h
+}
@@ -0,0 +1,55 @@
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// batchWriter counts the calls of the encoder
+type batchWriter struct {
+	bytes.Buffer
+	batches  int
+	messages int
+}
+
+func (w *batchWriter) WriteBuffers(bufs net.Buffers) (int64, error) {
+	w.batches++
+	return bufs.WriteTo(&w.Buffer)
+}
+
+func (w *batchWriter) EndMessage() error {
+	w.messages++
+	return nil
+}
+
+func TestChunkEncoder(t *testing.T) {
+	w := &batchWriter{}
+	ce := newChunkEncoder(w)
+	ce.setChunkSize(4096)
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	msgs := []*rtmpMessage{
+		{csID: csIDVideo, timestamp: 40, typeID: TypeIDVideoMessage, streamID: mediaStreamID, payload: payload},
+		{csID: 400, timestamp: 0x1000000, typeID: TypeIDAudioMessage, streamID: mediaStreamID, payload: payload[:5000]},
+		{csID: csIDProtocolControl, typeID: TypeIDUserCtrl, payload: nil},
+	}
+	for _, msg := range msgs {
+		if err := ce.writeMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.batches != 3 || w.messages != 3 {
+		t.Fatalf("expect one batch and one end per message, got %d and %d", w.batches, w.messages)
+	}
+	cs := newChunkStream(&w.Buffer)
+	_ = cs.setChunkSize(4096)
+	got, err := decodeAll(cs)
+	if len(got) != len(msgs) {
+		t.Fatalf("expect %d messages back, got %d: %v", len(msgs), len(got), err)
+	}
+	for i, msg := range msgs {
+		if got[i].csID != msg.csID || got[i].timestamp != msg.timestamp || got[i].typeID != msg.typeID || !bytes.Equal(got[i].payload, msg.payload) {
+			t.Errorf("message %d: expect %+v, got %+v", i, msg, got[i])
+		}
+	}
+}
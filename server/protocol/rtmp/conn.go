@@ -7,11 +7,17 @@ import (
 	"github.com/Opafanls/hylan/server/task"
 )
 
+// DefaultWriteBuffer is the write buffer of a connection when the config has none, a negative one writes
+// every message with one writev
+const DefaultWriteBuffer = 64 * 1024
+
 // Server is a RTMP connection.
 type Server struct {
 	ctx     context.Context
 	config  *hynet.TcpListenConfig
 	running bool
+	//bounds the messages of every connection, zero fields take DefaultLimits
+	Limits Limits
 	*hynet.TcpServer
 }
 
@@ -29,6 +35,9 @@ func (s *Server) Start() error {
 func (s *Server) Init() error {
 	s.ctx = log.GetCtxWithLogID(context.Background(), "RTMP_SERVER")
 	tcpServer := hynet.NewTcpServer(s.ctx, s.config.Addr, s.config.Port)
+	tcpServer.TLSConfig = s.config.TLS
+	tcpServer.Access = s.config.Access
+	tcpServer.Proxy = s.config.Proxy
 	s.TcpServer = tcpServer
 	if err := s.TcpServer.Init(); err != nil {
 		return err
@@ -40,7 +49,16 @@ func (s *Server) Init() error {
 func (s *Server) HandleConn(conn hynet.IHyConn) {
 	//accept tcp connection
 	task.SubmitTask0(s.ctx, func() {
-		rtmpHandler := NewRtmpHandler(log.GetCtxWithLogID(context.Background(), ""), conn)
-		rtmpHandler.OnInit()
+		ctx := log.GetCtxWithLogID(context.Background(), "")
+		rtmpHandler := NewRtmpHandler(ctx, conn)
+		rtmpHandler.access = s.config.Access
+		rtmpHandler.timeouts = s.config.Timeouts
+		rtmpHandler.setLimits(s.Limits)
+		rtmpHandler.writeBuffer = s.config.WriteBuffer
+		if rtmpHandler.writeBuffer == 0 {
+			rtmpHandler.writeBuffer = DefaultWriteBuffer
+		}
+		rtmpHandler.flush = s.config.Flush
+		rtmpHandler.OnInit(ctx)
 	})
 }
@@ -0,0 +1,239 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+)
+
+const (
+	flvVideoCodecAVC  = 7
+	flvVideoCodecHEVC = 12
+
+	flvSoundFormatMP3    = 2
+	flvSoundFormatExHead = 9
+	flvSoundFormatAAC    = 10
+	flvSoundFormatMP38K  = 14
+
+	flvFrameKey   = 1
+	flvFrameInter = 2
+
+	flvAVCSeqHeader = 0
+	flvAVCNALU      = 1
+
+	//enhanced rtmp packet types
+	exPacketTypeSequenceStart = 0
+	exPacketTypeCodedFrames   = 1
+	exPacketTypeSequenceEnd   = 2
+	exPacketTypeCodedFramesX  = 3
+
+	//enhanced rtmp audio packet types
+	exAudioPacketTypeSequenceStart      = 0
+	exAudioPacketTypeCodedFrames        = 1
+	exAudioPacketTypeSequenceEnd        = 2
+	exAudioPacketTypeMultichannelConfig = 4
+)
+
+var (
+	fourCCAVC  = [4]byte{'a', 'v', 'c', '1'}
+	fourCCHEVC = [4]byte{'h', 'v', 'c', '1'}
+	fourCCAAC  = [4]byte{'m', 'p', '4', 'a'}
+	fourCCOpus = [4]byte{'O', 'p', 'u', 's'}
+	fourCCMP3  = [4]byte{'.', 'm', 'p', '3'}
+)
+
+func sint24(b []byte) int32 {
+	v := int32(uint24(b))
+	if v&0x800000 != 0 {
+		v -= 0x1000000
+	}
+	return v
+}
+
+// parseVideoTag turns a flv video tag body into a packet, legacy and enhanced rtmp headers are supported
+func parseVideoTag(timestamp uint32, data []byte) (*proto.BasePacket, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty video tag")
+	}
+	pkt := &proto.BasePacket{
+		MediaType: protocol.MediaDataTypeVideo,
+		DTS:       int64(timestamp),
+		PTS:       int64(timestamp),
+	}
+	if data[0]&0x80 != 0 {
+		//enhanced rtmp: IsExHeader | FrameType(3) | PacketType(4) | FourCC
+		if len(data) < 5 {
+			return nil, fmt.Errorf("short enhanced video tag")
+		}
+		frameType := (data[0] >> 4) & 0x07
+		packetType := data[0] & 0x0f
+		var fourCC [4]byte
+		copy(fourCC[:], data[1:5])
+		switch fourCC {
+		case fourCCAVC:
+			pkt.Codec = constdef.CodecH264
+		case fourCCHEVC:
+			pkt.Codec = constdef.CodecH265
+		default:
+			return nil, fmt.Errorf("unsupported video fourcc %s", string(fourCC[:]))
+		}
+		pkt.KeyFrame = frameType == flvFrameKey
+		body := data[5:]
+		switch packetType {
+		case exPacketTypeSequenceStart:
+			pkt.SeqHeader = true
+		case exPacketTypeCodedFrames:
+			if len(body) < 3 {
+				return nil, fmt.Errorf("short coded frames")
+			}
+			pkt.PTS += int64(sint24(body[:3]))
+			body = body[3:]
+		case exPacketTypeCodedFramesX:
+		default:
+			return nil, nil
+		}
+		pkt.Payload = body
+		return pkt, nil
+	}
+	frameType := data[0] >> 4
+	codecID := data[0] & 0x0f
+	switch codecID {
+	case flvVideoCodecAVC:
+		pkt.Codec = constdef.CodecH264
+	case flvVideoCodecHEVC:
+		pkt.Codec = constdef.CodecH265
+	default:
+		return nil, fmt.Errorf("unsupported flv video codec %d", codecID)
+	}
+	if len(data) < 5 {
+		return nil, fmt.Errorf("short avc video tag")
+	}
+	pkt.KeyFrame = frameType == flvFrameKey
+	switch data[1] {
+	case flvAVCSeqHeader:
+		pkt.SeqHeader = true
+	case flvAVCNALU:
+		pkt.PTS += int64(sint24(data[2:5]))
+	default:
+		//end of sequence
+		return nil, nil
+	}
+	pkt.Payload = data[5:]
+	return pkt, nil
+}
+
+// parseAudioTag turns a flv audio tag body into a packet, legacy and enhanced rtmp headers are supported
+func parseAudioTag(timestamp uint32, data []byte) (*proto.BasePacket, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty audio tag")
+	}
+	pkt := &proto.BasePacket{
+		MediaType: protocol.MediaDataTypeAudio,
+		DTS:       int64(timestamp),
+		PTS:       int64(timestamp),
+	}
+	soundFormat := data[0] >> 4
+	switch soundFormat {
+	case flvSoundFormatAAC:
+		if len(data) < 2 {
+			return nil, fmt.Errorf("short aac audio tag")
+		}
+		pkt.Codec = constdef.CodecAAC
+		pkt.SeqHeader = data[1] == 0
+		pkt.Payload = data[2:]
+	case flvSoundFormatMP3, flvSoundFormatMP38K:
+		pkt.Codec = constdef.CodecMP3
+		pkt.Payload = data[1:]
+	case flvSoundFormatExHead:
+		//enhanced rtmp: SoundFormat(4) | AudioPacketType(4) | FourCC
+		if len(data) < 5 {
+			return nil, fmt.Errorf("short enhanced audio tag")
+		}
+		var fourCC [4]byte
+		copy(fourCC[:], data[1:5])
+		switch fourCC {
+		case fourCCAAC:
+			pkt.Codec = constdef.CodecAAC
+		case fourCCOpus:
+			pkt.Codec = constdef.CodecOpus
+		case fourCCMP3:
+			pkt.Codec = constdef.CodecMP3
+		default:
+			return nil, fmt.Errorf("unsupported audio fourcc %s", string(fourCC[:]))
+		}
+		switch data[0] & 0x0f {
+		case exAudioPacketTypeSequenceStart:
+			pkt.SeqHeader = true
+		case exAudioPacketTypeCodedFrames:
+		case exAudioPacketTypeSequenceEnd, exAudioPacketTypeMultichannelConfig:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("unsupported audio packet type %d", data[0]&0x0f)
+		}
+		pkt.Payload = data[5:]
+	default:
+		return nil, fmt.Errorf("unsupported flv sound format %d", soundFormat)
+	}
+	return pkt, nil
+}
+
+// packVideoTag builds the flv video tag body of pkt, hevc goes out as enhanced rtmp
+func packVideoTag(pkt *proto.BasePacket) []byte {
+	frameType := byte(flvFrameInter)
+	if pkt.KeyFrame || pkt.SeqHeader {
+		frameType = flvFrameKey
+	}
+	cts := uint32(pkt.PTS - pkt.DTS)
+	switch pkt.Codec {
+	case constdef.CodecH264:
+		tag := make([]byte, 5, 5+len(pkt.Payload))
+		tag[0] = frameType<<4 | flvVideoCodecAVC
+		if pkt.SeqHeader {
+			tag[1] = flvAVCSeqHeader
+		} else {
+			tag[1] = flvAVCNALU
+			putUint24(tag[2:5], cts)
+		}
+		return append(tag, pkt.Payload...)
+	case constdef.CodecH265:
+		tag := make([]byte, 8, 8+len(pkt.Payload))
+		copy(tag[1:5], fourCCHEVC[:])
+		if pkt.SeqHeader {
+			tag[0] = 0x80 | frameType<<4 | exPacketTypeSequenceStart
+			tag = tag[:5]
+		} else {
+			tag[0] = 0x80 | frameType<<4 | exPacketTypeCodedFrames
+			putUint24(tag[5:8], cts)
+		}
+		return append(tag, pkt.Payload...)
+	}
+	return nil
+}
+
+// packAudioTag builds the flv audio tag body of pkt, opus goes out as enhanced rtmp
+func packAudioTag(pkt *proto.BasePacket) []byte {
+	switch pkt.Codec {
+	case constdef.CodecAAC:
+		tag := make([]byte, 2, 2+len(pkt.Payload))
+		//aac is always signalled as 44kHz 16bit stereo, the real config is in the sequence header
+		tag[0] = flvSoundFormatAAC<<4 | 0x0f
+		if !pkt.SeqHeader {
+			tag[1] = 1
+		}
+		return append(tag, pkt.Payload...)
+	case constdef.CodecMP3:
+		tag := make([]byte, 1, 1+len(pkt.Payload))
+		tag[0] = flvSoundFormatMP3<<4 | 0x0f
+		return append(tag, pkt.Payload...)
+	case constdef.CodecOpus:
+		tag := make([]byte, 5, 5+len(pkt.Payload))
+		tag[0] = flvSoundFormatExHead<<4 | exAudioPacketTypeCodedFrames
+		if pkt.SeqHeader {
+			tag[0] = flvSoundFormatExHead<<4 | exAudioPacketTypeSequenceStart
+		}
+		copy(tag[1:5], fourCCOpus[:])
+		return append(tag, pkt.Payload...)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build go1.18
+
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzChunkStream(f *testing.F) {
+	connect, _ := encodeAMF0("connect", 1, map[string]interface{}{"app": "live"})
+	msg := &bytes.Buffer{}
+	_ = newChunkEncoder(msg).writeMessage(&rtmpMessage{csID: csIDCommand, typeID: TypeIDCommandMessageAMF0, payload: connect})
+	f.Add(msg.Bytes())
+	f.Add(append(chunkHeader0(csIDVideo, 300, TypeIDVideoMessage), make([]byte, 128)...))
+	f.Add([]byte{0x46, 0, 0, 1, 0, 0, 4, 8, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cs := newChunkStream(bytes.NewBuffer(data))
+		cs.limits = Limits{MaxChunkStreams: 4, MaxBuffered: 4096}.withDefaults()
+		for {
+			msg, err := cs.decodeChunkStream()
+			if cs.buffered < 0 || cs.buffered > cs.limits.MaxBuffered+int(cs.chunkSize) {
+				t.Fatalf("buffered %d bytes", cs.buffered)
+			}
+			if len(cs.chunkStreams) > cs.limits.MaxChunkStreams {
+				t.Fatalf("%d chunk streams", len(cs.chunkStreams))
+			}
+			if err != nil {
+				return
+			}
+			if msg != nil && uint32(len(msg.payload)) > cs.limits.maxMessage(msg.typeID) {
+				t.Fatalf("%s message of %d bytes", msg.typeID, len(msg.payload))
+			}
+			if msg != nil && msg.typeID == TypeIDSetChunkSize && len(msg.payload) >= 4 {
+				_ = cs.setChunkSize(uint24(msg.payload[1:4]) | uint32(msg.payload[0]&0x7f)<<24)
+			}
+		}
+	})
+}
+
+func FuzzAMF0(f *testing.F) {
+	for _, values := range [][]interface{}{
+		{"connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://127.0.0.1/live"}},
+		{"@setDataFrame", "onMetaData", map[string]interface{}{"width": 1280.0, "stereo": true}},
+		{[]interface{}{1.0, nil, "a"}},
+	} {
+		payload, _ := encodeAMF0(values...)
+		f.Add(payload)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := DefaultLimits
+		if limits.checkAMF0(data) != nil {
+			return
+		}
+		//what the check lets through is left to the decoder, it must not panic
+		_, _ = decodeAMF0(data)
+	})
+}
@@ -0,0 +1,270 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/metrics"
+)
+
+// limit reasons, the label of the protocol error counter
+const (
+	ReasonMessageSize  = "message_size"
+	ReasonChunkStreams = "chunk_streams"
+	ReasonBuffered     = "buffered"
+	ReasonAMF          = "amf"
+)
+
+const (
+	//protocol control messages have a fixed size of a few bytes
+	maxControlMessage = 64
+	//a partial message grows by at most this much per read, so a peer only gets the memory it sent
+	readStep = 64 * 1024
+)
+
+var ErrLimit = errors.New("rtmp limit exceeded")
+
+// LimitError closes a connection that broke one of its Limits
+type LimitError struct {
+	Reason string
+	Detail string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Detail)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimit
+}
+
+func newLimitError(reason, format string, args ...interface{}) error {
+	metrics.ProtocolErrors.With("rtmp", reason).Inc()
+	return &LimitError{Reason: reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Limits bound what a peer can make a connection hold, a zero field takes the default
+type Limits struct {
+	//payload caps, aggregate messages count as video, commands, data, shared objects and unknown types as data
+	MaxVideoMessage uint32
+	MaxAudioMessage uint32
+	MaxDataMessage  uint32
+	//chunk stream ids with a header state
+	MaxChunkStreams int
+	//bytes of the messages not complete yet, over every chunk stream
+	MaxBuffered int
+	//nesting of objects and arrays, and the longest string or the most members of one value
+	MaxAMFDepth  int
+	MaxAMFLength int
+}
+
+var DefaultLimits = Limits{
+	MaxVideoMessage: 8 << 20,
+	MaxAudioMessage: 64 << 10,
+	MaxDataMessage:  256 << 10,
+	MaxChunkStreams: 64,
+	MaxBuffered:     16 << 20,
+	MaxAMFDepth:     16,
+	MaxAMFLength:    64 << 10,
+}
+
+func (l Limits) withDefaults() Limits {
+	d := DefaultLimits
+	if l.MaxVideoMessage == 0 {
+		l.MaxVideoMessage = d.MaxVideoMessage
+	}
+	if l.MaxAudioMessage == 0 {
+		l.MaxAudioMessage = d.MaxAudioMessage
+	}
+	if l.MaxDataMessage == 0 {
+		l.MaxDataMessage = d.MaxDataMessage
+	}
+	if l.MaxChunkStreams == 0 {
+		l.MaxChunkStreams = d.MaxChunkStreams
+	}
+	if l.MaxBuffered == 0 {
+		l.MaxBuffered = d.MaxBuffered
+	}
+	if l.MaxAMFDepth == 0 {
+		l.MaxAMFDepth = d.MaxAMFDepth
+	}
+	if l.MaxAMFLength == 0 {
+		l.MaxAMFLength = d.MaxAMFLength
+	}
+	return l
+}
+
+// maxMessage is the payload cap of a message type
+func (l *Limits) maxMessage(typeID TypeID) uint32 {
+	switch typeID {
+	case TypeIDSetChunkSize, TypeIDAbortMessage, TypeIDAck, TypeIDUserCtrl, TypeIDWinAckSize, TypeIDSetPeerBandwidth:
+		return maxControlMessage
+	case TypeIDVideoMessage, TypeIDAggregateMessage:
+		return l.MaxVideoMessage
+	case TypeIDAudioMessage:
+		return l.MaxAudioMessage
+	}
+	return l.MaxDataMessage
+}
+
+// amf0 markers
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0Reference   = 0x07
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+	amf0Date        = 0x0b
+	amf0LongString  = 0x0c
+	amf0Unsupported = 0x0d
+	amf0XMLDocument = 0x0f
+	amf0TypedObject = 0x10
+)
+
+// checkAMF0 walks the values of payload without decoding them, so the decoder only sees bodies
+// within the depth and length limits whose sizes all fit in the payload
+func (l *Limits) checkAMF0(payload []byte) error {
+	c := amfChecker{buf: payload, maxDepth: l.MaxAMFDepth, maxLength: l.MaxAMFLength}
+	for c.pos < len(c.buf) {
+		if err := c.value(1); err != nil {
+			return newLimitError(ReasonAMF, "%v at byte %d", err, c.pos)
+		}
+	}
+	return nil
+}
+
+type amfChecker struct {
+	buf       []byte
+	pos       int
+	maxDepth  int
+	maxLength int
+}
+
+func (c *amfChecker) need(n int) error {
+	if n < 0 || len(c.buf)-c.pos < n {
+		return errors.New("truncated value")
+	}
+	return nil
+}
+
+func (c *amfChecker) skip(n int) error {
+	if err := c.need(n); err != nil {
+		return err
+	}
+	c.pos += n
+	return nil
+}
+
+// length reads a size field of n bytes and checks it against the length limit
+func (c *amfChecker) length(n int) (int, error) {
+	if err := c.need(n); err != nil {
+		return 0, err
+	}
+	var size int
+	if n == 2 {
+		size = int(binary.BigEndian.Uint16(c.buf[c.pos:]))
+	} else {
+		size = int(binary.BigEndian.Uint32(c.buf[c.pos:]))
+	}
+	c.pos += n
+	if size < 0 || size > c.maxLength {
+		return 0, fmt.Errorf("length %d over %d", size, c.maxLength)
+	}
+	return size, nil
+}
+
+func (c *amfChecker) str(n int) error {
+	size, err := c.length(n)
+	if err != nil {
+		return err
+	}
+	return c.skip(size)
+}
+
+func (c *amfChecker) value(depth int) error {
+	if depth > c.maxDepth {
+		return fmt.Errorf("depth over %d", c.maxDepth)
+	}
+	if err := c.need(1); err != nil {
+		return err
+	}
+	marker := c.buf[c.pos]
+	c.pos++
+	switch marker {
+	case amf0Number:
+		return c.skip(8)
+	case amf0Boolean:
+		return c.skip(1)
+	case amf0String:
+		return c.str(2)
+	case amf0LongString, amf0XMLDocument:
+		return c.str(4)
+	case amf0Null, amf0Undefined, amf0Unsupported:
+		return nil
+	case amf0Reference:
+		return c.skip(2)
+	case amf0Date:
+		return c.skip(10)
+	case amf0Object:
+		return c.members(depth)
+	case amf0TypedObject:
+		if err := c.str(2); err != nil {
+			return err
+		}
+		return c.members(depth)
+	case amf0ECMAArray:
+		//the count is only a hint, the members end with the object end marker
+		if _, err := c.length(4); err != nil {
+			return err
+		}
+		return c.members(depth)
+	case amf0StrictArray:
+		count, err := c.length(4)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			if err = c.value(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported marker 0x%02x", marker)
+}
+
+// members walks the key value pairs of an object up to the empty key and the end marker
+func (c *amfChecker) members(depth int) error {
+	for n := 0; ; n++ {
+		if n > c.maxLength {
+			return fmt.Errorf("more than %d members", c.maxLength)
+		}
+		if err := c.need(2); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint16(c.buf[c.pos:]) == 0 {
+			if err := c.skip(2); err != nil {
+				return err
+			}
+			if err := c.need(1); err != nil {
+				return err
+			}
+			if c.buf[c.pos] != amf0ObjectEnd {
+				return fmt.Errorf("empty key without the object end")
+			}
+			c.pos++
+			return nil
+		}
+		if err := c.str(2); err != nil {
+			return err
+		}
+		if err := c.value(depth + 1); err != nil {
+			return err
+		}
+	}
+}
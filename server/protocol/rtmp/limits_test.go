@@ -0,0 +1,148 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// chunkHeader0 is a fmt 0 chunk header of a one byte csid
+func chunkHeader0(csID int, length uint32, typeID TypeID) []byte {
+	b := make([]byte, 12)
+	b[0] = byte(csID)
+	putUint24(b[4:7], length)
+	b[7] = byte(typeID)
+	return b
+}
+
+func decodeAll(cs *chunkStream) ([]*rtmpMessage, error) {
+	var msgs []*rtmpMessage
+	for {
+		msg, err := cs.decodeChunkStream()
+		if err != nil {
+			return msgs, err
+		}
+		if msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+}
+
+func expectLimit(t *testing.T, err error, reason string) {
+	t.Helper()
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Reason != reason || !errors.Is(err, ErrLimit) {
+		t.Fatalf("expect a %s limit error, got %v", reason, err)
+	}
+}
+
+func TestMessageLimits(t *testing.T) {
+	conn := &bytes.Buffer{}
+	cs := newChunkStream(conn)
+	cs.limits = Limits{MaxVideoMessage: 1000, MaxAudioMessage: 10}.withDefaults()
+	conn.Write(chunkHeader0(csIDVideo, 1000, TypeIDVideoMessage))
+	conn.Write(make([]byte, 128))
+	conn.Write(chunkHeader0(csIDAudio, 11, TypeIDAudioMessage))
+	msgs, err := decodeAll(cs)
+	expectLimit(t, err, ReasonMessageSize)
+	if len(msgs) != 0 || cs.buffered != 128 || cap(cs.chunkStreams[csIDVideo].buf) != 1000 {
+		t.Fatalf("expect a partial video, got %d messages and %d buffered", len(msgs), cs.buffered)
+	}
+
+	//a control message can not claim more than a few bytes whatever the limits
+	cs = newChunkStream(bytes.NewBuffer(chunkHeader0(csIDProtocolControl, 100, TypeIDUserCtrl)))
+	_, err = decodeAll(cs)
+	expectLimit(t, err, ReasonMessageSize)
+}
+
+func TestChunkLimits(t *testing.T) {
+	conn := &bytes.Buffer{}
+	cs := newChunkStream(conn)
+	cs.limits = Limits{MaxChunkStreams: 3, MaxBuffered: 200}.withDefaults()
+	for csID := 3; csID < 5; csID++ {
+		conn.Write(chunkHeader0(csID, 200, TypeIDVideoMessage))
+		conn.Write(make([]byte, 128))
+	}
+	msgs, err := decodeAll(cs)
+	expectLimit(t, err, ReasonBuffered)
+	if len(msgs) != 0 || cs.buffered != 128 {
+		t.Fatalf("expect the second partial message to be refused, got %d buffered", cs.buffered)
+	}
+
+	//an aborted message gives its bytes back
+	cs.abort(3)
+	conn.Reset()
+	for csID := 4; csID < 7; csID++ {
+		conn.Write(chunkHeader0(csID, 2, TypeIDAudioMessage))
+		conn.Write([]byte{0xaf, 1})
+	}
+	msgs, err = decodeAll(cs)
+	expectLimit(t, err, ReasonChunkStreams)
+	if len(msgs) != 2 || cs.buffered != 0 {
+		t.Fatalf("expect two messages before the chunk stream limit, got %d and %d buffered", len(msgs), cs.buffered)
+	}
+}
+
+func TestLargeChunkSize(t *testing.T) {
+	conn := &bytes.Buffer{}
+	cs := newChunkStream(conn)
+	if err := cs.setChunkSize(0x7fffffff); err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{1, 2, 3}, 100000)
+	conn.Write(chunkHeader0(csIDVideo, uint32(len(payload)), TypeIDVideoMessage))
+	conn.Write(payload)
+	msg, err := cs.decodeChunkStream()
+	if err != nil || msg == nil || !bytes.Equal(msg.payload, payload) || cs.buffered != 0 {
+		t.Fatalf("expect the whole message out of one chunk, got %v", err)
+	}
+
+	//a short peer leaves no more than what it sent and one read step
+	conn.Write(chunkHeader0(csIDVideo, 1<<20, TypeIDVideoMessage))
+	conn.Write(make([]byte, 10))
+	if _, err = cs.decodeChunkStream(); err == nil {
+		t.Fatal("expect the short chunk to fail")
+	}
+	if cp := cs.chunkStreams[csIDVideo]; cap(cp.buf) > readStep {
+		t.Fatalf("expect the buffer to follow the reads, got %d bytes", cap(cp.buf))
+	}
+}
+
+func TestCheckAMF0(t *testing.T) {
+	limits := Limits{MaxAMFDepth: 3, MaxAMFLength: 100}.withDefaults()
+	connect, err := encodeAMF0("connect", 1, map[string]interface{}{"app": "live", "list": []interface{}{1.0, "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = limits.checkAMF0(connect); err != nil {
+		t.Fatalf("expect a connect command to pass, got %v", err)
+	}
+
+	nested := []interface{}{[]interface{}{[]interface{}{1.0}}}
+	for name, c := range map[string]struct {
+		payload []byte
+		err     string
+	}{
+		"depth":     {mustAMF0(t, nested), "depth over 3"},
+		"string":    {mustAMF0(t, strings.Repeat("a", 101)), "length 101 over 100"},
+		"array":     {[]byte{amf0StrictArray, 0xff, 0xff, 0xff, 0xff}, "over 100"},
+		"truncated": {connect[:len(connect)-3], "truncated"},
+		"object":    {[]byte{amf0Object, 0, 0, amf0Null}, "object end"},
+		"marker":    {[]byte{0x11}, "unsupported marker 0x11"},
+	} {
+		err = limits.checkAMF0(c.payload)
+		expectLimit(t, err, ReasonAMF)
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expect %q in %v", name, c.err, err)
+		}
+	}
+}
+
+func mustAMF0(t *testing.T, values ...interface{}) []byte {
+	payload, err := encodeAMF0(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
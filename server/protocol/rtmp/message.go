@@ -23,3 +23,56 @@ type NetConnectionConnectCommand struct {
 	VideoFunction  int          `mapstructure:"videoFunction" amf0:"videoFunction"`
 	ObjectEncoding EncodingType `mapstructure:"objectEncoding" amf0:"objectEncoding"`
 }
+
+type rtmpMessage struct {
+	csID      int
+	timestamp uint32
+	typeID    TypeID
+	streamID  uint32
+	payload   []byte
+}
+
+func (msg *rtmpMessage) TypeID() TypeID {
+	return msg.typeID
+}
+
+const (
+	csIDProtocolControl = 2
+	csIDCommand         = 3
+	csIDAudio           = 4
+	csIDVideo           = 6
+	csIDData            = 5
+)
+
+const (
+	UserCtrlStreamBegin      uint16 = 0
+	UserCtrlStreamEOF        uint16 = 1
+	UserCtrlStreamIsRecorded uint16 = 4
+	UserCtrlPingRequest      uint16 = 6
+	UserCtrlPingResponse     uint16 = 7
+)
+
+func parseConnectCommand(obj map[string]interface{}) *NetConnectionConnectCommand {
+	cmd := &NetConnectionConnectCommand{}
+	cmd.App, _ = obj["app"].(string)
+	cmd.Type, _ = obj["type"].(string)
+	cmd.FlashVer, _ = obj["flashVer"].(string)
+	cmd.TCURL, _ = obj["tcUrl"].(string)
+	cmd.Fpad, _ = obj["fpad"].(bool)
+	if v, ok := obj["capabilities"].(float64); ok {
+		cmd.Capabilities = int(v)
+	}
+	if v, ok := obj["audioCodecs"].(float64); ok {
+		cmd.AudioCodecs = int(v)
+	}
+	if v, ok := obj["videoCodecs"].(float64); ok {
+		cmd.VideoCodecs = int(v)
+	}
+	if v, ok := obj["videoFunction"].(float64); ok {
+		cmd.VideoFunction = int(v)
+	}
+	if v, ok := obj["objectEncoding"].(float64); ok {
+		cmd.ObjectEncoding = EncodingType(v)
+	}
+	return cmd
+}
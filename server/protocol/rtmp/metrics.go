@@ -0,0 +1,54 @@
+package rtmp
+
+import (
+	"errors"
+	"github.com/Opafanls/hylan/server/metrics"
+	"io"
+	"net"
+)
+
+var typeIDNames = map[TypeID]string{
+	TypeIDSetChunkSize:            "set_chunk_size",
+	TypeIDAbortMessage:            "abort",
+	TypeIDAck:                     "ack",
+	TypeIDUserCtrl:                "user_control",
+	TypeIDWinAckSize:              "window_ack_size",
+	TypeIDSetPeerBandwidth:        "set_peer_bandwidth",
+	TypeIDAudioMessage:            "audio",
+	TypeIDVideoMessage:            "video",
+	TypeIDDataMessageAMF3:         "data_amf3",
+	TypeIDSharedObjectMessageAMF3: "shared_object_amf3",
+	TypeIDCommandMessageAMF3:      "command_amf3",
+	TypeIDDataMessageAMF0:         "data_amf0",
+	TypeIDSharedObjectMessageAMF0: "shared_object_amf0",
+	TypeIDCommandMessageAMF0:      "command_amf0",
+	TypeIDAggregateMessage:        "aggregate",
+}
+
+func (t TypeID) String() string {
+	if name, ok := typeIDNames[t]; ok {
+		return name
+	}
+	return "other"
+}
+
+// messageCounters has a series per type id so counting a message needs no lookup
+var messageCounters [256]*metrics.Value
+
+func init() {
+	for i := range messageCounters {
+		messageCounters[i] = metrics.RtmpMessages.With(TypeID(i).String())
+	}
+}
+
+// handshakeReason puts a handshake error into one of a few labels
+func handshakeReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "io"
+}
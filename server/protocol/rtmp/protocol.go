@@ -1,13 +1,11 @@
 package rtmp
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"github.com/Opafanls/hylan/server/log"
-	"github.com/yutopp/go-amf0"
 	"io"
 	"time"
 )
@@ -92,7 +90,7 @@ func (s1 *S1C1) encode(conn io.Writer, cache []byte) error {
 }
 
 func (s1 *S1C1) decode(conn io.Reader, buf []byte) error {
-	_, err := io.ReadAtLeast(conn, buf, 1536)
+	_, err := io.ReadFull(conn, buf[:1536])
 	if err != nil {
 		return err
 	}
@@ -107,7 +105,7 @@ func (s1 *S1C1) decode(conn io.Reader, buf []byte) error {
 }
 
 func (s2 *C2) decodeAndAuth(conn io.Reader, buf []byte) error {
-	_, err := io.ReadAtLeast(conn, buf, 1536)
+	_, err := io.ReadFull(conn, buf[:1536])
 	if err != nil {
 		return err
 	}
@@ -180,56 +178,144 @@ func (hs *handshake) handshake(conn io.ReadWriter) error {
 	return nil
 }
 
+const defaultChunkSize = 128
+
 type chunkStream struct {
 	conn      io.ReadWriter
+	chunkSize uint32
+	headerBuf []byte
 	chunkData *chunkPayload
+	//every chunk stream id keeps its own header state for fmt 1-3 chunks
+	chunkStreams map[int]*chunkPayload
+	limits       Limits
+	//bytes of the pending messages of every chunk stream
+	buffered int
 }
 
 func newChunkStream(conn io.ReadWriter) *chunkStream {
 	cs := &chunkStream{}
 	cs.conn = conn
-	cs.chunkData = &chunkPayload{
+	cs.chunkSize = defaultChunkSize
+	cs.headerBuf = make([]byte, 64)
+	cs.chunkStreams = make(map[int]*chunkPayload)
+	cs.limits = DefaultLimits
+	return cs
+}
+
+func newChunkPayload() *chunkPayload {
+	return &chunkPayload{
 		chunkHeader: &chunkHeader{
 			basicChunkHeader: &basicChunkHeader{},
 			messageHeader:    &messageHeader{},
 		},
-		chunkData: &chunkData{
-			buf: make([]byte, 2048),
-		},
+		chunkData: &chunkData{},
 	}
-	return cs
 }
 
-func (cs *chunkStream) decodeChunkStream() error {
-	buf := make([]byte, 64)
-	err := cs.decodeBasicHeader(nil)
+// decodeChunkStream reads one chunk, the message is returned once its last chunk arrived
+func (cs *chunkStream) decodeChunkStream() (*rtmpMessage, error) {
+	buf := cs.headerBuf
+	fmt0, csID, err := cs.decodeBasicHeader(buf)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	cp, exist := cs.chunkStreams[csID]
+	if !exist {
+		if fmt0 != 0 {
+			return nil, fmt.Errorf("first chunk of csid %d has fmt %d", csID, fmt0)
+		}
+		if len(cs.chunkStreams) >= cs.limits.MaxChunkStreams {
+			return nil, newLimitError(ReasonChunkStreams, "csid %d over %d chunk streams", csID, cs.limits.MaxChunkStreams)
+		}
+		cp = newChunkPayload()
+		cs.chunkStreams[csID] = cp
 	}
+	cp.fmt = fmt0
+	cp.csID = csID
+	cs.chunkData = cp
 	err = cs.decodeMessageHeader(buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	//READ DATA
 	cd := cs.chunkData
-	chunkData0 := make([]byte, cd.messageLen)
-	_, err = io.ReadAtLeast(cs.conn, chunkData0, int(cd.messageLen))
-	if err != nil {
-		return err
+	if cd.buf == nil {
+		if max := cs.limits.maxMessage(cd.messageTypeID); cd.messageLen > max {
+			return nil, newLimitError(ReasonMessageSize, "%s message of %d bytes over %d", cd.messageTypeID, cd.messageLen, max)
+		}
+		cd.buf = make([]byte, 0, minUint32(cd.messageLen, readStep))
 	}
-	log.Infof(context.Background(), "message %s", string(chunkData0))
-	switch cd.messageTypeID {
-	case TypeIDCommandMessageAMF0:
-		var object map[string]interface{}
-		d := amf0.NewDecoder(bytes.NewReader(chunkData0))
-		//netCmd := &NetConnectionConnectCommand{}
-		err := d.Decode(&object)
-		return err
+	size := cd.messageLen - uint32(len(cd.buf))
+	if size > cs.chunkSize {
+		size = cs.chunkSize
 	}
-	return nil
+	if uint32(len(cd.buf))+size < cd.messageLen && cs.buffered+int(size) > cs.limits.MaxBuffered {
+		return nil, newLimitError(ReasonBuffered, "%d bytes of partial messages over %d", cs.buffered+int(size), cs.limits.MaxBuffered)
+	}
+	for size > 0 {
+		//grow with what arrives, a large declared length or chunk size costs nothing up front
+		n := minUint32(size, readStep)
+		read := len(cd.buf)
+		cd.buf = grow(cd.buf, int(n), int(cd.messageLen))
+		cs.buffered += int(n)
+		if _, err = io.ReadFull(cs.conn, cd.buf[read:]); err != nil {
+			return nil, err
+		}
+		size -= n
+	}
+	if uint32(len(cd.buf)) < cd.messageLen {
+		return nil, nil
+	}
+	msg := &rtmpMessage{
+		csID:      cd.csID,
+		timestamp: cd.timestamp,
+		typeID:    cd.messageTypeID,
+		streamID:  cd.messageStreamID,
+		payload:   cd.buf,
+	}
+	cs.drop(cd)
+	return msg, nil
+}
+
+// drop forgets the pending message of a chunk stream
+func (cs *chunkStream) drop(cd *chunkPayload) {
+	cs.buffered -= len(cd.buf)
+	cd.buf = nil
 }
 
-/**
+// abort drops the pending message of csID on an abort message
+func (cs *chunkStream) abort(csID int) {
+	if cp, ok := cs.chunkStreams[csID]; ok {
+		cs.drop(cp)
+	}
+}
+
+// grow extends buf by n bytes, the capacity doubles up to max
+func grow(buf []byte, n, max int) []byte {
+	if cap(buf)-len(buf) >= n {
+		return buf[:len(buf)+n]
+	}
+	size := 2 * cap(buf)
+	if size < len(buf)+n {
+		size = len(buf) + n
+	}
+	if size > max {
+		size = max
+	}
+	b := make([]byte, len(buf)+n, size)
+	copy(b, buf)
+	return b
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*
+*
 +--------------+----------------+--------------------+--------------+
 | Basic Header | Message Header | Extended Timestamp |  Chunk Data  |
 +--------------+----------------+--------------------+--------------+
@@ -258,44 +344,43 @@ type messageHeader struct { //(0, 3, 7, or 11 bytes)
 	messageLen      uint32 //3 byte
 	messageTypeID   TypeID //1 byte
 	messageStreamID uint32 //4byte
+	extended        bool
 }
 
 type chunkData struct { //(variable size):
+	//received bytes of the pending message, nil between messages
 	buf []byte
 }
 
-func (cs *chunkStream) decodeBasicHeader(buf []byte) error {
+func (cs *chunkStream) decodeBasicHeader(buf []byte) (byte, int, error) {
 	if len(buf) < 3 {
 		buf = make([]byte, 3)
 	}
 	_, err := io.ReadAtLeast(cs.conn, buf[:1], 1)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	basicHeader := cs.chunkData.basicChunkHeader
-	basicHeader.fmt = (buf[0] >> 6) & 0b0000_0011
+	fmt0 := (buf[0] >> 6) & 0b0000_0011
 	csID := int(buf[0] & 0b0011_1111)
 	switch csID {
 	case 0:
 		//1 byte
 		_, err = io.ReadAtLeast(cs.conn, buf[1:2], 1)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 		csID = int(buf[1]) + 64
 		break
 	case 1:
 		//2 bytes
-		_, err = io.ReadAtLeast(cs.conn, buf[1:], 2)
+		_, err = io.ReadAtLeast(cs.conn, buf[1:3], 2)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 		csID = int(buf[2])*256 + int(buf[1]) + 64
 		break
 	}
-	basicHeader.csID = csID
-	cs.chunkData.basicChunkHeader = basicHeader
-	return nil
+	return fmt0, csID, nil
 }
 
 func (cs *chunkStream) decodeMessageHeader(buf []byte) error {
@@ -308,7 +393,7 @@ func (cs *chunkStream) decodeMessageHeader(buf []byte) error {
 	case 2:
 		return cs.decodeFmtType2(buf)
 	case 3:
-		return nil
+		return cs.decodeFmtType3()
 	default:
 		return fmt.Errorf("invalid basic header fmt %d", fmt0)
 	}
@@ -335,27 +420,26 @@ func (cs *chunkStream) decodeFmtType0(buf []byte) error {
 		return err
 	}
 	mh := cs.chunkData.messageHeader
-	buf0 := make([]byte, 4)
-	copy(buf0[1:], buf[:3]) // 24bits BE
-	mh.timestamp = binary.BigEndian.Uint32(buf0)
-	copy(buf0[1:], buf[3:6]) // 24bits BE
-	mh.messageLen = binary.BigEndian.Uint32(buf0)
+	mh.timestamp = uint24(buf[:3])
+	mh.messageLen = uint24(buf[3:6])
 	mh.messageTypeID = TypeID(buf[6])
-	mh.messageStreamID = binary.BigEndian.Uint32(buf[7:])
+	//message stream id is the only little endian field
+	mh.messageStreamID = binary.LittleEndian.Uint32(buf[7:11])
 	mh.timestampDelta = 0
-	if mh.timestamp == 0xffffff {
-		cache32bits := make([]byte, 4)
-		_, err := io.ReadAtLeast(cs.conn, cache32bits, 4)
+	mh.extended = mh.timestamp == 0xffffff
+	if mh.extended {
+		//extend timestamp
+		mh.timestamp, err = cs.readExtendedTimestamp(buf)
 		if err != nil {
 			return err
 		}
-		//extend timestamp
-		mh.timestamp = binary.BigEndian.Uint32(cache32bits)
 	}
+	cs.drop(cs.chunkData)
 	return nil
 }
 
-/**
+/*
+*
 0                   1                   2                   3
 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
@@ -369,20 +453,29 @@ func (cs *chunkStream) decodeFmtType1(buf []byte) error {
 	if len(buf) < 7 {
 		buf = make([]byte, 7)
 	}
-	_, err := io.ReadAtLeast(cs.conn, buf, 7)
+	_, err := io.ReadAtLeast(cs.conn, buf[:7], 7)
 	if err != nil {
 		return err
 	}
 	mh := cs.chunkData.messageHeader
 	//stream id no change
-	mh.timestampDelta = binary.BigEndian.Uint32(buf[:3])
-	mh.messageLen = binary.BigEndian.Uint32(buf[3:6])
+	mh.timestampDelta = uint24(buf[:3])
+	mh.messageLen = uint24(buf[3:6])
 	mh.messageTypeID = TypeID(buf[6])
+	mh.extended = mh.timestampDelta == 0xffffff
+	if mh.extended {
+		mh.timestampDelta, err = cs.readExtendedTimestamp(buf)
+		if err != nil {
+			return err
+		}
+	}
 	mh.timestamp += mh.timestampDelta
+	cs.drop(cs.chunkData)
 	return nil
 }
 
-/**
+/*
+*
 0                   1                   2
 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
@@ -394,17 +487,65 @@ func (cs *chunkStream) decodeFmtType2(buf []byte) error {
 	if len(buf) < 3 {
 		buf = make([]byte, 3)
 	}
-	_, err := io.ReadAtLeast(cs.conn, buf, 3)
+	_, err := io.ReadAtLeast(cs.conn, buf[:3], 3)
 	if err != nil {
 		return err
 	}
 	mh := cs.chunkData.messageHeader
-	mh.timestampDelta = binary.BigEndian.Uint32(buf[:3])
+	mh.timestampDelta = uint24(buf[:3])
+	mh.extended = mh.timestampDelta == 0xffffff
+	if mh.extended {
+		mh.timestampDelta, err = cs.readExtendedTimestamp(buf)
+		if err != nil {
+			return err
+		}
+	}
 	mh.timestamp += mh.timestampDelta
+	cs.drop(cs.chunkData)
 	return nil
 }
 
-func (cs *chunkStream) readChunkData() {
-	//cd := cs.chunkData
-	//dataLen := cd.messageLen -
+// decodeFmtType3 has no message header, it either continues the pending message
+// or starts a new one with the previous header
+func (cs *chunkStream) decodeFmtType3() error {
+	cd := cs.chunkData
+	if cd.extended {
+		//the extended timestamp is repeated on every chunk
+		if _, err := cs.readExtendedTimestamp(cs.headerBuf); err != nil {
+			return err
+		}
+	}
+	if cd.buf == nil {
+		cd.timestamp += cd.timestampDelta
+	}
+	return nil
+}
+
+func (cs *chunkStream) readExtendedTimestamp(buf []byte) (uint32, error) {
+	if len(buf) < 4 {
+		buf = make([]byte, 4)
+	}
+	_, err := io.ReadAtLeast(cs.conn, buf[:4], 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:4]), nil
+}
+
+func (cs *chunkStream) setChunkSize(size uint32) error {
+	if size < 1 || size > 0x7fffffff {
+		return fmt.Errorf("invalid chunk size %d", size)
+	}
+	cs.chunkSize = size
+	return nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
 }
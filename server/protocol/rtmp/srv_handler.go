@@ -2,30 +2,99 @@ package rtmp
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/auth"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/constdef"
 	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/hook"
 	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWindowAckSize = 2500000
+	serverChunkSize      = 4096
+	mediaStreamID        = 1
 )
 
 type Handler struct {
 	ctx                context.Context
 	conn               hynet.IHyConn
 	rtmpMessageHandler *rtmpMessageHandler
+	//publish and play lists of the listener
+	access   *hynet.Access
+	timeouts hynet.Timeouts
+	limits   Limits
+	//the writes are buffered after the handshake, commands go out at once whatever the policy
+	writeBuffer int
+	flush       hynet.FlushPolicy
+	//phase of the read deadline, it names the timeout when a read fails
+	phase        string
+	phaseTimeout time.Duration
+
+	connectCmd *NetConnectionConnectCommand
+	//session id of on_connect, the publish or play gets the id of its own session
+	connID    string
+	hyStream  *stream.HyStream
+	source    session.SourceSessionI
+	sink      session.SinkSessionI
+	closeOnce sync.Once
 }
 
 type rtmpMessageHandler struct {
-	handshake   *handshake
-	chunkStream *chunkStream
+	handshake    *handshake
+	chunkStream  *chunkStream
+	chunkEncoder *chunkEncoder
+
+	windowAckSize uint32
+	received      uint32
+	lastAck       uint32
 }
 
 func NewRtmpHandler(ctx context.Context, conn hynet.IHyConn) *Handler {
 	rtmpHandler := &rtmpMessageHandler{}
 	rtmpHandler.handshake = newHandshake()
-	rtmpHandler.chunkStream = newChunkStream(conn)
+	rtmpHandler.chunkStream = newChunkStream(&countReader{ReadWriter: conn, handler: rtmpHandler})
+	rtmpHandler.chunkEncoder = newChunkEncoder(conn)
+	rtmpHandler.windowAckSize = defaultWindowAckSize
 	h := &Handler{ctx: ctx, conn: conn, rtmpMessageHandler: rtmpHandler}
+	h.setLimits(Limits{})
 	return h
 }
 
-func (h *Handler) OnInit() error {
+// setLimits bounds the messages of the peer, the zero fields of limits take the defaults
+func (h *Handler) setLimits(limits Limits) {
+	h.limits = limits.withDefaults()
+	h.rtmpMessageHandler.chunkStream.limits = h.limits
+}
+
+// countReader counts the received bytes for the acknowledgement window
+type countReader struct {
+	io.ReadWriter
+	handler *rtmpMessageHandler
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.ReadWriter.Read(p)
+	r.handler.received += uint32(n)
+	return n, err
+}
+
+func (h *Handler) OnInit(ctx context.Context) {
 	var err error
 	defer func() {
 		if err != nil {
@@ -33,13 +102,83 @@ func (h *Handler) OnInit() error {
 		} else {
 			log.Infof(h.ctx, "conn done with no err")
 		}
-		_ = h.conn.Close()
+		_ = h.OnClose()
 	}()
+	metrics.Connections.With("rtmp").Inc()
+	h.armRead(hynet.PhaseHandshake, h.timeouts.Handshake)
+	_ = hynet.SetDeadline(h.conn, hynet.WriteTimeout, h.timeouts.Handshake)
 	err = h.handshake()
 	if err != nil {
-		return err
+		metrics.HandshakeFailures.With("rtmp", handshakeReason(err)).Inc()
+		err = h.timedOut(err)
+		return
+	}
+	_ = hynet.SetDeadline(h.conn, hynet.WriteTimeout, 0)
+	_ = h.conn.SetConfig(hynet.Flush, h.flush)
+	_ = h.conn.SetConfig(hynet.WriteBuffer, h.writeBuffer)
+	h.armRead(hynet.PhaseFirstCommand, h.timeouts.FirstCommand)
+	err = h.messageLoop()
+}
+
+// armRead gives the next read d, a zero d reads without deadline
+func (h *Handler) armRead(phase string, d time.Duration) {
+	h.phase, h.phaseTimeout = phase, d
+	if d <= 0 {
+		h.phase = ""
+	}
+	_ = hynet.SetDeadline(h.conn, hynet.ReadTimeout, d)
+}
+
+// mediaReceived gives a publisher the idle timeout again
+func (h *Handler) mediaReceived() {
+	if h.phase == hynet.PhasePublishIdle {
+		_ = hynet.SetDeadline(h.conn, hynet.ReadTimeout, h.phaseTimeout)
+	}
+}
+
+// timedOut names the phase of the read that hit its deadline
+func (h *Handler) timedOut(err error) error {
+	return timedOut(err, h.phase, h.phaseTimeout)
+}
+
+// timedOut wraps an io error that hit the deadline of phase in a hynet.TimeoutError
+func timedOut(err error, phase string, d time.Duration) error {
+	err = hynet.NewTimeoutError(err, phase, d)
+	var timeout *hynet.TimeoutError
+	if errors.As(err, &timeout) {
+		metrics.Timeouts.With("rtmp", phase).Inc()
+	}
+	return err
+}
+
+func (h *Handler) OnMedia(ctx context.Context, mediaType protocol.MediaDataType, data interface{}) error {
+	pkt, ok := data.(*proto.BasePacket)
+	if !ok || h.source == nil {
+		return fmt.Errorf("unexpected media %T for %d", data, mediaType)
+	}
+	h.source.Push(ctx, pkt)
+	return nil
+}
+
+func (h *Handler) OnClose() error {
+	var err error
+	h.closeOnce.Do(func() {
+		h.stopPublish()
+		if h.sink != nil {
+			h.sink.Close()
+		}
+		err = h.conn.Close()
+		metrics.Connections.With("rtmp").Dec()
+	})
+	return err
+}
+
+func (h *Handler) peer() *proto.Peer {
+	peer := &proto.Peer{Protocol: "rtmp", Kick: func() { _ = h.OnClose() }}
+	if addr := h.conn.RemoteAddr(); addr != nil {
+		peer.RemoteAddr = addr.String()
 	}
-	return h.messageLoop()
+	return peer
 }
 
 func (h *Handler) handshake() error {
@@ -47,5 +186,386 @@ func (h *Handler) handshake() error {
 }
 
 func (h *Handler) messageLoop() error {
-	return h.rtmpMessageHandler.chunkStream.decodeChunkStream()
+	cs := h.rtmpMessageHandler.chunkStream
+	for {
+		msg, err := cs.decodeChunkStream()
+		if err != nil {
+			return h.timedOut(err)
+		}
+		if err = h.sendAckIfNeeded(); err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		messageCounters[msg.typeID].Inc()
+		if err = h.handleMessage(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (h *Handler) handleMessage(msg *rtmpMessage) error {
+	switch msg.typeID {
+	case TypeIDSetChunkSize:
+		if len(msg.payload) < 4 {
+			return fmt.Errorf("short set chunk size message")
+		}
+		return h.rtmpMessageHandler.chunkStream.setChunkSize(binary.BigEndian.Uint32(msg.payload) & 0x7fffffff)
+	case TypeIDAbortMessage:
+		if len(msg.payload) >= 4 {
+			h.rtmpMessageHandler.chunkStream.abort(int(binary.BigEndian.Uint32(msg.payload)))
+		}
+	case TypeIDWinAckSize:
+		if len(msg.payload) >= 4 {
+			h.rtmpMessageHandler.windowAckSize = binary.BigEndian.Uint32(msg.payload)
+		}
+	case TypeIDAudioMessage:
+		pkt, err := parseAudioTag(msg.timestamp, msg.payload)
+		if err != nil {
+			log.Warnf(h.ctx, "drop audio: %+v", err)
+			return nil
+		}
+		if pkt == nil {
+			return nil
+		}
+		h.mediaReceived()
+		return h.OnMedia(h.ctx, protocol.MediaDataTypeAudio, pkt)
+	case TypeIDVideoMessage:
+		pkt, err := parseVideoTag(msg.timestamp, msg.payload)
+		if err != nil {
+			log.Warnf(h.ctx, "drop video: %+v", err)
+			return nil
+		}
+		if pkt == nil {
+			return nil
+		}
+		h.mediaReceived()
+		return h.OnMedia(h.ctx, protocol.MediaDataTypeVideo, pkt)
+	case TypeIDCommandMessageAMF3:
+		if len(msg.payload) > 0 {
+			//amf3 commands are amf0 encoded after a leading zero byte
+			msg.payload = msg.payload[1:]
+		}
+		return h.handleCommand(msg)
+	case TypeIDCommandMessageAMF0:
+		return h.handleCommand(msg)
+	case TypeIDDataMessageAMF0:
+		if err := h.limits.checkAMF0(msg.payload); err != nil {
+			return err
+		}
+		values, err := decodeAMF0(msg.payload)
+		if err != nil {
+			log.Warnf(h.ctx, "decode data message failed: %+v", err)
+			return nil
+		}
+		log.Debugf(h.ctx, "data message %+v", values)
+	}
+	return nil
+}
+
+func (h *Handler) handleCommand(msg *rtmpMessage) error {
+	if err := h.limits.checkAMF0(msg.payload); err != nil {
+		return err
+	}
+	values, err := decodeAMF0(msg.payload)
+	if err != nil {
+		return constdef.NewHyError("decode command failed", err)
+	}
+	name := amfString(values, 0)
+	txID := amfNumber(values, 1)
+	log.Infof(h.ctx, "command %s %+v", name, values)
+	switch name {
+	case "connect":
+		return h.onConnect(txID, amfObject(values, 2))
+	case "createStream":
+		return h.writeCommand(csIDCommand, 0, "_result", txID, nil, mediaStreamID)
+	case "publish":
+		return h.onPublish(amfString(values, 3))
+	case "play":
+		return h.onPlay(amfString(values, 3))
+	case "releaseStream", "FCPublish", "FCUnpublish", "getStreamLength":
+		return h.writeCommand(csIDCommand, 0, "_result", txID, nil, nil)
+	case "deleteStream", "closeStream":
+		if h.hyStream != nil {
+			h.stopPublish()
+			//the connection waits for a publish or play again, one first command deadline from here
+			h.armRead(hynet.PhaseFirstCommand, h.timeouts.FirstCommand)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) onConnect(txID float64, cmdObj map[string]interface{}) error {
+	if cmdObj == nil {
+		return fmt.Errorf("connect without command object")
+	}
+	h.connectCmd = parseConnectCommand(cmdObj)
+	if u, err := url.Parse(h.connectCmd.TCURL); err == nil {
+		if v := vhost.Match(u); !v.Enabled {
+			h.rejectConnect(txID, fmt.Sprintf("Vhost %s is disabled.", v.Name))
+			return fmt.Errorf("%w: %s", vhost.ErrDisabled, v.Name)
+		}
+		//the stream is only known on publish or play, a token on tcUrl can already be too old
+		if auth.Expired(u) {
+			h.rejectConnect(txID, "Token expired.")
+			return fmt.Errorf("%w: %s", vhost.ErrUnauthorized, auth.ErrExpired)
+		}
+		h.connID = session.NextID()
+		ev := hook.NewEvent(hook.OnConnect, u, h.connID, "rtmp", h.peer().RemoteAddr)
+		ev.StreamID = ""
+		ev.URL = h.connectCmd.TCURL
+		hook.Notify(ev)
+	}
+	if err := h.writeProtocolControl(TypeIDWinAckSize, defaultWindowAckSize); err != nil {
+		return err
+	}
+	//limit type dynamic
+	if err := h.writeProtocolControl(TypeIDSetPeerBandwidth, defaultWindowAckSize, 2); err != nil {
+		return err
+	}
+	if err := h.writeProtocolControl(TypeIDSetChunkSize, serverChunkSize); err != nil {
+		return err
+	}
+	h.rtmpMessageHandler.chunkEncoder.setChunkSize(serverChunkSize)
+	props := map[string]interface{}{
+		"fmsVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}
+	info := map[string]interface{}{
+		"level":          "status",
+		"code":           "NetConnection.Connect.Success",
+		"description":    "Connection succeeded.",
+		"objectEncoding": int(h.connectCmd.ObjectEncoding),
+	}
+	return h.writeCommand(csIDCommand, 0, "_result", txID, props, info)
+}
+
+func (h *Handler) rejectConnect(txID float64, description string) {
+	_ = h.writeCommand(csIDCommand, 0, "_error", txID, nil, map[string]interface{}{
+		"level":       "error",
+		"code":        "NetConnection.Connect.Rejected",
+		"description": description,
+	})
+}
+
+// streamURL joins tcUrl and the publish/play name, the query of both is kept
+func (h *Handler) streamURL(name string) (*url.URL, error) {
+	if h.connectCmd == nil {
+		return nil, fmt.Errorf("stream command before connect")
+	}
+	u, err := url.Parse(h.connectCmd.TCURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	if idx := strings.Index(name, "?"); idx >= 0 {
+		extra, err := url.ParseQuery(name[idx+1:])
+		if err == nil {
+			for key, vals := range extra {
+				query[key] = vals
+			}
+		}
+		name = name[:idx]
+	}
+	app := strings.Trim(h.connectCmd.App, "/")
+	if idx := strings.Index(app, "?"); idx >= 0 {
+		app = app[:idx]
+	}
+	u.Path = "/" + app + "/" + name
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+func (h *Handler) onPublish(name string) error {
+	u, err := h.streamURL(name)
+	if err != nil {
+		return err
+	}
+	if err = h.access.Allow(hynet.OpPublish, h.peer().RemoteAddr); err != nil {
+		_ = h.writeOnStatus("error", "NetStream.Publish.BadName", err.Error())
+		return err
+	}
+	if _, err = vhost.Publish(u, h.peer().RemoteAddr); err != nil {
+		_ = h.writeOnStatus("error", "NetStream.Publish.BadName", err.Error())
+		return err
+	}
+	h.source = session.NewSourceSession(h.ctx, h)
+	h.source.SetPeer(h.peer())
+	if err = hook.Publish(h.ctx, hook.NewEvent(hook.OnPublish, u, h.source.ID(), "rtmp", h.peer().RemoteAddr)); err != nil {
+		h.closeSource()
+		_ = h.writeOnStatus("error", "NetStream.Publish.BadName", err.Error())
+		return err
+	}
+	hyStream := stream.NewHyStream0(u, h.source)
+	err = stream.DefaultHyStreamManager.AddStream(hyStream)
+	if err != nil {
+		h.closeSource()
+		_ = h.writeOnStatus("error", "NetStream.Publish.BadName", "Stream already publishing.")
+		return err
+	}
+	h.hyStream = hyStream
+	h.armRead(hynet.PhasePublishIdle, h.timeouts.PublishIdle)
+	log.Infof(h.ctx, "publish stream %s", hyStream.Base().ID())
+	return h.writeOnStatus("status", "NetStream.Publish.Start", "Start publishing.")
+}
+
+// closeSource drops the source of a refused publish, no packet reaches it then
+func (h *Handler) closeSource() {
+	h.source.Close()
+	h.source = nil
+}
+
+func (h *Handler) stopPublish() {
+	if h.hyStream == nil {
+		return
+	}
+	log.Infof(h.ctx, "unpublish stream %s", h.hyStream.Base().ID())
+	stream.DefaultHyStreamManager.RemoveStreamIfMatch(h.hyStream)
+	h.hyStream.Source().Close()
+	h.hyStream = nil
+}
+
+func (h *Handler) onPlay(name string) error {
+	u, err := h.streamURL(name)
+	if err != nil {
+		return err
+	}
+	if err = h.access.Allow(hynet.OpPlay, h.peer().RemoteAddr); err != nil {
+		_ = h.writeOnStatus("error", "NetStream.Play.Failed", err.Error())
+		return err
+	}
+	if _, err = vhost.Play(u, h.peer().RemoteAddr); err != nil {
+		_ = h.writeOnStatus("error", "NetStream.Play.Failed", err.Error())
+		return err
+	}
+	streamID := base.NewBase0(u).ID()
+	hyStream, exist := stream.DefaultHyStreamManager.GetStream(streamID)
+	if !exist {
+		_ = h.writeOnStatus("error", "NetStream.Play.StreamNotFound", "Stream not found.")
+		return constdef.NewHyError(streamID, constdef.ErrStreamNotFound)
+	}
+	sinkID := session.NextID()
+	stop, err := hook.Play(h.ctx, hook.NewEvent(hook.OnPlay, u, sinkID, "rtmp", h.peer().RemoteAddr))
+	if err != nil {
+		_ = h.writeOnStatus("error", "NetStream.Play.Failed", err.Error())
+		return err
+	}
+	if err = h.writePlayStart(); err != nil {
+		stop()
+		return err
+	}
+	h.sink = hyStream.Source().AddSink(&proto.SinkArg{
+		Ctx:      h.ctx,
+		Protocol: constdef.SinkTypeRtmp,
+		Peer:     h.peer(),
+		ID:       sinkID,
+		OnClose:  stop,
+		SinkRtmp: &proto.SinkRtmp{},
+	})
+	//a player may send nothing at all, only its writes are watched
+	h.armRead("", 0)
+	log.Infof(h.ctx, "play stream %s", streamID)
+	task.SubmitTask0(h.ctx, h.playLoop)
+	return nil
+}
+
+func (h *Handler) writePlayStart() error {
+	if err := h.writeUserCtrl(UserCtrlStreamBegin, mediaStreamID); err != nil {
+		return err
+	}
+	if err := h.writeOnStatus("status", "NetStream.Play.Reset", "Playing and resetting."); err != nil {
+		return err
+	}
+	if err := h.writeOnStatus("status", "NetStream.Play.Start", "Started playing."); err != nil {
+		return err
+	}
+	data, err := encodeAMF0("|RtmpSampleAccess", true, true)
+	if err != nil {
+		return err
+	}
+	return h.writeMessage(csIDData, TypeIDDataMessageAMF0, mediaStreamID, 0, data)
+}
+
+func (h *Handler) playLoop() {
+	defer func() {
+		_ = h.OnClose()
+	}()
+	for {
+		data, ok := h.sink.Pull(h.ctx)
+		if !ok {
+			_ = h.writeUserCtrl(UserCtrlStreamEOF, mediaStreamID)
+			_ = h.writeOnStatus("status", "NetStream.Play.UnpublishNotify", "Stream is unpublished.")
+			return
+		}
+		pkt := data.Base()
+		err := hynet.SetDeadline(h.conn, hynet.WriteTimeout, h.timeouts.PlayStall)
+		if pkt.IsVideo() {
+			if tag := packVideoTag(pkt); tag != nil {
+				err = h.writeMessage(csIDVideo, TypeIDVideoMessage, mediaStreamID, uint32(pkt.DTS), tag)
+			}
+		} else if pkt.IsAudio() {
+			if tag := packAudioTag(pkt); tag != nil {
+				err = h.writeMessage(csIDAudio, TypeIDAudioMessage, mediaStreamID, uint32(pkt.DTS), tag)
+			}
+		}
+		if err != nil {
+			log.Errorf(h.ctx, "write media failed: %+v", timedOut(err, hynet.PhasePlayStall, h.timeouts.PlayStall))
+			return
+		}
+	}
+}
+
+func (h *Handler) sendAckIfNeeded() error {
+	mh := h.rtmpMessageHandler
+	if mh.windowAckSize == 0 || mh.received-mh.lastAck < mh.windowAckSize {
+		return nil
+	}
+	mh.lastAck = mh.received
+	return h.writeProtocolControl(TypeIDAck, mh.received)
+}
+
+func (h *Handler) writeMessage(csID int, typeID TypeID, streamID uint32, timestamp uint32, payload []byte) error {
+	err := h.rtmpMessageHandler.chunkEncoder.writeMessage(&rtmpMessage{
+		csID:      csID,
+		timestamp: timestamp,
+		typeID:    typeID,
+		streamID:  streamID,
+		payload:   payload,
+	})
+	if err == nil && typeID != TypeIDAudioMessage && typeID != TypeIDVideoMessage {
+		err = h.conn.Flush()
+	}
+	return err
+}
+
+func (h *Handler) writeProtocolControl(typeID TypeID, value uint32, extra ...byte) error {
+	payload := make([]byte, 4, 4+len(extra))
+	binary.BigEndian.PutUint32(payload, value)
+	payload = append(payload, extra...)
+	return h.writeMessage(csIDProtocolControl, typeID, controlStreamID, 0, payload)
+}
+
+func (h *Handler) writeUserCtrl(event uint16, value uint32) error {
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint16(payload, event)
+	binary.BigEndian.PutUint32(payload[2:], value)
+	return h.writeMessage(csIDProtocolControl, TypeIDUserCtrl, controlStreamID, 0, payload)
+}
+
+func (h *Handler) writeCommand(csID int, streamID uint32, values ...interface{}) error {
+	payload, err := encodeAMF0(values...)
+	if err != nil {
+		return err
+	}
+	return h.writeMessage(csID, TypeIDCommandMessageAMF0, streamID, 0, payload)
+}
+
+func (h *Handler) writeOnStatus(level, code, description string) error {
+	info := map[string]interface{}{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	}
+	return h.writeCommand(csIDData, mediaStreamID, "onStatus", 0, nil, info)
 }
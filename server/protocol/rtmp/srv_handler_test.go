@@ -0,0 +1,437 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/Opafanls/hylan/server/auth"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	conn    net.Conn
+	decoder *chunkStream
+	encoder *chunkEncoder
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c0c1 := make([]byte, 1537)
+	c0c1[0] = Version
+	if _, err = conn.Write(c0c1); err != nil {
+		t.Fatal(err)
+	}
+	s0s1s2 := make([]byte, 1+1536*2)
+	if _, err = io.ReadFull(conn, s0s1s2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(s0s1s2[1:1537]); err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{conn: conn, decoder: newChunkStream(conn), encoder: newChunkEncoder(conn)}
+}
+
+func (c *testClient) command(t *testing.T, streamID uint32, values ...interface{}) {
+	payload, err := encodeAMF0(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.encoder.writeMessage(&rtmpMessage{csID: csIDCommand, typeID: TypeIDCommandMessageAMF0, streamID: streamID, payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor reads messages until one matches typeID, protocol control messages are applied on the way
+func (c *testClient) waitFor(t *testing.T, typeID TypeID) *rtmpMessage {
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := c.decoder.decodeChunkStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.typeID == TypeIDSetChunkSize {
+			_ = c.decoder.setChunkSize(uint32(msg.payload[0])<<24 | uint32(msg.payload[1])<<16 | uint32(msg.payload[2])<<8 | uint32(msg.payload[3]))
+		}
+		if msg.typeID == typeID {
+			return msg
+		}
+	}
+}
+
+func (c *testClient) connect(t *testing.T, action string, name string) {
+	c.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://127.0.0.1:19351/live"})
+	c.waitFor(t, TypeIDCommandMessageAMF0)
+	c.command(t, 0, "createStream", 2, nil)
+	c.waitFor(t, TypeIDCommandMessageAMF0)
+	c.command(t, mediaStreamID, action, 0, nil, name)
+	msg := c.waitFor(t, TypeIDCommandMessageAMF0)
+	values, err := decodeAMF0(msg.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := amfObject(values, 3)["code"]; code != "NetStream.Publish.Start" && code != "NetStream.Play.Reset" {
+		t.Fatalf("unexpected status %+v", code)
+	}
+}
+
+func TestPublishAndPlay(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewServer(&hynet.TcpListenConfig{Addr: "127.0.0.1", Port: 19351})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := dialTestClient(t, "127.0.0.1:19351")
+	defer publisher.conn.Close()
+	publisher.connect(t, "publish", "test")
+	seqHeader := []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x0c, 0xff}
+	frame := []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}
+	for _, tag := range [][]byte{seqHeader, frame} {
+		err := publisher.encoder.writeMessage(&rtmpMessage{csID: csIDVideo, typeID: TypeIDVideoMessage, streamID: mediaStreamID, payload: tag})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//aac lc 44.1kHz stereo
+	err := publisher.encoder.writeMessage(&rtmpMessage{csID: csIDAudio, typeID: TypeIDAudioMessage, streamID: mediaStreamID, payload: []byte{0xaf, 0, 0x12, 0x10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	hyStream, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:19351:/live/test")
+	if !exist {
+		t.Fatalf("published stream not found")
+	}
+	if info := hyStream.AudioInfo(); info == nil || info.Codec != constdef.CodecAAC || info.SampleRate != 44100 || info.Channels != 2 {
+		t.Fatalf("unexpected audio info %+v", info)
+	}
+
+	player := dialTestClient(t, "127.0.0.1:19351")
+	defer player.conn.Close()
+	player.connect(t, "play", "test")
+	for _, expected := range [][]byte{seqHeader, frame} {
+		msg := player.waitFor(t, TypeIDVideoMessage)
+		if !bytes.Equal(msg.payload, expected) {
+			t.Fatalf("unexpected video tag %x", msg.payload)
+		}
+	}
+}
+
+func TestAudioTags(t *testing.T) {
+	tests := []struct {
+		tag       []byte
+		codec     constdef.CodecID
+		seqHeader bool
+		payload   []byte
+	}{
+		{[]byte{0xaf, 0, 0x12, 0x10}, constdef.CodecAAC, true, []byte{0x12, 0x10}},
+		{[]byte{0xaf, 1, 0x21}, constdef.CodecAAC, false, []byte{0x21}},
+		{[]byte{0x2f, 0xff, 0xfb}, constdef.CodecMP3, false, []byte{0xff, 0xfb}},
+		{[]byte{0x90, 'O', 'p', 'u', 's', 'O', 'H'}, constdef.CodecOpus, true, []byte{'O', 'H'}},
+		{[]byte{0x91, 'O', 'p', 'u', 's', 0xfc}, constdef.CodecOpus, false, []byte{0xfc}},
+		{[]byte{0x91, 'm', 'p', '4', 'a', 0x21}, constdef.CodecAAC, false, []byte{0x21}},
+		{[]byte{0x91, '.', 'm', 'p', '3', 0xff}, constdef.CodecMP3, false, []byte{0xff}},
+	}
+	for _, test := range tests {
+		pkt, err := parseAudioTag(0, test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Codec != test.codec || pkt.SeqHeader != test.seqHeader || !bytes.Equal(pkt.Payload, test.payload) {
+			t.Fatalf("unexpected packet %+v of tag % x", pkt, test.tag)
+		}
+		if test.tag[0]>>4 != flvSoundFormatExHead || test.codec == constdef.CodecOpus {
+			if tag := packAudioTag(pkt); !bytes.Equal(tag, test.tag) {
+				t.Fatalf("expect tag % x, got % x", test.tag, tag)
+			}
+		}
+	}
+	if pkt, err := parseAudioTag(0, []byte{0x92, 'O', 'p', 'u', 's'}); pkt != nil || err != nil {
+		t.Fatalf("expect sequence end to be skipped")
+	}
+	if _, err := parseAudioTag(0, []byte{0x91, 'f', 'L', 'a', 'C'}); err == nil {
+		t.Fatalf("expect error for unsupported fourcc")
+	}
+}
+
+func TestVhostRejected(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	vhost.SetTable(vhost.NewTable(&vhost.Vhost{Name: "def", Enabled: true, Auth: vhost.Auth{PublishToken: "secret"}},
+		&vhost.Vhost{Name: "off", Domains: []string{"off.example.com"}}))
+	defer vhost.SetTable(nil)
+	server := NewServer(&hynet.TcpListenConfig{Addr: "127.0.0.1", Port: 19352})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	status := func(c *testClient) map[string]interface{} {
+		values, err := decodeAMF0(c.waitFor(t, TypeIDCommandMessageAMF0).payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return amfObject(values, 3)
+	}
+	off := dialTestClient(t, "127.0.0.1:19352")
+	defer off.conn.Close()
+	off.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://off.example.com:19352/live"})
+	if code := status(off)["code"]; code != "NetConnection.Connect.Rejected" {
+		t.Fatalf("expect the disabled vhost to reject, got %+v", code)
+	}
+
+	publisher := dialTestClient(t, "127.0.0.1:19352")
+	defer publisher.conn.Close()
+	publisher.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://127.0.0.1:19352/live"})
+	publisher.waitFor(t, TypeIDCommandMessageAMF0)
+	publisher.command(t, mediaStreamID, "publish", 0, nil, "test?token=wrong")
+	if code := status(publisher)["code"]; code != "NetStream.Publish.BadName" {
+		t.Fatalf("expect the wrong token to be refused, got %+v", code)
+	}
+	if _, exist := stream.DefaultHyStreamManager.GetStream("def:/live/test"); exist {
+		t.Fatal("expect no stream")
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	auth.SetVerifier(auth.NewVerifier(&auth.App{Name: "live", Secret: "secret", Publish: true}))
+	defer auth.SetVerifier(nil)
+	server := NewServer(&hynet.TcpListenConfig{Addr: "127.0.0.1", Port: 19352})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	status := func(c *testClient) map[string]interface{} {
+		values, err := decodeAMF0(c.waitFor(t, TypeIDCommandMessageAMF0).payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return amfObject(values, 3)
+	}
+	expired := dialTestClient(t, "127.0.0.1:19352")
+	defer expired.conn.Close()
+	expired.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://127.0.0.1:19352/live?expire=1&sign=00"})
+	if code := status(expired)["code"]; code != "NetConnection.Connect.Rejected" {
+		t.Fatalf("expect the expired token to reject, got %+v", code)
+	}
+
+	publish := func(name string) string {
+		c := dialTestClient(t, "127.0.0.1:19352")
+		defer c.conn.Close()
+		c.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://127.0.0.1:19352/live"})
+		c.waitFor(t, TypeIDCommandMessageAMF0)
+		c.command(t, mediaStreamID, "publish", 0, nil, name)
+		code, _ := status(c)["code"].(string)
+		return code
+	}
+	other := &url.URL{Path: "/live/other"}
+	auth.SignURL(other, "secret", auth.ActionPublish, time.Now().Add(time.Minute), "")
+	if code := publish("test?" + other.RawQuery); code != "NetStream.Publish.BadName" {
+		t.Fatalf("expect a token of another stream to be refused, got %s", code)
+	}
+	signed := &url.URL{Path: "/live/test"}
+	auth.SignURL(signed, "secret", auth.ActionPublish, time.Now().Add(time.Minute), "")
+	if code := publish("test?" + signed.RawQuery); code != "NetStream.Publish.Start" {
+		t.Fatalf("expect the signed publish to start, got %s", code)
+	}
+}
+
+func TestHookDenied(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"deny": true, "reason": "unknown publisher"}`))
+	}))
+	defer callback.Close()
+	hooks := hook.NewHooks(&hook.Config{URLs: map[string][]string{hook.OnPublish: {callback.URL}}})
+	if err := hooks.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hooks.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hooks.Close()
+	server := NewServer(&hynet.TcpListenConfig{Addr: "127.0.0.1", Port: 19352})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	publisher := dialTestClient(t, "127.0.0.1:19352")
+	defer publisher.conn.Close()
+	publisher.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://127.0.0.1:19352/live"})
+	publisher.waitFor(t, TypeIDCommandMessageAMF0)
+	publisher.command(t, mediaStreamID, "publish", 0, nil, "test")
+	values, err := decodeAMF0(publisher.waitFor(t, TypeIDCommandMessageAMF0).payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := amfObject(values, 3); info["code"] != "NetStream.Publish.BadName" || !strings.Contains(info["description"].(string), "unknown publisher") {
+		t.Fatalf("expect the hook to deny, got %+v", info)
+	}
+	if _, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:19352:/live/test"); exist {
+		t.Fatal("expect no stream")
+	}
+}
+
+func TestAccessRejected(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	deny, err := hynet.ParseCIDRs([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := hynet.NewAccess(context.Background(), "rtmp", &hynet.AccessConfig{PublishDeny: deny, MaxConnsPerIP: 1})
+	server := NewServer(&hynet.TcpListenConfig{Addr: "127.0.0.1", Port: 19352, Access: access})
+	if err = server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	publisher := dialTestClient(t, "127.0.0.1:19352")
+	defer publisher.conn.Close()
+	publisher.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://127.0.0.1:19352/live"})
+	publisher.waitFor(t, TypeIDCommandMessageAMF0)
+
+	second, err := net.Dial("tcp", "127.0.0.1:19352")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = second.Write(make([]byte, 1537)); err == nil {
+		_, err = second.Read(make([]byte, 1))
+	}
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("expect the connection past the per ip limit to be closed, got %v", err)
+	}
+
+	publisher.command(t, mediaStreamID, "publish", 0, nil, "test")
+	values, err := decodeAMF0(publisher.waitFor(t, TypeIDCommandMessageAMF0).payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := amfObject(values, 3); info["code"] != "NetStream.Publish.BadName" || !strings.Contains(info["description"].(string), hynet.ReasonPublish) {
+		t.Fatalf("expect the publish deny list to refuse, got %+v", info)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	timeouts := hynet.Timeouts{Handshake: 100 * time.Millisecond, FirstCommand: 100 * time.Millisecond, PublishIdle: 100 * time.Millisecond}
+	server := NewServer(&hynet.TcpListenConfig{Addr: "127.0.0.1", Port: 19352, Timeouts: timeouts})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	//closedIn reads until the server closes conn, which has to be in the phase
+	closedIn := func(conn net.Conn, phase string) {
+		before := metrics.Timeouts.With("rtmp", phase).Get()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 4096)
+		for {
+			_, err := conn.Read(buf)
+			if err == nil {
+				continue
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatalf("expect the server to close the connection in %s", phase)
+			}
+			break
+		}
+		if metrics.Timeouts.With("rtmp", phase).Get() != before+1 {
+			t.Fatalf("expect a %s timeout to be counted", phase)
+		}
+	}
+
+	silent, err := net.Dial("tcp", "127.0.0.1:19352")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	closedIn(silent, hynet.PhaseHandshake)
+
+	idle := dialTestClient(t, "127.0.0.1:19352")
+	defer idle.conn.Close()
+	closedIn(idle.conn, hynet.PhaseFirstCommand)
+
+	//commands other than publish and play leave the deadline of the handshake end as it is
+	chatty := dialTestClient(t, "127.0.0.1:19352")
+	defer chatty.conn.Close()
+	payload, err := encodeAMF0("releaseStream", 2, nil, "chatty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			if chatty.encoder.writeMessage(&rtmpMessage{csID: csIDCommand, typeID: TypeIDCommandMessageAMF0, payload: payload}) != nil {
+				return
+			}
+		}
+	}()
+	closedIn(chatty.conn, hynet.PhaseFirstCommand)
+
+	publisher := dialTestClient(t, "127.0.0.1:19352")
+	defer publisher.conn.Close()
+	publisher.connect(t, "publish", "idle")
+	if _, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:19351:/live/idle"); !exist {
+		t.Fatal("expect the stream to be published")
+	}
+	closedIn(publisher.conn, hynet.PhasePublishIdle)
+	if _, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:19351:/live/idle"); exist {
+		t.Fatal("expect the idle publisher to be unpublished")
+	}
+}
@@ -0,0 +1,185 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pion/rtp"
+)
+
+const AACSamplesPerFrame = 1024
+
+// AACDepacketizer parses RFC 3640 payloads, the defaults are the AAC-hbr mode
+type AACDepacketizer struct {
+	SizeLength       int
+	IndexLength      int
+	IndexDeltaLength int
+
+	seq          seqTracker
+	fragment     []byte
+	fragmentSize int
+	fragmentTs   uint32
+}
+
+func NewAACDepacketizer() *AACDepacketizer {
+	d := &AACDepacketizer{}
+	d.SizeLength = 13
+	d.IndexLength = 3
+	d.IndexDeltaLength = 3
+	return d
+}
+
+func readBits(buf []byte, pos *int, n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := (buf[*pos/8] >> (7 - uint(*pos%8))) & 1
+		v = v<<1 | int(bit)
+		*pos++
+	}
+	return v
+}
+
+func (d *AACDepacketizer) Depacketize(pkt *rtp.Packet) ([]*Frame, error) {
+	if d.seq.gap(pkt) {
+		d.fragment = nil
+	}
+	payload := pkt.Payload
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("short aac payload")
+	}
+	headersBits := int(binary.BigEndian.Uint16(payload))
+	headersLen := (headersBits + 7) / 8
+	if headersBits == 0 || 2+headersLen > len(payload) {
+		return nil, fmt.Errorf("invalid aac au headers length %d", headersBits)
+	}
+	headers := payload[2 : 2+headersLen]
+	data := payload[2+headersLen:]
+	var sizes []int
+	for pos := 0; pos < headersBits; {
+		indexLength := d.IndexDeltaLength
+		if len(sizes) == 0 {
+			indexLength = d.IndexLength
+		}
+		if pos+d.SizeLength+indexLength > headersBits {
+			return nil, fmt.Errorf("invalid aac au header")
+		}
+		sizes = append(sizes, readBits(headers, &pos, d.SizeLength))
+		readBits(headers, &pos, indexLength)
+	}
+
+	if d.fragment != nil && pkt.Timestamp != d.fragmentTs {
+		//the rest of the fragmented au got lost
+		d.fragment = nil
+	}
+	if d.fragment != nil || (len(sizes) == 1 && sizes[0] > len(data)) {
+		if len(sizes) != 1 {
+			d.fragment = nil
+			return nil, fmt.Errorf("fragmented aac packet with %d au", len(sizes))
+		}
+		if d.fragment == nil {
+			d.fragmentSize = sizes[0]
+			d.fragmentTs = pkt.Timestamp
+			d.fragment = make([]byte, 0, sizes[0])
+		}
+		d.fragment = append(d.fragment, data...)
+		if len(d.fragment) > d.fragmentSize {
+			d.fragment = nil
+			return nil, fmt.Errorf("aac fragment exceeds au size")
+		}
+		if !pkt.Marker {
+			return nil, nil
+		}
+		au := d.fragment
+		d.fragment = nil
+		if len(au) != d.fragmentSize {
+			return nil, fmt.Errorf("incomplete aac fragment")
+		}
+		return []*Frame{{Timestamp: d.fragmentTs, Units: [][]byte{au}}}, nil
+	}
+
+	frames := make([]*Frame, 0, len(sizes))
+	for i, size := range sizes {
+		if size > len(data) {
+			return frames, fmt.Errorf("aac au exceeds payload")
+		}
+		frames = append(frames, &Frame{
+			Timestamp: pkt.Timestamp + uint32(i*AACSamplesPerFrame),
+			Units:     [][]byte{append([]byte(nil), data[:size]...)},
+		})
+		data = data[size:]
+	}
+	return frames, nil
+}
+
+// AACPacketizer emits AAC-hbr payloads, consecutive au share a packet and large ones are fragmented
+type AACPacketizer struct {
+	*Sequencer
+	MaxPayload int
+}
+
+func NewAACPacketizer(payloadType uint8, sampleRate int) *AACPacketizer {
+	p := &AACPacketizer{}
+	p.Sequencer = NewSequencer(payloadType, sampleRate)
+	p.MaxPayload = DefaultMaxPayload
+	return p
+}
+
+// Packetize treats the units as consecutive au starting at pts
+func (p *AACPacketizer) Packetize(pts int64, aus [][]byte) []*rtp.Packet {
+	ts := p.Timestamp(pts)
+	var pkts []*rtp.Packet
+	var batch [][]byte
+	batchSize := 2
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		payload := make([]byte, 2, batchSize)
+		binary.BigEndian.PutUint16(payload, uint16(len(batch)*16))
+		for _, au := range batch {
+			payload = append(payload, byte(len(au)>>5), byte(len(au)<<3))
+		}
+		for _, au := range batch {
+			payload = append(payload, au...)
+		}
+		pkts = append(pkts, p.NewPacket(ts, true, payload))
+		ts += uint32(len(batch) * AACSamplesPerFrame)
+		batch = nil
+		batchSize = 2
+	}
+	for _, au := range aus {
+		if len(au) == 0 {
+			continue
+		}
+		if 4+len(au) > p.MaxPayload {
+			flush()
+			pkts = append(pkts, p.fragment(ts, au)...)
+			ts += AACSamplesPerFrame
+			continue
+		}
+		if batchSize+2+len(au) > p.MaxPayload {
+			flush()
+		}
+		batch = append(batch, au)
+		batchSize += 2 + len(au)
+	}
+	flush()
+	return pkts
+}
+
+func (p *AACPacketizer) fragment(ts uint32, au []byte) []*rtp.Packet {
+	var pkts []*rtp.Packet
+	header := []byte{0, 16, byte(len(au) >> 5), byte(len(au) << 3)}
+	data := au
+	for len(data) > 0 {
+		size := p.MaxPayload - len(header)
+		if size > len(data) {
+			size = len(data)
+		}
+		payload := make([]byte, 0, len(header)+size)
+		payload = append(payload, header...)
+		payload = append(payload, data[:size]...)
+		data = data[size:]
+		pkts = append(pkts, p.NewPacket(ts, len(data) == 0, payload))
+	}
+	return pkts
+}
@@ -0,0 +1,94 @@
+package rtp
+
+import (
+	"fmt"
+	"github.com/pion/rtp"
+)
+
+const (
+	OpusClockRate = 48000
+	G711ClockRate = 8000
+
+	PayloadTypePCMU = 0
+	PayloadTypePCMA = 8
+)
+
+// OpusDepacketizer returns the opus packet of each rtp packet, RFC 7587
+type OpusDepacketizer struct{}
+
+func NewOpusDepacketizer() *OpusDepacketizer {
+	return &OpusDepacketizer{}
+}
+
+func (d *OpusDepacketizer) Depacketize(pkt *rtp.Packet) ([]*Frame, error) {
+	if len(pkt.Payload) == 0 {
+		return nil, fmt.Errorf("empty opus payload")
+	}
+	return []*Frame{{Timestamp: pkt.Timestamp, Units: [][]byte{append([]byte(nil), pkt.Payload...)}}}, nil
+}
+
+// OpusPacketizer puts every opus packet into its own rtp packet
+type OpusPacketizer struct {
+	*Sequencer
+}
+
+func NewOpusPacketizer(payloadType uint8) *OpusPacketizer {
+	p := &OpusPacketizer{}
+	p.Sequencer = NewSequencer(payloadType, OpusClockRate)
+	return p
+}
+
+func (p *OpusPacketizer) Packetize(pts int64, frames [][]byte) []*rtp.Packet {
+	ts := p.Timestamp(pts)
+	pkts := make([]*rtp.Packet, 0, len(frames))
+	for _, frame := range frames {
+		if len(frame) > 0 {
+			pkts = append(pkts, p.NewPacket(ts, false, frame))
+		}
+	}
+	return pkts
+}
+
+// G711Depacketizer returns the samples of each rtp packet, RFC 3551
+type G711Depacketizer struct{}
+
+func NewG711Depacketizer() *G711Depacketizer {
+	return &G711Depacketizer{}
+}
+
+func (d *G711Depacketizer) Depacketize(pkt *rtp.Packet) ([]*Frame, error) {
+	if len(pkt.Payload) == 0 {
+		return nil, fmt.Errorf("empty g711 payload")
+	}
+	return []*Frame{{Timestamp: pkt.Timestamp, Units: [][]byte{append([]byte(nil), pkt.Payload...)}}}, nil
+}
+
+// G711Packetizer splits the samples into packets, one byte is one sample
+type G711Packetizer struct {
+	*Sequencer
+	MaxPayload int
+}
+
+func NewG711Packetizer(payloadType uint8) *G711Packetizer {
+	p := &G711Packetizer{}
+	p.Sequencer = NewSequencer(payloadType, G711ClockRate)
+	p.MaxPayload = DefaultMaxPayload
+	return p
+}
+
+func (p *G711Packetizer) Packetize(pts int64, samples [][]byte) []*rtp.Packet {
+	ts := p.Timestamp(pts)
+	var pkts []*rtp.Packet
+	for _, data := range samples {
+		for len(data) > 0 {
+			size := p.MaxPayload
+			if size > len(data) {
+				size = len(data)
+			}
+			pkts = append(pkts, p.NewPacket(ts, false, data[:size]))
+			ts += uint32(size)
+			data = data[size:]
+		}
+	}
+	return pkts
+}
@@ -0,0 +1,182 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pion/rtp"
+)
+
+// RFC 6184 payload structures
+const (
+	h264StapA = 24
+	h264StapB = 25
+	h264Mtap1 = 26
+	h264Mtap2 = 27
+	h264FuA   = 28
+	h264FuB   = 29
+)
+
+// H264Depacketizer reassembles single nal unit, STAP-A and FU-A payloads into access units
+type H264Depacketizer struct {
+	seq      seqTracker
+	ts       uint32
+	nalus    [][]byte
+	fragment []byte
+}
+
+func NewH264Depacketizer() *H264Depacketizer {
+	return &H264Depacketizer{}
+}
+
+func (d *H264Depacketizer) Depacketize(pkt *rtp.Packet) ([]*Frame, error) {
+	var frames []*Frame
+	if d.seq.gap(pkt) {
+		d.fragment = nil
+	}
+	if len(d.nalus) > 0 && pkt.Timestamp != d.ts {
+		//the marker of the previous access unit got lost or was never set
+		frames = append(frames, d.flush())
+	}
+	d.ts = pkt.Timestamp
+	payload := pkt.Payload
+	if len(payload) < 1 {
+		return frames, fmt.Errorf("empty h264 payload")
+	}
+	switch payload[0] & 0x1f {
+	case h264StapA:
+		payload = payload[1:]
+		for len(payload) > 0 {
+			if len(payload) < 2 {
+				return frames, fmt.Errorf("invalid h264 STAP-A")
+			}
+			size := int(binary.BigEndian.Uint16(payload))
+			payload = payload[2:]
+			if size == 0 || size > len(payload) {
+				return frames, fmt.Errorf("invalid h264 STAP-A")
+			}
+			d.nalus = append(d.nalus, append([]byte(nil), payload[:size]...))
+			payload = payload[size:]
+		}
+	case h264FuA:
+		if len(payload) < 2 {
+			return frames, fmt.Errorf("short h264 FU-A")
+		}
+		fuHeader := payload[1]
+		if fuHeader&0x80 != 0 {
+			d.fragment = []byte{(payload[0] & 0xe0) | (fuHeader & 0x1f)}
+		} else if d.fragment == nil {
+			//lost the start of the fragment
+			return frames, nil
+		}
+		d.fragment = append(d.fragment, payload[2:]...)
+		if fuHeader&0x40 != 0 {
+			d.nalus = append(d.nalus, d.fragment)
+			d.fragment = nil
+		}
+	case h264StapB, h264Mtap1, h264Mtap2, h264FuB:
+		return frames, fmt.Errorf("h264 payload type %d not supported", payload[0]&0x1f)
+	case 0, 30, 31:
+		return frames, fmt.Errorf("invalid h264 payload type %d", payload[0]&0x1f)
+	default:
+		d.nalus = append(d.nalus, append([]byte(nil), payload...))
+	}
+	if pkt.Marker && len(d.nalus) > 0 {
+		frames = append(frames, d.flush())
+	}
+	return frames, nil
+}
+
+func (d *H264Depacketizer) flush() *Frame {
+	frame := &Frame{Timestamp: d.ts, Units: d.nalus}
+	d.nalus = nil
+	return frame
+}
+
+// H264Packetizer emits single nal unit packets, STAP-A for small units and FU-A for large ones
+type H264Packetizer struct {
+	*Sequencer
+	MaxPayload int
+}
+
+func NewH264Packetizer(payloadType uint8) *H264Packetizer {
+	p := &H264Packetizer{}
+	p.Sequencer = NewSequencer(payloadType, VideoClockRate)
+	p.MaxPayload = DefaultMaxPayload
+	return p
+}
+
+func (p *H264Packetizer) Packetize(pts int64, nalus [][]byte) []*rtp.Packet {
+	ts := p.Timestamp(pts)
+	var pkts []*rtp.Packet
+	var batch [][]byte
+	batchSize := 1
+	flush := func() {
+		switch len(batch) {
+		case 0:
+		case 1:
+			pkts = append(pkts, p.NewPacket(ts, false, batch[0]))
+		default:
+			header := byte(h264StapA)
+			for _, nalu := range batch {
+				header |= nalu[0] & 0x80
+				if nri := nalu[0] & 0x60; nri > header&0x60 {
+					header = header&^0x60 | nri
+				}
+			}
+			payload := make([]byte, 1, batchSize)
+			payload[0] = header
+			for _, nalu := range batch {
+				payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+				payload = append(payload, nalu...)
+			}
+			pkts = append(pkts, p.NewPacket(ts, false, payload))
+		}
+		batch = nil
+		batchSize = 1
+	}
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		if len(nalu) > p.MaxPayload {
+			flush()
+			pkts = append(pkts, p.fragment(ts, nalu)...)
+			continue
+		}
+		if batchSize+2+len(nalu) > p.MaxPayload {
+			flush()
+		}
+		batch = append(batch, nalu)
+		batchSize += 2 + len(nalu)
+	}
+	flush()
+	return setMarker(pkts)
+}
+
+func (p *H264Packetizer) fragment(ts uint32, nalu []byte) []*rtp.Packet {
+	var pkts []*rtp.Packet
+	indicator := (nalu[0] & 0xe0) | h264FuA
+	naluType := nalu[0] & 0x1f
+	data := nalu[1:]
+	start := true
+	for len(data) > 0 {
+		size := p.MaxPayload - 2
+		if size > len(data) {
+			size = len(data)
+		}
+		fuHeader := naluType
+		if start {
+			fuHeader |= 0x80
+			start = false
+		}
+		if size == len(data) {
+			fuHeader |= 0x40
+		}
+		payload := make([]byte, 0, 2+size)
+		payload = append(payload, indicator, fuHeader)
+		payload = append(payload, data[:size]...)
+		pkts = append(pkts, p.NewPacket(ts, false, payload))
+		data = data[size:]
+	}
+	return pkts
+}
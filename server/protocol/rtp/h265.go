@@ -0,0 +1,181 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/pion/rtp"
+)
+
+// RFC 7798 payload structures, DONL fields are not supported
+const (
+	h265AP   = 48
+	h265FU   = 49
+	h265PACI = 50
+)
+
+// H265Depacketizer reassembles single nal unit, aggregation and fragmentation payloads into access units
+type H265Depacketizer struct {
+	seq      seqTracker
+	ts       uint32
+	nalus    [][]byte
+	fragment []byte
+}
+
+func NewH265Depacketizer() *H265Depacketizer {
+	return &H265Depacketizer{}
+}
+
+func (d *H265Depacketizer) Depacketize(pkt *rtp.Packet) ([]*Frame, error) {
+	var frames []*Frame
+	if d.seq.gap(pkt) {
+		d.fragment = nil
+	}
+	if len(d.nalus) > 0 && pkt.Timestamp != d.ts {
+		frames = append(frames, d.flush())
+	}
+	d.ts = pkt.Timestamp
+	payload := pkt.Payload
+	if len(payload) < 3 {
+		return frames, fmt.Errorf("short h265 payload")
+	}
+	switch codec.H265NaluType(payload) {
+	case h265AP:
+		payload = payload[2:]
+		for len(payload) > 0 {
+			if len(payload) < 2 {
+				return frames, fmt.Errorf("invalid h265 aggregation packet")
+			}
+			size := int(binary.BigEndian.Uint16(payload))
+			payload = payload[2:]
+			if size < 2 || size > len(payload) {
+				return frames, fmt.Errorf("invalid h265 aggregation packet")
+			}
+			d.nalus = append(d.nalus, append([]byte(nil), payload[:size]...))
+			payload = payload[size:]
+		}
+	case h265FU:
+		fuHeader := payload[2]
+		if fuHeader&0x80 != 0 {
+			d.fragment = []byte{(payload[0] & 0x81) | (fuHeader&0x3f)<<1, payload[1]}
+		} else if d.fragment == nil {
+			//lost the start of the fragment
+			return frames, nil
+		}
+		d.fragment = append(d.fragment, payload[3:]...)
+		if fuHeader&0x40 != 0 {
+			d.nalus = append(d.nalus, d.fragment)
+			d.fragment = nil
+		}
+	case h265PACI:
+		return frames, fmt.Errorf("h265 PACI packet not supported")
+	default:
+		d.nalus = append(d.nalus, append([]byte(nil), payload...))
+	}
+	if pkt.Marker && len(d.nalus) > 0 {
+		frames = append(frames, d.flush())
+	}
+	return frames, nil
+}
+
+func (d *H265Depacketizer) flush() *Frame {
+	frame := &Frame{Timestamp: d.ts, Units: d.nalus}
+	d.nalus = nil
+	return frame
+}
+
+// H265Packetizer emits single nal unit packets, aggregation packets for small units and fragmentation units for large ones
+type H265Packetizer struct {
+	*Sequencer
+	MaxPayload int
+}
+
+func NewH265Packetizer(payloadType uint8) *H265Packetizer {
+	p := &H265Packetizer{}
+	p.Sequencer = NewSequencer(payloadType, VideoClockRate)
+	p.MaxPayload = DefaultMaxPayload
+	return p
+}
+
+func (p *H265Packetizer) Packetize(pts int64, nalus [][]byte) []*rtp.Packet {
+	ts := p.Timestamp(pts)
+	var pkts []*rtp.Packet
+	var batch [][]byte
+	batchSize := 2
+	flush := func() {
+		switch len(batch) {
+		case 0:
+		case 1:
+			pkts = append(pkts, p.NewPacket(ts, false, batch[0]))
+		default:
+			//F is set if any unit has it, layer id and tid are the lowest of the units
+			var forbidden byte
+			layerID, tid := byte(0x3f), byte(0x07)
+			for _, nalu := range batch {
+				forbidden |= nalu[0] & 0x80
+				if l := (nalu[0]&0x01)<<5 | nalu[1]>>3; l < layerID {
+					layerID = l
+				}
+				if t := nalu[1] & 0x07; t < tid {
+					tid = t
+				}
+			}
+			payload := make([]byte, 2, batchSize)
+			payload[0] = forbidden | h265AP<<1 | layerID>>5
+			payload[1] = layerID<<3 | tid
+			for _, nalu := range batch {
+				payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+				payload = append(payload, nalu...)
+			}
+			pkts = append(pkts, p.NewPacket(ts, false, payload))
+		}
+		batch = nil
+		batchSize = 2
+	}
+	for _, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+		if len(nalu) > p.MaxPayload {
+			flush()
+			pkts = append(pkts, p.fragment(ts, nalu)...)
+			continue
+		}
+		if batchSize+2+len(nalu) > p.MaxPayload {
+			flush()
+		}
+		batch = append(batch, nalu)
+		batchSize += 2 + len(nalu)
+	}
+	flush()
+	return setMarker(pkts)
+}
+
+func (p *H265Packetizer) fragment(ts uint32, nalu []byte) []*rtp.Packet {
+	var pkts []*rtp.Packet
+	header := []byte{(nalu[0] & 0x81) | h265FU<<1, nalu[1]}
+	naluType := codec.H265NaluType(nalu)
+	data := nalu[2:]
+	start := true
+	for len(data) > 0 {
+		size := p.MaxPayload - 3
+		if size > len(data) {
+			size = len(data)
+		}
+		fuHeader := naluType
+		if start {
+			fuHeader |= 0x80
+			start = false
+		}
+		if size == len(data) {
+			fuHeader |= 0x40
+		}
+		payload := make([]byte, 0, 3+size)
+		payload = append(payload, header...)
+		payload = append(payload, fuHeader)
+		payload = append(payload, data[:size]...)
+		pkts = append(pkts, p.NewPacket(ts, false, payload))
+		data = data[size:]
+	}
+	return pkts
+}
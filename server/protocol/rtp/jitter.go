@@ -0,0 +1,156 @@
+package rtp
+
+import (
+	"github.com/pion/rtp"
+	"time"
+)
+
+const (
+	DefaultJitterSize = 128
+	//a gap is skipped once the packets behind it waited this long, however few they are
+	DefaultJitterDelay = 200 * time.Millisecond
+	//late packets in a row that mean the sender jumped or restarted its sequence numbers
+	resyncDiscards = 16
+)
+
+// JitterBuffer reorders packets by sequence number, a gap is skipped once size packets are waiting
+// behind it or the first of them waited MaxDelay. A new ssrc or a run of late packets starts over.
+type JitterBuffer struct {
+	//zero waits for size packets only
+	MaxDelay time.Duration
+	size     int
+	unwrap   SeqUnwrapper
+	started  bool
+	ssrc     uint32
+	next     int64
+	pkts     map[int64]*jitterEntry
+	//late packets in a row
+	behind   int
+	lost     uint64
+	discards uint64
+	resyncs  uint64
+	now      func() time.Time
+}
+
+type jitterEntry struct {
+	pkt *rtp.Packet
+	at  time.Time
+}
+
+func NewJitterBuffer(size int) *JitterBuffer {
+	if size <= 0 {
+		size = DefaultJitterSize
+	}
+	j := &JitterBuffer{}
+	j.MaxDelay = DefaultJitterDelay
+	j.size = size
+	j.pkts = make(map[int64]*jitterEntry)
+	j.now = time.Now
+	return j
+}
+
+// Push stores pkt and returns the packets that are now in order
+func (j *JitterBuffer) Push(pkt *rtp.Packet) []*rtp.Packet {
+	var out []*rtp.Packet
+	if j.started && pkt.SSRC != j.ssrc {
+		out = j.resync(out)
+	}
+	seq := j.unwrap.Unwrap(pkt.SequenceNumber)
+	if !j.started {
+		j.start(pkt.SSRC, seq)
+	}
+	if seq < j.next {
+		//late or duplicated
+		j.discards++
+		if j.behind++; j.behind < resyncDiscards {
+			return out
+		}
+		//a jump of more than half the sequence space unwraps behind for good
+		out = j.resync(out)
+		seq = j.unwrap.Unwrap(pkt.SequenceNumber)
+		j.start(pkt.SSRC, seq)
+	}
+	if _, exist := j.pkts[seq]; exist {
+		j.discards++
+		return out
+	}
+	j.behind = 0
+	now := j.now()
+	j.pkts[seq] = &jitterEntry{pkt: pkt, at: now}
+	out = j.drain(out)
+	for len(j.pkts) >= j.size || j.MaxDelay > 0 && len(j.pkts) > 0 && now.Sub(j.firstArrival()) >= j.MaxDelay {
+		j.skip()
+		out = j.drain(out)
+	}
+	return out
+}
+
+func (j *JitterBuffer) start(ssrc uint32, seq int64) {
+	j.started = true
+	j.ssrc = ssrc
+	j.next = seq
+}
+
+// resync hands out what is waiting and forgets the sequence, the next packet starts it again
+func (j *JitterBuffer) resync(out []*rtp.Packet) []*rtp.Packet {
+	for len(j.pkts) > 0 {
+		j.skip()
+		out = j.drain(out)
+	}
+	j.unwrap = SeqUnwrapper{}
+	j.started = false
+	j.behind = 0
+	j.resyncs++
+	return out
+}
+
+// skip moves over the gap before the oldest waiting packet
+func (j *JitterBuffer) skip() {
+	first := true
+	var oldest int64
+	for s := range j.pkts {
+		if first || s < oldest {
+			first = false
+			oldest = s
+		}
+	}
+	j.lost += uint64(oldest - j.next)
+	j.next = oldest
+}
+
+func (j *JitterBuffer) firstArrival() time.Time {
+	var first time.Time
+	for _, entry := range j.pkts {
+		if first.IsZero() || entry.at.Before(first) {
+			first = entry.at
+		}
+	}
+	return first
+}
+
+func (j *JitterBuffer) drain(out []*rtp.Packet) []*rtp.Packet {
+	for {
+		entry, exist := j.pkts[j.next]
+		if !exist {
+			return out
+		}
+		delete(j.pkts, j.next)
+		j.next++
+		out = append(out, entry.pkt)
+	}
+}
+
+// Lost is the number of packets skipped over
+func (j *JitterBuffer) Lost() uint64 {
+	return j.lost
+}
+
+// Discards is the number of late or duplicated packets
+func (j *JitterBuffer) Discards() uint64 {
+	return j.discards
+}
+
+// Resyncs counts the times the sequence started over
+func (j *JitterBuffer) Resyncs() uint64 {
+	return j.resyncs
+}
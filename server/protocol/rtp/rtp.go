@@ -2,6 +2,51 @@ package rtp
 
 import "github.com/pion/rtp"
 
+const (
+	// DefaultMaxPayload keeps a packet with its headers under a common path mtu
+	DefaultMaxPayload = 1200
+	VideoClockRate    = 90000
+
+	rtpVersion = 2
+)
+
 type Packet struct {
 	*rtp.Packet
 }
+
+// Frame is a complete unit out of a depacketizer, the nal units of an access unit or one audio frame
+type Frame struct {
+	Timestamp uint32
+	Units     [][]byte
+}
+
+type Depacketizer interface {
+	// Depacketize returns the frames completed by pkt, packets must arrive in sequence order
+	Depacketize(pkt *rtp.Packet) ([]*Frame, error)
+}
+
+type Packetizer interface {
+	// Packetize splits units sharing one presentation time in ms into rtp packets
+	Packetize(pts int64, units [][]byte) []*rtp.Packet
+}
+
+// seqTracker reports gaps in the sequence numbers so fragments spanning a loss are dropped
+type seqTracker struct {
+	started bool
+	next    uint16
+}
+
+func (s *seqTracker) gap(pkt *rtp.Packet) bool {
+	gap := s.started && pkt.SequenceNumber != s.next
+	s.started = true
+	s.next = pkt.SequenceNumber + 1
+	return gap
+}
+
+// setMarker flags the last packet of a frame
+func setMarker(pkts []*rtp.Packet) []*rtp.Packet {
+	if len(pkts) > 0 {
+		pkts[len(pkts)-1].Marker = true
+	}
+	return pkts
+}
@@ -0,0 +1,236 @@
+package rtp
+
+import (
+	"bytes"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/pion/rtp"
+	"testing"
+	"time"
+)
+
+func testUnit(header []byte, size int) []byte {
+	unit := make([]byte, size)
+	copy(unit, header)
+	for i := len(header); i < size; i++ {
+		unit[i] = byte(i)
+	}
+	return unit
+}
+
+// roundTrip marshals the packets so the depacketizer sees what goes over the wire
+func roundTrip(t *testing.T, d Depacketizer, pkts []*rtp.Packet) []*Frame {
+	var frames []*Frame
+	for _, pkt := range pkts {
+		buf, err := pkt.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := &rtp.Packet{}
+		if err = parsed.Unmarshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		out, err := d.Depacketize(parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, out...)
+	}
+	return frames
+}
+
+func checkUnits(t *testing.T, frame *Frame, units [][]byte) {
+	if len(frame.Units) != len(units) {
+		t.Fatalf("expected %d units, got %d", len(units), len(frame.Units))
+	}
+	for i := range units {
+		if !bytes.Equal(frame.Units[i], units[i]) {
+			t.Fatalf("unit %d mismatch", i)
+		}
+	}
+}
+
+func TestH264RoundTrip(t *testing.T) {
+	p := NewH264Packetizer(96)
+	units := [][]byte{testUnit([]byte{0x67}, 20), testUnit([]byte{0x68}, 4), testUnit([]byte{0x65}, 5000)}
+	pkts := p.Packetize(40, units)
+	if pkts[0].Payload[0]&0x1f != h264StapA || pkts[1].Payload[0]&0x1f != h264FuA {
+		t.Fatalf("expected STAP-A then FU-A")
+	}
+	if !pkts[len(pkts)-1].Marker || pkts[0].Marker {
+		t.Fatal("marker must be on the last packet only")
+	}
+	frames := roundTrip(t, NewH264Depacketizer(), pkts)
+	if len(frames) != 1 || frames[0].Timestamp != p.InitialTs+3600 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+	checkUnits(t, frames[0], units)
+}
+
+func TestH264TimestampChangeFlushes(t *testing.T) {
+	d := NewH264Depacketizer()
+	first := &rtp.Packet{Header: rtp.Header{SequenceNumber: 1, Timestamp: 100}, Payload: []byte{0x65, 1}}
+	second := &rtp.Packet{Header: rtp.Header{SequenceNumber: 2, Timestamp: 200}, Payload: []byte{0x41, 2}}
+	if frames, _ := d.Depacketize(first); len(frames) != 0 {
+		t.Fatal("frame without marker must wait")
+	}
+	frames, err := d.Depacketize(second)
+	if err != nil || len(frames) != 1 || frames[0].Timestamp != 100 {
+		t.Fatalf("unexpected frames %+v %v", frames, err)
+	}
+}
+
+func TestH264LostFragment(t *testing.T) {
+	p := NewH264Packetizer(96)
+	pkts := p.Packetize(0, [][]byte{testUnit([]byte{0x65}, 4000)})
+	d := NewH264Depacketizer()
+	frames := roundTrip(t, d, append(pkts[:1:1], pkts[2:]...))
+	if len(frames) != 0 {
+		t.Fatalf("fragment with a lost packet must be dropped, got %+v", frames)
+	}
+}
+
+func TestH265RoundTrip(t *testing.T) {
+	p := NewH265Packetizer(96)
+	units := [][]byte{
+		testUnit([]byte{0x40, 0x01}, 24),
+		testUnit([]byte{0x42, 0x01}, 40),
+		testUnit([]byte{0x44, 0x01}, 8),
+		testUnit([]byte{0x26, 0x01}, 3000),
+	}
+	pkts := p.Packetize(0, units)
+	if codec.H265NaluType(pkts[0].Payload) != h265AP || codec.H265NaluType(pkts[1].Payload) != h265FU {
+		t.Fatalf("expected AP then FU")
+	}
+	frames := roundTrip(t, NewH265Depacketizer(), pkts)
+	if len(frames) != 1 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+	checkUnits(t, frames[0], units)
+}
+
+func TestAACRoundTrip(t *testing.T) {
+	p := NewAACPacketizer(97, 44100)
+	aus := [][]byte{testUnit(nil, 200), testUnit(nil, 300), testUnit(nil, 2500)}
+	pkts := p.Packetize(0, aus)
+	if len(pkts) != 4 {
+		t.Fatalf("expected 1 aggregated and 3 fragment packets, got %d", len(pkts))
+	}
+	frames := roundTrip(t, NewAACDepacketizer(), pkts)
+	if len(frames) != 3 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+	for i, frame := range frames {
+		if frame.Timestamp != p.InitialTs+uint32(i*AACSamplesPerFrame) {
+			t.Fatalf("unexpected timestamp of au %d", i)
+		}
+		checkUnits(t, frame, aus[i:i+1])
+	}
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	p := NewG711Packetizer(PayloadTypePCMA)
+	samples := testUnit(nil, 1600)
+	pkts := p.Packetize(0, [][]byte{samples})
+	if len(pkts) != 2 || pkts[1].Timestamp-pkts[0].Timestamp != 1200 {
+		t.Fatalf("unexpected packets %d", len(pkts))
+	}
+	frames := roundTrip(t, NewG711Depacketizer(), pkts)
+	if !bytes.Equal(append(frames[0].Units[0], frames[1].Units[0]...), samples) {
+		t.Fatal("samples mismatch")
+	}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	j := NewJitterBuffer(4)
+	var got []uint16
+	for _, seq := range []uint16{65534, 0, 65535, 1, 1, 3, 4, 5, 6} {
+		for _, pkt := range j.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}) {
+			got = append(got, pkt.SequenceNumber)
+		}
+	}
+	expected := []uint16{65534, 65535, 0, 1, 3, 4, 5, 6}
+	if len(got) != len(expected) {
+		t.Fatalf("unexpected order %v", got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("unexpected order %v", got)
+		}
+	}
+	if j.Lost() != 1 || j.Discards() != 1 {
+		t.Fatalf("unexpected lost %d discards %d", j.Lost(), j.Discards())
+	}
+}
+
+func TestTimebaseWraparound(t *testing.T) {
+	tb := NewTimebase(VideoClockRate)
+	if ms := tb.Ms(0xffffffff - 8999); ms != 0 {
+		t.Fatalf("first timestamp must map to 0, got %d", ms)
+	}
+	if ms := tb.Ms(9000); ms != 200 {
+		t.Fatalf("unexpected ms after wraparound %d", ms)
+	}
+	if ms := tb.Ms(0); ms != 100 {
+		t.Fatalf("unexpected ms of reordered timestamp %d", ms)
+	}
+}
+
+func pushSeqs(j *JitterBuffer, ssrc uint32, seqs ...uint16) []uint16 {
+	var got []uint16
+	for _, seq := range seqs {
+		for _, pkt := range j.Push(&rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq}}) {
+			got = append(got, pkt.SequenceNumber)
+		}
+	}
+	return got
+}
+
+func TestJitterBufferResync(t *testing.T) {
+	//a jump past half the sequence space looks late until enough packets in a row say otherwise
+	j := NewJitterBuffer(DefaultJitterSize)
+	pushSeqs(j, 1, 100, 101)
+	var jump []uint16
+	for seq := uint16(40000); seq < 40000+resyncDiscards+2; seq++ {
+		jump = append(jump, seq)
+	}
+	got := pushSeqs(j, 1, jump...)
+	if j.Resyncs() != 1 || len(got) != 3 || got[0] != 40000+resyncDiscards-1 {
+		t.Fatalf("expect to resync on the jump, got %v after %d resyncs", got, j.Resyncs())
+	}
+
+	//a new ssrc flushes the packets of the old one and starts over from its own base
+	j = NewJitterBuffer(DefaultJitterSize)
+	got = pushSeqs(j, 1, 10, 11, 13)
+	got = append(got, pushSeqs(j, 2, 5, 6)...)
+	expected := []uint16{10, 11, 13, 5, 6}
+	if len(got) != len(expected) || j.Resyncs() != 1 || j.Lost() != 1 {
+		t.Fatalf("unexpected order %v, %d resyncs and %d lost", got, j.Resyncs(), j.Lost())
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("unexpected order %v", got)
+		}
+	}
+}
+
+func TestJitterBufferDelay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	j := NewJitterBuffer(DefaultJitterSize)
+	j.now = func() time.Time {
+		return now
+	}
+	if got := pushSeqs(j, 1, 1, 3); len(got) != 1 {
+		t.Fatalf("expect 3 to wait for 2, got %v", got)
+	}
+	now = now.Add(DefaultJitterDelay / 2)
+	if got := pushSeqs(j, 1, 4); len(got) != 0 {
+		t.Fatalf("expect the gap to hold, got %v", got)
+	}
+	now = now.Add(DefaultJitterDelay / 2)
+	if got := pushSeqs(j, 1, 5); len(got) != 3 || got[0] != 3 || j.Lost() != 1 {
+		t.Fatalf("expect the gap released after the delay, got %v and %d lost", got, j.Lost())
+	}
+	if got := pushSeqs(j, 1, 2); len(got) != 0 || j.Discards() != 1 {
+		t.Fatalf("expect the late packet discarded, got %v", got)
+	}
+}
@@ -0,0 +1,49 @@
+package rtp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pion/rtp"
+)
+
+// Sequencer keeps the ssrc, sequence number and timestamp base of an outgoing track
+type Sequencer struct {
+	PayloadType    uint8
+	ClockRate      int
+	SSRC           uint32
+	SequenceNumber uint16
+	InitialTs      uint32
+}
+
+func NewSequencer(payloadType uint8, clockRate int) *Sequencer {
+	var buf [10]byte
+	_, _ = rand.Read(buf[:])
+	s := &Sequencer{}
+	s.PayloadType = payloadType
+	s.ClockRate = clockRate
+	s.SSRC = binary.BigEndian.Uint32(buf[0:4])
+	s.SequenceNumber = binary.BigEndian.Uint16(buf[4:6])
+	s.InitialTs = binary.BigEndian.Uint32(buf[6:10])
+	return s
+}
+
+// Timestamp maps a presentation time in ms to the rtp clock
+func (s *Sequencer) Timestamp(pts int64) uint32 {
+	return s.InitialTs + uint32(pts*int64(s.ClockRate)/1000)
+}
+
+func (s *Sequencer) NewPacket(ts uint32, marker bool, payload []byte) *rtp.Packet {
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        rtpVersion,
+			PayloadType:    s.PayloadType,
+			SequenceNumber: s.SequenceNumber,
+			Timestamp:      ts,
+			SSRC:           s.SSRC,
+			Marker:         marker,
+		},
+		Payload: payload,
+	}
+	s.SequenceNumber++
+	return pkt
+}
@@ -0,0 +1,68 @@
+package rtp
+
+// SeqUnwrapper extends 16 bit sequence numbers so they keep increasing across wraparound
+type SeqUnwrapper struct {
+	started bool
+	last    uint16
+	ext     int64
+}
+
+func (u *SeqUnwrapper) Unwrap(seq uint16) int64 {
+	if !u.started {
+		u.started = true
+		u.last = seq
+		u.ext = int64(seq)
+		return u.ext
+	}
+	ext := u.ext + int64(int16(seq-u.last))
+	if ext > u.ext {
+		u.last = seq
+		u.ext = ext
+	}
+	return ext
+}
+
+// TsUnwrapper extends 32 bit rtp timestamps so they keep increasing across wraparound
+type TsUnwrapper struct {
+	started bool
+	last    uint32
+	ext     int64
+}
+
+func (u *TsUnwrapper) Unwrap(ts uint32) int64 {
+	if !u.started {
+		u.started = true
+		u.last = ts
+		u.ext = int64(ts)
+		return u.ext
+	}
+	ext := u.ext + int64(int32(ts-u.last))
+	if ext > u.ext {
+		u.last = ts
+		u.ext = ext
+	}
+	return ext
+}
+
+// Timebase maps rtp timestamps of a track to ms since its first packet, the internal packet timebase
+type Timebase struct {
+	clockRate int
+	unwrapper TsUnwrapper
+	started   bool
+	base      int64
+}
+
+func NewTimebase(clockRate int) *Timebase {
+	t := &Timebase{}
+	t.clockRate = clockRate
+	return t
+}
+
+func (t *Timebase) Ms(ts uint32) int64 {
+	ext := t.unwrapper.Unwrap(ts)
+	if !t.started {
+		t.started = true
+		t.base = ext
+	}
+	return (ext - t.base) * 1000 / int64(t.clockRate)
+}
@@ -0,0 +1,192 @@
+package rtp
+
+import (
+	"fmt"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"github.com/aler9/gortsplib/pkg/aac"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/pion/rtp"
+	"time"
+)
+
+// TrackDecoder turns the rtp packets of a track into media packets, a sequence header goes first
+type TrackDecoder interface {
+	Decode(pkt *rtp.Packet) []*proto.BasePacket
+}
+
+// TrackEncoder turns media packets into the rtp packets of a track
+type TrackEncoder interface {
+	Encode(pkt *proto.BasePacket) []*rtp.Packet
+}
+
+func msToDuration(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// frameDecoder reorders packets and maps the frame timestamps to ms
+type frameDecoder struct {
+	jitter       *JitterBuffer
+	depacketizer Depacketizer
+	timebase     *Timebase
+}
+
+func (d *frameDecoder) decode(pkt *rtp.Packet, onFrame func(units [][]byte, pts int64)) {
+	for _, ordered := range d.jitter.Push(pkt) {
+		frames, _ := d.depacketizer.Depacketize(ordered)
+		for _, frame := range frames {
+			onFrame(frame.Units, d.timebase.Ms(frame.Timestamp))
+		}
+	}
+}
+
+type videoTrackDecoder struct {
+	frameDecoder
+	framer *codec.VideoFramer
+	dtsEst *h264.DTSEstimator
+	pkts   []*proto.BasePacket
+}
+
+// NewH264TrackDecoder starts with the parameter sets out of band, they may be nil
+func NewH264TrackDecoder(sps []byte, pps []byte) TrackDecoder {
+	return newVideoTrackDecoder(codec.NewVideoFramer(constdef.CodecH264, nil, sps, pps), NewH264Depacketizer())
+}
+
+// NewH265TrackDecoder starts with the parameter sets out of band, they may be nil
+func NewH265TrackDecoder(vps []byte, sps []byte, pps []byte) TrackDecoder {
+	return newVideoTrackDecoder(codec.NewVideoFramer(constdef.CodecH265, vps, sps, pps), NewH265Depacketizer())
+}
+
+func newVideoTrackDecoder(framer *codec.VideoFramer, depacketizer Depacketizer) *videoTrackDecoder {
+	d := &videoTrackDecoder{}
+	d.jitter = NewJitterBuffer(DefaultJitterSize)
+	d.depacketizer = depacketizer
+	d.timebase = NewTimebase(VideoClockRate)
+	d.framer = framer
+	d.dtsEst = h264.NewDTSEstimator()
+	return d
+}
+
+func (d *videoTrackDecoder) Decode(pkt *rtp.Packet) []*proto.BasePacket {
+	d.pkts = nil
+	d.decode(pkt, d.decodeFrame)
+	return d.pkts
+}
+
+// decodeFrame estimates the dts, rtp only carries the pts
+func (d *videoTrackDecoder) decodeFrame(nalus [][]byte, pts int64) {
+	dts := d.dtsEst.Feed(msToDuration(pts))
+	d.pkts = d.framer.Frame(d.pkts, nalus, int64(dts/time.Millisecond), pts)
+}
+
+type audioTrackDecoder struct {
+	frameDecoder
+	codec      constdef.CodecID
+	header     []byte
+	headerSent bool
+	pkts       []*proto.BasePacket
+}
+
+// NewAudioTrackDecoder emits every audio frame as a packet, header is the sequence header payload
+func NewAudioTrackDecoder(codecID constdef.CodecID, depacketizer Depacketizer, clockRate int, header []byte) TrackDecoder {
+	d := &audioTrackDecoder{}
+	d.jitter = NewJitterBuffer(DefaultJitterSize)
+	d.depacketizer = depacketizer
+	d.timebase = NewTimebase(clockRate)
+	d.codec = codecID
+	d.header = header
+	return d
+}
+
+func (d *audioTrackDecoder) Decode(pkt *rtp.Packet) []*proto.BasePacket {
+	d.pkts = nil
+	d.decode(pkt, d.decodeFrame)
+	return d.pkts
+}
+
+func (d *audioTrackDecoder) decodeFrame(units [][]byte, pts int64) {
+	if !d.headerSent {
+		d.headerSent = true
+		d.pkts = append(d.pkts, &proto.BasePacket{
+			MediaType: protocol.MediaDataTypeAudio,
+			Codec:     d.codec,
+			DTS:       pts,
+			PTS:       pts,
+			SeqHeader: true,
+			Payload:   d.header,
+		})
+	}
+	for _, unit := range units {
+		d.pkts = append(d.pkts, &proto.BasePacket{
+			MediaType: protocol.MediaDataTypeAudio,
+			Codec:     d.codec,
+			DTS:       pts,
+			PTS:       pts,
+			Payload:   unit,
+		})
+	}
+}
+
+// videoTrackEncoder repeats the parameter sets before keyframes so readers can join at any keyframe
+type videoTrackEncoder struct {
+	packetizer Packetizer
+	paramSets  [][]byte
+}
+
+func (e *videoTrackEncoder) Encode(pkt *proto.BasePacket) []*rtp.Packet {
+	if pkt.SeqHeader {
+		return nil
+	}
+	nalus, err := codec.DecodeAVCC(pkt.Payload)
+	if err != nil {
+		return nil
+	}
+	if pkt.KeyFrame {
+		nalus = append(append([][]byte{}, e.paramSets...), nalus...)
+	}
+	return e.packetizer.Packetize(pkt.PTS, nalus)
+}
+
+type audioTrackEncoder struct {
+	packetizer Packetizer
+}
+
+func (e *audioTrackEncoder) Encode(pkt *proto.BasePacket) []*rtp.Packet {
+	if pkt.SeqHeader {
+		return nil
+	}
+	return e.packetizer.Packetize(pkt.PTS, [][]byte{pkt.Payload})
+}
+
+// NewTrackEncoder builds the encoder of a track from its sequence header, g711 keeps its static payload type
+func NewTrackEncoder(header *proto.BasePacket, payloadType uint8) (TrackEncoder, error) {
+	switch header.Codec {
+	case constdef.CodecH264:
+		sps, pps, err := codec.ParseAVCDecoderConfig(header.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &videoTrackEncoder{packetizer: NewH264Packetizer(payloadType), paramSets: [][]byte{sps, pps}}, nil
+	case constdef.CodecH265:
+		vps, sps, pps, err := codec.ParseHEVCDecoderConfig(header.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &videoTrackEncoder{packetizer: NewH265Packetizer(payloadType), paramSets: [][]byte{vps, sps, pps}}, nil
+	case constdef.CodecAAC:
+		var config aac.MPEG4AudioConfig
+		if err := config.Decode(header.Payload); err != nil {
+			return nil, err
+		}
+		return &audioTrackEncoder{packetizer: NewAACPacketizer(payloadType, config.SampleRate)}, nil
+	case constdef.CodecOpus:
+		return &audioTrackEncoder{packetizer: NewOpusPacketizer(payloadType)}, nil
+	case constdef.CodecPCMU:
+		return &audioTrackEncoder{packetizer: NewG711Packetizer(PayloadTypePCMU)}, nil
+	case constdef.CodecPCMA:
+		return &audioTrackEncoder{packetizer: NewG711Packetizer(PayloadTypePCMA)}, nil
+	}
+	return nil, fmt.Errorf("codec %s not supported by rtp", header.Codec)
+}
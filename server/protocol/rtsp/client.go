@@ -0,0 +1,187 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/aler9/gortsplib"
+	rtspbase "github.com/aler9/gortsplib/pkg/base"
+	"github.com/pion/rtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 30 * time.Second
+)
+
+type PullConfig struct {
+	//camera url, credentials in the userinfo are used for basic/digest auth
+	URL string
+	//url players use for the pulled stream, its host and path make the stream id
+	StreamURL string
+	//tcp, udp or empty to try udp first and fall back to tcp
+	Transport  string
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Puller pulls a rtsp camera and republishes it as a source session, it reconnects with backoff until closed
+type Puller struct {
+	ctx       context.Context
+	config    *PullConfig
+	streamURL *url.URL
+	running   bool
+
+	mu     sync.Mutex
+	client *gortsplib.Client
+	stop   chan struct{}
+}
+
+func NewPuller(config *PullConfig) *Puller {
+	p := &Puller{}
+	p.config = config
+	return p
+}
+
+func (p *Puller) Init() error {
+	if !strings.HasPrefix(p.config.URL, "rtsp://") && !strings.HasPrefix(p.config.URL, "rtsps://") {
+		return fmt.Errorf("invalid rtsp url %s", p.config.URL)
+	}
+	streamURL, err := url.Parse(p.config.StreamURL)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(p.config.Transport) {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("invalid rtsp transport %s", p.config.Transport)
+	}
+	if p.config.MinBackoff <= 0 {
+		p.config.MinBackoff = defaultMinBackoff
+	}
+	if p.config.MaxBackoff < p.config.MinBackoff {
+		p.config.MaxBackoff = defaultMaxBackoff
+	}
+	p.streamURL = streamURL
+	p.ctx = log.GetCtxWithLogID(context.Background(), "RTSP_PULL")
+	p.stop = make(chan struct{})
+	p.running = true
+	return nil
+}
+
+func (p *Puller) Start() error {
+	task.SubmitTask0(p.ctx, p.run)
+	return nil
+}
+
+func (p *Puller) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return
+	}
+	p.running = false
+	close(p.stop)
+	if p.client != nil {
+		_ = p.client.Close()
+	}
+}
+
+func (p *Puller) isRunning() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+func (p *Puller) run() {
+	backoff := p.config.MinBackoff
+	for p.isRunning() {
+		start := time.Now()
+		err := p.pull()
+		if !p.isRunning() {
+			return
+		}
+		if time.Since(start) > p.config.MaxBackoff {
+			//the last session was healthy for a while
+			backoff = p.config.MinBackoff
+		}
+		log.Warnf(p.ctx, "pull %s failed: %+v, retry in %s", p.config.StreamURL, err, backoff)
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > p.config.MaxBackoff {
+			backoff = p.config.MaxBackoff
+		}
+	}
+}
+
+// pull runs one rtsp session until it breaks
+func (p *Puller) pull() error {
+	u, err := rtspbase.ParseURL(p.config.URL)
+	if err != nil {
+		return err
+	}
+	var pub *publisher
+	c := &gortsplib.Client{
+		OnPacketRTP: func(trackID int, pkt *rtp.Packet) {
+			pub.onPacketRTP(trackID, pkt)
+		},
+	}
+	switch strings.ToLower(p.config.Transport) {
+	case "tcp":
+		transport := gortsplib.TransportTCP
+		c.Transport = &transport
+	case "udp":
+		transport := gortsplib.TransportUDP
+		c.Transport = &transport
+	}
+	if err = c.Start(u.Scheme, u.Host); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		_ = c.Close()
+		return nil
+	}
+	p.client = c
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.client = nil
+		p.mu.Unlock()
+		_ = c.Close()
+	}()
+
+	tracks, baseURL, _, err := c.Describe(u)
+	if err != nil {
+		return err
+	}
+	pub, err = newPublisher(p.ctx, p.streamURL, tracks)
+	if err != nil {
+		return err
+	}
+	if err = stream.DefaultHyStreamManager.AddStream(pub.hyStream); err != nil {
+		return err
+	}
+	//kicking a pulled stream reconnects it
+	pub.source.SetPeer(&proto.Peer{Protocol: "rtsp-pull", RemoteAddr: u.Host, Kick: func() { _ = c.Close() }})
+	defer func() {
+		_ = pub.OnClose()
+	}()
+	if err = c.SetupAndPlay(tracks, baseURL); err != nil {
+		return err
+	}
+	log.Infof(p.ctx, "pulling %s as %s", u.CloneWithoutCredentials(), pub.hyStream.Base().ID())
+	return c.Wait()
+}
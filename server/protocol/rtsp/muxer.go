@@ -0,0 +1,164 @@
+package rtsp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	hyrtp "github.com/Opafanls/hylan/server/protocol/rtp"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/aac"
+	"sync/atomic"
+)
+
+const (
+	videoPayloadType = 96
+	audioPayloadType = 97
+)
+
+// streamMuxer is the shared reader side of a stream, one sink feeds every rtsp reader
+type streamMuxer struct {
+	ctx          context.Context
+	hyStream     *stream.HyStream
+	sink         session.SinkSessionI
+	serverStream *gortsplib.ServerStream
+	videoTrackID int
+	audioTrackID int
+	video        hyrtp.TrackEncoder
+	audio        hyrtp.TrackEncoder
+	//the sessions past PLAY, they are the players of the shared sink
+	playing int32
+}
+
+func newStreamMuxer(ctx context.Context, hyStream *stream.HyStream) (*streamMuxer, error) {
+	m := &streamMuxer{ctx: ctx, hyStream: hyStream, videoTrackID: -1, audioTrackID: -1}
+	var tracks gortsplib.Tracks
+	for _, header := range hyStream.Source().SeqHeaders() {
+		pkt := header.Base()
+		track, encoder, err := newTrack(pkt)
+		if err != nil {
+			log.Warnf(ctx, "skip %s track: %+v", pkt.Codec, err)
+			continue
+		}
+		if pkt.IsVideo() {
+			m.videoTrackID = len(tracks)
+			m.video = encoder
+		} else {
+			m.audioTrackID = len(tracks)
+			m.audio = encoder
+		}
+		tracks = append(tracks, track)
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("stream %s has no track for rtsp", hyStream.Base().ID())
+	}
+	m.serverStream = gortsplib.NewServerStream(tracks)
+	m.sink = hyStream.Source().AddSink(&proto.SinkArg{
+		Ctx:      ctx,
+		Protocol: constdef.SinkTypeRtsp,
+		//the sink is shared by every rtsp reader of the stream, the playing sessions are its players
+		Peer:     &proto.Peer{Protocol: "rtsp", Internal: true, Players: m.players},
+		SinkRtsp: &proto.SinkRtsp{},
+	})
+	return m, nil
+}
+
+func (m *streamMuxer) players() int {
+	return int(atomic.LoadInt32(&m.playing))
+}
+
+// newTrack builds the sdp track from a sequence header
+func newTrack(header *proto.BasePacket) (gortsplib.Track, hyrtp.TrackEncoder, error) {
+	track, payloadType, err := newSdpTrack(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	encoder, err := hyrtp.NewTrackEncoder(header, payloadType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return track, encoder, nil
+}
+
+func newSdpTrack(header *proto.BasePacket) (gortsplib.Track, uint8, error) {
+	switch header.Codec {
+	case constdef.CodecH264:
+		sps, pps, err := codec.ParseAVCDecoderConfig(header.Payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		track, err := gortsplib.NewTrackH264(videoPayloadType, sps, pps, nil)
+		return track, videoPayloadType, err
+	case constdef.CodecH265:
+		vps, sps, pps, err := codec.ParseHEVCDecoderConfig(header.Payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		fmtp := fmt.Sprintf("%d sprop-vps=%s; sprop-sps=%s; sprop-pps=%s", videoPayloadType,
+			base64.StdEncoding.EncodeToString(vps),
+			base64.StdEncoding.EncodeToString(sps),
+			base64.StdEncoding.EncodeToString(pps))
+		track, err := gortsplib.NewTrackGeneric("video", []string{fmt.Sprint(videoPayloadType)},
+			fmt.Sprintf("%d H265/90000", videoPayloadType), fmtp)
+		return track, videoPayloadType, err
+	case constdef.CodecAAC:
+		var config aac.MPEG4AudioConfig
+		if err := config.Decode(header.Payload); err != nil {
+			return nil, 0, err
+		}
+		track, err := gortsplib.NewTrackAAC(audioPayloadType, int(config.Type), config.SampleRate,
+			config.ChannelCount, config.AOTSpecificConfig)
+		return track, audioPayloadType, err
+	case constdef.CodecOpus:
+		channels := 2
+		if len(header.Payload) > 9 {
+			channels = int(header.Payload[9])
+		}
+		track, err := gortsplib.NewTrackOpus(audioPayloadType, hyrtp.OpusClockRate, channels)
+		return track, audioPayloadType, err
+	case constdef.CodecPCMU:
+		return gortsplib.NewTrackPCMU(), hyrtp.PayloadTypePCMU, nil
+	case constdef.CodecPCMA:
+		track, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, "8 PCMA/8000", "")
+		return track, hyrtp.PayloadTypePCMA, err
+	}
+	return nil, 0, fmt.Errorf("codec not supported by rtsp")
+}
+
+func (m *streamMuxer) run(onDone func()) {
+	defer func() {
+		m.sink.Close()
+		_ = m.serverStream.Close()
+		onDone()
+	}()
+	for {
+		data, ok := m.sink.Pull(m.ctx)
+		if !ok {
+			log.Infof(m.ctx, "rtsp muxer of %s done", m.hyStream.Base().ID())
+			return
+		}
+		pkt := data.Base()
+		if pkt.SeqHeader {
+			continue
+		}
+		trackID, encoder := m.audioTrackID, m.audio
+		if pkt.IsVideo() {
+			trackID, encoder = m.videoTrackID, m.video
+		}
+		if encoder == nil {
+			continue
+		}
+		for _, rtpPkt := range encoder.Encode(pkt) {
+			m.serverStream.WritePacketRTP(trackID, rtpPkt)
+		}
+	}
+}
+
+func (m *streamMuxer) close() {
+	m.sink.Close()
+}
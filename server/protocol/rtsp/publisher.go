@@ -0,0 +1,154 @@
+package rtsp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	hyrtp "github.com/Opafanls/hylan/server/protocol/rtp"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/aac"
+	"github.com/pion/rtp"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// publisher feeds the rtp packets of an announced session into a source session
+type publisher struct {
+	ctx      context.Context
+	hyStream *stream.HyStream
+	source   session.SourceSessionI
+	tracks   []hyrtp.TrackDecoder
+}
+
+func newPublisher(ctx context.Context, u *url.URL, tracks gortsplib.Tracks) (*publisher, error) {
+	p := &publisher{ctx: ctx}
+	supported := 0
+	for _, track := range tracks {
+		decoder := newTrackDecoder(track)
+		if decoder == nil {
+			log.Warnf(ctx, "skip unsupported track %s", trackRtpMap(track))
+		} else {
+			supported++
+		}
+		p.tracks = append(p.tracks, decoder)
+	}
+	if supported == 0 {
+		return nil, fmt.Errorf("no supported track")
+	}
+	p.source = session.NewSourceSession(ctx, p)
+	p.hyStream = stream.NewHyStream0(u, p.source)
+	return p, nil
+}
+
+func (p *publisher) OnInit(ctx context.Context) {
+}
+
+func (p *publisher) OnMedia(ctx context.Context, mediaType protocol.MediaDataType, data interface{}) error {
+	pkt, ok := data.(*proto.BasePacket)
+	if !ok {
+		return fmt.Errorf("unexpected media %T for %d", data, mediaType)
+	}
+	p.source.Push(ctx, pkt)
+	return nil
+}
+
+func (p *publisher) OnClose() error {
+	stream.DefaultHyStreamManager.RemoveStreamIfMatch(p.hyStream)
+	p.source.Close()
+	return nil
+}
+
+func (p *publisher) onPacketRTP(trackID int, pkt *rtp.Packet) {
+	if trackID < 0 || trackID >= len(p.tracks) || p.tracks[trackID] == nil {
+		return
+	}
+	for _, mediaPkt := range p.tracks[trackID].Decode(pkt) {
+		_ = p.OnMedia(p.ctx, mediaPkt.MediaType, mediaPkt)
+	}
+}
+
+func trackRtpMap(track gortsplib.Track) string {
+	for _, attr := range track.MediaDescription().Attributes {
+		if attr.Key == "rtpmap" {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func trackFmtp(track gortsplib.Track) map[string]string {
+	params := make(map[string]string)
+	for _, attr := range track.MediaDescription().Attributes {
+		if attr.Key != "fmtp" {
+			continue
+		}
+		idx := strings.Index(attr.Value, " ")
+		if idx < 0 {
+			continue
+		}
+		for _, kv := range strings.Split(attr.Value[idx+1:], ";") {
+			kv = strings.TrimSpace(kv)
+			if pos := strings.Index(kv, "="); pos > 0 {
+				params[strings.ToLower(kv[:pos])] = kv[pos+1:]
+			}
+		}
+	}
+	return params
+}
+
+func newTrackDecoder(track gortsplib.Track) hyrtp.TrackDecoder {
+	switch t := track.(type) {
+	case *gortsplib.TrackH264:
+		return hyrtp.NewH264TrackDecoder(t.SPS(), t.PPS())
+	case *gortsplib.TrackAAC:
+		config, err := aac.MPEG4AudioConfig{
+			Type:              aac.MPEG4AudioType(t.Type()),
+			SampleRate:        t.ClockRate(),
+			ChannelCount:      t.ChannelCount(),
+			AOTSpecificConfig: t.AOTSpecificConfig(),
+		}.Encode()
+		if err != nil {
+			return nil
+		}
+		depacketizer := hyrtp.NewAACDepacketizer()
+		params := trackFmtp(track)
+		for key, length := range map[string]*int{
+			"sizelength":       &depacketizer.SizeLength,
+			"indexlength":      &depacketizer.IndexLength,
+			"indexdeltalength": &depacketizer.IndexDeltaLength,
+		} {
+			if v, err := strconv.Atoi(params[key]); err == nil {
+				*length = v
+			}
+		}
+		return hyrtp.NewAudioTrackDecoder(constdef.CodecAAC, depacketizer, t.ClockRate(), config)
+	case *gortsplib.TrackOpus:
+		return hyrtp.NewAudioTrackDecoder(constdef.CodecOpus, hyrtp.NewOpusDepacketizer(), t.ClockRate(), codec.OpusHead(t.ChannelCount()))
+	case *gortsplib.TrackPCMU:
+		return hyrtp.NewAudioTrackDecoder(constdef.CodecPCMU, hyrtp.NewG711Depacketizer(), hyrtp.G711ClockRate, nil)
+	}
+	rtpMap := strings.ToUpper(trackRtpMap(track))
+	formats := track.MediaDescription().MediaName.Formats
+	if strings.Contains(rtpMap, "PCMA/") || (rtpMap == "" && len(formats) == 1 && formats[0] == "8") {
+		return hyrtp.NewAudioTrackDecoder(constdef.CodecPCMA, hyrtp.NewG711Depacketizer(), hyrtp.G711ClockRate, nil)
+	}
+	if strings.Contains(rtpMap, "PCMU/") {
+		return hyrtp.NewAudioTrackDecoder(constdef.CodecPCMU, hyrtp.NewG711Depacketizer(), hyrtp.G711ClockRate, nil)
+	}
+	if strings.Contains(rtpMap, "H265/") {
+		params := trackFmtp(track)
+		vps, _ := base64.StdEncoding.DecodeString(params["sprop-vps"])
+		sps, _ := base64.StdEncoding.DecodeString(params["sprop-sps"])
+		pps, _ := base64.StdEncoding.DecodeString(params["sprop-pps"])
+		return hyrtp.NewH265TrackDecoder(vps, sps, pps)
+	}
+	return nil
+}
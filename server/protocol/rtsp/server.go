@@ -0,0 +1,358 @@
+package rtsp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"github.com/aler9/gortsplib"
+	rtspbase "github.com/aler9/gortsplib/pkg/base"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimeout is the read and write timeout when the config sets none
+const DefaultTimeout = 10 * time.Second
+
+type ListenConfig struct {
+	Addr string
+	Port int
+	//udp ports for rtp/rtcp, udp transport is disabled when zero
+	RtpPort  int
+	RtcpPort int
+	//rtsps when set, it can't be combined with the udp transport
+	TLS          *tls.Config
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	//connections, publishes and plays are checked against it, nil lets everyone in
+	Access *hynet.Access
+	//reads the PROXY header of the trusted load balancers, nil reads none
+	Proxy *hynet.Proxy
+}
+
+// Server is a RTSP server, ANNOUNCE/RECORD publishes and DESCRIBE/SETUP/PLAY reads a stream
+type Server struct {
+	ctx     context.Context
+	config  *ListenConfig
+	running bool
+	server  *gortsplib.Server
+
+	mu         sync.Mutex
+	publishers map[*gortsplib.ServerSession]*publisher
+	muxers     map[string]*streamMuxer
+	players    map[*gortsplib.ServerSession]*player
+	//the publishers past RECORD, read by every rtp packet without mu
+	recording sync.Map
+	//of the connections accepted from now on, gortsplib keeps the ones it started with
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// player is a session past PLAY
+type player struct {
+	//on_stop
+	stop  func()
+	muxer *streamMuxer
+}
+
+func NewServer(config *ListenConfig) *Server {
+	s := &Server{}
+	s.config = config
+	return s
+}
+
+func (s *Server) Init() error {
+	s.ctx = log.GetCtxWithLogID(context.Background(), "RTSP_SERVER")
+	s.publishers = make(map[*gortsplib.ServerSession]*publisher)
+	s.players = make(map[*gortsplib.ServerSession]*player)
+	s.muxers = make(map[string]*streamMuxer)
+	s.SetTimeouts(s.config.ReadTimeout, s.config.WriteTimeout)
+	s.server = &gortsplib.Server{
+		Handler:      s,
+		RTSPAddress:  fmt.Sprintf("%s:%d", s.config.Addr, s.config.Port),
+		TLSConfig:    s.config.TLS,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		Listen:       s.listen,
+	}
+	if s.config.RtpPort != 0 && s.config.RtcpPort != 0 {
+		s.server.UDPRTPAddress = fmt.Sprintf("%s:%d", s.config.Addr, s.config.RtpPort)
+		s.server.UDPRTCPAddress = fmt.Sprintf("%s:%d", s.config.Addr, s.config.RtcpPort)
+	}
+	s.running = true
+	return nil
+}
+
+// listen is the tcp listener of gortsplib, the rejected connections never reach it
+func (s *Server) listen(network, address string) (net.Listener, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutListener{Listener: s.config.Access.Listener(s.config.Proxy.Listener(listener)), server: s}, nil
+}
+
+// SetTimeouts applies to the connections accepted from now on, DefaultTimeout when zero. The udp
+// transport keeps the timeouts the server started with.
+func (s *Server) SetTimeouts(read, write time.Duration) {
+	if read <= 0 {
+		read = DefaultTimeout
+	}
+	if write <= 0 {
+		write = DefaultTimeout
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readTimeout = read
+	s.writeTimeout = write
+}
+
+// timeoutListener moves the deadlines gortsplib sets with its timeouts to the ones of the server
+// when the connection was accepted
+type timeoutListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *timeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	s := l.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &timeoutConn{
+		Conn:       conn,
+		readShift:  s.readTimeout - s.server.ReadTimeout,
+		writeShift: s.writeTimeout - s.server.WriteTimeout,
+	}, nil
+}
+
+type timeoutConn struct {
+	net.Conn
+	readShift  time.Duration
+	writeShift time.Duration
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		t = t.Add(c.readShift)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	if !t.IsZero() {
+		t = t.Add(c.writeShift)
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (s *Server) Start() error {
+	log.Infof(s.ctx, "listen rtsp server@%s:%d", s.config.Addr, s.config.Port)
+	return s.server.Start()
+}
+
+func (s *Server) Close() {
+	s.running = false
+	_ = s.server.Close()
+}
+
+func streamURL(req *rtspbase.Request, path string, query string) *url.URL {
+	return &url.URL{
+		Scheme:   "rtsp",
+		Host:     req.URL.Host,
+		Path:     "/" + strings.TrimPrefix(path, "/"),
+		RawQuery: query,
+	}
+}
+
+// muxer returns the rtsp reader side of the stream, creating it on first use
+func (s *Server) muxer(u *url.URL) (*streamMuxer, error) {
+	id := base.NewBase0(u).ID()
+	hyStream, exist := stream.DefaultHyStreamManager.GetStream(id)
+	if !exist {
+		return nil, fmt.Errorf("stream %s not found", id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.muxers[id]; ok {
+		if m.hyStream == hyStream {
+			return m, nil
+		}
+		//stale muxer of a previous publisher
+		m.close()
+		delete(s.muxers, id)
+	}
+	m, err := newStreamMuxer(log.GetCtxWithLogID(s.ctx, "RTSP_MUXER"), hyStream)
+	if err != nil {
+		return nil, err
+	}
+	s.muxers[id] = m
+	task.SubmitTask0(m.ctx, func() {
+		m.run(func() {
+			s.mu.Lock()
+			if s.muxers[id] == m {
+				delete(s.muxers, id)
+			}
+			s.mu.Unlock()
+		})
+	})
+	return m, nil
+}
+
+func (s *Server) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
+	log.Infof(s.ctx, "rtsp conn opened %s", ctx.Conn.NetConn().RemoteAddr())
+	metrics.Connections.With("rtsp").Inc()
+}
+
+func (s *Server) OnConnClose(ctx *gortsplib.ServerHandlerOnConnCloseCtx) {
+	log.Infof(s.ctx, "rtsp conn closed %s: %+v", ctx.Conn.NetConn().RemoteAddr(), ctx.Error)
+	metrics.Connections.With("rtsp").Dec()
+}
+
+func (s *Server) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	s.mu.Lock()
+	p, exist := s.publishers[ctx.Session]
+	delete(s.publishers, ctx.Session)
+	s.recording.Delete(ctx.Session)
+	pl, playing := s.players[ctx.Session]
+	delete(s.players, ctx.Session)
+	s.mu.Unlock()
+	if exist {
+		log.Infof(p.ctx, "rtsp publisher of %s closed: %+v", p.hyStream.Base().ID(), ctx.Error)
+		_ = p.OnClose()
+	}
+	if playing {
+		atomic.AddInt32(&pl.muxer.playing, -1)
+		pl.stop()
+	}
+}
+
+func (s *Server) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*rtspbase.Response, *gortsplib.ServerStream, error) {
+	u := streamURL(ctx.Request, ctx.Path, ctx.Query)
+	if err := s.config.Access.Allow(hynet.OpPlay, ctx.Conn.NetConn().RemoteAddr().String()); err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusForbidden}, nil, err
+	}
+	if _, err := vhost.Play(u, ctx.Conn.NetConn().RemoteAddr().String()); err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusCode(vhost.HTTPStatus(err))}, nil, err
+	}
+	m, err := s.muxer(u)
+	if err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusNotFound}, nil, err
+	}
+	return &rtspbase.Response{StatusCode: rtspbase.StatusOK}, m.serverStream, nil
+}
+
+func (s *Server) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*rtspbase.Response, error) {
+	u := streamURL(ctx.Request, ctx.Path, ctx.Query)
+	if err := s.config.Access.Allow(hynet.OpPublish, ctx.Conn.NetConn().RemoteAddr().String()); err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusForbidden}, err
+	}
+	if _, err := vhost.Publish(u, ctx.Conn.NetConn().RemoteAddr().String()); err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusCode(vhost.HTTPStatus(err))}, err
+	}
+	p, err := newPublisher(log.GetCtxWithLogID(s.ctx, "RTSP_PUBLISH"), u, ctx.Tracks)
+	if err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusUnsupportedMediaType}, err
+	}
+	if err = hook.Publish(p.ctx, hook.NewEvent(hook.OnPublish, u, p.source.ID(), "rtsp", ctx.Conn.NetConn().RemoteAddr().String())); err != nil {
+		p.source.Close()
+		return &rtspbase.Response{StatusCode: rtspbase.StatusForbidden}, err
+	}
+	if err = stream.DefaultHyStreamManager.AddStream(p.hyStream); err != nil {
+		p.source.Close()
+		return &rtspbase.Response{StatusCode: rtspbase.StatusBadRequest}, err
+	}
+	sess := ctx.Session
+	p.source.SetPeer(&proto.Peer{
+		Protocol:   "rtsp",
+		RemoteAddr: ctx.Conn.NetConn().RemoteAddr().String(),
+		Kick:       func() { _ = sess.Close() },
+	})
+	s.mu.Lock()
+	s.publishers[ctx.Session] = p
+	s.mu.Unlock()
+	log.Infof(p.ctx, "rtsp publish stream %s", p.hyStream.Base().ID())
+	return &rtspbase.Response{StatusCode: rtspbase.StatusOK}, nil
+}
+
+func (s *Server) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*rtspbase.Response, *gortsplib.ServerStream, error) {
+	s.mu.Lock()
+	_, publishing := s.publishers[ctx.Session]
+	s.mu.Unlock()
+	if publishing {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusOK}, nil, nil
+	}
+	u := streamURL(ctx.Request, ctx.Path, ctx.Query)
+	if err := s.config.Access.Allow(hynet.OpPlay, ctx.Conn.NetConn().RemoteAddr().String()); err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusForbidden}, nil, err
+	}
+	if _, err := vhost.Play(u, ctx.Conn.NetConn().RemoteAddr().String()); err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusCode(vhost.HTTPStatus(err))}, nil, err
+	}
+	m, err := s.muxer(u)
+	if err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusNotFound}, nil, err
+	}
+	return &rtspbase.Response{StatusCode: rtspbase.StatusOK}, m.serverStream, nil
+}
+
+// OnPlay counts the session as a player and asks on_play once, a play after pause is let through.
+// The player limits are checked again here, the sessions of the shared sink count from PLAY on.
+func (s *Server) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*rtspbase.Response, error) {
+	s.mu.Lock()
+	_, playing := s.players[ctx.Session]
+	s.mu.Unlock()
+	if playing {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusOK}, nil
+	}
+	u := streamURL(ctx.Request, ctx.Path, ctx.Query)
+	if _, err := vhost.Play(u, ctx.Conn.NetConn().RemoteAddr().String()); err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusCode(vhost.HTTPStatus(err))}, err
+	}
+	m, err := s.muxer(u)
+	if err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusNotFound}, err
+	}
+	stop, err := hook.Play(s.ctx, hook.NewEvent(hook.OnPlay, u, session.NextID(), "rtsp", ctx.Conn.NetConn().RemoteAddr().String()))
+	if err != nil {
+		return &rtspbase.Response{StatusCode: rtspbase.StatusForbidden}, err
+	}
+	atomic.AddInt32(&m.playing, 1)
+	s.mu.Lock()
+	s.players[ctx.Session] = &player{stop: stop, muxer: m}
+	s.mu.Unlock()
+	return &rtspbase.Response{StatusCode: rtspbase.StatusOK}, nil
+}
+
+// OnRecord resolves the publisher of the session once, its packets are looked up without the server lock
+func (s *Server) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*rtspbase.Response, error) {
+	s.mu.Lock()
+	p, exist := s.publishers[ctx.Session]
+	s.mu.Unlock()
+	if exist {
+		s.recording.Store(ctx.Session, p)
+	}
+	return &rtspbase.Response{StatusCode: rtspbase.StatusOK}, nil
+}
+
+func (s *Server) OnPacketRTP(ctx *gortsplib.ServerHandlerOnPacketRTPCtx) {
+	if p, exist := s.recording.Load(ctx.Session); exist {
+		p.(*publisher).onPacketRTP(ctx.TrackID, ctx.Packet)
+	}
+}
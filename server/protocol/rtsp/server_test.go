@@ -0,0 +1,331 @@
+package rtsp
+
+import (
+	"bytes"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/protocol/rtmp"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/rtph264"
+	"github.com/pion/rtp"
+	gortmp "github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+)
+
+var initOnce sync.Once
+
+func startServers(t *testing.T) {
+	initOnce.Do(func() {
+		stream.InitHyStreamManager()
+		task.InitTaskSystem()
+		listeners := []hynet.ListenServer{
+			rtmp.NewServer(&hynet.TcpListenConfig{Addr: "127.0.0.1", Port: 19350}),
+			NewServer(&ListenConfig{Addr: "127.0.0.1", Port: 18554}),
+		}
+		for _, listener := range listeners {
+			if err := listener.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := listener.Start(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// readFirstIDR plays the stream over rtsp and waits for a keyframe
+func readFirstIDR(t *testing.T, u string) {
+	transport := gortsplib.TransportTCP
+	got := make(chan []byte, 1)
+	decoder := &rtph264.Decoder{}
+	decoder.Init()
+	c := gortsplib.Client{
+		Transport: &transport,
+		OnPacketRTP: func(trackID int, pkt *rtp.Packet) {
+			nalus, _, err := decoder.DecodeUntilMarker(pkt)
+			if err != nil {
+				return
+			}
+			for _, nalu := range nalus {
+				if nalu[0]&0x1f == codec.H264NaluIDR {
+					select {
+					case got <- nalu:
+					default:
+					}
+				}
+			}
+		},
+	}
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = c.StartReading(u); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	track, ok := c.Tracks()[0].(*gortsplib.TrackH264)
+	if !ok || !bytes.Equal(track.SPS(), testSPS) || !bytes.Equal(track.PPS(), testPPS) {
+		t.Fatalf("unexpected sdp track %+v", c.Tracks()[0])
+	}
+	select {
+	case nalu := <-got:
+		if !bytes.Equal(nalu, testIDR) {
+			t.Fatalf("unexpected idr %x", nalu)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no idr received")
+	}
+}
+
+func TestRtmpPublishRtspPlay(t *testing.T) {
+	startServers(t)
+	//the stream ids name the port without vhosts, the default vhost makes both ports one stream
+	vhost.SetTable(vhost.NewTable(nil))
+	defer vhost.SetTable(nil)
+	client, err := gortmp.Dial("rtmp", "127.0.0.1:19350", &gortmp.ConnConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{App: "live", TCURL: "rtmp://127.0.0.1:19350/live"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtmpStream, err := client.CreateStream(nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rtmpStream.Publish(&rtmpmsg.NetStreamPublish{PublishingName: "rtmp2rtsp", PublishingType: "live"}); err != nil {
+		t.Fatal(err)
+	}
+	seqHeader := append([]byte{0x17, 0, 0, 0, 0}, codec.BuildAVCDecoderConfig(testSPS, testPPS)...)
+	if err = rtmpStream.Write(6, 0, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(seqHeader)}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		frame := append([]byte{0x17, 1, 0, 0, 0}, codec.EncodeAVCC([][]byte{testIDR})...)
+		for ts := uint32(0); ; ts += 40 {
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+			if rtmpStream.Write(6, ts, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(frame)}) != nil {
+				return
+			}
+		}
+	}()
+	readFirstIDR(t, "rtsp://127.0.0.1:18554/live/rtmp2rtsp")
+}
+
+func TestRtspPublishRtspPlay(t *testing.T) {
+	startServers(t)
+	track, err := gortsplib.NewTrackH264(96, testSPS, testPPS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := gortsplib.TransportTCP
+	publisher := gortsplib.Client{Transport: &transport}
+	err = publisher.StartPublishing("rtsp://127.0.0.1:18554/live/rtsp2rtsp", gortsplib.Tracks{track})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		encoder := &rtph264.Encoder{PayloadType: 96}
+		encoder.Init()
+		for pts := time.Duration(0); ; pts += 40 * time.Millisecond {
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+			pkts, err := encoder.Encode([][]byte{testSPS, testPPS, testIDR}, pts)
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				if publisher.WritePacketRTP(0, pkt) != nil {
+					return
+				}
+			}
+		}
+	}()
+	readFirstIDR(t, "rtsp://127.0.0.1:18554/live/rtsp2rtsp")
+}
+
+func TestPullRelay(t *testing.T) {
+	startServers(t)
+	track, err := gortsplib.NewTrackH264(96, testSPS, testPPS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := gortsplib.TransportTCP
+	publisher := gortsplib.Client{Transport: &transport}
+	err = publisher.StartPublishing("rtsp://127.0.0.1:18554/live/cam", gortsplib.Tracks{track})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		encoder := &rtph264.Encoder{PayloadType: 96}
+		encoder.Init()
+		for pts := time.Duration(0); ; pts += 40 * time.Millisecond {
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+			pkts, err := encoder.Encode([][]byte{testIDR}, pts)
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				if publisher.WritePacketRTP(0, pkt) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	puller := NewPuller(&PullConfig{
+		URL:        "rtsp://127.0.0.1:18554/live/cam",
+		StreamURL:  "rtsp://127.0.0.1:18554/live/cam_relay",
+		Transport:  "tcp",
+		MinBackoff: 100 * time.Millisecond,
+	})
+	if err = puller.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err = puller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer puller.Close()
+	readFirstIDR(t, "rtsp://127.0.0.1:18554/live/cam_relay")
+}
+
+func TestSetTimeouts(t *testing.T) {
+	startServers(t)
+	server := NewServer(&ListenConfig{Addr: "127.0.0.1", Port: 18680})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	//the publisher sends nothing after RECORD, the new read timeout ends it long before the old one
+	server.SetTimeouts(300*time.Millisecond, 0)
+	track, err := gortsplib.NewTrackH264(96, testSPS, testPPS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := gortsplib.TransportTCP
+	publisher := gortsplib.Client{Transport: &transport}
+	if err = publisher.StartPublishing("rtsp://127.0.0.1:18680/live/timeout", gortsplib.Tracks{track}); err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if _, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:18680:/live/timeout"); !exist {
+		t.Fatal("stream not published")
+	}
+	for i := 0; i < 30; i++ {
+		if _, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:18680:/live/timeout"); !exist {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("silent publisher not closed after the new read timeout")
+}
+
+func TestPlayerLimit(t *testing.T) {
+	startServers(t)
+	vhost.SetTable(vhost.NewTable(&vhost.Vhost{Name: constdef.StreamPad, Enabled: true, Limits: vhost.Limits{MaxPlayersPerStream: 1}}))
+	defer vhost.SetTable(nil)
+	track, err := gortsplib.NewTrackH264(96, testSPS, testPPS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := gortsplib.TransportTCP
+	publisher := gortsplib.Client{Transport: &transport}
+	if err = publisher.StartPublishing("rtsp://127.0.0.1:18554/live/limit", gortsplib.Tracks{track}); err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		encoder := &rtph264.Encoder{PayloadType: 96}
+		encoder.Init()
+		for pts := time.Duration(0); ; pts += 40 * time.Millisecond {
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+			pkts, err := encoder.Encode([][]byte{testSPS, testPPS, testIDR}, pts)
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				if publisher.WritePacketRTP(0, pkt) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	//the shared sink is no player, the first reader gets in
+	play := func() (*gortsplib.Client, error) {
+		c := &gortsplib.Client{Transport: &transport}
+		var err error
+		for i := 0; i < 50; i++ {
+			if err = c.StartReading("rtsp://127.0.0.1:18554/live/limit"); err == nil {
+				return c, nil
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil, err
+	}
+	first, err := play()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := &gortsplib.Client{Transport: &transport}
+	if err = second.StartReading("rtsp://127.0.0.1:18554/live/limit"); err == nil {
+		second.Close()
+		t.Fatal("a second player got over max_players_per_stream")
+	}
+	//the session that ended frees its place
+	first.Close()
+	third, err := play()
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Close()
+}
@@ -0,0 +1,168 @@
+package srt
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 30 * time.Second
+)
+
+type CallerConfig struct {
+	//address of the remote srt listener
+	Addr string
+	//stream id sent to the remote listener, its mode has to match Push
+	StreamID string
+	//url of the local stream, its host and path make the stream id
+	StreamURL string
+	//push the local stream to the remote listener instead of pulling the remote one
+	Push       bool
+	Latency    time.Duration
+	Passphrase string
+	PbKeyLen   int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Caller connects to a remote srt listener to pull or push a stream, it reconnects with backoff until closed
+type Caller struct {
+	ctx       context.Context
+	config    *CallerConfig
+	streamURL *url.URL
+	running   bool
+
+	mu   sync.Mutex
+	conn *Conn
+	stop chan struct{}
+}
+
+func NewCaller(config *CallerConfig) *Caller {
+	c := &Caller{}
+	c.config = config
+	return c
+}
+
+func (c *Caller) Init() error {
+	streamURL, err := url.Parse(c.config.StreamURL)
+	if err != nil {
+		return err
+	}
+	if c.config.Addr == "" {
+		return fmt.Errorf("srt caller of %s has no address", c.config.StreamURL)
+	}
+	if c.config.MinBackoff <= 0 {
+		c.config.MinBackoff = defaultMinBackoff
+	}
+	if c.config.MaxBackoff < c.config.MinBackoff {
+		c.config.MaxBackoff = defaultMaxBackoff
+	}
+	c.streamURL = streamURL
+	c.ctx = log.GetCtxWithLogID(context.Background(), "SRT_CALLER")
+	c.stop = make(chan struct{})
+	c.running = true
+	return nil
+}
+
+func (c *Caller) Start() error {
+	task.SubmitTask0(c.ctx, c.run)
+	return nil
+}
+
+func (c *Caller) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return
+	}
+	c.running = false
+	close(c.stop)
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
+
+func (c *Caller) isRunning() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
+
+func (c *Caller) run() {
+	backoff := c.config.MinBackoff
+	for c.isRunning() {
+		start := time.Now()
+		err := c.call()
+		if !c.isRunning() {
+			return
+		}
+		if time.Since(start) > c.config.MaxBackoff {
+			//the last session was healthy for a while
+			backoff = c.config.MinBackoff
+		}
+		log.Warnf(c.ctx, "srt call %s for %s failed: %+v, retry in %s", c.config.Addr, c.config.StreamURL, err, backoff)
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// call runs one connection until it breaks
+func (c *Caller) call() error {
+	var hyStream *stream.HyStream
+	if c.config.Push {
+		id := base.NewBase0(c.streamURL).ID()
+		var exist bool
+		if hyStream, exist = stream.DefaultHyStreamManager.GetStream(id); !exist {
+			return fmt.Errorf("stream %s not found", id)
+		}
+	}
+	conn, err := Dial(c.ctx, c.config.Addr, &Config{
+		Latency:    c.config.Latency,
+		Passphrase: c.config.Passphrase,
+		PbKeyLen:   c.config.PbKeyLen,
+		StreamID:   c.config.StreamID,
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		_ = conn.Close()
+		return nil
+	}
+	c.conn = conn
+	c.mu.Unlock()
+	if c.config.Push {
+		peer := connPeer("srt-push", conn)
+		peer.Internal = true
+		play(c.ctx, hyStream, conn, &proto.SinkArg{Peer: peer})
+		return fmt.Errorf("push ended")
+	}
+	p := mpegts.NewPublisher(c.ctx, c.streamURL)
+	if err = stream.DefaultHyStreamManager.AddStream(p.HyStream()); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.SetPeer(connPeer("srt-pull", conn))
+	log.Infof(c.ctx, "srt pull %s from %s", p.HyStream().Base().ID(), c.config.Addr)
+	publish(c.ctx, p, conn)
+	return fmt.Errorf("pull ended")
+}
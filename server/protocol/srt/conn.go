@@ -0,0 +1,600 @@
+package srt
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/task"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLatency         = 120 * time.Millisecond
+	DefaultPeerIdleTimeout = 5 * time.Second
+
+	tickInterval      = 10 * time.Millisecond
+	keepaliveInterval = time.Second
+	minNakInterval    = 20 * time.Millisecond
+	// the sender keeps packets a bit longer than the receiver waits for them
+	sendDropExtra = time.Second
+	readQueueSize = 4096
+	// a nak never asks for more than this many packets of one range
+	maxNakRange = 8192
+	// unacked packets resent at once when the acks stall, the tail of a burst has no later packet to reveal its loss
+	maxStaleResend = 64
+	maxLossRanges  = 128
+	ackBufferSize  = 8192
+)
+
+type Config struct {
+	//receiver latency, lost packets not recovered within it are skipped
+	Latency time.Duration
+	//enables AES-CTR encryption when set
+	Passphrase string
+	//key length in bytes, 16, 24 or 32
+	PbKeyLen int
+	//stream id a caller sends in the handshake
+	StreamID        string
+	PeerIdleTimeout time.Duration
+}
+
+func (c *Config) withDefaults() *Config {
+	config := *c
+	if config.Latency <= 0 {
+		config.Latency = DefaultLatency
+	}
+	if config.PbKeyLen == 0 {
+		config.PbKeyLen = 16
+	}
+	if config.PeerIdleTimeout <= 0 {
+		config.PeerIdleTimeout = DefaultPeerIdleTimeout
+	}
+	return &config
+}
+
+func (c *Config) validate() error {
+	if c.Passphrase == "" {
+		return nil
+	}
+	return checkPassphrase(c.Passphrase, c.PbKeyLen)
+}
+
+type sendEntry struct {
+	pkt     *packet
+	created time.Time
+	sent    time.Time
+}
+
+type recvEntry struct {
+	payload []byte
+	arrival time.Time
+}
+
+// Stats are the counters of a connection
+type Stats struct {
+	PacketsSent     uint64
+	PacketsReceived uint64
+	Retransmitted   uint64
+	// packets the receiver gave up on after the latency
+	Dropped uint64
+	// packets reported lost by the receiver
+	Lost uint64
+	RTT  time.Duration
+}
+
+// Conn is a live srt connection, every Write is sent as one message of at most MaxPayloadSize bytes
+type Conn struct {
+	ctx         context.Context
+	localAddr   net.Addr
+	remoteAddr  net.Addr
+	output      func(data []byte) error
+	localSocket uint32
+	peerSocket  uint32
+	streamID    string
+	latency     time.Duration
+	idleTimeout time.Duration
+	crypto      *cryptoCtx
+	start       time.Time
+	onClose     func()
+
+	mu sync.Mutex
+	//sender
+	nextSeq  uint32
+	sendHead uint32
+	msgNo    uint32
+	sendBuf  map[uint32]*sendEntry
+	lastSent time.Time
+	//receiver
+	recvNext   uint32
+	recvMax    uint32
+	recvBuf    map[uint32]*recvEntry
+	lost       map[uint32]time.Time
+	ackNo      uint32
+	acks       map[uint32]time.Time
+	lastAckSeq uint32
+	lastRecv   time.Time
+	//the rtt starts with a guess until the first ackack
+	rttMeasured bool
+	stats       Stats
+
+	readCh chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConn(ctx context.Context, config *Config, localSocket uint32, peerSocket uint32, sendSeq uint32, recvSeq uint32) *Conn {
+	c := &Conn{}
+	c.ctx = ctx
+	c.localSocket = localSocket
+	c.peerSocket = peerSocket
+	c.latency = config.Latency
+	c.idleTimeout = config.PeerIdleTimeout
+	c.start = time.Now()
+	c.nextSeq = sendSeq
+	c.sendHead = sendSeq
+	c.msgNo = 1
+	c.sendBuf = make(map[uint32]*sendEntry)
+	c.lastSent = c.start
+	c.recvNext = recvSeq
+	c.recvMax = recvSeq
+	c.lastAckSeq = recvSeq
+	c.recvBuf = make(map[uint32]*recvEntry)
+	c.lost = make(map[uint32]time.Time)
+	c.acks = make(map[uint32]time.Time)
+	c.lastRecv = c.start
+	c.stats.RTT = 100 * time.Millisecond
+	c.readCh = make(chan []byte, readQueueSize)
+	c.closed = make(chan struct{})
+	return c
+}
+
+func (c *Conn) run() {
+	task.SubmitTask0(c.ctx, c.loop)
+}
+
+func (c *Conn) StreamID() string {
+	return c.streamID
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) Latency() time.Duration {
+	return c.latency
+}
+
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Read returns one message, b should hold MaxPayloadSize bytes
+func (c *Conn) Read(b []byte) (int, error) {
+	select {
+	case payload := <-c.readCh:
+		return copy(b, payload), nil
+	default:
+	}
+	select {
+	case payload := <-c.readCh:
+		return copy(b, payload), nil
+	case <-c.closed:
+		select {
+		case payload := <-c.readCh:
+			return copy(b, payload), nil
+		default:
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write splits b into messages of MaxPayloadSize bytes
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	n := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > MaxPayloadSize {
+			size = MaxPayloadSize
+		}
+		if err := c.writeMessage(b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+func (c *Conn) writeMessage(b []byte) error {
+	c.mu.Lock()
+	p := &packet{
+		seq:       c.nextSeq,
+		position:  positionSolo,
+		msgNo:     c.msgNo,
+		timestamp: c.timestamp(),
+		dstSocket: c.peerSocket,
+		payload:   append([]byte{}, b...),
+	}
+	if c.crypto != nil {
+		p.keyFlag = c.crypto.active
+		c.crypto.crypt(p.keyFlag, p.seq, p.payload)
+	}
+	c.nextSeq = seqAdd(c.nextSeq, 1)
+	c.msgNo = (c.msgNo + 1) & maxMsgNo
+	if c.msgNo == 0 {
+		c.msgNo = 1
+	}
+	now := time.Now()
+	c.sendBuf[p.seq] = &sendEntry{pkt: p, created: now, sent: now}
+	c.stats.PacketsSent++
+	c.mu.Unlock()
+	return c.send(p)
+}
+
+func (c *Conn) timestamp() uint32 {
+	return uint32(time.Since(c.start) / time.Microsecond)
+}
+
+func (c *Conn) send(p *packet) error {
+	c.mu.Lock()
+	c.lastSent = time.Now()
+	c.mu.Unlock()
+	return c.output(p.marshal(make([]byte, 0, headerSize+len(p.payload))))
+}
+
+func (c *Conn) sendControl(ctrlType uint16, typeInfo uint32, payload []byte) {
+	p := &packet{
+		control:   true,
+		ctrlType:  ctrlType,
+		typeInfo:  typeInfo,
+		timestamp: c.timestamp(),
+		dstSocket: c.peerSocket,
+		payload:   payload,
+	}
+	_ = c.send(p)
+}
+
+// handle processes a packet of the peer, it's called by the socket read loop
+func (c *Conn) handle(p *packet) {
+	c.mu.Lock()
+	c.lastRecv = time.Now()
+	c.mu.Unlock()
+	if !p.control {
+		c.handleData(p)
+		return
+	}
+	switch p.ctrlType {
+	case ctrlAck:
+		c.handleAck(p)
+	case ctrlAckAck:
+		c.handleAckAck(p)
+	case ctrlNak:
+		c.handleNak(p)
+	case ctrlShutdown:
+		c.shutdown(false)
+	case ctrlUser:
+		if p.subtype == extKMReq {
+			c.handleKMReq(p)
+		}
+	}
+}
+
+// handleKMReq takes the keys the sender refreshes, the KMRSP echoes them or tells why not
+func (c *Conn) handleKMReq(p *packet) {
+	rsp := p.payload
+	if c.crypto == nil {
+		rsp = appendUint32(nil, kmStateNoSecret)
+	} else if err := c.crypto.refresh(p.payload); err != nil {
+		log.Warnf(c.ctx, "srt key refresh of %s: %+v", c.remoteAddr, err)
+		rsp = appendUint32(nil, kmStateBadSecret)
+	}
+	c.send(&packet{
+		control:   true,
+		ctrlType:  ctrlUser,
+		subtype:   extKMRsp,
+		timestamp: c.timestamp(),
+		dstSocket: c.peerSocket,
+		payload:   rsp,
+	})
+}
+
+func (c *Conn) handleData(p *packet) {
+	if p.keyFlag != keyNone {
+		if c.crypto == nil || !c.crypto.crypt(p.keyFlag, p.seq, p.payload) {
+			return
+		}
+	}
+	c.mu.Lock()
+	c.stats.PacketsReceived++
+	if seqDiff(p.seq, c.recvNext) < 0 || seqDiff(p.seq, c.recvMax) > maxNakRange || c.recvBuf[p.seq] != nil {
+		//duplicated, or too far ahead to be trusted
+		c.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	var newLoss [][2]uint32
+	if seqDiff(p.seq, c.recvMax) >= 0 {
+		if seqDiff(p.seq, c.recvMax) > 0 {
+			newLoss = append(newLoss, [2]uint32{c.recvMax, seqAdd(p.seq, -1)})
+			for s := c.recvMax; s != p.seq; s = seqAdd(s, 1) {
+				c.lost[s] = now
+				c.stats.Lost++
+			}
+		}
+		c.recvMax = seqAdd(p.seq, 1)
+	} else {
+		delete(c.lost, p.seq)
+	}
+	c.recvBuf[p.seq] = &recvEntry{payload: append([]byte{}, p.payload...), arrival: now}
+	c.deliver()
+	c.mu.Unlock()
+	if newLoss != nil {
+		c.sendControl(ctrlNak, 0, encodeLossList(newLoss))
+	}
+}
+
+// deliver hands the in order packets to the reader, it needs the lock
+func (c *Conn) deliver() {
+	for {
+		e, exist := c.recvBuf[c.recvNext]
+		if !exist {
+			return
+		}
+		delete(c.recvBuf, c.recvNext)
+		c.recvNext = seqAdd(c.recvNext, 1)
+		select {
+		case c.readCh <- e.payload:
+		default:
+			c.stats.Dropped++
+		}
+	}
+}
+
+func (c *Conn) handleAck(p *packet) {
+	if len(p.payload) < 4 {
+		return
+	}
+	ackSeq := binary.BigEndian.Uint32(p.payload) & maxSeq
+	c.mu.Lock()
+	if len(p.payload) >= 8 {
+		//the sender learns the rtt from the receiver
+		if rtt := binary.BigEndian.Uint32(p.payload[4:8]); rtt > 0 {
+			c.stats.RTT = time.Duration(rtt) * time.Microsecond
+		}
+	}
+	if seqDiff(ackSeq, c.sendHead) > 0 && seqDiff(ackSeq, c.nextSeq) <= 0 {
+		for s := c.sendHead; s != ackSeq; s = seqAdd(s, 1) {
+			delete(c.sendBuf, s)
+		}
+		c.sendHead = ackSeq
+	}
+	c.mu.Unlock()
+	c.sendControl(ctrlAckAck, p.typeInfo, nil)
+}
+
+func (c *Conn) handleAckAck(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent, exist := c.acks[p.typeInfo]
+	if !exist {
+		return
+	}
+	for ackNo := range c.acks {
+		if ackNo-p.typeInfo > 1<<31 || ackNo == p.typeInfo {
+			delete(c.acks, ackNo)
+		}
+	}
+	if !c.rttMeasured {
+		c.rttMeasured = true
+		c.stats.RTT = time.Since(sent)
+		return
+	}
+	c.stats.RTT = (c.stats.RTT*7 + time.Since(sent)) / 8
+}
+
+func (c *Conn) handleNak(p *packet) {
+	var resend []*packet
+	c.mu.Lock()
+	for _, r := range decodeLossList(p.payload) {
+		if seqDiff(r[1], r[0]) < 0 || seqDiff(r[1], r[0]) > maxNakRange {
+			continue
+		}
+		for s := r[0]; ; s = seqAdd(s, 1) {
+			if e, exist := c.sendBuf[s]; exist {
+				e.sent = time.Now()
+				pkt := *e.pkt
+				pkt.retransmit = true
+				resend = append(resend, &pkt)
+				c.stats.Retransmitted++
+			}
+			if s == r[1] {
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+	for _, pkt := range resend {
+		_ = c.send(pkt)
+	}
+}
+
+func (c *Conn) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		c.tick()
+	}
+}
+
+func (c *Conn) tick() {
+	now := time.Now()
+	c.mu.Lock()
+	if now.Sub(c.lastRecv) > c.idleTimeout {
+		c.mu.Unlock()
+		log.Infof(c.ctx, "srt peer %s idle, closing", c.remoteAddr)
+		c.shutdown(true)
+		return
+	}
+	c.dropLate(now)
+	c.dropUnacked(now)
+	var ack []byte
+	var ackNo uint32
+	if c.recvNext != c.lastAckSeq {
+		c.lastAckSeq = c.recvNext
+		c.ackNo++
+		ackNo = c.ackNo
+		c.acks[ackNo] = now
+		ack = appendUint32(nil, c.recvNext)
+		ack = appendUint32(ack, uint32(c.stats.RTT/time.Microsecond))
+		ack = appendUint32(ack, uint32(c.stats.RTT/time.Microsecond/2))
+		ack = appendUint32(ack, ackBufferSize)
+		ack = appendUint32(ack, 0)
+		ack = appendUint32(ack, 0)
+		ack = appendUint32(ack, 0)
+	}
+	nak := c.periodicLoss(now)
+	resend := c.staleUnacked(now)
+	keepalive := now.Sub(c.lastSent) > keepaliveInterval
+	c.mu.Unlock()
+	for _, pkt := range resend {
+		_ = c.send(pkt)
+	}
+	if ack != nil {
+		c.sendControl(ctrlAck, ackNo, ack)
+	}
+	if nak != nil {
+		c.sendControl(ctrlNak, 0, nak)
+	} else if keepalive && ack == nil {
+		c.sendControl(ctrlKeepalive, 0, nil)
+	}
+}
+
+// dropLate skips the missing packets in front of a packet that waited longer than the latency
+func (c *Conn) dropLate(now time.Time) {
+	if len(c.recvBuf) == 0 {
+		return
+	}
+	for s := c.recvNext; seqDiff(c.recvMax, s) > 0; s = seqAdd(s, 1) {
+		e, exist := c.recvBuf[s]
+		if !exist {
+			continue
+		}
+		if now.Sub(e.arrival) < c.latency {
+			return
+		}
+		for ; c.recvNext != s; c.recvNext = seqAdd(c.recvNext, 1) {
+			delete(c.lost, c.recvNext)
+			c.stats.Dropped++
+		}
+		c.deliver()
+		return
+	}
+}
+
+// dropUnacked forgets the packets the receiver can't use anymore
+func (c *Conn) dropUnacked(now time.Time) {
+	for c.sendHead != c.nextSeq {
+		e, exist := c.sendBuf[c.sendHead]
+		if exist && now.Sub(e.created) < c.latency+sendDropExtra {
+			return
+		}
+		delete(c.sendBuf, c.sendHead)
+		c.sendHead = seqAdd(c.sendHead, 1)
+	}
+}
+
+// staleUnacked returns the oldest packets neither acked nor resent within a few rtt
+func (c *Conn) staleUnacked(now time.Time) []*packet {
+	interval := c.stats.RTT*4 + minNakInterval
+	var resend []*packet
+	for s := c.sendHead; s != c.nextSeq && len(resend) < maxStaleResend; s = seqAdd(s, 1) {
+		e, exist := c.sendBuf[s]
+		if !exist {
+			continue
+		}
+		if now.Sub(e.sent) < interval {
+			break
+		}
+		e.sent = now
+		pkt := *e.pkt
+		pkt.retransmit = true
+		resend = append(resend, &pkt)
+		c.stats.Retransmitted++
+	}
+	return resend
+}
+
+// periodicLoss reports the packets still missing once per rtt
+func (c *Conn) periodicLoss(now time.Time) []byte {
+	interval := c.stats.RTT * 2
+	if interval < minNakInterval {
+		interval = minNakInterval
+	}
+	var seqs []uint32
+	for s, last := range c.lost {
+		if now.Sub(last) >= interval {
+			seqs = append(seqs, s)
+			c.lost[s] = now
+		}
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqDiff(seqs[i], seqs[j]) < 0
+	})
+	var ranges [][2]uint32
+	for _, s := range seqs {
+		if n := len(ranges); n > 0 && seqAdd(ranges[n-1][1], 1) == s {
+			ranges[n-1][1] = s
+			continue
+		}
+		if len(ranges) == maxLossRanges {
+			break
+		}
+		ranges = append(ranges, [2]uint32{s, s})
+	}
+	return encodeLossList(ranges)
+}
+
+func (c *Conn) Close() error {
+	c.shutdown(true)
+	return nil
+}
+
+func (c *Conn) shutdown(notify bool) {
+	c.once.Do(func() {
+		if notify {
+			c.sendControl(ctrlShutdown, 0, []byte{0, 0, 0, 0})
+		}
+		close(c.closed)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+// Done is closed with the connection
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
@@ -0,0 +1,255 @@
+package srt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"sync"
+)
+
+const (
+	saltSize         = 16
+	kmHeaderSize     = 16
+	wrapOverhead     = 8
+	pbkdf2Iterations = 2048
+
+	kmSign        = 0x2029
+	kmCipherCTR   = 2
+	kmStreamSRT   = 2
+	kmVersionPT   = 0x12
+	minPassphrase = 10
+	maxPassphrase = 79
+)
+
+// key material states a KMRSP carries in place of the key material
+const (
+	kmStateNoSecret  = 3
+	kmStateBadSecret = 4
+)
+
+var wrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// cryptoCtx holds the even and odd stream encrypting keys, the key flag of a data packet picks one.
+// The sender refreshes them with a KMREQ carrying the new key alone or both keys.
+type cryptoCtx struct {
+	passphrase string
+	mu         sync.RWMutex
+	//by key flag - 1, nil until the sender announced it
+	keys [2]*sek
+	//the key flag of what is sent
+	active byte
+}
+
+// sek is a stream encrypting key with the salt it came with
+type sek struct {
+	salt  []byte
+	key   []byte
+	block cipher.Block
+}
+
+func checkPassphrase(passphrase string, keyLen int) error {
+	if len(passphrase) < minPassphrase || len(passphrase) > maxPassphrase {
+		return fmt.Errorf("srt passphrase must be %d to %d characters", minPassphrase, maxPassphrase)
+	}
+	switch keyLen {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("invalid srt key length %d", keyLen)
+	}
+	return nil
+}
+
+// newCryptoCtx makes a random even key to send with
+func newCryptoCtx(passphrase string, keyLen int) (*cryptoCtx, error) {
+	salt := make([]byte, saltSize)
+	key := make([]byte, keyLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	even, err := newSEK(salt, key)
+	if err != nil {
+		return nil, err
+	}
+	c := &cryptoCtx{passphrase: passphrase, active: keyEven}
+	c.keys[0] = even
+	return c, nil
+}
+
+func newSEK(salt []byte, key []byte) (*sek, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sek{salt: salt, key: key, block: block}, nil
+}
+
+// kek derives the key encrypting key from the passphrase and the last 8 bytes of the salt
+func kek(passphrase string, salt []byte, keyLen int) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt[len(salt)-8:], pbkdf2Iterations, keyLen, sha1.New)
+}
+
+// marshalKeyMaterial builds the KMREQ message carrying the wrapped keys, the even one first
+func (c *cryptoCtx) marshalKeyMaterial() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var flags byte
+	var salt, plain []byte
+	for i, k := range c.keys {
+		if k != nil {
+			flags |= byte(1 << i)
+			salt = k.salt
+			plain = append(plain, k.key...)
+		}
+	}
+	if flags == 0 {
+		return nil, fmt.Errorf("no srt key to send")
+	}
+	keyLen := len(plain)
+	if flags == keyEven|keyOdd {
+		keyLen /= 2
+	}
+	wrapped, err := keyWrap(kek(c.passphrase, salt, keyLen), plain)
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{kmVersionPT, kmSign >> 8, kmSign & 0xff, flags, 0, 0, 0, 0,
+		kmCipherCTR, 0, kmStreamSRT, 0, 0, 0, byte(len(salt) / 4), byte(keyLen / 4)}
+	buf = append(buf, salt...)
+	return append(buf, wrapped...), nil
+}
+
+// parseKeyMaterial unwraps the even key, the odd key or both out of a KMREQ
+func parseKeyMaterial(data []byte, passphrase string) (*cryptoCtx, error) {
+	if len(data) < kmHeaderSize || data[0] != kmVersionPT || binary.BigEndian.Uint16(data[1:3]) != kmSign {
+		return nil, fmt.Errorf("invalid srt key material")
+	}
+	flags := data[3] & 0x03
+	if flags == 0 || data[8] != kmCipherCTR || int(data[14])*4 != saltSize {
+		return nil, fmt.Errorf("unsupported srt key material")
+	}
+	count := 1
+	if flags == keyEven|keyOdd {
+		count = 2
+	}
+	saltLen := int(data[14]) * 4
+	keyLen := int(data[15]) * 4
+	if len(data) < kmHeaderSize+saltLen+count*keyLen+wrapOverhead {
+		return nil, fmt.Errorf("short srt key material")
+	}
+	salt := append([]byte{}, data[kmHeaderSize:kmHeaderSize+saltLen]...)
+	wrapped := data[kmHeaderSize+saltLen : kmHeaderSize+saltLen+count*keyLen+wrapOverhead]
+	plain, err := keyUnwrap(kek(passphrase, salt, keyLen), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	c := &cryptoCtx{passphrase: passphrase, active: keyEven}
+	for i := range c.keys {
+		if flags&byte(1<<i) == 0 {
+			continue
+		}
+		if c.keys[i], err = newSEK(salt, plain[:keyLen]); err != nil {
+			return nil, err
+		}
+		plain = plain[keyLen:]
+	}
+	if c.keys[0] == nil {
+		c.active = keyOdd
+	}
+	return c, nil
+}
+
+// refresh takes the keys of a KMREQ sent in the stream, the keys it does not carry are kept
+func (c *cryptoCtx) refresh(data []byte) error {
+	next, err := parseKeyMaterial(data, c.passphrase)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, k := range next.keys {
+		if k != nil {
+			c.keys[i] = k
+		}
+	}
+	return nil
+}
+
+// crypt en/decrypts a payload in place with AES-CTR, the iv mixes the salt with the packet index.
+// It is false when the peer never sent the key of keyFlag.
+func (c *cryptoCtx) crypt(keyFlag byte, seq uint32, payload []byte) bool {
+	if keyFlag != keyEven && keyFlag != keyOdd {
+		return false
+	}
+	c.mu.RLock()
+	k := c.keys[keyFlag-1]
+	c.mu.RUnlock()
+	if k == nil {
+		return false
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint32(iv[10:14], seq)
+	for i := 0; i < 14; i++ {
+		iv[i] ^= k.salt[i]
+	}
+	cipher.NewCTR(k.block, iv).XORKeyStream(payload, payload)
+	return true
+}
+
+// keyWrap is the AES key wrap of RFC 3394
+func keyWrap(kek []byte, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(plain) / 8
+	out := make([]byte, 8+len(plain))
+	copy(out, wrapIV)
+	copy(out[8:], plain)
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[i*8:i*8+8])
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[i*8:], b[8:])
+		}
+	}
+	return out, nil
+}
+
+func keyUnwrap(kek []byte, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("invalid wrapped key length %d", len(wrapped))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	out := append([]byte{}, wrapped...)
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(out[:8])^t)
+			copy(b[8:], out[i*8:i*8+8])
+			block.Decrypt(b, b)
+			copy(out[:8], b[:8])
+			copy(out[i*8:], b[8:])
+		}
+	}
+	if !bytes.Equal(out[:8], wrapIV) {
+		return nil, fmt.Errorf("srt passphrase mismatch")
+	}
+	return out[8:], nil
+}
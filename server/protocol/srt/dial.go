@@ -0,0 +1,189 @@
+package srt
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/task"
+	"net"
+	"time"
+)
+
+const (
+	connectTimeout    = 3 * time.Second
+	handshakeInterval = 250 * time.Millisecond
+)
+
+var rejectReasons = map[uint32]string{
+	rejectPeer:      "peer rejected",
+	rejectRogue:     "rogue peer",
+	rejectBadSecret: "bad passphrase",
+	rejectUnsecure:  "encryption mismatch",
+}
+
+// Dial connects to a srt listener in caller mode
+func Dial(ctx context.Context, addr string, config *Config) (*Conn, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if len(config.StreamID) > maxStreamIDLength {
+		return nil, fmt.Errorf("srt stream id longer than %d", maxStreamIDLength)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := handshakeCaller(ctx, udp, config)
+	if err != nil {
+		_ = udp.Close()
+		return nil, err
+	}
+	c.localAddr = udp.LocalAddr()
+	c.remoteAddr = udpAddr
+	c.output = func(data []byte) error {
+		_, err := udp.Write(data)
+		return err
+	}
+	c.onClose = func() {
+		_ = udp.Close()
+	}
+	c.run()
+	task.SubmitTask0(ctx, func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				c.shutdown(false)
+				return
+			}
+			p, err := parsePacket(buf[:n])
+			if err != nil || p.dstSocket != c.localSocket {
+				continue
+			}
+			if p.control && p.ctrlType == ctrlHandshake {
+				//a repeated conclusion answer
+				continue
+			}
+			c.handle(p)
+		}
+	})
+	return c, nil
+}
+
+// exchange repeats a handshake until the listener answers it
+func exchange(udp *net.UDPConn, request []byte, localSocket uint32, deadline time.Time) (*handshake, error) {
+	buf := make([]byte, maxPacketSize)
+	for time.Now().Before(deadline) {
+		if _, err := udp.Write(request); err != nil {
+			return nil, err
+		}
+		_ = udp.SetReadDeadline(time.Now().Add(handshakeInterval))
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			p, err := parsePacket(buf[:n])
+			if err != nil || !p.control || p.ctrlType != ctrlHandshake || p.dstSocket != localSocket {
+				continue
+			}
+			hs, err := parseHandshake(p.payload)
+			if err != nil {
+				continue
+			}
+			return hs, nil
+		}
+	}
+	return nil, fmt.Errorf("srt handshake timeout")
+}
+
+func handshakeCaller(ctx context.Context, udp *net.UDPConn, config *Config) (*Conn, error) {
+	deadline := time.Now().Add(connectTimeout)
+	localSocket := randomUint32() & maxSeq
+	if localSocket == 0 {
+		localSocket = 1
+	}
+	isn := randomUint32() & maxSeq
+	induction := &handshake{
+		version:    4,
+		extension:  2,
+		initialSeq: isn,
+		mtu:        defaultMTU,
+		flowWindow: defaultFlowWindow,
+		hsType:     hsInduction,
+		socketID:   localSocket,
+	}
+	request := (&packet{control: true, ctrlType: ctrlHandshake, payload: induction.marshal(true)}).marshal(nil)
+	resp, err := exchange(udp, request, localSocket, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if resp.hsType != hsInduction || resp.version < hsVersion || resp.extension != hsMagic {
+		return nil, fmt.Errorf("srt listener doesn't support handshake v5")
+	}
+	conclusion := &handshake{
+		version:    hsVersion,
+		extension:  extFlagHSReq,
+		initialSeq: isn,
+		mtu:        defaultMTU,
+		flowWindow: defaultFlowWindow,
+		hsType:     hsConclusion,
+		socketID:   localSocket,
+		cookie:     resp.cookie,
+		hasSRT:     true,
+		srtVersion: srtVersion,
+		recvDelay:  uint16(config.Latency / time.Millisecond),
+		sendDelay:  uint16(config.Latency / time.Millisecond),
+		streamID:   config.StreamID,
+	}
+	var crypto *cryptoCtx
+	if config.Passphrase != "" {
+		if crypto, err = newCryptoCtx(config.Passphrase, config.PbKeyLen); err != nil {
+			return nil, err
+		}
+		if conclusion.keyMaterial, err = crypto.marshalKeyMaterial(); err != nil {
+			return nil, err
+		}
+		conclusion.encryption = uint16(config.PbKeyLen / 8)
+		conclusion.extension |= extFlagKMReq
+	}
+	conclusion.srtFlags = srtFlags(crypto != nil)
+	if config.StreamID != "" {
+		conclusion.extension |= extFlagConfig
+	}
+	request = (&packet{control: true, ctrlType: ctrlHandshake, payload: conclusion.marshal(true)}).marshal(nil)
+	for {
+		resp, err = exchange(udp, request, localSocket, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if resp.hsType != hsInduction {
+			//late answers to the induction are skipped
+			break
+		}
+	}
+	_ = udp.SetReadDeadline(time.Time{})
+	if resp.hsType >= hsRejectBase && resp.hsType != hsConclusion {
+		reason := resp.hsType - hsRejectBase
+		if text, exist := rejectReasons[reason]; exist {
+			return nil, fmt.Errorf("srt connection rejected: %s", text)
+		}
+		return nil, fmt.Errorf("srt connection rejected: %d", reason)
+	}
+	if resp.hsType != hsConclusion || !resp.hasSRT {
+		return nil, fmt.Errorf("unexpected srt handshake answer %d", resp.hsType)
+	}
+	negotiated := *config
+	negotiated.Latency = negotiateLatency(config.Latency, resp)
+	c := newConn(ctx, &negotiated, localSocket, resp.socketID, isn, isn)
+	c.streamID = config.StreamID
+	c.crypto = crypto
+	return c, nil
+}
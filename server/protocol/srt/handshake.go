@@ -0,0 +1,192 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	handshakeSize = 48
+
+	hsInduction  = 0x00000001
+	hsConclusion = 0xffffffff
+	// rejections are sent as the handshake type
+	hsRejectBase = 1000
+
+	hsMagic   = 0x4a17
+	hsVersion = 5
+
+	extHSReq = 1
+	extHSRsp = 2
+	extKMReq = 3
+	extKMRsp = 4
+	extSID   = 5
+
+	extFlagHSReq  = 0x01
+	extFlagKMReq  = 0x02
+	extFlagConfig = 0x04
+
+	srtVersion = 0x00010401
+
+	flagTSBPDSnd    = 0x01
+	flagTSBPDRcv    = 0x02
+	flagCrypt       = 0x04
+	flagTLPktDrop   = 0x08
+	flagPeriodicNak = 0x10
+	flagRexmit      = 0x20
+
+	defaultMTU        = 1500
+	defaultFlowWindow = 8192
+	maxStreamIDLength = 512
+)
+
+// rejection reasons
+const (
+	rejectPeer      = 2
+	rejectRogue     = 4
+	rejectBadSecret = 10
+	rejectUnsecure  = 11
+)
+
+type handshake struct {
+	version    uint32
+	encryption uint16
+	extension  uint16
+	initialSeq uint32
+	mtu        uint32
+	flowWindow uint32
+	hsType     uint32
+	socketID   uint32
+	cookie     uint32
+	peerIP     [16]byte
+
+	//HSREQ/HSRSP
+	srtVersion uint32
+	srtFlags   uint32
+	recvDelay  uint16
+	sendDelay  uint16
+	hasSRT     bool
+
+	keyMaterial []byte
+	streamID    string
+}
+
+func parseHandshake(data []byte) (*handshake, error) {
+	if len(data) < handshakeSize {
+		return nil, fmt.Errorf("short handshake %d", len(data))
+	}
+	h := &handshake{}
+	h.version = binary.BigEndian.Uint32(data[0:4])
+	h.encryption = binary.BigEndian.Uint16(data[4:6])
+	h.extension = binary.BigEndian.Uint16(data[6:8])
+	h.initialSeq = binary.BigEndian.Uint32(data[8:12])
+	h.mtu = binary.BigEndian.Uint32(data[12:16])
+	h.flowWindow = binary.BigEndian.Uint32(data[16:20])
+	h.hsType = binary.BigEndian.Uint32(data[20:24])
+	h.socketID = binary.BigEndian.Uint32(data[24:28])
+	h.cookie = binary.BigEndian.Uint32(data[28:32])
+	copy(h.peerIP[:], data[32:48])
+	if h.version < hsVersion || h.hsType != hsConclusion {
+		return h, nil
+	}
+	data = data[handshakeSize:]
+	for len(data) >= 4 {
+		extType := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4])) * 4
+		data = data[4:]
+		if length > len(data) {
+			return nil, fmt.Errorf("handshake extension %d overflows", extType)
+		}
+		content := data[:length]
+		data = data[length:]
+		switch extType {
+		case extHSReq, extHSRsp:
+			if len(content) < 12 {
+				return nil, fmt.Errorf("short handshake extension")
+			}
+			h.hasSRT = true
+			h.srtVersion = binary.BigEndian.Uint32(content[0:4])
+			h.srtFlags = binary.BigEndian.Uint32(content[4:8])
+			h.recvDelay = binary.BigEndian.Uint16(content[8:10])
+			h.sendDelay = binary.BigEndian.Uint16(content[10:12])
+		case extKMReq, extKMRsp:
+			h.keyMaterial = append([]byte{}, content...)
+		case extSID:
+			h.streamID = decodeStreamID(content)
+		}
+	}
+	return h, nil
+}
+
+func (h *handshake) marshal(request bool) []byte {
+	buf := make([]byte, 0, 128)
+	buf = appendUint32(buf, h.version)
+	buf = appendUint16(buf, h.encryption)
+	buf = appendUint16(buf, h.extension)
+	buf = appendUint32(buf, h.initialSeq)
+	buf = appendUint32(buf, h.mtu)
+	buf = appendUint32(buf, h.flowWindow)
+	buf = appendUint32(buf, h.hsType)
+	buf = appendUint32(buf, h.socketID)
+	buf = appendUint32(buf, h.cookie)
+	buf = append(buf, h.peerIP[:]...)
+	if h.hsType != hsConclusion || h.version < hsVersion {
+		return buf
+	}
+	if h.hasSRT {
+		extType := uint16(extHSRsp)
+		if request {
+			extType = extHSReq
+		}
+		buf = appendUint16(buf, extType)
+		buf = appendUint16(buf, 3)
+		buf = appendUint32(buf, h.srtVersion)
+		buf = appendUint32(buf, h.srtFlags)
+		buf = appendUint16(buf, h.recvDelay)
+		buf = appendUint16(buf, h.sendDelay)
+	}
+	if h.keyMaterial != nil {
+		extType := uint16(extKMRsp)
+		if request {
+			extType = extKMReq
+		}
+		buf = appendUint16(buf, extType)
+		buf = appendUint16(buf, uint16(len(h.keyMaterial)/4))
+		buf = append(buf, h.keyMaterial...)
+	}
+	if h.streamID != "" && request {
+		sid := encodeStreamID(h.streamID)
+		buf = appendUint16(buf, extSID)
+		buf = appendUint16(buf, uint16(len(sid)/4))
+		buf = append(buf, sid...)
+	}
+	return buf
+}
+
+// the stream id travels as 32 bit words in little endian order, padded with zeros
+func encodeStreamID(sid string) []byte {
+	buf := []byte(sid)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	for i := 0; i < len(buf); i += 4 {
+		buf[i], buf[i+1], buf[i+2], buf[i+3] = buf[i+3], buf[i+2], buf[i+1], buf[i]
+	}
+	return buf
+}
+
+func decodeStreamID(data []byte) string {
+	buf := make([]byte, len(data)-len(data)%4)
+	for i := 0; i < len(buf); i += 4 {
+		buf[i], buf[i+1], buf[i+2], buf[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+	}
+	for len(buf) > 0 && buf[len(buf)-1] == 0 {
+		buf = buf[:len(buf)-1]
+	}
+	return string(buf)
+}
+
+func durationMs(ms uint16) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,314 @@
+package srt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/task"
+	"net"
+	"sync"
+	"time"
+)
+
+const acceptQueueSize = 64
+
+// accepted remembers the conclusion answer, the caller repeats its conclusion until it gets one
+type accepted struct {
+	conn     *Conn
+	response []byte
+}
+
+// Listener accepts srt callers on one udp socket, packets are routed by the destination socket id
+type Listener struct {
+	ctx    context.Context
+	conn   *net.UDPConn
+	secret []byte
+
+	mu sync.Mutex
+	//replaced by SetPeerIdleTimeout, the accepted callers keep a copy
+	config   *Config
+	conns    map[uint32]*Conn
+	accepted map[string]*accepted
+	accept   chan *Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func Listen(ctx context.Context, addr string, config *Config) (*Listener, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{}
+	l.ctx = ctx
+	l.config = config
+	l.conn = conn
+	l.secret = make([]byte, 32)
+	if _, err = rand.Read(l.secret); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	l.conns = make(map[uint32]*Conn)
+	l.accepted = make(map[string]*accepted)
+	l.accept = make(chan *Conn, acceptQueueSize)
+	l.closed = make(chan struct{})
+	task.SubmitTask0(ctx, l.readLoop)
+	return l, nil
+}
+
+// SetPeerIdleTimeout applies to the callers accepted from now on, DefaultPeerIdleTimeout when zero
+func (l *Listener) SetPeerIdleTimeout(timeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	config := *l.config
+	config.PeerIdleTimeout = timeout
+	l.config = config.withDefaults()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Accept waits for the next caller that completed the handshake
+func (l *Listener) Accept() (*Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.mu.Lock()
+		conns := make([]*Conn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+		for _, c := range conns {
+			_ = c.Close()
+		}
+		_ = l.conn.Close()
+	})
+	return nil
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				log.Errorf(l.ctx, "srt listener read failed: %+v", err)
+				_ = l.Close()
+			}
+			return
+		}
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		if p.control && p.ctrlType == ctrlHandshake && p.dstSocket == 0 {
+			l.handleHandshake(addr, p)
+			continue
+		}
+		l.mu.Lock()
+		c := l.conns[p.dstSocket]
+		l.mu.Unlock()
+		if c != nil && c.remoteAddr.String() == addr.String() {
+			c.handle(p)
+		}
+	}
+}
+
+// cookie binds the handshake to the caller address, it changes every minute
+func (l *Listener) cookie(addr *net.UDPAddr, minute int64) uint32 {
+	mac := hmac.New(sha256.New, l.secret)
+	_, _ = mac.Write([]byte(addr.String()))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(minute))
+	_, _ = mac.Write(b[:])
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+func (l *Listener) validCookie(addr *net.UDPAddr, cookie uint32) bool {
+	minute := time.Now().Unix() / 60
+	return cookie == l.cookie(addr, minute) || cookie == l.cookie(addr, minute-1)
+}
+
+func (l *Listener) reply(addr *net.UDPAddr, dstSocket uint32, payload []byte) {
+	p := &packet{control: true, ctrlType: ctrlHandshake, dstSocket: dstSocket, payload: payload}
+	_, _ = l.conn.WriteToUDP(p.marshal(nil), addr)
+}
+
+// rejectLabels name the reject reasons in the metrics
+var rejectLabels = map[uint32]string{
+	rejectPeer:      "peer",
+	rejectBadSecret: "bad_secret",
+	rejectUnsecure:  "unsecure",
+}
+
+func (l *Listener) reject(addr *net.UDPAddr, hs *handshake, reason uint32) {
+	log.Warnf(l.ctx, "reject srt caller %s: %d", addr, reason)
+	label, ok := rejectLabels[reason]
+	if !ok {
+		label = "other"
+	}
+	metrics.HandshakeFailures.With("srt", label).Inc()
+	resp := &handshake{version: hsVersion, hsType: hsRejectBase + reason, initialSeq: hs.initialSeq, socketID: 0}
+	l.reply(addr, hs.socketID, resp.marshal(false))
+}
+
+func (l *Listener) handleHandshake(addr *net.UDPAddr, p *packet) {
+	hs, err := parseHandshake(p.payload)
+	if err != nil {
+		return
+	}
+	switch hs.hsType {
+	case hsInduction:
+		resp := &handshake{
+			version:    hsVersion,
+			extension:  hsMagic,
+			initialSeq: hs.initialSeq,
+			mtu:        defaultMTU,
+			flowWindow: defaultFlowWindow,
+			hsType:     hsInduction,
+			cookie:     l.cookie(addr, time.Now().Unix()/60),
+		}
+		l.reply(addr, hs.socketID, resp.marshal(false))
+	case hsConclusion:
+		l.handleConclusion(addr, hs)
+	}
+}
+
+func (l *Listener) handleConclusion(addr *net.UDPAddr, hs *handshake) {
+	if !l.validCookie(addr, hs.cookie) {
+		return
+	}
+	key := fmt.Sprintf("%s/%d", addr, hs.socketID)
+	l.mu.Lock()
+	done := l.accepted[key]
+	config := *l.config
+	l.mu.Unlock()
+	if done != nil {
+		l.reply(addr, hs.socketID, done.response)
+		return
+	}
+	if hs.version < hsVersion || !hs.hasSRT {
+		l.reject(addr, hs, rejectPeer)
+		return
+	}
+	var crypto *cryptoCtx
+	if config.Passphrase != "" || hs.keyMaterial != nil {
+		if config.Passphrase == "" || hs.keyMaterial == nil {
+			l.reject(addr, hs, rejectUnsecure)
+			return
+		}
+		var err error
+		if crypto, err = parseKeyMaterial(hs.keyMaterial, config.Passphrase); err != nil {
+			l.reject(addr, hs, rejectBadSecret)
+			return
+		}
+	}
+	config.Latency = negotiateLatency(config.Latency, hs)
+	c := newConn(l.ctx, &config, l.newSocketID(), hs.socketID, hs.initialSeq, hs.initialSeq)
+	c.localAddr = l.conn.LocalAddr()
+	c.remoteAddr = addr
+	c.streamID = hs.streamID
+	c.crypto = crypto
+	c.output = func(data []byte) error {
+		_, err := l.conn.WriteToUDP(data, addr)
+		return err
+	}
+	resp := &handshake{
+		version:     hsVersion,
+		extension:   extFlagHSReq,
+		initialSeq:  hs.initialSeq,
+		mtu:         defaultMTU,
+		flowWindow:  defaultFlowWindow,
+		hsType:      hsConclusion,
+		socketID:    c.localSocket,
+		hasSRT:      true,
+		srtVersion:  srtVersion,
+		srtFlags:    srtFlags(crypto != nil),
+		recvDelay:   uint16(config.Latency / time.Millisecond),
+		sendDelay:   uint16(config.Latency / time.Millisecond),
+		keyMaterial: hs.keyMaterial,
+	}
+	if crypto != nil {
+		resp.extension |= extFlagKMReq
+	}
+	response := resp.marshal(false)
+	c.onClose = func() {
+		l.mu.Lock()
+		delete(l.conns, c.localSocket)
+		delete(l.accepted, key)
+		l.mu.Unlock()
+	}
+	l.mu.Lock()
+	l.conns[c.localSocket] = c
+	l.accepted[key] = &accepted{conn: c, response: response}
+	l.mu.Unlock()
+	c.run()
+	l.reply(addr, hs.socketID, response)
+	select {
+	case l.accept <- c:
+	default:
+		log.Warnf(l.ctx, "srt accept queue full, drop caller %s", addr)
+		_ = c.Close()
+	}
+}
+
+func (l *Listener) newSocketID() uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		id := randomUint32() & maxSeq
+		if _, exist := l.conns[id]; id != 0 && !exist {
+			return id
+		}
+	}
+}
+
+func randomUint32() uint32 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// negotiateLatency uses the larger latency of both ends
+func negotiateLatency(latency time.Duration, hs *handshake) time.Duration {
+	if peer := durationMs(hs.recvDelay); peer > latency {
+		latency = peer
+	}
+	if peer := durationMs(hs.sendDelay); peer > latency {
+		latency = peer
+	}
+	return latency
+}
+
+func srtFlags(crypt bool) uint32 {
+	flags := uint32(flagTSBPDSnd | flagTSBPDRcv | flagTLPktDrop | flagPeriodicNak | flagRexmit)
+	if crypt {
+		flags |= flagCrypt
+	}
+	return flags
+}
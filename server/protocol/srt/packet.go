@@ -0,0 +1,154 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	headerSize = 16
+	// seven ts packets, what every srt implementation sends for live streams
+	MaxPayloadSize = 1316
+	maxPacketSize  = 1500
+
+	ctrlHandshake = 0x0000
+	ctrlKeepalive = 0x0001
+	ctrlAck       = 0x0002
+	ctrlNak       = 0x0003
+	ctrlShutdown  = 0x0005
+	ctrlAckAck    = 0x0006
+	//user defined, the subtype tells what, the key material is refreshed with it
+	ctrlUser = 0x7fff
+
+	maxSeq    = 0x7fffffff
+	maxMsgNo  = 0x03ffffff
+	lossRange = 0x80000000
+
+	// packet position flags, a live message is always a solo packet
+	positionSolo = 0x03
+)
+
+// key flags of data packets
+const (
+	keyNone = 0
+	keyEven = 1
+	keyOdd  = 2
+)
+
+type packet struct {
+	control   bool
+	timestamp uint32
+	dstSocket uint32
+
+	//data packets
+	seq        uint32
+	position   byte
+	keyFlag    byte
+	retransmit bool
+	msgNo      uint32
+
+	//control packets
+	ctrlType uint16
+	subtype  uint16
+	typeInfo uint32
+
+	payload []byte
+}
+
+func parsePacket(data []byte) (*packet, error) {
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("short srt packet %d", len(data))
+	}
+	p := &packet{}
+	word0 := binary.BigEndian.Uint32(data[0:4])
+	word1 := binary.BigEndian.Uint32(data[4:8])
+	p.timestamp = binary.BigEndian.Uint32(data[8:12])
+	p.dstSocket = binary.BigEndian.Uint32(data[12:16])
+	p.payload = data[headerSize:]
+	if word0&0x80000000 != 0 {
+		p.control = true
+		p.ctrlType = uint16(word0 >> 16 & 0x7fff)
+		p.subtype = uint16(word0)
+		p.typeInfo = word1
+		return p, nil
+	}
+	p.seq = word0
+	p.position = byte(word1 >> 30)
+	p.keyFlag = byte(word1>>27) & 0x03
+	p.retransmit = word1&(1<<26) != 0
+	p.msgNo = word1 & maxMsgNo
+	return p, nil
+}
+
+func (p *packet) marshal(buf []byte) []byte {
+	var word0, word1 uint32
+	if p.control {
+		word0 = 0x80000000 | uint32(p.ctrlType)<<16 | uint32(p.subtype)
+		word1 = p.typeInfo
+	} else {
+		word0 = p.seq & maxSeq
+		word1 = uint32(p.position)<<30 | uint32(p.keyFlag&0x03)<<27 | p.msgNo&maxMsgNo
+		if p.retransmit {
+			word1 |= 1 << 26
+		}
+	}
+	buf = appendUint32(buf, word0)
+	buf = appendUint32(buf, word1)
+	buf = appendUint32(buf, p.timestamp)
+	buf = appendUint32(buf, p.dstSocket)
+	return append(buf, p.payload...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+// sequence numbers are 31 bit and wrap around
+func seqAdd(seq uint32, n int32) uint32 {
+	return uint32(int32(seq)+n) & maxSeq
+}
+
+// seqDiff is a-b taking the wraparound into account
+func seqDiff(a uint32, b uint32) int32 {
+	d := (a - b) & maxSeq
+	if d > maxSeq/2 {
+		return int32(d) - maxSeq - 1
+	}
+	return int32(d)
+}
+
+// lossList encodes the lost sequence numbers of a nak, a range sets the high bit of its first number
+func encodeLossList(ranges [][2]uint32) []byte {
+	var buf []byte
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			buf = appendUint32(buf, r[0])
+		} else {
+			buf = appendUint32(buf, r[0]|lossRange)
+			buf = appendUint32(buf, r[1])
+		}
+	}
+	return buf
+}
+
+func decodeLossList(data []byte) [][2]uint32 {
+	var ranges [][2]uint32
+	for len(data) >= 4 {
+		first := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if first&lossRange == 0 {
+			ranges = append(ranges, [2]uint32{first, first})
+			continue
+		}
+		if len(data) < 4 {
+			break
+		}
+		ranges = append(ranges, [2]uint32{first & maxSeq, binary.BigEndian.Uint32(data) & maxSeq})
+		data = data[4:]
+	}
+	return ranges
+}
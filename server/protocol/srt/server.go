@@ -0,0 +1,159 @@
+package srt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"net"
+	"time"
+)
+
+type ListenConfig struct {
+	Addr string
+	Port int
+	//receiver latency, DefaultLatency when zero
+	Latency time.Duration
+	//callers have to encrypt with it when set
+	Passphrase string
+	PbKeyLen   int
+	//callers silent for this long are dropped, DefaultPeerIdleTimeout when zero
+	PeerIdleTimeout time.Duration
+	//callers are checked once their handshake is done, nil lets everyone in
+	Access *hynet.Access
+}
+
+// Server accepts srt callers, "m=publish" stream ids publish mpeg-ts into the server, the others play
+type Server struct {
+	ctx      context.Context
+	config   *ListenConfig
+	running  bool
+	listener *Listener
+}
+
+func NewServer(config *ListenConfig) *Server {
+	s := &Server{}
+	s.config = config
+	return s
+}
+
+func (s *Server) Init() error {
+	s.ctx = log.GetCtxWithLogID(context.Background(), "SRT_SERVER")
+	listener, err := Listen(s.ctx, fmt.Sprintf("%s:%d", s.config.Addr, s.config.Port), &Config{
+		Latency:         s.config.Latency,
+		Passphrase:      s.config.Passphrase,
+		PbKeyLen:        s.config.PbKeyLen,
+		PeerIdleTimeout: s.config.PeerIdleTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.running = true
+	return nil
+}
+
+func (s *Server) Start() error {
+	log.Infof(s.ctx, "listen srt server@%s:%d", s.config.Addr, s.config.Port)
+	task.SubmitTask0(s.ctx, func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Errorf(s.ctx, "srt accept failed: %+v", err)
+				}
+				return
+			}
+			task.SubmitTask0(s.ctx, func() {
+				s.handle(conn)
+			})
+		}
+	})
+	return nil
+}
+
+// SetPeerIdleTimeout applies to the callers accepted from now on, the connected ones keep theirs
+func (s *Server) SetPeerIdleTimeout(timeout time.Duration) {
+	s.listener.SetPeerIdleTimeout(timeout)
+}
+
+func (s *Server) Close() {
+	s.running = false
+	_ = s.listener.Close()
+}
+
+func (s *Server) handle(conn *Conn) {
+	ctx := log.GetCtxWithLogID(s.ctx, "SRT")
+	release, err := s.config.Access.Admit(conn.RemoteAddr())
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer release()
+	metrics.Connections.With("srt").Inc()
+	defer metrics.Connections.With("srt").Dec()
+	sid, err := ParseStreamID(conn.StreamID())
+	if err != nil {
+		metrics.HandshakeFailures.With("srt", "stream_id").Inc()
+		log.Warnf(ctx, "close srt caller %s: %+v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	u := sid.URL(s.config.Addr)
+	op, admit := hynet.OpPlay, vhost.Play
+	if sid.Publish {
+		op, admit = hynet.OpPublish, vhost.Publish
+	}
+	if err = s.config.Access.Allow(op, conn.RemoteAddr().String()); err != nil {
+		_ = conn.Close()
+		return
+	}
+	if _, err = admit(u, conn.RemoteAddr().String()); err != nil {
+		log.Warnf(ctx, "close srt caller %s: %+v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	if sid.Publish {
+		p := mpegts.NewPublisher(ctx, u)
+		if err = hook.Publish(ctx, hook.NewEvent(hook.OnPublish, u, p.HyStream().Source().ID(), "srt", conn.RemoteAddr().String())); err != nil {
+			log.Warnf(ctx, "close srt caller %s: %+v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+		if err = stream.DefaultHyStreamManager.AddStream(p.HyStream()); err != nil {
+			log.Warnf(ctx, "srt publish %s failed: %+v", p.HyStream().Base().ID(), err)
+			_ = conn.Close()
+			return
+		}
+		p.SetPeer(connPeer("srt", conn))
+		log.Infof(ctx, "srt publish stream %s from %s", p.HyStream().Base().ID(), conn.RemoteAddr())
+		publish(ctx, p, conn)
+		return
+	}
+	id := base.NewBase0(u).ID()
+	hyStream, exist := stream.DefaultHyStreamManager.GetStream(id)
+	if !exist {
+		log.Warnf(ctx, "srt play %s: stream not found", id)
+		_ = conn.Close()
+		return
+	}
+	sinkID := session.NextID()
+	stop, err := hook.Play(ctx, hook.NewEvent(hook.OnPlay, u, sinkID, "srt", conn.RemoteAddr().String()))
+	if err != nil {
+		log.Warnf(ctx, "close srt caller %s: %+v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	log.Infof(ctx, "srt play stream %s to %s", id, conn.RemoteAddr())
+	play(ctx, hyStream, conn, &proto.SinkArg{Peer: connPeer("srt", conn), ID: sinkID, OnClose: stop})
+}
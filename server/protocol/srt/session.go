@@ -0,0 +1,89 @@
+package srt
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"io"
+)
+
+// publish feeds the mpeg-ts of a connection into the stream until the connection ends
+func publish(ctx context.Context, p *mpegts.Publisher, conn io.ReadCloser) {
+	defer conn.Close()
+	defer p.Close()
+	buf := make([]byte, MaxPayloadSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		_, _ = p.Write(buf[:n])
+	}
+	log.Infof(ctx, "srt publisher of %s done", p.HyStream().Base().ID())
+}
+
+// chunkWriter groups the ts packets of the muxer into srt messages
+type chunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (c *chunkWriter) Write(b []byte) (int, error) {
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= MaxPayloadSize {
+		return len(b), c.Flush()
+	}
+	return len(b), nil
+}
+
+func (c *chunkWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// connPeer is the srt connection as the admin api shows it
+func connPeer(protocol string, conn *Conn) *proto.Peer {
+	return &proto.Peer{Protocol: protocol, RemoteAddr: conn.RemoteAddr().String(), Kick: func() { _ = conn.Close() }}
+}
+
+// play muxes a stream into a connection until either ends, the player starts with the gop cache
+func play(ctx context.Context, hyStream *stream.HyStream, conn io.WriteCloser, arg *proto.SinkArg) {
+	arg.Ctx = ctx
+	arg.Protocol = constdef.SinkTypeSrt
+	arg.SinkSrt = &proto.SinkSrt{}
+	sink := hyStream.Source().AddSink(arg)
+	defer sink.Close()
+	defer conn.Close()
+	if done, ok := conn.(interface{ Done() <-chan struct{} }); ok {
+		//a silent stream would keep the sink blocked after the player left
+		task.SubmitTask0(ctx, func() {
+			<-done.Done()
+			sink.Close()
+		})
+	}
+	w := &chunkWriter{w: conn, buf: make([]byte, 0, MaxPayloadSize)}
+	muxer := mpegts.NewMuxer(w)
+	for {
+		data, ok := sink.Pull(ctx)
+		if !ok {
+			log.Infof(ctx, "srt player of %s done", hyStream.Base().ID())
+			return
+		}
+		err := muxer.WritePacket(data.Base())
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Infof(ctx, "srt player of %s left: %+v", hyStream.Base().ID(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package srt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPassphrase = "hylan-srt-secret"
+
+func TestKeyWrap(t *testing.T) {
+	//RFC 3394 4.1 and 4.6, the second is as long as the even and odd 128 bit keys wrapped together
+	cases := []struct {
+		kek      string
+		key      string
+		expected string
+	}{
+		{"000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff",
+			"1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5"},
+		{"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f",
+			"28c9f404c4b810f4cbccb35cfb87f8263f5786e2d80ed326cbc7f0e71a99f43bfb988b9b7a02dd21"},
+	}
+	for _, c := range cases {
+		kek, _ := hex.DecodeString(c.kek)
+		key, _ := hex.DecodeString(c.key)
+		expected, _ := hex.DecodeString(c.expected)
+		wrapped, err := keyWrap(kek, key)
+		if err != nil || !bytes.Equal(wrapped, expected) {
+			t.Fatalf("unexpected wrapped key %x", wrapped)
+		}
+		unwrapped, err := keyUnwrap(kek, wrapped)
+		if err != nil || !bytes.Equal(unwrapped, key) {
+			t.Fatalf("unexpected unwrapped key %x: %v", unwrapped, err)
+		}
+		kek[0] ^= 1
+		if _, err = keyUnwrap(kek, wrapped); err == nil {
+			t.Fatal("unwrap with a wrong kek succeeded")
+		}
+	}
+}
+
+func TestKeyMaterial(t *testing.T) {
+	sender, err := newCryptoCtx(testPassphrase, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	odd, err := newCryptoCtx(testPassphrase, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//an odd key alone, then both keys under the salt of the odd one
+	sender.keys[0], sender.keys[1] = nil, odd.keys[0]
+	sender.active = keyOdd
+	oddOnly, err := sender.marshalKeyMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.keys[0], _ = newSEK(odd.keys[0].salt, bytes.Repeat([]byte{7}, 16))
+	both, err := sender.marshalKeyMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oddOnly[3] != keyOdd || both[3] != keyEven|keyOdd || len(both) != kmHeaderSize+saltSize+32+wrapOverhead {
+		t.Fatalf("unexpected key material headers %x %x", oddOnly[:kmHeaderSize], both[:kmHeaderSize])
+	}
+
+	receiver, err := parseKeyMaterial(oddOnly, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.keys[0] != nil || receiver.active != keyOdd {
+		t.Fatal("an odd key alone was taken for the even one")
+	}
+	payload := []byte("odd key payload")
+	data := append([]byte{}, payload...)
+	sender.crypt(keyOdd, 42, data)
+	if receiver.crypt(keyEven, 42, append([]byte{}, data...)) {
+		t.Fatal("decrypted with a key never sent")
+	}
+	if !receiver.crypt(keyOdd, 42, data) || !bytes.Equal(data, payload) {
+		t.Fatalf("unexpected odd key payload %q", data)
+	}
+
+	if err = receiver.refresh(both); err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []byte{keyEven, keyOdd} {
+		data = append([]byte{}, payload...)
+		sender.crypt(flag, 43, data)
+		if !receiver.crypt(flag, 43, data) || !bytes.Equal(data, payload) {
+			t.Fatalf("unexpected payload %q with key flag %d", data, flag)
+		}
+	}
+	if err = receiver.refresh(both[:len(both)-8]); err == nil {
+		t.Fatal("refreshed with short key material")
+	}
+	if _, err = parseKeyMaterial(both, "another-srt-secret"); err == nil {
+		t.Fatal("parsed key material with a wrong passphrase")
+	}
+}
+
+func TestKeyRefresh(t *testing.T) {
+	config := (&Config{Passphrase: testPassphrase}).withDefaults()
+	sender, err := newCryptoCtx(testPassphrase, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km, err := sender.marshalKeyMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConn(context.Background(), config, 1, 2, 100, 200)
+	if c.crypto, err = parseKeyMaterial(km, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+	var sent []*packet
+	c.output = func(data []byte) error {
+		p, err := parsePacket(data)
+		if err != nil {
+			return err
+		}
+		sent = append(sent, p)
+		return nil
+	}
+
+	//the sender announces the odd key in the stream and switches to it
+	if sender.keys[1], err = newSEK(sender.keys[0].salt, bytes.Repeat([]byte{9}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	sender.keys[0] = nil
+	if km, err = sender.marshalKeyMaterial(); err != nil {
+		t.Fatal(err)
+	}
+	c.handle(&packet{control: true, ctrlType: ctrlUser, subtype: extKMReq, payload: km})
+	if len(sent) != 1 || sent[0].ctrlType != ctrlUser || sent[0].subtype != extKMRsp || !bytes.Equal(sent[0].payload, km) {
+		t.Fatalf("unexpected key material response %+v", sent)
+	}
+	payload := []byte("after the refresh")
+	p := &packet{seq: 200, keyFlag: keyOdd, payload: append([]byte{}, payload...)}
+	sender.crypt(p.keyFlag, p.seq, p.payload)
+	c.handle(p)
+	c.mu.Lock()
+	received := c.stats.PacketsReceived
+	c.mu.Unlock()
+	if received != 1 {
+		t.Fatal("the odd key packet was dropped")
+	}
+
+	c.handle(&packet{control: true, ctrlType: ctrlUser, subtype: extKMReq, payload: km[:kmHeaderSize]})
+	if len(sent) != 2 || sent[1].subtype != extKMRsp || binary.BigEndian.Uint32(sent[1].payload) != kmStateBadSecret {
+		t.Fatalf("unexpected key material response %+v", sent)
+	}
+}
+
+func TestParseStreamID(t *testing.T) {
+	cases := []struct {
+		sid      string
+		resource string
+		host     string
+		publish  bool
+		fail     bool
+	}{
+		{sid: "#!::r=live/cam1,m=publish", resource: "live/cam1", publish: true},
+		{sid: "#!::h=example.com,r=/live/cam1,u=admin", resource: "live/cam1", host: "example.com"},
+		{sid: "live/cam1", resource: "live/cam1"},
+		{sid: "#!::r=live/cam1,m=bidirectional", fail: true},
+		{sid: "#!::m=publish", fail: true},
+		{sid: "", fail: true},
+	}
+	for _, c := range cases {
+		s, err := ParseStreamID(c.sid)
+		if c.fail {
+			if err == nil {
+				t.Fatalf("%q parsed", c.sid)
+			}
+			continue
+		}
+		if err != nil || s.Resource != c.resource || s.Host != c.host || s.Publish != c.publish {
+			t.Fatalf("unexpected stream id %q: %+v %v", c.sid, s, err)
+		}
+	}
+	if id := encodeStreamID("#!::r=a"); decodeStreamID(id) != "#!::r=a" || len(id) != 8 || string(id[:4]) != "::!#" {
+		t.Fatalf("unexpected encoded stream id %q", id)
+	}
+}
+
+// lossyProxy relays udp datagrams between one caller and a listener, dropping a share of the non handshake packets
+type lossyProxy struct {
+	conn   *net.UDPConn
+	target *net.UDPAddr
+	loss   float64
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	caller  *net.UDPAddr
+	dropped int
+}
+
+func newLossyProxy(t *testing.T, target net.Addr, loss float64) *lossyProxy {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &lossyProxy{conn: conn, target: target.(*net.UDPAddr), loss: loss, rnd: rand.New(rand.NewSource(1))}
+	go p.run()
+	return p
+}
+
+func (p *lossyProxy) drop(data []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(data) >= 4 && binary.BigEndian.Uint32(data)>>16 == 0x8000 {
+		return false
+	}
+	if p.rnd.Float64() < p.loss {
+		p.dropped++
+		return true
+	}
+	return false
+}
+
+func (p *lossyProxy) droppedCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+func (p *lossyProxy) run() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if p.drop(buf[:n]) {
+			continue
+		}
+		if addr.String() == p.target.String() {
+			p.mu.Lock()
+			caller := p.caller
+			p.mu.Unlock()
+			if caller != nil {
+				_, _ = p.conn.WriteToUDP(buf[:n], caller)
+			}
+			continue
+		}
+		p.mu.Lock()
+		p.caller = addr
+		p.mu.Unlock()
+		_, _ = p.conn.WriteToUDP(buf[:n], p.target)
+	}
+}
+
+func TestSetPeerIdleTimeout(t *testing.T) {
+	task.InitTaskSystem()
+	ctx := context.Background()
+	l, err := Listen(ctx, "127.0.0.1:0", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accept := func() *Conn {
+		caller, err := Dial(ctx, l.Addr().String(), &Config{StreamID: "live/idle"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = caller.Close() })
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	before := accept()
+	l.SetPeerIdleTimeout(300 * time.Millisecond)
+	after := accept()
+	if before.idleTimeout != DefaultPeerIdleTimeout || after.idleTimeout != 300*time.Millisecond {
+		t.Fatalf("unexpected idle timeouts %s and %s", before.idleTimeout, after.idleTimeout)
+	}
+	l.SetPeerIdleTimeout(0)
+	if last := accept(); last.idleTimeout != DefaultPeerIdleTimeout {
+		t.Fatalf("unexpected idle timeout %s", last.idleTimeout)
+	}
+}
+
+func TestLossyTransfer(t *testing.T) {
+	task.InitTaskSystem()
+	ctx := context.Background()
+	l, err := Listen(ctx, "127.0.0.1:0", &Config{Latency: 400 * time.Millisecond, Passphrase: testPassphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	proxy := newLossyProxy(t, l.Addr(), 0.1)
+	defer proxy.conn.Close()
+
+	if _, err = Dial(ctx, proxy.conn.LocalAddr().String(), &Config{StreamID: "live/test", Passphrase: "wrong-passphrase"}); err == nil {
+		t.Fatal("dial with a wrong passphrase succeeded")
+	}
+	caller, err := Dial(ctx, proxy.conn.LocalAddr().String(), &Config{StreamID: "#!::r=live/test,m=publish", Passphrase: testPassphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.StreamID() != "#!::r=live/test,m=publish" || conn.Latency() != 400*time.Millisecond {
+		t.Fatalf("unexpected stream id %q latency %s", conn.StreamID(), conn.Latency())
+	}
+
+	const messages = 500
+	go func() {
+		msg := make([]byte, MaxPayloadSize)
+		for i := 0; i < messages; i++ {
+			binary.BigEndian.PutUint32(msg, uint32(i))
+			if _, err := caller.Write(msg); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	buf := make([]byte, MaxPayloadSize)
+	for i := 0; i < messages; i++ {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != MaxPayloadSize || binary.BigEndian.Uint32(buf) != uint32(i) {
+			t.Fatalf("message %d: got %d bytes of message %d %+v", i, n, binary.BigEndian.Uint32(buf), conn.Stats())
+		}
+	}
+	stats := conn.Stats()
+	if proxy.droppedCount() == 0 || stats.Lost == 0 || stats.Dropped != 0 || caller.Stats().Retransmitted == 0 {
+		t.Fatalf("unexpected stats %+v, %d dropped by the proxy", stats, proxy.droppedCount())
+	}
+
+	_ = caller.Close()
+	select {
+	case <-conn.Done():
+	case <-time.After(DefaultPeerIdleTimeout + time.Second):
+		t.Fatal("listener side not closed")
+	}
+}
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	testPPS = []byte{0x68, 0xce, 0x06, 0xe2}
+)
+
+func TestPublishPlay(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewServer(&ListenConfig{Addr: "127.0.0.1", Port: 19080})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ctx := context.Background()
+
+	proxy := newLossyProxy(t, server.listener.Addr(), 0.05)
+	defer proxy.conn.Close()
+	pub, err := Dial(ctx, proxy.conn.LocalAddr().String(), &Config{StreamID: "#!::r=live/srt,m=publish"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	w := &chunkWriter{w: pub}
+	muxer := mpegts.NewMuxer(w)
+	write := func(pkt *proto.BasePacket) {
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, SeqHeader: true,
+		Payload: codec.BuildAVCDecoderConfig(testSPS, testPPS)})
+	idr := make([]byte, 3000)
+	idr[0] = 0x65
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i) | 0x80
+	}
+	frame := func(i int) *proto.BasePacket {
+		return &proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, DTS: int64(i * 40),
+			PTS: int64(i * 40), KeyFrame: i%10 == 0, Payload: codec.EncodeAVCC([][]byte{idr})}
+	}
+	//the stream shows up once the publisher's first packets are demuxed
+	for i := 0; i < 20; i++ {
+		write(frame(i))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:/live/srt"); !exist {
+		t.Fatal("srt stream not published")
+	}
+
+	player, err := Dial(ctx, server.listener.Addr().String(), &Config{StreamID: "#!::r=live/srt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	var got []*proto.BasePacket
+	demuxer := mpegts.NewDemuxer(func(pkt *proto.BasePacket) {
+		got = append(got, pkt)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, MaxPayloadSize)
+		for len(got) < 10 {
+			n, err := player.Read(buf)
+			if err != nil {
+				return
+			}
+			_ = demuxer.Write(buf[:n])
+		}
+	}()
+	for i := 20; i < 60; i++ {
+		write(frame(i))
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("player timeout")
+	}
+	if len(got) < 10 || !got[0].SeqHeader || !got[1].KeyFrame {
+		t.Fatalf("unexpected played packets %+v", got[:1])
+	}
+	nalus, _ := codec.DecodeAVCC(got[1].Payload)
+	if len(nalus) == 0 || !bytes.Equal(nalus[len(nalus)-1], idr) {
+		t.Fatal("keyframe corrupted")
+	}
+
+	_ = pub.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:/live/srt"); !exist {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream not removed after the publisher left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,71 @@
+package srt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const streamIDPrefix = "#!::"
+
+// StreamID is the access control stream id, "#!::r=app/stream,m=publish", a plain id is the resource alone
+type StreamID struct {
+	Resource string
+	Host     string
+	User     string
+	Session  string
+	Publish  bool
+	// keys without a meaning for the server, they are kept as query params of the stream url
+	Params url.Values
+}
+
+func ParseStreamID(sid string) (*StreamID, error) {
+	s := &StreamID{Params: url.Values{}}
+	if !strings.HasPrefix(sid, streamIDPrefix) {
+		s.Resource = sid
+	} else {
+		for _, pair := range strings.Split(sid[len(streamIDPrefix):], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid srt stream id item %q", pair)
+			}
+			switch kv[0] {
+			case "r":
+				s.Resource = kv[1]
+			case "h":
+				s.Host = kv[1]
+			case "u":
+				s.User = kv[1]
+			case "s":
+				s.Session = kv[1]
+			case "m":
+				switch kv[1] {
+				case "publish":
+					s.Publish = true
+				case "request":
+				default:
+					return nil, fmt.Errorf("srt stream id mode %s not supported", kv[1])
+				}
+			case "t":
+				if kv[1] != "stream" {
+					return nil, fmt.Errorf("srt stream id type %s not supported", kv[1])
+				}
+			default:
+				s.Params.Set(kv[0], kv[1])
+			}
+		}
+	}
+	s.Resource = strings.Trim(s.Resource, "/")
+	if s.Resource == "" {
+		return nil, fmt.Errorf("srt stream id %q has no resource", sid)
+	}
+	return s, nil
+}
+
+// URL is the stream url of the resource, the host defaults to the listener address
+func (s *StreamID) URL(host string) *url.URL {
+	if s.Host != "" {
+		host = s.Host
+	}
+	return &url.URL{Scheme: "srt", Host: host, Path: "/" + s.Resource, RawQuery: s.Params.Encode()}
+}
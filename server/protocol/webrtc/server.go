@@ -0,0 +1,277 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	whipPrefix     = "/whip/"
+	whepPrefix     = "/whep/"
+	resourcePrefix = "/webrtc/session/"
+
+	maxOfferSize = 64 * 1024
+
+	videoPayloadType = 102
+	audioPayloadType = 111
+)
+
+type ListenConfig struct {
+	Addr string
+	Port int
+	//udp port range for ice, any ephemeral port when zero
+	ICEPortMin uint16
+	ICEPortMax uint16
+	//public addresses announced as host candidates behind 1:1 nat
+	PublicIPs []string
+	//whip/whep over https when set, browsers only negotiate from secure origins
+	TLS *tls.Config
+	//connections, publishes and plays are checked against it, nil lets everyone in
+	Access *hynet.Access
+	//reads the PROXY header of the trusted load balancers, nil reads none
+	Proxy *hynet.Proxy
+}
+
+// Server serves WHIP ingest on /whip/{app}/{stream} and WHEP playback on /whep/{app}/{stream}
+type Server struct {
+	ctx      context.Context
+	config   *ListenConfig
+	running  bool
+	api      *webrtc.API
+	listener net.Listener
+	server   *http.Server
+
+	mu       sync.Mutex
+	sessions map[string]io.Closer
+}
+
+func NewServer(config *ListenConfig) *Server {
+	s := &Server{}
+	s.config = config
+	return s
+}
+
+func (s *Server) Init() error {
+	mediaEngine := &webrtc.MediaEngine{}
+	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: []webrtc.RTCPFeedback{
+				{Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"},
+			},
+		},
+		PayloadType: videoPayloadType,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return err
+	}
+	err = mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: audioPayloadType,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return err
+	}
+	registry := &interceptor.Registry{}
+	if err = webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return err
+	}
+	settings := webrtc.SettingEngine{}
+	if s.config.ICEPortMin != 0 && s.config.ICEPortMax != 0 {
+		if err = settings.SetEphemeralUDPPortRange(s.config.ICEPortMin, s.config.ICEPortMax); err != nil {
+			return err
+		}
+	}
+	if len(s.config.PublicIPs) > 0 {
+		settings.SetNAT1To1IPs(s.config.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	s.api = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(settings))
+
+	s.ctx = log.GetCtxWithLogID(context.Background(), "WEBRTC_SERVER")
+	s.sessions = make(map[string]io.Closer)
+	mux := http.NewServeMux()
+	mux.HandleFunc(whipPrefix, s.serveWhip)
+	mux.HandleFunc(whepPrefix, s.serveWhep)
+	mux.HandleFunc(resourcePrefix, s.serveResource)
+	s.server = &http.Server{Handler: mux}
+	s.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.Addr, s.config.Port))
+	if err != nil {
+		return err
+	}
+	s.listener = s.config.Proxy.Listener(s.listener)
+	s.listener = s.config.Access.Listener(s.listener)
+	if s.config.TLS != nil {
+		s.listener = tls.NewListener(s.listener, s.config.TLS)
+	}
+	s.running = true
+	return nil
+}
+
+func (s *Server) Start() error {
+	log.Infof(s.ctx, "listen webrtc server@%s:%d", s.config.Addr, s.config.Port)
+	task.SubmitTask0(s.ctx, func() {
+		err := s.server.Serve(s.listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			log.Errorf(s.ctx, "webrtc server stopped: %+v", err)
+		}
+	})
+	return nil
+}
+
+// StopAccept closes the listener, the requests being served go on
+func (s *Server) StopAccept() {
+	_ = s.listener.Close()
+}
+
+// Drained is true once every WHIP/WHEP session ended
+func (s *Server) Drained() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions) == 0
+}
+
+func (s *Server) Close() {
+	s.running = false
+	_ = s.server.Close()
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		if session, exist := s.removeSession(id); exist {
+			_ = session.Close()
+		}
+	}
+}
+
+func (s *Server) addSession(session io.Closer) string {
+	var buf [16]byte
+	_, _ = rand.Read(buf[:])
+	id := hex.EncodeToString(buf[:])
+	s.mu.Lock()
+	s.sessions[id] = session
+	s.mu.Unlock()
+	metrics.Connections.With("webrtc").Inc()
+	return id
+}
+
+// removeSession is the only way out of sessions, the first one to remove a session closes it
+func (s *Server) removeSession(id string) (io.Closer, bool) {
+	s.mu.Lock()
+	session, exist := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	if exist {
+		metrics.Connections.With("webrtc").Dec()
+	}
+	return session, exist
+}
+
+func streamURL(r *http.Request, prefix string) *url.URL {
+	return &url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     "/" + strings.TrimPrefix(r.URL.Path, prefix),
+		RawQuery: r.URL.RawQuery,
+	}
+}
+
+// readOffer checks the request of a WHIP/WHEP endpoint and returns the sdp offer
+func readOffer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return "", false
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "content type must be application/sdp", http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return string(offer), true
+}
+
+// answer completes the negotiation without trickle ice, every candidate is in the answer
+func answer(pc *webrtc.PeerConnection, offer string) (string, error) {
+	err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+	desc, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(desc); err != nil {
+		return "", err
+	}
+	<-gatherComplete
+	return pc.LocalDescription().SDP, nil
+}
+
+func writeAnswer(w http.ResponseWriter, id string, sdp string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", resourcePrefix+id)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = io.WriteString(w, sdp)
+}
+
+// serveResource ends a WHIP/WHEP session on DELETE
+func (s *Server) serveResource(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, resourcePrefix)
+	session, exist := s.removeSession(id)
+	if !exist {
+		http.NotFound(w, r)
+		return
+	}
+	_ = session.Close()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,197 @@
+package webrtc
+
+import (
+	"bytes"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/metrics"
+	hyrtp "github.com/Opafanls/hylan/server/protocol/rtp"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	testPPS = []byte{0x68, 0xce, 0x06, 0xe2}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+)
+
+// negotiate posts the offer of pc to a WHIP/WHEP endpoint, applies the answer and returns the session resource
+func negotiate(t *testing.T, pc *webrtc.PeerConnection, endpoint string) string {
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	resp, err := http.Post(endpoint, "application/sdp", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(resp.Header.Get("Location"), resourcePrefix) {
+		t.Fatalf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)}); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Header.Get("Location")
+}
+
+func TestWhipPublishWhepPlay(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewServer(&ListenConfig{Addr: "127.0.0.1", Port: 18088})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	publisher, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = publisher.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	negotiate(t, publisher, "http://127.0.0.1:18088/whip/live/webrtc")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		packetizer := hyrtp.NewH264Packetizer(102)
+		for pts := int64(0); ; pts += 40 {
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+			for _, pkt := range packetizer.Packetize(pts, [][]byte{testSPS, testPPS, testIDR}) {
+				_ = track.WriteRTP(pkt)
+			}
+		}
+	}()
+
+	//the stream exists once the publisher sent its first keyframe
+	for i := 0; i < 100; i++ {
+		if s, exist := stream.DefaultHyStreamManager.GetStream("127.0.0.1:18088:/live/webrtc"); exist && len(s.Source().SeqHeaders()) > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	player, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	_, err = player.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan []byte, 1)
+	player.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		depacketizer := hyrtp.NewH264Depacketizer()
+		for {
+			pkt, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			frames, _ := depacketizer.Depacketize(pkt)
+			for _, frame := range frames {
+				for _, nalu := range frame.Units {
+					if nalu[0]&0x1f == codec.H264NaluIDR {
+						select {
+						case got <- nalu:
+						default:
+						}
+					}
+				}
+			}
+		}
+	})
+	negotiate(t, player, "http://127.0.0.1:18088/whep/live/webrtc")
+	select {
+	case nalu := <-got:
+		if !bytes.Equal(nalu, testIDR) {
+			t.Fatalf("unexpected idr %x", nalu)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no idr received")
+	}
+}
+
+func TestSessionGauge(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	server := NewServer(&ListenConfig{Addr: "127.0.0.1", Port: 18089})
+	if err := server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	gauge := metrics.Connections.With("webrtc")
+	open := gauge.Get()
+
+	publish := func(path string) (*webrtc.PeerConnection, string) {
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = pc.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+		return pc, negotiate(t, pc, "http://127.0.0.1:18089/whip"+path)
+	}
+
+	first, location := publish("/live/gauge1")
+	defer first.Close()
+	if gauge.Get() != open+1 {
+		t.Fatalf("unexpected open connections %d", gauge.Get()-open)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, "http://127.0.0.1:18089"+location, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || gauge.Get() != open {
+		t.Fatalf("unexpected open connections %d after a delete answered %d", gauge.Get()-open, resp.StatusCode)
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || gauge.Get() != open {
+		t.Fatalf("unexpected open connections %d after a second delete answered %d", gauge.Get()-open, resp.StatusCode)
+	}
+
+	second, _ := publish("/live/gauge2")
+	defer second.Close()
+	server.Close()
+	if gauge.Get() != open {
+		t.Fatalf("unexpected open connections %d after close", gauge.Get()-open)
+	}
+}
@@ -0,0 +1,222 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/proto"
+	hyrtp "github.com/Opafanls/hylan/server/protocol/rtp"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"github.com/pion/webrtc/v3"
+	"net/http"
+	"sync"
+)
+
+type whepTrack struct {
+	local   *webrtc.TrackLocalStaticRTP
+	encoder hyrtp.TrackEncoder
+}
+
+// whepPlayer sends a stream to a WHEP peer connection, each player has its own sink
+type whepPlayer struct {
+	ctx      context.Context
+	hyStream *stream.HyStream
+	pc       *webrtc.PeerConnection
+	video    *whepTrack
+	audio    *whepTrack
+	onClose  func()
+	//remoteAddr is the http client that negotiated the session
+	remoteAddr string
+	sinkID     string
+
+	mu     sync.Mutex
+	sink   session.SinkSessionI
+	closed bool
+	start  sync.Once
+	once   sync.Once
+}
+
+func (s *Server) serveWhep(w http.ResponseWriter, r *http.Request) {
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+	u := streamURL(r, whepPrefix)
+	if err := s.config.Access.Allow(hynet.OpPlay, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := vhost.Play(u, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), vhost.HTTPStatus(err))
+		return
+	}
+	id := base.NewBase0(u).ID()
+	hyStream, exist := stream.DefaultHyStreamManager.GetStream(id)
+	if !exist {
+		http.Error(w, fmt.Sprintf("stream %s not found", id), http.StatusNotFound)
+		return
+	}
+	ctx := log.GetCtxWithLogID(s.ctx, "WHEP")
+	sinkID := session.NextID()
+	stop, err := hook.Play(ctx, hook.NewEvent(hook.OnPlay, u, sinkID, "whep", r.RemoteAddr))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		stop()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := &whepPlayer{ctx: ctx, hyStream: hyStream, pc: pc, remoteAddr: r.RemoteAddr, sinkID: sinkID}
+	if err = p.addTracks(); err != nil {
+		_ = pc.Close()
+		stop()
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	sessionID := s.addSession(p)
+	//the player may never connect, on_stop is sent when the session ends rather than the sink
+	p.onClose = func() {
+		s.removeSession(sessionID)
+		stop()
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Infof(p.ctx, "whep player of %s %s", id, state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			p.start.Do(func() {
+				task.SubmitTask0(p.ctx, p.play)
+			})
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			_ = p.Close()
+		}
+	})
+	sdp, err := answer(pc, offer)
+	if err != nil {
+		metrics.HandshakeFailures.With("webrtc", "sdp").Inc()
+		_ = p.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAnswer(w, sessionID, sdp)
+}
+
+// addTracks offers the H.264 and Opus tracks of the stream, other codecs can't be played by browsers
+func (p *whepPlayer) addTracks() error {
+	for _, header := range p.hyStream.Source().SeqHeaders() {
+		pkt := header.Base()
+		var capability webrtc.RTPCodecCapability
+		var payloadType uint8
+		switch pkt.Codec {
+		case constdef.CodecH264:
+			capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}
+			payloadType = videoPayloadType
+		case constdef.CodecOpus:
+			capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+			payloadType = audioPayloadType
+		default:
+			log.Warnf(p.ctx, "skip %s track, not supported by webrtc", pkt.Codec)
+			continue
+		}
+		encoder, err := hyrtp.NewTrackEncoder(pkt, payloadType)
+		if err != nil {
+			return err
+		}
+		kind := "audio"
+		if pkt.IsVideo() {
+			kind = "video"
+		}
+		local, err := webrtc.NewTrackLocalStaticRTP(capability, kind, "hylan")
+		if err != nil {
+			return err
+		}
+		sender, err := p.pc.AddTrack(local)
+		if err != nil {
+			return err
+		}
+		task.SubmitTask0(p.ctx, func() {
+			//rtcp has to be read for the interceptors to work
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		})
+		if pkt.IsVideo() {
+			p.video = &whepTrack{local: local, encoder: encoder}
+		} else {
+			p.audio = &whepTrack{local: local, encoder: encoder}
+		}
+	}
+	if p.video == nil && p.audio == nil {
+		return fmt.Errorf("stream %s has no track for webrtc", p.hyStream.Base().ID())
+	}
+	return nil
+}
+
+// play attaches the sink once connected so the player starts with the gop cache
+func (p *whepPlayer) play() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.sink = p.hyStream.Source().AddSink(&proto.SinkArg{
+		Ctx:        p.ctx,
+		Protocol:   constdef.SinkTypeWebrtc,
+		Peer:       &proto.Peer{Protocol: "whep", RemoteAddr: p.remoteAddr, Kick: func() { _ = p.Close() }},
+		ID:         p.sinkID,
+		SinkWebrtc: &proto.SinkWebrtc{},
+	})
+	sink := p.sink
+	p.mu.Unlock()
+	defer p.Close()
+	for {
+		data, ok := sink.Pull(p.ctx)
+		if !ok {
+			log.Infof(p.ctx, "whep player of %s done", p.hyStream.Base().ID())
+			return
+		}
+		pkt := data.Base()
+		track := p.audio
+		if pkt.IsVideo() {
+			track = p.video
+		}
+		if track == nil {
+			continue
+		}
+		for _, rtpPkt := range track.encoder.Encode(pkt) {
+			if err := track.local.WriteRTP(rtpPkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (p *whepPlayer) Close() error {
+	p.once.Do(func() {
+		p.mu.Lock()
+		p.closed = true
+		if p.sink != nil {
+			p.sink.Close()
+		}
+		p.mu.Unlock()
+		_ = p.pc.Close()
+		if p.onClose != nil {
+			p.onClose()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,177 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	hyrtp "github.com/Opafanls/hylan/server/protocol/rtp"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyframes are requested periodically so the gop cache stays fresh for late joiners
+const pliInterval = 3 * time.Second
+
+// whipPublisher feeds the tracks of a WHIP peer connection into a source session
+type whipPublisher struct {
+	ctx      context.Context
+	hyStream *stream.HyStream
+	source   session.SourceSessionI
+	pc       *webrtc.PeerConnection
+	onClose  func()
+
+	mu   sync.Mutex
+	once sync.Once
+	//ends the periodic keyframe requests
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+func newWhipPublisher(ctx context.Context, u *url.URL, pc *webrtc.PeerConnection) *whipPublisher {
+	p := &whipPublisher{ctx: ctx, pc: pc}
+	p.closed, p.cancel = context.WithCancel(ctx)
+	p.source = session.NewSourceSession(ctx, p)
+	p.hyStream = stream.NewHyStream0(u, p.source)
+	return p
+}
+
+func (s *Server) serveWhip(w http.ResponseWriter, r *http.Request) {
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+	u := streamURL(r, whipPrefix)
+	if err := s.config.Access.Allow(hynet.OpPublish, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := vhost.Publish(u, r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), vhost.HTTPStatus(err))
+		return
+	}
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := newWhipPublisher(log.GetCtxWithLogID(s.ctx, "WHIP"), u, pc)
+	if err = hook.Publish(p.ctx, hook.NewEvent(hook.OnPublish, u, p.source.ID(), "whip", r.RemoteAddr)); err != nil {
+		_ = pc.Close()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err = stream.DefaultHyStreamManager.AddStream(p.hyStream); err != nil {
+		_ = pc.Close()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	id := s.addSession(p)
+	p.onClose = func() {
+		s.removeSession(id)
+	}
+	p.source.SetPeer(&proto.Peer{Protocol: "whip", RemoteAddr: r.RemoteAddr, Kick: func() { _ = p.Close() }})
+	pc.OnTrack(p.onTrack)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Infof(p.ctx, "whip publisher of %s %s", p.hyStream.Base().ID(), state)
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			_ = p.Close()
+		}
+	})
+	sdp, err := answer(pc, offer)
+	if err != nil {
+		metrics.HandshakeFailures.With("webrtc", "sdp").Inc()
+		_ = p.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof(p.ctx, "whip publish stream %s", p.hyStream.Base().ID())
+	writeAnswer(w, id, sdp)
+}
+
+func (p *whipPublisher) onTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	var decoder hyrtp.TrackDecoder
+	switch strings.ToLower(track.Codec().MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		decoder = hyrtp.NewH264TrackDecoder(nil, nil)
+		p.requestKeyFrames(track.SSRC())
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		channels := int(track.Codec().Channels)
+		if channels == 0 {
+			channels = 2
+		}
+		decoder = hyrtp.NewAudioTrackDecoder(constdef.CodecOpus, hyrtp.NewOpusDepacketizer(), hyrtp.OpusClockRate, codec.OpusHead(channels))
+	default:
+		log.Warnf(p.ctx, "skip unsupported track %s", track.Codec().MimeType)
+		return
+	}
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		for _, mediaPkt := range decoder.Decode(pkt) {
+			_ = p.OnMedia(p.ctx, mediaPkt.MediaType, mediaPkt)
+		}
+	}
+}
+
+// requestKeyFrames sends a pli now and every pliInterval until the publisher closes or rtcp fails
+func (p *whipPublisher) requestKeyFrames(ssrc webrtc.SSRC) {
+	ctx, cancel := context.WithCancel(p.closed)
+	pli := func() {
+		if p.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}) != nil {
+			cancel()
+		}
+	}
+	pli()
+	task.Every(ctx, pliInterval, pli)
+}
+
+func (p *whipPublisher) OnInit(ctx context.Context) {
+}
+
+// OnMedia is called by every track, the lock keeps their packets interleaved
+func (p *whipPublisher) OnMedia(ctx context.Context, mediaType protocol.MediaDataType, data interface{}) error {
+	pkt, ok := data.(*proto.BasePacket)
+	if !ok {
+		return fmt.Errorf("unexpected media %T for %d", data, mediaType)
+	}
+	p.mu.Lock()
+	p.source.Push(ctx, pkt)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *whipPublisher) OnClose() error {
+	stream.DefaultHyStreamManager.RemoveStreamIfMatch(p.hyStream)
+	p.source.Close()
+	return nil
+}
+
+func (p *whipPublisher) Close() error {
+	p.once.Do(func() {
+		p.cancel()
+		_ = p.pc.Close()
+		_ = p.OnClose()
+		if p.onClose != nil {
+			p.onClose()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,233 @@
+package record
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatTS        = "ts"
+	writeBufferSize = 256 * 1024
+)
+
+type Config struct {
+	//Dir gets one sub directory per app
+	Dir string
+	//only ts for now
+	Format string
+	//apps to record, every app when empty
+	Apps []string
+	//only record on the vhosts with their own record settings
+	VhostOnly bool
+}
+
+// Recorder writes every published stream of the configured apps into a file, one file per publish.
+// A vhost with its own record settings has them in place of Dir and Apps.
+type Recorder struct {
+	ctx    context.Context
+	config *Config
+
+	mu      sync.Mutex
+	running bool
+	sinks   map[session.SinkSessionI]struct{}
+	wg      sync.WaitGroup
+	cancel  func()
+}
+
+func NewRecorder(config *Config) *Recorder {
+	r := &Recorder{}
+	r.config = config
+	return r
+}
+
+func (r *Recorder) Init() error {
+	r.ctx = log.GetCtxWithLogID(context.Background(), "RECORDER")
+	r.sinks = make(map[session.SinkSessionI]struct{})
+	if r.config.Format != FormatTS {
+		return fmt.Errorf("unsupported record format %q", r.config.Format)
+	}
+	if r.config.VhostOnly {
+		return nil
+	}
+	return os.MkdirAll(r.config.Dir, 0755)
+}
+
+func (r *Recorder) Start() error {
+	r.mu.Lock()
+	r.running = true
+	r.cancel = stream.DefaultHyStreamManager.OnAdd(r.onStream)
+	r.mu.Unlock()
+	if r.config.VhostOnly {
+		log.Infof(r.ctx, "record the vhosts with their own record settings")
+	} else {
+		log.Infof(r.ctx, "record %v into %s", r.apps(), r.config.Dir)
+	}
+	return nil
+}
+
+// StopAccept stops recording new publishes, the running recordings go on until their streams end
+func (r *Recorder) StopAccept() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = false
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+// Drained is true once the recordings running when it stopped accepting are written
+func (r *Recorder) Drained() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sinks) == 0
+}
+
+// Close ends the running recordings and waits for their files to be written
+func (r *Recorder) Close() {
+	r.StopAccept()
+	r.mu.Lock()
+	sinks := r.sinks
+	r.sinks = make(map[session.SinkSessionI]struct{})
+	r.mu.Unlock()
+	for sink := range sinks {
+		sink.Close()
+	}
+	r.wg.Wait()
+}
+
+func (r *Recorder) apps() string {
+	if len(r.config.Apps) == 0 {
+		return "every app"
+	}
+	return strings.Join(r.config.Apps, ",")
+}
+
+func matchApp(apps []string, app string) bool {
+	if len(apps) == 0 {
+		return true
+	}
+	for _, a := range apps {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recorder) onStream(hyStream *stream.HyStream) {
+	dir, apps := r.config.Dir, r.config.Apps
+	if v := vhost.Match(hyStream.Base().URL()); v.Record != nil {
+		if !v.Record.Enabled {
+			return
+		}
+		dir, apps = v.Record.Dir, v.Record.Apps
+	} else if r.config.VhostOnly {
+		return
+	}
+	app, name := splitPath(hyStream.Base().URL().Path)
+	if !matchApp(apps, app) {
+		return
+	}
+	ctx := log.GetCtxWithLogID(r.ctx, "RECORD")
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return
+	}
+	sink := hyStream.Source().AddSink(&proto.SinkArg{
+		Ctx:      ctx,
+		Protocol: constdef.SinkTypeFile,
+		Peer:     &proto.Peer{Protocol: "record", Internal: true},
+		SinkFile: &proto.SinkFile{},
+	})
+	r.sinks[sink] = struct{}{}
+	r.wg.Add(1)
+	r.mu.Unlock()
+	path := filepath.Join(dir, safeName(app), fmt.Sprintf("%s-%s.%s", safeName(name), time.Now().Format("20060102150405"), r.config.Format))
+	task.SubmitTask0(ctx, func() {
+		defer r.wg.Done()
+		defer func() {
+			r.mu.Lock()
+			delete(r.sinks, sink)
+			r.mu.Unlock()
+			sink.Close()
+		}()
+		if err := record(ctx, sink, path); err != nil {
+			log.Errorf(ctx, "record %s into %s: %+v", hyStream.Base().ID(), path, err)
+			return
+		}
+		log.Infof(ctx, "record %s done: %s", hyStream.Base().ID(), path)
+		ev := hook.NewEvent(hook.OnRecordDone, hyStream.Base().URL(), sink.ID(), "record", "")
+		ev.File = path
+		hook.Notify(ev)
+	})
+}
+
+// record muxes the sink into path until the stream ends
+func record(ctx context.Context, sink session.SinkSessionI, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriterSize(f, writeBufferSize)
+	muxer := mpegts.NewMuxer(buf)
+	for {
+		data, ok := sink.Pull(ctx)
+		if !ok {
+			break
+		}
+		if err = muxer.WritePacket(data.Base()); err != nil {
+			break
+		}
+	}
+	if flushErr := buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// splitPath returns the app and the stream name of /{app}/{name}
+func splitPath(path string) (string, string) {
+	path = strings.Trim(path, "/")
+	if idx := strings.Index(path, "/"); idx >= 0 {
+		return path[:idx], path[idx+1:]
+	}
+	return "", path
+}
+
+// safeName keeps a path element inside Dir whatever the publisher named the stream
+func safeName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			b[i] = '_'
+		}
+	}
+	name := strings.TrimLeft(string(b), ".")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
@@ -0,0 +1,103 @@
+package record
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func publish(t *testing.T, host, path string) *stream.HyStream {
+	ctx := context.Background()
+	source := session.NewSourceSession(ctx, nil)
+	hyStream := stream.NewHyStream0(&url.URL{Host: host, Path: path}, source)
+	if err := stream.DefaultHyStreamManager.AddStream(hyStream); err != nil {
+		t.Fatal(err)
+	}
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	source.Push(ctx, &proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264, SeqHeader: true,
+		Payload: codec.BuildAVCDecoderConfig(sps, pps)})
+	for i := 0; i < 25; i++ {
+		nalu := []byte{0x41, 0x9a, 0x00, 0x00}
+		if i == 0 {
+			nalu[0] = 0x65
+		}
+		source.Push(ctx, &proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, Codec: constdef.CodecH264,
+			DTS: int64(i * 40), PTS: int64(i * 40), KeyFrame: i == 0, Payload: codec.EncodeAVCC([][]byte{nalu})})
+	}
+	return hyStream
+}
+
+func TestRecorder(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	dir := t.TempDir()
+	r := NewRecorder(&Config{Dir: dir, Format: FormatTS, Apps: []string{"live"}})
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	recorded := publish(t, "127.0.0.1", "/live/../cam")
+	skipped := publish(t, "127.0.0.1", "/other/cam")
+	recorded.Source().Close()
+	skipped.Source().Close()
+	r.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(filepath.Dir(files[0])) != "live" {
+		t.Fatalf("expect one recording of the live app, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || len(data)%188 != 0 || data[0] != 0x47 {
+		t.Fatalf("unexpected ts file of %d bytes", len(data))
+	}
+}
+
+func TestVhostRecord(t *testing.T) {
+	stream.InitHyStreamManager()
+	task.InitTaskSystem()
+	dir := t.TempDir()
+	vhost.SetTable(vhost.NewTable(nil,
+		&vhost.Vhost{Name: "a", Domains: []string{"a.example.com"}, Enabled: true, Record: &vhost.Record{Enabled: true, Dir: filepath.Join(dir, "a")}},
+		&vhost.Vhost{Name: "b", Domains: []string{"b.example.com"}, Enabled: true, Record: &vhost.Record{}},
+	))
+	defer vhost.SetTable(nil)
+	//the server wide recording is off, only vhost a records
+	r := NewRecorder(&Config{Dir: filepath.Join(dir, "server"), Format: FormatTS, VhostOnly: true})
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		publish(t, host, "/live/cam").Source().Close()
+	}
+	r.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", "*.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Dir(files[0]) != filepath.Join(dir, "a", "live") {
+		t.Fatalf("expect one recording of vhost a, got %v", files)
+	}
+}
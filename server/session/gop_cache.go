@@ -0,0 +1,82 @@
+package session
+
+import (
+	"github.com/Opafanls/hylan/server/proto"
+	"sync"
+)
+
+// gopCache keeps the sequence headers and the packets of the latest gop,
+// so a sink joining mid-stream can start decoding from a keyframe
+type gopCache struct {
+	rw          sync.RWMutex
+	maxSize     int
+	videoHeader proto.PacketI
+	audioHeader proto.PacketI
+	gop         []proto.PacketI
+	hasKeyFrame bool
+}
+
+func newGopCache(maxSize int) *gopCache {
+	return &gopCache{maxSize: maxSize}
+}
+
+func (c *gopCache) push(pkt proto.PacketI) {
+	b := pkt.Base()
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	if b.SeqHeader {
+		if b.IsVideo() {
+			c.videoHeader = pkt
+		} else if b.IsAudio() {
+			c.audioHeader = pkt
+		}
+		return
+	}
+	if b.IsVideo() && b.KeyFrame {
+		c.gop = c.gop[:0]
+		c.hasKeyFrame = true
+	}
+	if !c.hasKeyFrame && c.videoHeader != nil {
+		//wait for the first keyframe of a video stream
+		return
+	}
+	if len(c.gop) >= c.maxSize {
+		//gop too long, drop it and wait for the next keyframe
+		c.gop = c.gop[:0]
+		c.hasKeyFrame = false
+		return
+	}
+	c.gop = append(c.gop, pkt)
+}
+
+func (c *gopCache) headers() []proto.PacketI {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	var pkts []proto.PacketI
+	if c.videoHeader != nil {
+		pkts = append(pkts, c.videoHeader)
+	}
+	if c.audioHeader != nil {
+		pkts = append(pkts, c.audioHeader)
+	}
+	return pkts
+}
+
+func (c *gopCache) snapshot() []proto.PacketI {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	var pkts []proto.PacketI
+	if c.videoHeader != nil {
+		pkts = append(pkts, c.videoHeader)
+	}
+	if c.audioHeader != nil {
+		pkts = append(pkts, c.audioHeader)
+	}
+	return append(pkts, c.gop...)
+}
+
+func (c *gopCache) size() int {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return len(c.gop)
+}
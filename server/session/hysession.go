@@ -2,40 +2,109 @@ package session
 
 import (
 	"context"
+	"github.com/Opafanls/hylan/server/codec"
 	"github.com/Opafanls/hylan/server/constdef"
 	"github.com/Opafanls/hylan/server/core/pb"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/metrics"
 	"github.com/Opafanls/hylan/server/proto"
 	"github.com/Opafanls/hylan/server/protocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var sessionSeq int64
+
+// ring sizes of new sessions, the running ones keep theirs
+var (
+	cacheSize    int64 = constdef.DefaultCacheSize
+	gopCacheSize int64 = constdef.DefaultGopCacheSize
+)
+
+// SetCacheSizes changes the packet and gop cache sizes of the sessions created from now on
+func SetCacheSizes(packets, gopPackets int) {
+	atomic.StoreInt64(&cacheSize, int64(packets))
+	atomic.StoreInt64(&gopCacheSize, int64(gopPackets))
+}
+
 type HySessionI interface {
 	Cycle()
 	SessionType() constdef.SessionType
+	Ctx() context.Context
+	Close()
+	//ID is unique within the process, the admin api addresses sessions with it
+	ID() string
+	StartTime() time.Time
+	Peer() *proto.Peer
+	SetPeer(peer *proto.Peer)
+	//Kick ends the session together with its connection
+	Kick()
 }
 
 type SourceSessionI interface {
 	HySessionI
 	Push(ctx context.Context, pkt proto.PacketI)
-	Pull(ctx context.Context) (proto.PacketI, bool)
-	AddSink(arg *proto.SinkArg) HySessionI
+	AddSink(arg *proto.SinkArg) SinkSessionI
+	RemoveSink(sink SinkSessionI)
+	Sinks() []SinkSessionI
+	SeqHeaders() []proto.PacketI
+	//VideoInfo is parsed out of the latest video sequence header, nil until one arrives
+	VideoInfo() *codec.VideoInfo
+	//AudioInfo is parsed out of the latest audio sequence header, or the first frame of codecs without one
+	AudioInfo() *codec.AudioInfo
+	TimestampStats() TimestampStats
+	Stats() SourceStats
+	Closed() bool
 }
 
 type SinkSessionI interface {
 	HySessionI
+	Pull(ctx context.Context) (proto.PacketI, bool)
+	SinkType() constdef.SinkType
+	//BytesOut counts the media payload pulled so far
+	BytesOut() int64
+	Dropped() int64
 }
 
 type HySession struct {
 	sessCtx         context.Context
 	protocolSession protocol.Handler
 	sessionType     constdef.SessionType
+	id              string
+	startTime       time.Time
+	peer            atomic.Value
 }
 
 type HySessionSource struct {
-	cache pb.CacheRing
 	*HySession
+
+	gop        *gopCache
+	timestamps *timestampSanitizer
+	counter    *sourceCounter
+	rw         sync.RWMutex
+	sinks      map[*HySessionSink]struct{}
+	videoInfo  *codec.VideoInfo
+	audioInfo  *codec.AudioInfo
+	closed     bool
+	//bytesIn is the server wide series of the publishing protocol, set with the peer
+	bytesIn atomic.Value
 }
+
 type HySessionSink struct {
 	*HySession
+	cache    pb.CacheRing
+	sinkType constdef.SinkType
+	source   *HySessionSource
+	rebase   sinkRebase
+	bytesOut int64
+	dropped  int64
+	once     sync.Once
+	onClose  func()
+	//server wide series of the sink protocol
+	bytesOutMetric *metrics.Value
+	droppedMetric  *metrics.Value
 }
 
 func NewHySession(ctx context.Context, ps protocol.Handler, sessionType constdef.SessionType) HySessionI {
@@ -43,40 +112,304 @@ func NewHySession(ctx context.Context, ps protocol.Handler, sessionType constdef
 		sessCtx:         ctx,
 		protocolSession: ps,
 		sessionType:     sessionType,
+		id:              NextID(),
+		startTime:       time.Now(),
 	}
 	if sessionType == constdef.SessionTypeSource {
 		sourceSession := &HySessionSource{}
 		sourceSession.HySession = hySession
-		sourceSession.cache = pb.NewRing0(constdef.DefaultCacheSize)
+		sourceSession.gop = newGopCache(int(atomic.LoadInt64(&gopCacheSize)))
+		sourceSession.timestamps = newTimestampSanitizer(DefaultTsJumpThreshold, DefaultTsMaxInterleave)
+		sourceSession.counter = newSourceCounter()
+		sourceSession.sinks = make(map[*HySessionSink]struct{})
 		return sourceSession
 	} else if sessionType == constdef.SessionTypeSink {
 		sinkSession := &HySessionSink{}
 		sinkSession.HySession = hySession
+		sinkSession.cache = pb.NewRing0(uint64(atomic.LoadInt64(&cacheSize)))
 		return sinkSession
 	}
 	return hySession
 }
 
+// NextID is a new session id, for a session that needs it before it is created
+func NextID() string {
+	return strconv.FormatInt(atomic.AddInt64(&sessionSeq, 1), 10)
+}
+
+// NewSourceSession is a shortcut for protocol handlers publishing a stream
+func NewSourceSession(ctx context.Context, ps protocol.Handler) SourceSessionI {
+	return NewHySession(ctx, ps, constdef.SessionTypeSource).(SourceSessionI)
+}
+
 func (hy *HySession) Cycle() {
 	//session := hy.protocolSession
 }
 
-func (hy *HySessionSource) AddSink(arg *proto.SinkArg) HySessionI {
-	return nil
+func (hy *HySession) Ctx() context.Context {
+	return hy.sessCtx
+}
+
+func (hy *HySession) Close() {
+}
+
+func (hy *HySession) SessionType() constdef.SessionType {
+	return hy.sessionType
+}
+
+func (hy *HySession) ID() string {
+	return hy.id
+}
+
+func (hy *HySession) StartTime() time.Time {
+	return hy.startTime
+}
+
+// Peer returns the connection set by the protocol, nil when it did not tell
+func (hy *HySession) Peer() *proto.Peer {
+	peer, _ := hy.peer.Load().(*proto.Peer)
+	return peer
+}
+
+func (hy *HySession) SetPeer(peer *proto.Peer) {
+	if peer != nil {
+		hy.peer.Store(peer)
+	}
+}
+
+// Kick closes the connection of the peer, the protocol handler is closed when there is none
+func (hy *HySession) Kick() {
+	if peer := hy.Peer(); peer != nil && peer.Kick != nil {
+		peer.Kick()
+		return
+	}
+	if hy.protocolSession != nil {
+		_ = hy.protocolSession.OnClose()
+	}
+}
+
+func (hy *HySessionSource) AddSink(arg *proto.SinkArg) SinkSessionI {
+	ctx := arg.Ctx
+	if ctx == nil {
+		ctx = hy.sessCtx
+	}
+	sink := NewHySession(ctx, nil, constdef.SessionTypeSink).(*HySessionSink)
+	if arg.ID != "" {
+		sink.id = arg.ID
+	}
+	sink.onClose = arg.OnClose
+	sink.sinkType = arg.Protocol
+	sink.source = hy
+	sink.SetPeer(arg.Peer)
+	sink.bytesOutMetric = metrics.BytesOut.With(arg.Protocol.String())
+	sink.droppedMetric = metrics.SinkDropped.With(arg.Protocol.String())
+
+	hy.rw.Lock()
+	defer hy.rw.Unlock()
+	if hy.closed {
+		sink.cache.Close()
+		return sink
+	}
+	for _, pkt := range hy.gop.snapshot() {
+		sink.push(pkt)
+	}
+	hy.sinks[sink] = struct{}{}
+	return sink
+}
+
+// Sinks returns the sinks attached right now
+func (hy *HySessionSource) Sinks() []SinkSessionI {
+	hy.rw.RLock()
+	defer hy.rw.RUnlock()
+	sinks := make([]SinkSessionI, 0, len(hy.sinks))
+	for sink := range hy.sinks {
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// SetPeer also picks the server wide bytes in series of the peer protocol
+func (hy *HySessionSource) SetPeer(peer *proto.Peer) {
+	if peer == nil {
+		return
+	}
+	hy.HySession.SetPeer(peer)
+	hy.bytesIn.Store(metrics.BytesIn.With(peer.Protocol))
+}
+
+// Kick ends the publisher, a source without peer and handler is just closed
+func (hy *HySessionSource) Kick() {
+	if hy.Peer() == nil && hy.protocolSession == nil {
+		hy.Close()
+		return
+	}
+	hy.HySession.Kick()
+}
+
+func (hy *HySessionSource) RemoveSink(sink SinkSessionI) {
+	s, ok := sink.(*HySessionSink)
+	if !ok {
+		return
+	}
+	hy.rw.Lock()
+	delete(hy.sinks, s)
+	hy.rw.Unlock()
 }
 
+// Push sanitizes the timestamps of pkt in place and hands it to the gop cache and every sink
 func (hy *HySessionSource) Push(ctx context.Context, pkt proto.PacketI) {
-	hy.cache.Push(pkt)
+	hy.timestamps.sanitize(ctx, pkt.Base())
+	hy.counter.add(pkt.Base())
+	if bytesIn, ok := hy.bytesIn.Load().(*metrics.Value); ok {
+		bytesIn.Add(int64(len(pkt.Base().Payload)))
+	}
+	if b := pkt.Base(); b.SeqHeader && b.IsVideo() {
+		hy.updateVideoInfo(ctx, b)
+	} else if b.IsAudio() && (b.SeqHeader || b.Codec == constdef.CodecMP3 && hy.AudioInfo() == nil) {
+		hy.updateAudioInfo(ctx, b)
+	}
+	//a sink joining takes the write lock, it gets pkt from the gop snapshot or from here, never both
+	hy.rw.RLock()
+	hy.gop.push(pkt)
+	for sink := range hy.sinks {
+		sink.push(pkt)
+	}
+	hy.rw.RUnlock()
+}
+
+func (hy *HySessionSource) updateVideoInfo(ctx context.Context, header *proto.BasePacket) {
+	info, err := codec.ParseVideoConfig(header.Codec, header.Payload)
+	if err != nil {
+		log.Warnf(ctx, "parse %v sequence header: %+v", header.Codec, err)
+	} else {
+		log.Infof(ctx, "video %v %s@%s %dx%d %.2ffps", info.Codec, info.ProfileName(), info.LevelName(), info.Width, info.Height, info.FrameRate)
+	}
+	hy.rw.Lock()
+	hy.videoInfo = info
+	hy.rw.Unlock()
+}
+
+func (hy *HySessionSource) VideoInfo() *codec.VideoInfo {
+	hy.rw.RLock()
+	defer hy.rw.RUnlock()
+	return hy.videoInfo
+}
+
+func (hy *HySessionSource) updateAudioInfo(ctx context.Context, pkt *proto.BasePacket) {
+	info, err := codec.ParseAudioInfo(pkt)
+	if err != nil {
+		log.Warnf(ctx, "parse %v audio config: %+v", pkt.Codec, err)
+		return
+	}
+	if info == nil {
+		return
+	}
+	log.Infof(ctx, "audio %v %dHz %d channels", info.Codec, info.SampleRate, info.Channels)
+	hy.rw.Lock()
+	hy.audioInfo = info
+	hy.rw.Unlock()
+}
+
+func (hy *HySessionSource) TimestampStats() TimestampStats {
+	return hy.timestamps.snapshot()
+}
+
+// Stats reads the counters of the source with atomics only
+func (hy *HySessionSource) Stats() SourceStats {
+	stats := hy.counter.snapshot()
+	stats.Timestamps = hy.timestamps.snapshot()
+	stats.GopCache = hy.gop.size()
+	return stats
+}
+
+func (hy *HySessionSource) AudioInfo() *codec.AudioInfo {
+	hy.rw.RLock()
+	defer hy.rw.RUnlock()
+	return hy.audioInfo
 }
 
-func (hy *HySessionSource) Pull(ctx context.Context) (proto.PacketI, bool) {
+func (hy *HySessionSource) SeqHeaders() []proto.PacketI {
+	return hy.gop.headers()
+}
+
+// Close ends the source, every attached sink gets a false Pull once drained
+func (hy *HySessionSource) Close() {
+	hy.rw.Lock()
+	if hy.closed {
+		hy.rw.Unlock()
+		return
+	}
+	hy.closed = true
+	sinks := hy.sinks
+	hy.sinks = make(map[*HySessionSink]struct{})
+	hy.rw.Unlock()
+	for sink := range sinks {
+		sink.cache.Close()
+	}
+}
+
+func (hy *HySessionSource) Closed() bool {
+	hy.rw.RLock()
+	defer hy.rw.RUnlock()
+	return hy.closed
+}
+
+// Pull returns the next packet rebased to the first one this sink got
+func (hy *HySessionSink) Pull(ctx context.Context) (proto.PacketI, bool) {
 	data, exist := hy.cache.Pull()
 	if !exist {
 		return nil, false
 	}
-	return data.(proto.PacketI), true
+	pkt := hy.rebase.rebase(data.(proto.PacketI))
+	size := int64(len(pkt.Base().Payload))
+	atomic.AddInt64(&hy.bytesOut, size)
+	if hy.source != nil {
+		hy.bytesOutMetric.Add(size)
+		hy.source.counter.addBytesOut(size)
+	}
+	return pkt, true
 }
 
-func (hy *HySession) SessionType() constdef.SessionType {
-	return hy.sessionType
+// push queues a packet, a player too slow to keep up loses the oldest ones
+func (hy *HySessionSink) push(pkt proto.PacketI) {
+	if hy.cache.Push(pkt) {
+		return
+	}
+	atomic.AddInt64(&hy.dropped, 1)
+	hy.droppedMetric.Inc()
+	hy.source.counter.addDropped()
+}
+
+func (hy *HySessionSink) BytesOut() int64 {
+	return atomic.LoadInt64(&hy.bytesOut)
+}
+
+// Dropped counts the packets overwritten before this sink read them
+func (hy *HySessionSink) Dropped() int64 {
+	return atomic.LoadInt64(&hy.dropped)
+}
+
+// Kick wakes up the player loop, which ends its connection, and closes the connection of the peer as well
+func (hy *HySessionSink) Kick() {
+	hy.Close()
+	if peer := hy.Peer(); peer != nil && peer.Kick != nil {
+		peer.Kick()
+	}
+}
+
+func (hy *HySessionSink) SinkType() constdef.SinkType {
+	return hy.sinkType
+}
+
+// Close detaches the sink from its source and wakes up a blocked Pull
+func (hy *HySessionSink) Close() {
+	hy.once.Do(func() {
+		if hy.source != nil {
+			hy.source.RemoveSink(hy)
+		}
+		hy.cache.Close()
+		if hy.onClose != nil {
+			hy.onClose()
+		}
+	})
 }
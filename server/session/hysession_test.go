@@ -0,0 +1,99 @@
+package session
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/codec"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSourceVideoInfo(t *testing.T) {
+	ctx := context.Background()
+	source := NewSourceSession(ctx, nil)
+	if source.VideoInfo() != nil {
+		t.Fatalf("expect no video info before the sequence header")
+	}
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	source.Push(ctx, &proto.BasePacket{
+		MediaType: protocol.MediaDataTypeVideo,
+		Codec:     constdef.CodecH264,
+		SeqHeader: true,
+		Payload:   codec.BuildAVCDecoderConfig(sps, pps),
+	})
+	info := source.VideoInfo()
+	if info == nil || info.Width != 1280 || info.Height != 720 || info.Profile != 66 {
+		t.Fatalf("unexpected video info %+v", info)
+	}
+	if len(source.SeqHeaders()) != 1 {
+		t.Fatalf("expect the sequence header cached")
+	}
+}
+
+func TestSlowSinkDrops(t *testing.T) {
+	ctx := context.Background()
+	source := NewSourceSession(ctx, nil)
+	sink := source.AddSink(&proto.SinkArg{Ctx: ctx, Protocol: constdef.SinkTypeRtmp})
+	for i := 0; i < constdef.DefaultCacheSize+10; i++ {
+		source.Push(ctx, &proto.BasePacket{MediaType: protocol.MediaDataTypeAudio, DTS: int64(i), Payload: []byte{1}})
+	}
+	if sink.Dropped() != 10 {
+		t.Fatalf("expect 10 drops, got %d", sink.Dropped())
+	}
+	if s := source.Stats(); s.Dropped != 10 || s.GopCache == 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestAddSinkDuringPush(t *testing.T) {
+	ctx := context.Background()
+	//audio only with caches for the whole stream, each sink sees it from the start
+	const packets = 20000
+	SetCacheSizes(packets, packets)
+	defer SetCacheSizes(constdef.DefaultCacheSize, constdef.DefaultGopCacheSize)
+	for round := 0; round < 5; round++ {
+		source := NewSourceSession(ctx, nil)
+		var mu sync.Mutex
+		var sinks []SinkSessionI
+		//sinks join while the packets are pushed
+		var wg sync.WaitGroup
+		for g := 0; g < 2; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 25; i++ {
+					sink := source.AddSink(&proto.SinkArg{Ctx: ctx, Protocol: constdef.SinkTypeRtmp})
+					mu.Lock()
+					sinks = append(sinks, sink)
+					mu.Unlock()
+					time.Sleep(20 * time.Microsecond)
+				}
+			}()
+		}
+		for i := 0; i < packets; i++ {
+			source.Push(ctx, &proto.BasePacket{MediaType: protocol.MediaDataTypeAudio, DTS: int64(i), Payload: []byte{1}})
+		}
+		wg.Wait()
+		source.Close()
+		for n, sink := range sinks {
+			next := int64(0)
+			for {
+				pkt, ok := sink.Pull(ctx)
+				if !ok {
+					break
+				}
+				if dts := pkt.Base().DTS; dts != next {
+					t.Fatalf("round %d sink %d: expect dts %d, got %d", round, n, next, dts)
+				}
+				next++
+			}
+			if next != packets {
+				t.Fatalf("round %d sink %d: expect %d packets, got %d", round, n, packets, next)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package session
+
+import (
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"sync/atomic"
+	"time"
+)
+
+// statsWindow is the longest rate window in seconds, one bucket per second
+const statsWindow = 10
+
+// TrackStats is a snapshot of one track of a source
+type TrackStats struct {
+	Codec     constdef.CodecID `json:"codec"`
+	Bytes     int64            `json:"bytes"`
+	Frames    int64            `json:"frames"`
+	KeyFrames int64            `json:"key_frames"`
+	//bits per second of the last complete second and of the last statsWindow seconds
+	Bitrate1s  int64   `json:"bitrate_1s"`
+	Bitrate10s int64   `json:"bitrate_10s"`
+	FrameRate  float64 `json:"frame_rate"`
+	//frames and milliseconds between the last two keyframes
+	GopFrames   int64     `json:"gop_frames"`
+	GopDuration int64     `json:"gop_duration"`
+	LastDTS     int64     `json:"last_dts"`
+	LastPacket  time.Time `json:"last_packet"`
+}
+
+// SourceStats is a snapshot of a source, reading it never blocks the publisher
+type SourceStats struct {
+	StartTime time.Time  `json:"start_time"`
+	Video     TrackStats `json:"video"`
+	Audio     TrackStats `json:"audio"`
+	//dts of the latest video packet minus the one of the latest audio packet
+	AVSkew     int64          `json:"av_skew"`
+	Timestamps TimestampStats `json:"timestamps"`
+	//BytesOut is the payload pulled by every sink, the ones gone included
+	BytesOut int64 `json:"bytes_out"`
+	//Dropped counts the packets sinks were too slow to read
+	Dropped int64 `json:"dropped"`
+	//GopCache is the number of packets a joining sink starts with
+	GopCache int `json:"gop_cache"`
+}
+
+type rateBucket struct {
+	sec    int64
+	bytes  int64
+	frames int64
+}
+
+// trackCounter is updated with atomics only, readers may see a bucket in the middle of being reset
+type trackCounter struct {
+	codec        int64
+	bytes        int64
+	frames       int64
+	keyFrames    int64
+	lastKeyFrame int64
+	lastKeyDTS   int64
+	gopFrames    int64
+	gopDuration  int64
+	lastDTS      int64
+	lastPacket   int64
+	startSec     int64
+	//one more bucket than the window, the current second fills it while the window keeps statsWindow full ones
+	buckets [statsWindow + 1]rateBucket
+}
+
+func (c *trackCounter) add(pkt *proto.BasePacket, now time.Time) {
+	size := int64(len(pkt.Payload))
+	sec := now.Unix()
+	atomic.CompareAndSwapInt64(&c.startSec, 0, sec)
+	atomic.StoreInt64(&c.codec, int64(pkt.Codec))
+	atomic.AddInt64(&c.bytes, size)
+	frames := atomic.AddInt64(&c.frames, 1)
+	if pkt.KeyFrame {
+		if atomic.AddInt64(&c.keyFrames, 1) > 1 {
+			atomic.StoreInt64(&c.gopFrames, frames-atomic.LoadInt64(&c.lastKeyFrame))
+			atomic.StoreInt64(&c.gopDuration, pkt.DTS-atomic.LoadInt64(&c.lastKeyDTS))
+		}
+		atomic.StoreInt64(&c.lastKeyFrame, frames)
+		atomic.StoreInt64(&c.lastKeyDTS, pkt.DTS)
+	}
+	atomic.StoreInt64(&c.lastDTS, pkt.DTS)
+	atomic.StoreInt64(&c.lastPacket, now.UnixNano())
+	b := &c.buckets[sec%int64(len(c.buckets))]
+	if atomic.LoadInt64(&b.sec) != sec {
+		atomic.StoreInt64(&b.bytes, 0)
+		atomic.StoreInt64(&b.frames, 0)
+		atomic.StoreInt64(&b.sec, sec)
+	}
+	atomic.AddInt64(&b.bytes, size)
+	atomic.AddInt64(&b.frames, 1)
+}
+
+func (c *trackCounter) snapshot(now time.Time) TrackStats {
+	s := TrackStats{
+		Codec:       constdef.CodecID(atomic.LoadInt64(&c.codec)),
+		Bytes:       atomic.LoadInt64(&c.bytes),
+		Frames:      atomic.LoadInt64(&c.frames),
+		KeyFrames:   atomic.LoadInt64(&c.keyFrames),
+		GopFrames:   atomic.LoadInt64(&c.gopFrames),
+		GopDuration: atomic.LoadInt64(&c.gopDuration),
+		LastDTS:     atomic.LoadInt64(&c.lastDTS),
+	}
+	if last := atomic.LoadInt64(&c.lastPacket); last > 0 {
+		s.LastPacket = time.Unix(0, last)
+	}
+	startSec := atomic.LoadInt64(&c.startSec)
+	if startSec == 0 {
+		return s
+	}
+	//the current second is still filling up, the windows end with the one before it
+	sec := now.Unix()
+	var bytes, frames int64
+	for i := range c.buckets {
+		b := &c.buckets[i]
+		bucketSec := atomic.LoadInt64(&b.sec)
+		if bucketSec >= sec || bucketSec < sec-statsWindow {
+			continue
+		}
+		n := atomic.LoadInt64(&b.bytes)
+		if bucketSec == sec-1 {
+			s.Bitrate1s = n * 8
+		}
+		bytes += n
+		frames += atomic.LoadInt64(&b.frames)
+	}
+	span := sec - startSec
+	if span > statsWindow {
+		span = statsWindow
+	}
+	if span > 0 {
+		s.Bitrate10s = bytes * 8 / span
+		s.FrameRate = float64(frames) / float64(span)
+	}
+	return s
+}
+
+// sourceCounter keeps the counters of both tracks
+type sourceCounter struct {
+	start    time.Time
+	video    trackCounter
+	audio    trackCounter
+	bytesOut int64
+	dropped  int64
+}
+
+func newSourceCounter() *sourceCounter {
+	return &sourceCounter{start: time.Now()}
+}
+
+func (c *sourceCounter) add(pkt *proto.BasePacket) {
+	if pkt.SeqHeader {
+		return
+	}
+	if pkt.IsVideo() {
+		c.video.add(pkt, time.Now())
+	} else if pkt.IsAudio() {
+		c.audio.add(pkt, time.Now())
+	}
+}
+
+func (c *sourceCounter) addBytesOut(n int64) {
+	atomic.AddInt64(&c.bytesOut, n)
+}
+
+func (c *sourceCounter) addDropped() {
+	atomic.AddInt64(&c.dropped, 1)
+}
+
+func (c *sourceCounter) snapshot() SourceStats {
+	now := time.Now()
+	s := SourceStats{
+		StartTime: c.start,
+		Video:     c.video.snapshot(now),
+		Audio:     c.audio.snapshot(now),
+		BytesOut:  atomic.LoadInt64(&c.bytesOut),
+		Dropped:   atomic.LoadInt64(&c.dropped),
+	}
+	if s.Video.Frames > 0 && s.Audio.Frames > 0 {
+		s.AVSkew = s.Video.LastDTS - s.Audio.LastDTS
+	}
+	return s
+}
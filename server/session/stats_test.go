@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrackStats(t *testing.T) {
+	c := &trackCounter{}
+	start := time.Unix(1000, 0)
+	//3 seconds of 25fps with 1000 byte frames and a keyframe every 50 frames
+	for i := 0; i < 75; i++ {
+		c.add(&proto.BasePacket{
+			MediaType: protocol.MediaDataTypeVideo,
+			Codec:     constdef.CodecH264,
+			DTS:       int64(i * 40),
+			KeyFrame:  i%50 == 0,
+			Payload:   make([]byte, 1000),
+		}, start.Add(time.Duration(i)*40*time.Millisecond))
+	}
+	s := c.snapshot(start.Add(3 * time.Second))
+	if s.Codec != constdef.CodecH264 || s.Frames != 75 || s.Bytes != 75000 || s.KeyFrames != 2 {
+		t.Fatalf("unexpected totals %+v", s)
+	}
+	if s.Bitrate1s != 200000 || s.Bitrate10s != 200000 || s.FrameRate != 25 {
+		t.Fatalf("unexpected rates %+v", s)
+	}
+	if s.GopFrames != 50 || s.GopDuration != 2000 || s.LastDTS != 74*40 {
+		t.Fatalf("unexpected gop %+v", s)
+	}
+	//silence empties the windows
+	s = c.snapshot(start.Add(20 * time.Second))
+	if s.Bitrate1s != 0 || s.Bitrate10s != 0 || s.FrameRate != 0 {
+		t.Fatalf("expect idle rates, got %+v", s)
+	}
+}
+
+func TestSteadyTrackStats(t *testing.T) {
+	c := &trackCounter{}
+	start := time.Unix(1000, 0)
+	//20.5 seconds of 10fps with 1000 byte frames, 80kbit/s
+	for i := 0; i < 205; i++ {
+		c.add(&proto.BasePacket{
+			MediaType: protocol.MediaDataTypeAudio,
+			Codec:     constdef.CodecAAC,
+			DTS:       int64(i * 100),
+			Payload:   make([]byte, 1000),
+		}, start.Add(time.Duration(i)*100*time.Millisecond))
+		//the windows hold steady whenever they are read, the first packet of a second included
+		if now := start.Add(time.Duration(i) * 100 * time.Millisecond); now.Sub(start) > statsWindow*time.Second {
+			if s := c.snapshot(now); s.Bitrate1s != 80000 || s.Bitrate10s != 80000 || s.FrameRate != 10 {
+				t.Fatalf("unexpected rates at %v: %+v", now.Sub(start), s)
+			}
+		}
+	}
+}
+
+func TestSourceStats(t *testing.T) {
+	ctx := context.Background()
+	source := NewSourceSession(ctx, nil)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_ = source.Stats()
+		}
+	}()
+	for i := int64(0); i < 100; i++ {
+		source.Push(ctx, &proto.BasePacket{MediaType: protocol.MediaDataTypeVideo, DTS: i * 40, Payload: []byte{1}})
+		source.Push(ctx, &proto.BasePacket{MediaType: protocol.MediaDataTypeAudio, DTS: i*40 - 100, Payload: []byte{1}})
+	}
+	wg.Wait()
+	s := source.Stats()
+	if s.Video.Frames != 100 || s.Audio.Frames != 100 {
+		t.Fatalf("unexpected frames %+v", s)
+	}
+	//audio is clamped to zero at first, then trails the video by 100ms
+	if s.AVSkew != 100 {
+		t.Fatalf("unexpected skew %d", s.AVSkew)
+	}
+}
@@ -0,0 +1,173 @@
+package session
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/proto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//a dts moving more than this between two packets of a track is a discontinuity, not jitter
+	DefaultTsJumpThreshold int64 = 3000
+	//audio and video of a source are kept this close to each other
+	DefaultTsMaxInterleave int64 = 2000
+
+	trackVideo = 0
+	trackAudio = 1
+)
+
+// TimestampStats counts the corrections of a source, every counter is one packet
+type TimestampStats struct {
+	//dts going back a little, clamped to keep the track monotonic
+	Backwards int64 `json:"backwards"`
+	//dts jumping beyond the threshold, the track continues from where it was
+	Jumps int64 `json:"jumps"`
+	//a track drifting too far from the other one, pulled back next to it
+	Interleave int64 `json:"interleave"`
+}
+
+type trackTimestamp struct {
+	started  bool
+	offset   int64
+	lastIn   int64
+	lastOut  int64
+	duration int64
+	lastSeen time.Time
+}
+
+// timestampSanitizer rebases the dts of a source to start at zero and keeps every track monotonic and
+// continuous, encoders reconnecting or wrapping their clock would otherwise break the muxers of every sink
+type timestampSanitizer struct {
+	jumpThreshold int64
+	maxInterleave int64
+
+	mu     sync.Mutex
+	based  bool
+	base   int64
+	tracks [2]trackTimestamp
+	stats  TimestampStats
+}
+
+func newTimestampSanitizer(jumpThreshold int64, maxInterleave int64) *timestampSanitizer {
+	s := &timestampSanitizer{}
+	s.jumpThreshold = jumpThreshold
+	s.maxInterleave = maxInterleave
+	return s
+}
+
+func (s *timestampSanitizer) sanitize(ctx context.Context, pkt *proto.BasePacket) {
+	index := trackVideo
+	if pkt.IsAudio() {
+		index = trackAudio
+	} else if !pkt.IsVideo() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	track := &s.tracks[index]
+	cts := pkt.PTS - pkt.DTS
+	if cts < 0 {
+		cts = 0
+	}
+	if pkt.SeqHeader {
+		//headers do not advance the track, they take the time of the packet before them
+		pkt.DTS = track.lastOut
+		pkt.PTS = track.lastOut
+		return
+	}
+	if !s.based {
+		s.based = true
+		s.base = pkt.DTS
+		s.tracks[trackVideo].offset = -s.base
+		s.tracks[trackAudio].offset = -s.base
+		log.Infof(ctx, "rebase timestamps from %d to zero", s.base)
+	}
+	now := time.Now()
+	in := pkt.DTS
+	out := in + track.offset
+	switch {
+	case track.started && (in-track.lastIn > s.jumpThreshold || in-track.lastIn < -s.jumpThreshold):
+		atomic.AddInt64(&s.stats.Jumps, 1)
+		out = track.lastOut + track.duration
+		other := &s.tracks[1-index]
+		if aligned := in + other.offset; other.started && aligned >= track.lastOut && aligned-track.lastOut <= s.jumpThreshold {
+			//the other track went through the same discontinuity already, follow it to stay in sync
+			out = aligned
+		}
+		track.offset = out - in
+		log.Warnf(ctx, "track %d dts jumped %dms, continue at %d", index, in-track.lastIn, out)
+	case out < track.lastOut:
+		//the offset is kept, a single late packet must not shift the packets after it
+		atomic.AddInt64(&s.stats.Backwards, 1)
+		log.Warnf(ctx, "track %d dts went back %dms, clamped to %d", index, track.lastOut-out, track.lastOut)
+		out = track.lastOut
+	}
+	other := &s.tracks[1-index]
+	if other.started && now.Sub(other.lastSeen) < time.Duration(s.maxInterleave)*time.Millisecond {
+		if drift := out - other.lastOut; drift > s.maxInterleave || drift < -s.maxInterleave {
+			atomic.AddInt64(&s.stats.Interleave, 1)
+			log.Warnf(ctx, "track %d is %dms away from the other track, moved to %d", index, drift, other.lastOut)
+			out = other.lastOut
+			if out < track.lastOut {
+				out = track.lastOut
+			}
+			track.offset = out - in
+		}
+	}
+	if track.started && out > track.lastOut {
+		track.duration = out - track.lastOut
+	}
+	if track.duration <= 0 {
+		track.duration = 1
+	}
+	track.started = true
+	track.lastIn = in
+	track.lastOut = out
+	track.lastSeen = now
+	pkt.DTS = out
+	pkt.PTS = out + cts
+}
+
+// snapshot does not take the lock of the publish path
+func (s *timestampSanitizer) snapshot() TimestampStats {
+	return TimestampStats{
+		Backwards:  atomic.LoadInt64(&s.stats.Backwards),
+		Jumps:      atomic.LoadInt64(&s.stats.Jumps),
+		Interleave: atomic.LoadInt64(&s.stats.Interleave),
+	}
+}
+
+// sinkRebase shifts the packets of a sink so a late joiner starts near zero,
+// the packets are shared with other sinks so they are copied before being changed
+type sinkRebase struct {
+	based bool
+	base  int64
+}
+
+func (r *sinkRebase) rebase(pkt proto.PacketI) proto.PacketI {
+	b := pkt.Base()
+	if !r.based {
+		if b.SeqHeader {
+			cp := *b
+			cp.DTS, cp.PTS = 0, 0
+			return &cp
+		}
+		r.based = true
+		r.base = b.DTS
+	}
+	if r.base == 0 {
+		return pkt
+	}
+	cp := *b
+	cp.DTS -= r.base
+	cp.PTS -= r.base
+	if cp.DTS < 0 {
+		//audio of the gop cache may start a little before the keyframe
+		cp.PTS -= cp.DTS
+		cp.DTS = 0
+	}
+	return &cp
+}
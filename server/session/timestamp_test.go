@@ -0,0 +1,91 @@
+package session
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/protocol"
+	"testing"
+)
+
+func tsPacket(mediaType protocol.MediaDataType, dts int64, cts int64) *proto.BasePacket {
+	return &proto.BasePacket{MediaType: mediaType, DTS: dts, PTS: dts + cts}
+}
+
+func TestTimestampSanitizer(t *testing.T) {
+	ctx := context.Background()
+	s := newTimestampSanitizer(DefaultTsJumpThreshold, DefaultTsMaxInterleave)
+	var video, audio protocol.MediaDataType = protocol.MediaDataTypeVideo, protocol.MediaDataTypeAudio
+	tests := []struct {
+		pkt *proto.BasePacket
+		dts int64
+		pts int64
+	}{
+		//rebased to zero, the composition offset is kept
+		{tsPacket(video, 90000, 80), 0, 80},
+		{tsPacket(audio, 90010, 0), 10, 10},
+		{tsPacket(video, 90040, 0), 40, 40},
+		//back a little, clamped without moving the packets after it
+		{tsPacket(video, 90020, 0), 40, 40},
+		{tsPacket(video, 90080, 0), 80, 80},
+		//encoder reconnect, continues one frame later
+		{tsPacket(video, 5000, 0), 120, 120},
+		{tsPacket(video, 5040, 0), 160, 160},
+		//audio jumps as well and stays next to the video
+		{tsPacket(audio, 5030, 0), 150, 150},
+		{tsPacket(audio, 5053, 0), 173, 173},
+	}
+	for i, test := range tests {
+		s.sanitize(ctx, test.pkt)
+		if test.pkt.DTS != test.dts || test.pkt.PTS != test.pts {
+			t.Fatalf("packet %d: expect %d/%d, got %d/%d", i, test.dts, test.pts, test.pkt.DTS, test.pkt.PTS)
+		}
+	}
+	header := &proto.BasePacket{MediaType: video, SeqHeader: true, DTS: 123456}
+	s.sanitize(ctx, header)
+	if header.DTS != 160 {
+		t.Fatalf("expect the header at the track time, got %d", header.DTS)
+	}
+	stats := s.snapshot()
+	if stats.Backwards != 1 || stats.Jumps != 2 || stats.Interleave != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	//video running away from the audio is pulled back next to it
+	drift := tsPacket(video, 5040+2500, 0)
+	s.sanitize(ctx, drift)
+	if drift.DTS != 173 || s.snapshot().Interleave != 1 {
+		t.Fatalf("expect interleave correction, got %d %+v", drift.DTS, s.snapshot())
+	}
+}
+
+func TestSinkRebase(t *testing.T) {
+	ctx := context.Background()
+	source := NewSourceSession(ctx, nil)
+	var first *proto.BasePacket
+	for i := int64(0); i < 5; i++ {
+		pkt := tsPacket(protocol.MediaDataTypeVideo, 1000+i*40, 0)
+		pkt.KeyFrame = i == 3
+		source.Push(ctx, pkt)
+		if first == nil {
+			first = pkt
+		}
+	}
+	sink := source.AddSink(&proto.SinkArg{Ctx: ctx})
+	defer sink.Close()
+	for _, expect := range []int64{0, 40} {
+		pkt, ok := sink.Pull(ctx)
+		if !ok {
+			t.Fatalf("sink closed")
+		}
+		if pkt.Base().DTS != expect {
+			t.Fatalf("expect dts %d, got %d", expect, pkt.Base().DTS)
+		}
+	}
+	//the source keeps its own timeline
+	if headers := source.SeqHeaders(); len(headers) != 0 {
+		t.Fatalf("unexpected headers")
+	}
+	if first.DTS != 0 {
+		t.Fatalf("expect the source rebased to zero, got %d", first.DTS)
+	}
+}
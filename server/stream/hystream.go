@@ -2,27 +2,29 @@ package stream
 
 import (
 	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/codec"
 	"github.com/Opafanls/hylan/server/session"
 	"net/url"
 )
 
 type HyStreamI interface {
 	Base() base.StreamBaseI
-	Source() session.HySessionI
+	Source() session.SourceSessionI
+	Stats() session.SourceStats
 }
 
 // HyStream biz stream
 type HyStream struct {
 	StreamBase    base.StreamBaseI
-	SourceSession session.HySessionI
+	SourceSession session.SourceSessionI
 }
 
-func NewHyStream0(uri *url.URL, sourceSession session.HySessionI) *HyStream {
+func NewHyStream0(uri *url.URL, sourceSession session.SourceSessionI) *HyStream {
 	baseData := base.NewBase0(uri)
 	return NewHyStream(baseData, sourceSession)
 }
 
-func NewHyStream(streamBase base.StreamBaseI, sourceSession session.HySessionI) *HyStream {
+func NewHyStream(streamBase base.StreamBaseI, sourceSession session.SourceSessionI) *HyStream {
 	hyStream := &HyStream{}
 	hyStream.StreamBase = streamBase
 	hyStream.SourceSession = sourceSession
@@ -33,6 +35,21 @@ func (stream *HyStream) Base() base.StreamBaseI {
 	return stream.StreamBase
 }
 
-func (stream *HyStream) Source() session.HySessionI {
+func (stream *HyStream) Source() session.SourceSessionI {
 	return stream.SourceSession
 }
+
+// VideoInfo returns the parsed sps of the published video, nil for audio only streams
+func (stream *HyStream) VideoInfo() *codec.VideoInfo {
+	return stream.SourceSession.VideoInfo()
+}
+
+// AudioInfo returns the parsed audio config, nil for video only streams
+func (stream *HyStream) AudioInfo() *codec.AudioInfo {
+	return stream.SourceSession.AudioInfo()
+}
+
+// Stats is safe to call at any rate, it never blocks the publisher
+func (stream *HyStream) Stats() session.SourceStats {
+	return stream.SourceSession.Stats()
+}
@@ -1,12 +1,21 @@
 package stream
 
-import "sync"
+import (
+	"github.com/Opafanls/hylan/server/constdef"
+	"sync"
+)
 
 var DefaultHyStreamManager *HyStreamManager
 
 type HyStreamManager struct {
 	rwLock    *sync.RWMutex
 	streamMap map[string]*HyStream
+	onAdd     []*streamHook
+	onRemove  []*streamHook
+}
+
+type streamHook struct {
+	fn func(hyStream *HyStream)
 }
 
 func InitHyStreamManager() {
@@ -20,15 +29,97 @@ func NewHyStreamManager() *HyStreamManager {
 	return HyStreamManager
 }
 
-func (streamManager *HyStreamManager) AddStream(hyStream *HyStream) {
+// AddStream registers a published stream, a stream id can only have one publisher
+func (streamManager *HyStreamManager) AddStream(hyStream *HyStream) error {
 	id := hyStream.StreamBase.ID()
 	streamManager.rwLock.Lock()
+	if _, exist := streamManager.streamMap[id]; exist {
+		streamManager.rwLock.Unlock()
+		return constdef.NewHyError(id, constdef.ErrStreamExists)
+	}
 	streamManager.streamMap[id] = hyStream
+	onAdd := streamManager.onAdd
+	streamManager.rwLock.Unlock()
+	for _, hook := range onAdd {
+		hook.fn(hyStream)
+	}
+	return nil
+}
+
+// OnAdd calls fn with every stream added from now on until the returned cancel is called,
+// fn runs on the publisher goroutine and must not block
+func (streamManager *HyStreamManager) OnAdd(fn func(hyStream *HyStream)) (cancel func()) {
+	return streamManager.hook(&streamManager.onAdd, fn)
+}
+
+// OnRemove calls fn with every stream removed from now on until the returned cancel is called,
+// fn must not block either
+func (streamManager *HyStreamManager) OnRemove(fn func(hyStream *HyStream)) (cancel func()) {
+	return streamManager.hook(&streamManager.onRemove, fn)
+}
+
+func (streamManager *HyStreamManager) hook(hooks *[]*streamHook, fn func(hyStream *HyStream)) (cancel func()) {
+	hook := &streamHook{fn: fn}
+	streamManager.rwLock.Lock()
+	//copy on write, the hooks are called without the lock
+	*hooks = append((*hooks)[:len(*hooks):len(*hooks)], hook)
 	streamManager.rwLock.Unlock()
+	return func() {
+		streamManager.rwLock.Lock()
+		defer streamManager.rwLock.Unlock()
+		kept := make([]*streamHook, 0, len(*hooks))
+		for _, h := range *hooks {
+			if h != hook {
+				kept = append(kept, h)
+			}
+		}
+		*hooks = kept
+	}
 }
 
 func (streamManager *HyStreamManager) RemoveStream(streamBaseID string) {
 	streamManager.rwLock.Lock()
+	hyStream, exist := streamManager.streamMap[streamBaseID]
 	delete(streamManager.streamMap, streamBaseID)
+	onRemove := streamManager.onRemove
 	streamManager.rwLock.Unlock()
+	if exist {
+		for _, hook := range onRemove {
+			hook.fn(hyStream)
+		}
+	}
+}
+
+// RemoveStreamIfMatch only removes the entry when it still belongs to hyStream
+func (streamManager *HyStreamManager) RemoveStreamIfMatch(hyStream *HyStream) {
+	id := hyStream.StreamBase.ID()
+	streamManager.rwLock.Lock()
+	exist := streamManager.streamMap[id] == hyStream
+	if exist {
+		delete(streamManager.streamMap, id)
+	}
+	onRemove := streamManager.onRemove
+	streamManager.rwLock.Unlock()
+	if exist {
+		for _, hook := range onRemove {
+			hook.fn(hyStream)
+		}
+	}
+}
+
+func (streamManager *HyStreamManager) GetStream(streamBaseID string) (*HyStream, bool) {
+	streamManager.rwLock.RLock()
+	hyStream, exist := streamManager.streamMap[streamBaseID]
+	streamManager.rwLock.RUnlock()
+	return hyStream, exist
+}
+
+func (streamManager *HyStreamManager) Streams() []*HyStream {
+	streamManager.rwLock.RLock()
+	streams := make([]*HyStream, 0, len(streamManager.streamMap))
+	for _, hyStream := range streamManager.streamMap {
+		streams = append(streams, hyStream)
+	}
+	streamManager.rwLock.RUnlock()
+	return streams
 }
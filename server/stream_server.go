@@ -1,57 +1,836 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"github.com/Opafanls/hylan/server/admin"
+	"github.com/Opafanls/hylan/server/auth"
+	"github.com/Opafanls/hylan/server/config"
 	"github.com/Opafanls/hylan/server/core/hynet"
+	"github.com/Opafanls/hylan/server/forward"
+	"github.com/Opafanls/hylan/server/hook"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/Opafanls/hylan/server/protocol/httpts"
+	"github.com/Opafanls/hylan/server/protocol/mpegts"
 	"github.com/Opafanls/hylan/server/protocol/rtmp"
+	"github.com/Opafanls/hylan/server/protocol/rtsp"
+	"github.com/Opafanls/hylan/server/protocol/srt"
+	"github.com/Opafanls/hylan/server/protocol/webrtc"
+	"github.com/Opafanls/hylan/server/record"
+	"github.com/Opafanls/hylan/server/session"
 	"github.com/Opafanls/hylan/server/stream"
 	"github.com/Opafanls/hylan/server/task"
+	"github.com/Opafanls/hylan/server/vhost"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	//how often the config file is checked for changes
+	reloadInterval = 2 * time.Second
+	//requests to an admin api being replaced get this long to finish
+	apiShutdownTimeout = 5 * time.Second
+	//how often the retired parts are checked for connections left
+	pruneInterval = 10 * time.Second
 )
 
 type HylanServer struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
 	stopChan chan struct{}
+	stopOnce sync.Once
+	//closed by a second stop signal, the drain is cut short
+	forceChan chan struct{}
+	forceOnce sync.Once
+	center    *config.Center
+
+	//the running parts, a reload changes them
+	mu       sync.Mutex
+	recorder *record.Recorder
+	//replaced on reload, they stopped accepting and are closed once drained or on shutdown
+	retired   []hynet.ListenServer
+	forwarder *forward.Forwarder
+	hooks     *hook.Hooks
+	api       *admin.Server
+	listeners []*runningListener
+	pullers   map[config.RtspPullConfig]*rtsp.Puller
+	callers   map[config.SrtCallConfig]*srt.Caller
 }
 
-func NewHylanServer() *HylanServer {
+type runningListener struct {
+	conf   config.ListenerConfig
+	server hynet.ListenServer
+}
+
+// NewHylanServer runs the config of center, which has to be validated already, config.Default when nil
+func NewHylanServer(center *config.Center) *HylanServer {
 	hylanServer := &HylanServer{}
 	hylanServer.stopChan = make(chan struct{})
+	hylanServer.forceChan = make(chan struct{})
+	if center == nil {
+		center = config.NewCenter("", config.Default())
+	}
+	hylanServer.center = center
+	hylanServer.pullers = make(map[config.RtspPullConfig]*rtsp.Puller)
+	hylanServer.callers = make(map[config.SrtCallConfig]*srt.Caller)
 	return hylanServer
 }
 
+// Start runs the server until Stop, SIGINT or SIGTERM, it returns once the server is shut down
 func (hy *HylanServer) Start() {
 	hy.initBase()
 	hy.initServer()
+	hy.initReload()
+	hy.initSignals()
 	hy.wait()
+	hy.shutdown()
+}
+
+// Stop starts the shutdown, a second call cuts the drain short
+func (hy *HylanServer) Stop() {
+	stopped := false
+	hy.stopOnce.Do(func() {
+		stopped = true
+		close(hy.stopChan)
+	})
+	if !stopped {
+		hy.forceOnce.Do(func() {
+			close(hy.forceChan)
+		})
+	}
 }
 
 func (hy *HylanServer) initBase() {
+	conf := hy.center.Current()
+	if err := log.Init(&log.Config{Level: conf.Log.Level, Output: conf.Log.Output}); err != nil {
+		panic(err)
+	}
+	hy.ctx, hy.cancel = context.WithCancel(log.GetCtxWithLogID(context.Background(), "HYLAN_SERVER"))
+	session.SetCacheSizes(conf.Cache.Packets, conf.Cache.GopPackets)
+	hynet.DefaultConnChanSize = conf.Cache.ConnQueue
+	hynet.SetLimits(hynet.Limits{MaxConns: conf.Connections.Max, MaxConnsPerIP: conf.Connections.MaxPerIP})
 	stream.InitHyStreamManager()
-	task.InitTaskSystem()
+	pools := make([]task.PoolConfig, 0, len(conf.TaskPools))
+	for _, p := range conf.TaskPools {
+		pools = append(pools, task.PoolConfig{Name: p.Name, Workers: p.Workers, QueueSize: p.Queue})
+	}
+	task.InitTaskSystem(pools...)
 }
 
 func (hy *HylanServer) initServer() {
-	hy.listeners()
+	conf := hy.center.Current()
+	hy.mu.Lock()
+	defer hy.mu.Unlock()
+	vhost.SetTable(newVhostTable(conf.Vhosts))
+	auth.SetVerifier(newVerifier(conf.Auth))
+	hy.hooks = hook.NewHooks(newHooksConfig(conf.Hooks))
+	if err := start(hy.hooks); err != nil {
+		panic(err)
+	}
+	//recorder and forwarder are started first so they see the first publish
+	if err := hy.startRecorder(conf.Record, conf.Vhosts); err != nil {
+		panic(err)
+	}
+	hy.forwarder = forward.NewForwarder()
+	if err := start(hy.forwarder); err != nil {
+		panic(err)
+	}
+	for _, l := range conf.Listeners {
+		if err := hy.startListener(l, conf.Timeouts); err != nil {
+			panic(err)
+		}
+	}
+	if conf.API.Enabled {
+		if err := hy.startAPI(conf.API); err != nil {
+			panic(err)
+		}
+	}
+	for _, c := range conf.RtspPulls {
+		if err := hy.startPuller(c); err != nil {
+			panic(err)
+		}
+	}
+	for _, c := range conf.SrtCalls {
+		if err := hy.startCaller(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// initReload applies the config again when the file changes, on SIGHUP and on POST /api/v1/reload
+func (hy *HylanServer) initReload() {
+	hy.center.OnLog(hy.reloadLog)
+	hy.center.OnCache(hy.reloadCache)
+	hy.center.OnTimeouts(hy.reloadTimeouts)
+	hy.center.OnConnections(hy.reloadConnections)
+	hy.center.OnRecord(hy.reloadRecord)
+	hy.center.OnAPI(hy.reloadAPI)
+	hy.center.OnAuth(hy.reloadAuth)
+	hy.center.OnHooks(hy.reloadHooks)
+	hy.center.OnListeners(hy.reloadListeners)
+	hy.center.OnRtspPulls(hy.reloadRtspPulls)
+	hy.center.OnSrtCalls(hy.reloadSrtCalls)
+	hy.center.OnVhosts(hy.reloadVhosts)
+	task.SubmitTask0(hy.ctx, func() {
+		hy.center.Watch(hy.ctx, reloadInterval)
+	})
+	task.Every(hy.ctx, pruneInterval, hy.pruneRetired)
 }
 
-func (hy *HylanServer) listeners() {
-	listeners := []hynet.ListenServer{
-		rtmp.NewServer(&hynet.TcpListenConfig{
-			Addr: "",
-			Port: 1935,
-		}),
+// initSignals reloads on SIGHUP and stops on SIGINT or SIGTERM
+func (hy *HylanServer) initSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	task.SubmitTask0(hy.ctx, func() {
+		defer signal.Stop(signals)
+		for {
+			var sig os.Signal
+			select {
+			case <-hy.ctx.Done():
+				return
+			case sig = <-signals:
+			}
+			if sig != syscall.SIGHUP {
+				log.Infof(hy.ctx, "%s, shutting down", sig)
+				hy.Stop()
+				continue
+			}
+			changed, err := hy.center.Reload()
+			if err != nil {
+				log.Errorf(hy.ctx, "reload on SIGHUP, keep the running config: %v", err)
+				continue
+			}
+			log.Infof(hy.ctx, "reloaded on SIGHUP, changed %v", changed)
+		}
+	})
+}
+
+// lockRunning takes the lock unless the server is shutting down, a reload can't start anything then
+func (hy *HylanServer) lockRunning() bool {
+	hy.mu.Lock()
+	if hy.ctx.Err() != nil {
+		hy.mu.Unlock()
+		return false
 	}
+	return true
+}
 
-	for _, listener := range listeners {
-		err := listener.Init()
-		if err != nil {
-			panic(err)
+func (hy *HylanServer) reloadLog(_, conf config.LogConfig) {
+	if err := log.Init(&log.Config{Level: conf.Level, Output: conf.Output}); err != nil {
+		log.Errorf(hy.ctx, "apply log config: %v", err)
+	}
+}
+
+// reloadCache applies to the sessions and the listeners started from now on
+func (hy *HylanServer) reloadCache(_, conf config.CacheConfig) {
+	session.SetCacheSizes(conf.Packets, conf.GopPackets)
+	hy.mu.Lock()
+	hynet.DefaultConnChanSize = conf.ConnQueue
+	hy.mu.Unlock()
+}
+
+// reloadTimeouts applies to the connections accepted from now on. The srt and rtsp listeners take
+// them as they run, the rtmp and ts ones are restarted and let the accepted connections go on.
+func (hy *HylanServer) reloadTimeouts(_, conf config.TimeoutConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	var restart []config.ListenerConfig
+	for _, l := range hy.listeners {
+		switch server := l.server.(type) {
+		case *srt.Server:
+			server.SetPeerIdleTimeout(conf.Idle)
+		case *rtsp.Server:
+			server.SetTimeouts(conf.Read, conf.Write)
+		default:
+			switch l.conf.Protocol {
+			case config.ProtocolRtmp, config.ProtocolTs:
+				restart = append(restart, l.conf)
+			}
+		}
+	}
+	for _, l := range restart {
+		hy.stopListener(l)
+		if err := hy.startListener(l, conf); err != nil {
+			log.Errorf(hy.ctx, "restart %s listener %s:%d: %v", l.Protocol, l.Addr, l.Port, err)
+		}
+	}
+}
+
+// pruneRetired closes the retired parts whose connections are all gone
+func (hy *HylanServer) pruneRetired() {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	retired := hy.retired[:0]
+	for _, server := range hy.retired {
+		if drainer, ok := server.(hynet.Drainer); ok && drainer.Drained() {
+			server.Close()
+			continue
+		}
+		retired = append(retired, server)
+	}
+	hy.retired = retired
+}
+
+// reloadRecord leaves the running recordings to finish and records the new publishes with conf
+func (hy *HylanServer) reloadRecord(_, conf config.RecordConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	hy.restartRecorder(conf, hy.center.Current().Vhosts)
+}
+
+// reloadConnections applies to the connections accepted from now on, none is closed to get under a lower limit
+func (hy *HylanServer) reloadConnections(_, conf config.ConnectionsConfig) {
+	hynet.SetLimits(hynet.Limits{MaxConns: conf.Max, MaxConnsPerIP: conf.MaxPerIP})
+}
+
+// reloadAuth applies to the publishers and players from now on, the admitted ones stay
+func (hy *HylanServer) reloadAuth(_, conf config.AuthConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	auth.SetVerifier(newVerifier(conf))
+}
+
+// reloadHooks applies to the events from now on
+func (hy *HylanServer) reloadHooks(_, conf config.HooksConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	hy.hooks.SetConfig(newHooksConfig(conf))
+}
+
+// reloadVhosts applies to the publishers and players from now on, a vhost can start or stop recording
+func (hy *HylanServer) reloadVhosts(_, vhosts []config.VhostConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	vhost.SetTable(newVhostTable(vhosts))
+	hy.restartRecorder(hy.center.Current().Record, vhosts)
+}
+
+func (hy *HylanServer) restartRecorder(conf config.RecordConfig, vhosts []config.VhostConfig) {
+	if hy.recorder != nil {
+		hy.recorder.StopAccept()
+		hy.retired = append(hy.retired, hy.recorder)
+		hy.recorder = nil
+	}
+	if err := hy.startRecorder(conf, vhosts); err != nil {
+		log.Errorf(hy.ctx, "start recorder: %v", err)
+	}
+}
+
+// reloadAPI only swaps the token when the endpoint stays, else the api moves to the new endpoint
+// after the requests being served, the reload request among them, are done
+func (hy *HylanServer) reloadAPI(old, conf config.APIConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	if old.Enabled && conf.Enabled && old.Addr == conf.Addr && old.Port == conf.Port &&
+		reflect.DeepEqual(old.TLS, conf.TLS) {
+		hy.api.SetToken(conf.Token)
+		hy.mu.Unlock()
+		return
+	}
+	api := hy.api
+	hy.api = nil
+	hy.mu.Unlock()
+	task.SubmitTask0(hy.ctx, func() {
+		if api != nil {
+			ctx, cancel := context.WithTimeout(hy.ctx, apiShutdownTimeout)
+			_ = api.Shutdown(ctx)
+			cancel()
+		}
+		if !conf.Enabled || !hy.lockRunning() {
+			return
+		}
+		defer hy.mu.Unlock()
+		if err := hy.startAPI(conf); err != nil {
+			log.Errorf(hy.ctx, "start admin api %s:%d: %v", conf.Addr, conf.Port, err)
+		}
+	})
+}
+
+// reloadListeners stops the removed listeners before starting the added ones, a changed listener
+// keeps its port
+func (hy *HylanServer) reloadListeners(added, removed []config.ListenerConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	for _, l := range removed {
+		hy.stopListener(l)
+	}
+	timeouts := hy.center.Current().Timeouts
+	for _, l := range added {
+		if err := hy.startListener(l, timeouts); err != nil {
+			log.Errorf(hy.ctx, "start %s listener %s:%d: %v", l.Protocol, l.Addr, l.Port, err)
+		}
+	}
+}
+
+func (hy *HylanServer) reloadRtspPulls(added, removed []config.RtspPullConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	for _, c := range removed {
+		if puller, exist := hy.pullers[c]; exist {
+			puller.Close()
+			delete(hy.pullers, c)
+		}
+	}
+	for _, c := range added {
+		if err := hy.startPuller(c); err != nil {
+			log.Errorf(hy.ctx, "start rtsp pull %s: %v", c.URL, err)
+		}
+	}
+}
+
+func (hy *HylanServer) reloadSrtCalls(added, removed []config.SrtCallConfig) {
+	if !hy.lockRunning() {
+		return
+	}
+	defer hy.mu.Unlock()
+	for _, c := range removed {
+		if caller, exist := hy.callers[c]; exist {
+			caller.Close()
+			delete(hy.callers, c)
+		}
+	}
+	for _, c := range added {
+		if err := hy.startCaller(c); err != nil {
+			log.Errorf(hy.ctx, "start srt call %s: %v", c.Addr, err)
+		}
+	}
+}
+
+// startRecorder runs when the record section or a vhost records
+func (hy *HylanServer) startRecorder(conf config.RecordConfig, vhosts []config.VhostConfig) error {
+	vhostRecords := false
+	for _, v := range vhosts {
+		vhostRecords = vhostRecords || (v.Record != nil && v.Record.Enabled)
+	}
+	if !conf.Enabled && !vhostRecords {
+		return nil
+	}
+	recorder := record.NewRecorder(&record.Config{
+		Dir:       conf.Dir,
+		Format:    conf.Format,
+		Apps:      conf.Apps,
+		VhostOnly: !conf.Enabled,
+	})
+	if err := start(recorder); err != nil {
+		return err
+	}
+	hy.recorder = recorder
+	return nil
+}
+
+func (hy *HylanServer) startAPI(conf config.APIConfig) error {
+	tlsConfig, err := conf.TLS.Load()
+	if err != nil {
+		return err
+	}
+	api := admin.NewServer(&admin.ListenConfig{
+		Addr:   conf.Addr,
+		Port:   conf.Port,
+		Token:  conf.Token,
+		TLS:    tlsConfig,
+		Reload: hy.center.Reload,
+	})
+	if err = start(api); err != nil {
+		return err
+	}
+	hy.api = api
+	return nil
+}
+
+func (hy *HylanServer) startListener(l config.ListenerConfig, timeouts config.TimeoutConfig) error {
+	tlsConfig, err := l.TLS.Load()
+	if err != nil {
+		return err
+	}
+	access, err := hy.newAccess(l)
+	if err != nil {
+		return err
+	}
+	proxy, err := hy.newProxy(l)
+	if err != nil {
+		return err
+	}
+	var listener hynet.ListenServer
+	switch l.Protocol {
+	case config.ProtocolRtmp:
+		server := rtmp.NewServer(&hynet.TcpListenConfig{
+			Addr:   l.Addr,
+			Port:   l.Port,
+			TLS:    tlsConfig,
+			Access: access,
+			Proxy:  proxy,
+			Timeouts: hynet.Timeouts{
+				Handshake:    timeouts.Handshake,
+				FirstCommand: timeouts.FirstCommand,
+				PublishIdle:  timeouts.PublishIdle,
+				PlayStall:    timeouts.PlayStall,
+			},
+			WriteBuffer: l.Write.Buffer,
+			Flush:       newFlushPolicy(l.Write),
+		})
+		server.Limits = rtmp.Limits{
+			MaxVideoMessage: uint32(l.RtmpLimits.MaxVideoMessage),
+			MaxAudioMessage: uint32(l.RtmpLimits.MaxAudioMessage),
+			MaxDataMessage:  uint32(l.RtmpLimits.MaxDataMessage),
+			MaxChunkStreams: l.RtmpLimits.MaxChunkStreams,
+			MaxBuffered:     l.RtmpLimits.MaxBuffered,
+			MaxAMFDepth:     l.RtmpLimits.MaxAMFDepth,
+			MaxAMFLength:    l.RtmpLimits.MaxAMFLength,
 		}
-		err = listener.Start()
+		listener = server
+	case config.ProtocolRtsp:
+		listener = rtsp.NewServer(&rtsp.ListenConfig{
+			Addr:         l.Addr,
+			Port:         l.Port,
+			RtpPort:      l.RtpPort,
+			RtcpPort:     l.RtcpPort,
+			TLS:          tlsConfig,
+			ReadTimeout:  timeouts.Read,
+			WriteTimeout: timeouts.Write,
+			Access:       access,
+			Proxy:        proxy,
+		})
+	case config.ProtocolWebrtc:
+		listener = webrtc.NewServer(&webrtc.ListenConfig{
+			Addr:       l.Addr,
+			Port:       l.Port,
+			ICEPortMin: l.ICEPortMin,
+			ICEPortMax: l.ICEPortMax,
+			PublicIPs:  l.PublicIPs,
+			TLS:        tlsConfig,
+			Access:     access,
+			Proxy:      proxy,
+		})
+	case config.ProtocolSrt:
+		listener = srt.NewServer(&srt.ListenConfig{
+			Addr:            l.Addr,
+			Port:            l.Port,
+			Latency:         l.Latency,
+			Passphrase:      l.Passphrase,
+			PbKeyLen:        l.PbKeyLen,
+			PeerIdleTimeout: timeouts.Idle,
+			Access:          access,
+		})
+	case config.ProtocolHttpTs:
+		listener = httpts.NewServer(&httpts.ListenConfig{
+			Addr:   l.Addr,
+			Port:   l.Port,
+			TLS:    tlsConfig,
+			Access: access,
+			Proxy:  proxy,
+		})
+	case config.ProtocolTs:
+		//raw ts ingest, one stream per port or multicast group
+		listener = mpegts.NewIngestServer(&mpegts.IngestConfig{
+			Network:     l.Network,
+			Addr:        l.Addr,
+			Port:        l.Port,
+			Interface:   l.Interface,
+			StreamURL:   l.StreamURL,
+			IdleTimeout: timeouts.Idle,
+			Access:      access,
+			Proxy:       proxy,
+		})
+	default:
+		return nil
+	}
+	if err = start(listener); err != nil {
+		return err
+	}
+	hy.listeners = append(hy.listeners, &runningListener{conf: l, server: listener})
+	return nil
+}
+
+// stopListener lets the accepted connections go on when the listener can stop accepting alone
+func (hy *HylanServer) stopListener(l config.ListenerConfig) {
+	for i, running := range hy.listeners {
+		if !reflect.DeepEqual(running.conf, l) {
+			continue
+		}
+		if acceptor, ok := running.server.(hynet.Acceptor); ok {
+			acceptor.StopAccept()
+			hy.retired = append(hy.retired, running.server)
+		} else {
+			running.server.Close()
+		}
+		hy.listeners = append(hy.listeners[:i], hy.listeners[i+1:]...)
+		log.Infof(hy.ctx, "stopped %s listener %s:%d", l.Protocol, l.Addr, l.Port)
+		return
+	}
+}
+
+func (hy *HylanServer) startPuller(c config.RtspPullConfig) error {
+	puller := rtsp.NewPuller(&rtsp.PullConfig{
+		URL:        c.URL,
+		StreamURL:  c.StreamURL,
+		Transport:  c.Transport,
+		MinBackoff: c.MinBackoff,
+		MaxBackoff: c.MaxBackoff,
+	})
+	if err := start(puller); err != nil {
+		return err
+	}
+	hy.pullers[c] = puller
+	return nil
+}
+
+func (hy *HylanServer) startCaller(c config.SrtCallConfig) error {
+	caller := srt.NewCaller(&srt.CallerConfig{
+		Addr:       c.Addr,
+		StreamID:   c.StreamID,
+		StreamURL:  c.StreamURL,
+		Push:       c.Push,
+		Latency:    c.Latency,
+		Passphrase: c.Passphrase,
+		PbKeyLen:   c.PbKeyLen,
+		MinBackoff: c.MinBackoff,
+		MaxBackoff: c.MaxBackoff,
+	})
+	if err := start(caller); err != nil {
+		return err
+	}
+	hy.callers[c] = caller
+	return nil
+}
+
+// newAccess is the access of every connection of the listener, the server wide limits apply with
+// an empty access section too
+func (hy *HylanServer) newAccess(l config.ListenerConfig) (*hynet.Access, error) {
+	conf := &hynet.AccessConfig{
+		MaxConnsPerIP: l.Access.MaxConnsPerIP,
+		Rate:          l.Access.Rate,
+		Burst:         l.Access.Burst,
+	}
+	for _, list := range []struct {
+		nets  *[]*net.IPNet
+		cidrs []string
+	}{
+		{&conf.Allow, l.Access.Allow},
+		{&conf.Deny, l.Access.Deny},
+		{&conf.PublishAllow, l.Access.PublishAllow},
+		{&conf.PublishDeny, l.Access.PublishDeny},
+		{&conf.PlayAllow, l.Access.PlayAllow},
+		{&conf.PlayDeny, l.Access.PlayDeny},
+	} {
+		nets, err := hynet.ParseCIDRs(list.cidrs)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%s listener access: %w", l.Protocol, err)
+		}
+		*list.nets = nets
+	}
+	return hynet.NewAccess(log.GetCtxWithLogID(hy.ctx, "ACCESS"), l.Protocol, conf), nil
+}
+
+func newFlushPolicy(conf config.WriteConfig) hynet.FlushPolicy {
+	switch conf.Flush {
+	case config.FlushBytes:
+		return hynet.FlushPolicy{Mode: hynet.FlushBytes, Bytes: conf.FlushBytes}
+	case config.FlushInterval:
+		return hynet.FlushPolicy{Mode: hynet.FlushInterval, Interval: conf.FlushInterval}
+	}
+	return hynet.FlushPolicy{Mode: hynet.FlushMessage}
+}
+
+// newProxy is nil when the listener trusts no load balancer
+func (hy *HylanServer) newProxy(l config.ListenerConfig) (*hynet.Proxy, error) {
+	if len(l.ProxyProtocol.Trusted) == 0 {
+		return nil, nil
+	}
+	trusted, err := hynet.ParseCIDRs(l.ProxyProtocol.Trusted)
+	if err != nil {
+		return nil, fmt.Errorf("%s listener proxy_protocol: %w", l.Protocol, err)
+	}
+	conf := &hynet.ProxyConfig{Trusted: trusted, HeaderTimeout: l.ProxyProtocol.HeaderTimeout}
+	return hynet.NewProxy(log.GetCtxWithLogID(hy.ctx, "PROXY"), l.Protocol, conf), nil
+}
+
+func newHooksConfig(conf config.HooksConfig) *hook.Config {
+	return &hook.Config{
+		URLs:          conf.Map(),
+		Timeout:       conf.Timeout,
+		Retries:       conf.Retries,
+		RetryInterval: conf.RetryInterval,
+	}
+}
+
+func newVerifier(conf config.AuthConfig) *auth.Verifier {
+	if len(conf.Apps) == 0 {
+		return nil
+	}
+	apps := make([]*auth.App, 0, len(conf.Apps))
+	for _, a := range conf.Apps {
+		apps = append(apps, &auth.App{Name: a.App, Secret: a.Secret, Publish: a.Publish, Play: a.Play, BindIP: a.BindIP})
+	}
+	return auth.NewVerifier(apps...)
+}
+
+// newVhostTable is nil without vhosts, SetTable installs no resolver then and the stream ids
+// keep naming the host or the vhost param
+func newVhostTable(vhosts []config.VhostConfig) *vhost.Table {
+	if len(vhosts) == 0 {
+		return nil
+	}
+	var def *vhost.Vhost
+	var list []*vhost.Vhost
+	for _, c := range vhosts {
+		v := &vhost.Vhost{
+			Name:    c.Name,
+			Domains: c.Domains,
+			Enabled: c.IsEnabled(),
+			Auth: vhost.Auth{
+				PublishToken: c.Auth.PublishToken,
+				PlayToken:    c.Auth.PlayToken,
+			},
+			Limits: vhost.Limits{
+				MaxStreams:          c.Limits.MaxStreams,
+				MaxPlayers:          c.Limits.MaxPlayers,
+				MaxPlayersPerStream: c.Limits.MaxPlayersPerStream,
+			},
+		}
+		if urls := c.Hooks.Map(); len(urls) > 0 {
+			v.Hooks = urls
+		}
+		if c.Record != nil {
+			v.Record = &vhost.Record{Enabled: c.Record.Enabled, Dir: c.Record.Dir, Apps: c.Record.Apps}
 		}
+		for _, f := range c.Forward {
+			v.Forward = append(v.Forward, vhost.Forward{
+				Addr:       f.Addr,
+				Latency:    f.Latency,
+				Passphrase: f.Passphrase,
+				PbKeyLen:   f.PbKeyLen,
+			})
+		}
+		if c.Default {
+			def = v
+		} else {
+			list = append(list, v)
+		}
+	}
+	return vhost.NewTable(def, list...)
+}
+
+func start(listener hynet.ListenServer) error {
+	if err := listener.Init(); err != nil {
+		return err
 	}
+	return listener.Start()
 }
 
 func (hy *HylanServer) wait() {
 	<-hy.stopChan
 }
+
+// shutdown drains the publishers when configured, then stops accepting, unpublishes every stream so the
+// players get the end of it, finalizes the recordings and waits for the tasks until the timeout
+func (hy *HylanServer) shutdown() {
+	conf := hy.center.Current().Shutdown
+	if conf.DrainTimeout > 0 {
+		hy.drain(conf.DrainTimeout)
+	}
+	hy.mu.Lock()
+	defer hy.mu.Unlock()
+	//no reload from now on
+	hy.cancel()
+
+	if hy.api != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		_ = hy.api.Shutdown(ctx)
+		cancel()
+		hy.api = nil
+	}
+	for _, l := range hy.listeners {
+		if acceptor, ok := l.server.(hynet.Acceptor); ok {
+			acceptor.StopAccept()
+		} else {
+			l.server.Close()
+		}
+	}
+	for _, puller := range hy.pullers {
+		puller.Close()
+	}
+	for _, caller := range hy.callers {
+		caller.Close()
+	}
+	hy.forwarder.Close()
+
+	streams := stream.DefaultHyStreamManager.Streams()
+	for _, hyStream := range streams {
+		stream.DefaultHyStreamManager.RemoveStreamIfMatch(hyStream)
+		hyStream.Source().Kick()
+		hyStream.Source().Close()
+	}
+	log.Infof(hy.ctx, "unpublished %d streams", len(streams))
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout)
+	defer cancel()
+	//the recorders wait for their files to be written
+	closers := hy.retired
+	if hy.recorder != nil {
+		closers = append(closers, hy.recorder)
+	}
+	done := make(chan struct{})
+	task.SubmitTask0(hy.ctx, func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Errorf(hy.ctx, "recordings not finished in %s", conf.Timeout)
+	}
+	for _, l := range hy.listeners {
+		l.server.Close()
+	}
+	//the last events are sent before the task system stops
+	hy.hooks.Close()
+	if err := task.Shutdown(ctx); err != nil {
+		log.Errorf(hy.ctx, "shutdown: %v", err)
+		return
+	}
+	log.Infof(hy.ctx, "shutdown done")
+}
+
+// drain refuses new publishers until the running ones are gone, the timeout or a second stop signal
+func (hy *HylanServer) drain(timeout time.Duration) {
+	vhost.SetDraining(true)
+	log.Infof(hy.ctx, "draining %d streams for at most %s", len(stream.DefaultHyStreamManager.Streams()), timeout)
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for len(stream.DefaultHyStreamManager.Streams()) > 0 {
+		select {
+		case <-deadline:
+			log.Warnf(hy.ctx, "drain timeout, %d streams left", len(stream.DefaultHyStreamManager.Streams()))
+			return
+		case <-hy.forceChan:
+			log.Warnf(hy.ctx, "drain cut short, %d streams left", len(stream.DefaultHyStreamManager.Streams()))
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package task
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/log"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrOverload = errors.New("task pool overloaded")
+
+// PoolConfig sizes a named pool, a pool without workers starts a goroutine per task
+type PoolConfig struct {
+	Name string
+	//tasks running at once, unbounded when zero
+	Workers int
+	//tasks waiting for a worker, a submit past it fails with ErrOverload
+	QueueSize int
+}
+
+// PoolStats are the counters of a pool, Running and Queued are the current tasks
+type PoolStats struct {
+	Name      string
+	Workers   int
+	Running   int64
+	Queued    int64
+	Completed uint64
+	Rejected  uint64
+	Panics    uint64
+}
+
+type job struct {
+	ctx context.Context
+	run Task
+}
+
+// pool runs the tasks of one name, the bounded ones on a fixed set of workers
+type pool struct {
+	config PoolConfig
+	queue  chan *job
+	wg     sync.WaitGroup
+
+	running   int64
+	queued    int64
+	completed uint64
+	rejected  uint64
+	panics    uint64
+}
+
+func newPool(config PoolConfig) *pool {
+	p := &pool{}
+	p.config = config
+	if config.Workers > 0 {
+		p.queue = make(chan *job, config.QueueSize)
+		for i := 0; i < config.Workers; i++ {
+			p.wg.Add(1)
+			go p.work()
+		}
+	}
+	return p
+}
+
+func (p *pool) submit(ctx context.Context, run Task) error {
+	j := &job{ctx: ctx, run: run}
+	if p.queue == nil {
+		atomic.AddInt64(&p.running, 1)
+		go p.exec(j)
+		return nil
+	}
+	atomic.AddInt64(&p.queued, 1)
+	select {
+	case p.queue <- j:
+		return nil
+	default:
+		atomic.AddInt64(&p.queued, -1)
+		atomic.AddUint64(&p.rejected, 1)
+		return errors.Wrapf(ErrOverload, "%s: %d workers busy, %d queued", p.config.Name, p.config.Workers, p.config.QueueSize)
+	}
+}
+
+func (p *pool) work() {
+	defer p.wg.Done()
+	for j := range p.queue {
+		//a task cancelled while queued never runs
+		if j.ctx.Err() != nil {
+			atomic.AddInt64(&p.queued, -1)
+			continue
+		}
+		//counted as running first so it is never missing from pending
+		atomic.AddInt64(&p.running, 1)
+		atomic.AddInt64(&p.queued, -1)
+		p.exec(j)
+	}
+}
+
+// exec runs a task counted as running, a panic is logged and the worker goes on
+func (p *pool) exec(j *job) {
+	defer func() {
+		atomic.AddInt64(&p.running, -1)
+		atomic.AddUint64(&p.completed, 1)
+		if r := recover(); r != nil {
+			atomic.AddUint64(&p.panics, 1)
+			errTmp, ok := r.(error)
+			if !ok {
+				errTmp = errors.Errorf("Panic: %+v", r)
+			}
+			err := errors.WithStack(errTmp)
+			log.Errorf(j.ctx, "task panic in pool %s: %+v", p.config.Name, err)
+		}
+	}()
+	j.run()
+}
+
+// close lets the workers finish the queue and stop, the pool must not be submitted to afterwards
+func (p *pool) close() {
+	if p.queue != nil {
+		close(p.queue)
+	}
+}
+
+func (p *pool) pending() int64 {
+	return atomic.LoadInt64(&p.running) + atomic.LoadInt64(&p.queued)
+}
+
+func (p *pool) stats() PoolStats {
+	return PoolStats{
+		Name:      p.config.Name,
+		Workers:   p.config.Workers,
+		Running:   atomic.LoadInt64(&p.running),
+		Queued:    atomic.LoadInt64(&p.queued),
+		Completed: atomic.LoadUint64(&p.completed),
+		Rejected:  atomic.LoadUint64(&p.rejected),
+		Panics:    atomic.LoadUint64(&p.panics),
+	}
+}
@@ -0,0 +1,108 @@
+package task
+
+import (
+	"context"
+	"github.com/Opafanls/hylan/server/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// timers are the armed timers of the delayed and periodic tasks, stopped on shutdown
+type timers struct {
+	mu  sync.Mutex
+	set map[*timer]struct{}
+}
+
+type timer struct {
+	t *time.Timer
+}
+
+func (t *timers) init() {
+	t.set = make(map[*timer]struct{})
+}
+
+// remove reports whether the timer was still armed, a stopped one was already counted out
+func (t *timers) remove(timer *timer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.set[timer]; !ok {
+		return false
+	}
+	delete(t.set, timer)
+	return true
+}
+
+func (t *timers) stopAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.set)
+	for timer := range t.set {
+		//a timer already firing finds itself removed and does nothing
+		timer.t.Stop()
+		delete(t.set, timer)
+	}
+	return n
+}
+
+func (d *DefaultTaskSystem) After(ctx context.Context, delay time.Duration, job Task) {
+	d.schedule(ctx, delay, func() {
+		d.runScheduled(ctx, job, nil)
+	})
+}
+
+func (d *DefaultTaskSystem) Every(ctx context.Context, interval time.Duration, job Task) {
+	var tick func()
+	tick = func() {
+		d.runScheduled(ctx, job, func() {
+			d.schedule(ctx, interval, tick)
+		})
+	}
+	d.schedule(ctx, interval, tick)
+}
+
+// schedule arms a timer for fire unless the system is shut down or ctx is done
+func (d *DefaultTaskSystem) schedule(ctx context.Context, delay time.Duration, fire func()) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.shutdown || ctx.Err() != nil {
+		return
+	}
+	atomic.AddInt64(&d.scheduled, 1)
+	armed := &timer{}
+	//the timer is registered under the lock so its callback can not miss it
+	d.timers.mu.Lock()
+	armed.t = time.AfterFunc(delay, func() {
+		if !d.timers.remove(armed) {
+			return
+		}
+		atomic.AddInt64(&d.scheduled, -1)
+		fire()
+	})
+	d.timers.set[armed] = struct{}{}
+	d.timers.mu.Unlock()
+}
+
+// runScheduled hands the job to the scheduled pool, next is called once it ran or was skipped
+// so periodic runs never overlap
+func (d *DefaultTaskSystem) runScheduled(ctx context.Context, job Task, next func()) {
+	if ctx.Err() != nil {
+		return
+	}
+	err := d.SubmitTo(ScheduledPool, ctx, func() {
+		if next != nil {
+			defer next()
+		}
+		if ctx.Err() == nil {
+			job()
+		}
+	})
+	if err != nil {
+		if err != ErrShutdown {
+			log.Warnf(ctx, "scheduled task skipped: %+v", err)
+		}
+		if next != nil && err != ErrShutdown {
+			next()
+		}
+	}
+}
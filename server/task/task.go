@@ -4,14 +4,33 @@ import (
 	"context"
 	"github.com/Opafanls/hylan/server/log"
 	"github.com/pkg/errors"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const (
+	//connections and other long lived tasks, unbounded unless configured; the config file refuses a bound
+	//since one would stop accepting connections
+	DefaultPool = "default"
+	//delayed and periodic tasks
+	ScheduledPool = "scheduled"
+)
+
+var (
+	ErrShutdown = errors.New("task system is shut down")
+	ErrNoPool   = errors.New("no such task pool")
+)
+
+var defaultScheduledPool = PoolConfig{Name: ScheduledPool, Workers: 4, QueueSize: 256}
+
 var defaultTaskSystem ISystem
 
-func InitTaskSystem() {
-	var num int32
-	defaultTaskSystem = &DefaultTaskSystem{goroutineNum: &num}
+// InitTaskSystem creates the default and scheduled pools and the given ones,
+// a config named after one of the builtin pools resizes it
+func InitTaskSystem(pools ...PoolConfig) {
+	defaultTaskSystem = NewDefaultTaskSystem(pools...)
 }
 
 func SubmitTask0(ctx context.Context, job Task) {
@@ -22,36 +41,148 @@ func SubmitTask0(ctx context.Context, job Task) {
 	}
 }
 
+// Submit runs job on the named pool, it fails with ErrOverload when the pool is full
+func Submit(pool string, ctx context.Context, job Task) error {
+	return defaultTaskSystem.SubmitTo(pool, ctx, job)
+}
+
+// After runs job once after delay unless ctx is done by then
+func After(ctx context.Context, delay time.Duration, job Task) {
+	defaultTaskSystem.After(ctx, delay, job)
+}
+
+// Every runs job each interval until ctx is done, the next run is timed from the end of the previous one
+func Every(ctx context.Context, interval time.Duration, job Task) {
+	defaultTaskSystem.Every(ctx, interval, job)
+}
+
+// Shutdown refuses new tasks and waits for the running ones until ctx is done
+func Shutdown(ctx context.Context) error {
+	return defaultTaskSystem.Shutdown(ctx)
+}
+
+// Stats are the counters of every pool ordered by name
+func Stats() []PoolStats {
+	if defaultTaskSystem == nil {
+		return nil
+	}
+	return defaultTaskSystem.Stats()
+}
+
+// Scheduled is the number of delayed and periodic tasks waiting for their time
+func Scheduled() int64 {
+	if defaultTaskSystem == nil {
+		return 0
+	}
+	return defaultTaskSystem.Scheduled()
+}
+
+// GoroutineNum is the number of submitted tasks still running
+func GoroutineNum() int32 {
+	var running int64
+	for _, s := range Stats() {
+		running += s.Running
+	}
+	return int32(running)
+}
+
 type Task func()
 
 type ISystem interface {
 	SubmitTask(ctx context.Context, job Task) error
-	Shutdown()
+	SubmitTo(pool string, ctx context.Context, job Task) error
+	After(ctx context.Context, delay time.Duration, job Task)
+	Every(ctx context.Context, interval time.Duration, job Task)
+	Stats() []PoolStats
+	Scheduled() int64
+	Shutdown(ctx context.Context) error
 }
 
 type DefaultTaskSystem struct {
-	goroutineNum *int32
+	//guards the pools against a submit racing the shutdown
+	mu       sync.RWMutex
+	pools    map[string]*pool
+	shutdown bool
+
+	timers    timers
+	scheduled int64
+}
+
+func NewDefaultTaskSystem(pools ...PoolConfig) *DefaultTaskSystem {
+	configs := map[string]PoolConfig{
+		DefaultPool:   {Name: DefaultPool},
+		ScheduledPool: defaultScheduledPool,
+	}
+	for _, c := range pools {
+		configs[c.Name] = c
+	}
+	d := &DefaultTaskSystem{}
+	d.pools = make(map[string]*pool, len(configs))
+	d.timers.init()
+	for name, c := range configs {
+		d.pools[name] = newPool(c)
+	}
+	return d
 }
 
 func (d *DefaultTaskSystem) SubmitTask(ctx context.Context, job Task) error {
-	atomic.AddInt32(d.goroutineNum, 1)
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				errTmp, ok := r.(error)
-				if !ok {
-					errTmp = errors.Errorf("Panic: %+v", r)
-				}
-				err := errors.WithStack(errTmp)
-				log.Errorf(ctx, "task panic: %+v", err)
-			}
-		}()
-		job()
-		atomic.AddInt32(d.goroutineNum, -1)
-	}()
-	return nil
-}
-
-func (d *DefaultTaskSystem) Shutdown() {
-	panic("shutdown")
+	return d.SubmitTo(DefaultPool, ctx, job)
+}
+
+func (d *DefaultTaskSystem) SubmitTo(name string, ctx context.Context, job Task) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.shutdown {
+		return ErrShutdown
+	}
+	p, ok := d.pools[name]
+	if !ok {
+		return errors.Wrap(ErrNoPool, name)
+	}
+	return p.submit(ctx, job)
+}
+
+func (d *DefaultTaskSystem) Stats() []PoolStats {
+	stats := make([]PoolStats, 0, len(d.pools))
+	for _, p := range d.pools {
+		stats = append(stats, p.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+func (d *DefaultTaskSystem) Scheduled() int64 {
+	return atomic.LoadInt64(&d.scheduled)
+}
+
+// Shutdown stops the timers and the pool workers once their queues are empty,
+// then waits for the running tasks until ctx is done
+func (d *DefaultTaskSystem) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.shutdown {
+		d.shutdown = true
+		atomic.AddInt64(&d.scheduled, -int64(d.timers.stopAll()))
+		for _, p := range d.pools {
+			p.close()
+		}
+	}
+	d.mu.Unlock()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var pending int64
+		for _, p := range d.pools {
+			pending += p.pending()
+		}
+		if pending <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("%d tasks still pending: %v", pending, ctx.Err())
+		case <-ticker.C:
+		}
+	}
 }
@@ -0,0 +1,137 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	InitTaskSystem()
+	release := make(chan struct{})
+	SubmitTask0(context.Background(), func() {
+		<-release
+	})
+	SubmitTask0(context.Background(), func() {
+		panic("counted anyway")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); err == nil {
+		t.Fatal("expect the blocked task to outlive the deadline")
+	}
+	if err := defaultTaskSystem.SubmitTask(context.Background(), func() {}); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("expect new tasks to be refused, got %v", err)
+	}
+	close(release)
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := GoroutineNum(); n != 0 {
+		t.Fatalf("expect no task left, got %d", n)
+	}
+}
+
+func TestBoundedPool(t *testing.T) {
+	InitTaskSystem(PoolConfig{Name: "small", Workers: 1, QueueSize: 1})
+	defer Shutdown(context.Background())
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if err := Submit("small", context.Background(), func() {
+		close(started)
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cancelled, cancel := context.WithCancel(context.Background())
+	ran := int32(0)
+	if err := Submit("small", cancelled, func() { atomic.StoreInt32(&ran, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := Submit("small", context.Background(), func() {}); !errors.Is(err, ErrOverload) {
+		t.Fatalf("expect the full pool to refuse, got %v", err)
+	}
+	if err := Submit("none", context.Background(), func() {}); !errors.Is(err, ErrNoPool) {
+		t.Fatalf("expect an unknown pool to be refused, got %v", err)
+	}
+	s := poolStats(t, "small")
+	if s.Running != 1 || s.Queued != 1 || s.Rejected != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	cancel()
+	close(release)
+	waitFor(t, func() bool {
+		s = poolStats(t, "small")
+		return s.Completed == 1 && s.Queued == 0
+	})
+	if err := Submit("small", context.Background(), func() { panic("counted") }); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		s = poolStats(t, "small")
+		return s.Completed == 2 && s.Running == 0 && s.Queued == 0
+	})
+	if s.Panics != 1 || atomic.LoadInt32(&ran) != 0 {
+		t.Fatalf("expect the panic counted and the cancelled task skipped, got %+v ran %d", s, ran)
+	}
+}
+
+func TestConfiguredDefaultPool(t *testing.T) {
+	InitTaskSystem(PoolConfig{Name: DefaultPool, Workers: 2, QueueSize: 4})
+	defer Shutdown(context.Background())
+	if s := poolStats(t, DefaultPool); s.Workers != 2 {
+		t.Fatalf("expect the configured workers, got %+v", s)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	InitTaskSystem()
+	ctx, cancel := context.WithCancel(context.Background())
+	var after, every int32
+	After(ctx, 10*time.Millisecond, func() { atomic.AddInt32(&after, 1) })
+	After(ctx, time.Hour, func() { atomic.AddInt32(&after, 1) })
+	Every(ctx, 5*time.Millisecond, func() { atomic.AddInt32(&every, 1) })
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&after) == 1 && atomic.LoadInt32(&every) >= 3
+	})
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt32(&every)
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&every) != n {
+		t.Fatal("expect the periodic task to stop with its context")
+	}
+	if Scheduled() != 1 {
+		t.Fatalf("expect the hour long timer to be pending, got %d", Scheduled())
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if Scheduled() != 0 {
+		t.Fatalf("expect the timers stopped on shutdown, got %d", Scheduled())
+	}
+}
+
+func poolStats(t *testing.T, name string) PoolStats {
+	for _, s := range Stats() {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no pool %s", name)
+	return PoolStats{}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,248 @@
+package vhost
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/Opafanls/hylan/server/auth"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/constdef"
+	"github.com/Opafanls/hylan/server/stream"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrDisabled     = errors.New("vhost disabled")
+	ErrUnauthorized = errors.New("invalid token")
+	ErrLimit        = errors.New("vhost limit reached")
+	ErrDraining     = errors.New("server is draining")
+)
+
+// Vhost is the policy of the streams published and played on some domains
+type Vhost struct {
+	Name string
+	//exact domains or wildcards like *.example.com
+	Domains []string
+	Enabled bool
+	Auth    Auth
+	//nil when the streams are recorded with the server settings
+	Record  *Record
+	Forward []Forward
+	Limits  Limits
+	//callback urls by event name in place of the server ones, nil when the vhost has none
+	Hooks map[string][]string
+}
+
+// Auth is a shared token the clients carry in the token query param, no token is asked when empty
+type Auth struct {
+	PublishToken string
+	PlayToken    string
+}
+
+type Record struct {
+	Enabled bool
+	Dir     string
+	//apps to record, every app when empty
+	Apps []string
+}
+
+// Forward pushes every stream published on the vhost to a remote srt listener
+type Forward struct {
+	Addr       string
+	Latency    time.Duration
+	Passphrase string
+	PbKeyLen   int
+}
+
+// Limits are not enforced when zero
+type Limits struct {
+	MaxStreams          int
+	MaxPlayers          int
+	MaxPlayersPerStream int
+}
+
+// Table matches stream urls to vhosts, the default vhost takes the urls no vhost matches
+type Table struct {
+	vhosts []*Vhost
+	def    *Vhost
+}
+
+// fallback is the vhost without any policy, every url is on it when no table is set
+var fallback = &Vhost{Name: constdef.StreamPad, Enabled: true}
+
+var table atomic.Value
+
+var draining int32
+
+// NewTable takes the default vhost first, fallback when nil
+func NewTable(def *Vhost, vhosts ...*Vhost) *Table {
+	t := &Table{}
+	if def == nil {
+		def = fallback
+	}
+	t.def = def
+	t.vhosts = vhosts
+	return t
+}
+
+// Match takes the vhost named by the vhost query param, then the one with the host of u among its domains
+func (t *Table) Match(u *url.URL) *Vhost {
+	if name := u.Query().Get("vhost"); name != "" {
+		if t.def.Name == name {
+			return t.def
+		}
+		for _, v := range t.vhosts {
+			if v.Name == name {
+				return v
+			}
+		}
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, v := range append([]*Vhost{t.def}, t.vhosts...) {
+		for _, domain := range v.Domains {
+			if matchDomain(strings.ToLower(domain), host) {
+				return v
+			}
+		}
+	}
+	return t.def
+}
+
+func matchDomain(domain, host string) bool {
+	if strings.HasPrefix(domain, "*.") {
+		return strings.HasSuffix(host, domain[1:])
+	}
+	return domain == host
+}
+
+// SetTable applies t to the streams published and played from now on, the stream ids name the vhost
+// instead of the host. A nil t drops the vhosts, the ids name the host again.
+func SetTable(t *Table) {
+	if t == nil {
+		table.Store(NewTable(nil))
+		base.SetVhostResolver(nil)
+		return
+	}
+	table.Store(t)
+	base.SetVhostResolver(func(u *url.URL) string {
+		return Match(u).Name
+	})
+}
+
+// Match is the vhost of u on the current table
+func Match(u *url.URL) *Vhost {
+	t, _ := table.Load().(*Table)
+	if t == nil {
+		return fallback
+	}
+	return t.Match(u)
+}
+
+// SetDraining makes Publish refuse every new publisher while the running ones go on, players are still admitted
+func SetDraining(on bool) {
+	var val int32
+	if on {
+		val = 1
+	}
+	atomic.StoreInt32(&draining, val)
+}
+
+func Draining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// Publish admits a publisher of u from clientAddr on its vhost, the error tells why not
+func Publish(u *url.URL, clientAddr string) (*Vhost, error) {
+	v := Match(u)
+	if Draining() {
+		return v, ErrDraining
+	}
+	if err := v.admit(u, auth.ActionPublish, clientAddr, v.Auth.PublishToken); err != nil {
+		return v, err
+	}
+	if v.Limits.MaxStreams > 0 && len(streams(v)) >= v.Limits.MaxStreams {
+		return v, fmt.Errorf("%w: %s has %d streams", ErrLimit, v.Name, v.Limits.MaxStreams)
+	}
+	return v, nil
+}
+
+// Play admits a player of u on its vhost, the limits are checked against the players at the time of the call
+func Play(u *url.URL, clientAddr string) (*Vhost, error) {
+	v := Match(u)
+	if err := v.admit(u, auth.ActionPlay, clientAddr, v.Auth.PlayToken); err != nil {
+		return v, err
+	}
+	if v.Limits.MaxPlayers > 0 {
+		total := 0
+		for _, hyStream := range streams(v) {
+			total += players(hyStream)
+		}
+		if total >= v.Limits.MaxPlayers {
+			return v, fmt.Errorf("%w: %s has %d players", ErrLimit, v.Name, v.Limits.MaxPlayers)
+		}
+	}
+	if v.Limits.MaxPlayersPerStream > 0 {
+		id := base.NewBase0(u).ID()
+		if hyStream, exist := stream.DefaultHyStreamManager.GetStream(id); exist && players(hyStream) >= v.Limits.MaxPlayersPerStream {
+			return v, fmt.Errorf("%w: %s has %d players", ErrLimit, id, v.Limits.MaxPlayersPerStream)
+		}
+	}
+	return v, nil
+}
+
+// admit checks the shared token of the vhost, then the signed token of the app
+func (v *Vhost) admit(u *url.URL, action auth.Action, clientAddr, token string) error {
+	if !v.Enabled {
+		return fmt.Errorf("%w: %s", ErrDisabled, v.Name)
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(u.Query().Get("token")), []byte(token)) != 1 {
+		return fmt.Errorf("%w for %s", ErrUnauthorized, v.Name)
+	}
+	if err := auth.Verify(action, u, clientAddr); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return nil
+}
+
+// streams are the published streams on v, a reload keeps the name of a vhost but not its pointer
+func streams(v *Vhost) []*stream.HyStream {
+	var list []*stream.HyStream
+	for _, hyStream := range stream.DefaultHyStreamManager.Streams() {
+		if Match(hyStream.Base().URL()).Name == v.Name {
+			list = append(list, hyStream)
+		}
+	}
+	return list
+}
+
+func players(hyStream *stream.HyStream) int {
+	n := 0
+	for _, sink := range hyStream.Source().Sinks() {
+		peer := sink.Peer()
+		switch {
+		case peer == nil:
+			n++
+		case peer.Players != nil:
+			n += peer.Players()
+		case !peer.Internal:
+			n++
+		}
+	}
+	return n
+}
+
+// HTTPStatus is the status a http endpoint answers a refused client with
+func HTTPStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrLimit), errors.Is(err, ErrDraining):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusForbidden
+	}
+}
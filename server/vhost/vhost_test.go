@@ -0,0 +1,144 @@
+package vhost
+
+import (
+	"context"
+	"errors"
+	"github.com/Opafanls/hylan/server/base"
+	"github.com/Opafanls/hylan/server/proto"
+	"github.com/Opafanls/hylan/server/session"
+	"github.com/Opafanls/hylan/server/stream"
+	"net/url"
+	"testing"
+)
+
+func mustURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestMatch(t *testing.T) {
+	def := &Vhost{Name: "default", Enabled: true}
+	a := &Vhost{Name: "a", Domains: []string{"a.example.com", "*.a.example.com"}, Enabled: true}
+	b := &Vhost{Name: "b", Domains: []string{"b.example.com"}}
+	table := NewTable(def, a, b)
+	for raw, expect := range map[string]*Vhost{
+		"rtmp://a.example.com/live/x":            a,
+		"rtmp://A.Example.com:1935/live/x":       a,
+		"rtmp://cdn.a.example.com/live/x":        a,
+		"http://b.example.com:8080/live/x":       b,
+		"rtmp://c.example.com/live/x":            def,
+		"rtmp://127.0.0.1/live/x":                def,
+		"rtmp://127.0.0.1/live/x?vhost=b":        b,
+		"rtmp://a.example.com/live/x?vhost=none": a,
+	} {
+		if v := table.Match(mustURL(t, raw)); v != expect {
+			t.Fatalf("%s: expect vhost %s, got %s", raw, expect.Name, v.Name)
+		}
+	}
+	if v := NewTable(nil).Match(mustURL(t, "rtmp://a.example.com/live/x")); v != fallback {
+		t.Fatalf("expect the fallback vhost, got %s", v.Name)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	stream.InitHyStreamManager()
+	SetTable(NewTable(nil, &Vhost{
+		Name:    "a",
+		Domains: []string{"a.example.com"},
+		Enabled: true,
+		Auth:    Auth{PublishToken: "pub", PlayToken: "play"},
+		Limits:  Limits{MaxStreams: 1, MaxPlayersPerStream: 1},
+	}, &Vhost{Name: "off", Domains: []string{"off.example.com"}}))
+	defer SetTable(nil)
+
+	//ids name the vhost, every domain of it shares the streams
+	if id := base.NewBase0(mustURL(t, "rtmp://a.example.com/live/x")).ID(); id != "a:/live/x" {
+		t.Fatalf("unexpected id %s", id)
+	}
+	if id := base.NewBase0(mustURL(t, "rtmp://other.example.com/live/x")).ID(); id != "PAD:/live/x" {
+		t.Fatalf("unexpected id %s", id)
+	}
+
+	if _, err := Publish(mustURL(t, "rtmp://off.example.com/live/x"), ""); !errors.Is(err, ErrDisabled) {
+		t.Fatalf("expect the disabled vhost to refuse, got %v", err)
+	}
+	if _, err := Publish(mustURL(t, "rtmp://a.example.com/live/x?token=play"), ""); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expect the wrong token to be refused, got %v", err)
+	}
+	u := mustURL(t, "rtmp://a.example.com/live/x?token=pub")
+	if v, err := Publish(u, ""); err != nil || v.Name != "a" {
+		t.Fatalf("expect the publisher to be admitted, got %v", err)
+	}
+	ctx := context.Background()
+	source := session.NewSourceSession(ctx, nil)
+	if err := stream.DefaultHyStreamManager.AddStream(stream.NewHyStream0(u, source)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Publish(mustURL(t, "rtmp://a.example.com/live/y?token=pub"), ""); !errors.Is(err, ErrLimit) {
+		t.Fatalf("expect max_streams to refuse, got %v", err)
+	}
+
+	play := mustURL(t, "http://a.example.com/live/x?token=play")
+	if _, err := Play(play, ""); err != nil {
+		t.Fatal(err)
+	}
+	//internal sinks are no players
+	source.AddSink(&proto.SinkArg{Ctx: ctx, Peer: &proto.Peer{Protocol: "record", Internal: true}})
+	if _, err := Play(play, ""); err != nil {
+		t.Fatal(err)
+	}
+	//a shared sink counts the players it feeds
+	feeding := 0
+	source.AddSink(&proto.SinkArg{Ctx: ctx, Peer: &proto.Peer{Protocol: "rtsp", Internal: true, Players: func() int { return feeding }}})
+	if _, err := Play(play, ""); err != nil {
+		t.Fatal(err)
+	}
+	feeding = 1
+	if _, err := Play(play, ""); !errors.Is(err, ErrLimit) {
+		t.Fatalf("expect the players of a shared sink to count, got %v", err)
+	}
+	feeding = 0
+	source.AddSink(&proto.SinkArg{Ctx: ctx, Peer: &proto.Peer{Protocol: "http-ts"}})
+	if _, err := Play(play, ""); !errors.Is(err, ErrLimit) || HTTPStatus(err) != 503 {
+		t.Fatalf("expect max_players_per_stream to refuse, got %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	stream.InitHyStreamManager()
+	SetDraining(true)
+	defer SetDraining(false)
+	u := mustURL(t, "rtmp://127.0.0.1/live/x")
+	if _, err := Publish(u, ""); !errors.Is(err, ErrDraining) || HTTPStatus(err) != 503 {
+		t.Fatalf("expect publishers to be refused while draining, got %v", err)
+	}
+	if _, err := Play(u, ""); err != nil {
+		t.Fatalf("expect players to be admitted while draining, got %v", err)
+	}
+}
+
+func TestNoTable(t *testing.T) {
+	//a server without vhosts sets no table, the ids keep naming the host and the vhost param
+	ids := func() {
+		if id := base.NewBase0(mustURL(t, "rtmp://a.example.com:1935/live/x")).ID(); id != "a.example.com:1935:/live/x" {
+			t.Fatalf("unexpected id %s", id)
+		}
+		if id := base.NewBase0(mustURL(t, "rtmp://a.example.com/live/x?vhost=b")).ID(); id != "b:/live/x" {
+			t.Fatalf("unexpected id %s", id)
+		}
+	}
+	ids()
+	SetTable(NewTable(nil, &Vhost{Name: "a", Domains: []string{"a.example.com"}, Enabled: true}))
+	if id := base.NewBase0(mustURL(t, "rtmp://a.example.com:1935/live/x")).ID(); id != "a:/live/x" {
+		t.Fatalf("unexpected id %s", id)
+	}
+	//vhosts dropped on reload
+	SetTable(nil)
+	ids()
+	if v := Match(mustURL(t, "rtmp://a.example.com/live/x")); v != fallback {
+		t.Fatalf("expect the fallback vhost, got %s", v.Name)
+	}
+}